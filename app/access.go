@@ -0,0 +1,78 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rejectedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cnaasprom_rejected_requests_total",
+	Help: "Requests rejected because the client address is not in the allowed networks",
+})
+
+func init() {
+	metrics.InternalRegistry.MustRegister(rejectedRequests)
+}
+
+// Parse the allowed networks; plain addresses are treated as single hosts
+func parseAllowedNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowed network %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %v", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Reject requests whose client address is outside the allowed networks.
+// The exporter's own health check has no client address and is let through
+// without counting it.
+func allowlistMiddleware(networks []*net.IPNet, next http.Handler) http.Handler {
+	if len(networks) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			for _, network := range networks {
+				if network.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		rejectedRequests.Inc()
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
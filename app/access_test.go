@@ -0,0 +1,43 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Only clients in the allowed networks are served; plain addresses allow
+// just that host
+func TestAllowedNetworks(t *testing.T) {
+	networks, err := parseAllowedNetworks([]string{"10.0.20.0/24", "192.0.2.7", "fd00::/64", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := allowlistMiddleware(networks, okHandler)
+
+	for remote, status := range map[string]int{
+		"10.0.20.5:40000":      http.StatusOK,
+		"10.0.21.5:40000":      http.StatusForbidden,
+		"192.0.2.7:40000":      http.StatusOK,
+		"192.0.2.8:40000":      http.StatusForbidden,
+		"[fd00::1]:40000":      http.StatusOK,
+		"[2001:db8::1]:40000":  http.StatusOK,
+		"[2001:db8::2]:40000":  http.StatusForbidden,
+		"[::ffff:10.0.20.5]:1": http.StatusOK,
+		"not an address":       http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.RemoteAddr = remote
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != status {
+			t.Errorf("client %s: status %d, want %d", remote, recorder.Code, status)
+		}
+	}
+
+	for _, entry := range []string{"10.0.20.0/33", "nnfcm.example.net"} {
+		if _, err := parseAllowedNetworks([]string{entry}); err == nil {
+			t.Errorf("allowed network %q accepted", entry)
+		}
+	}
+}
@@ -1,29 +1,275 @@
 package app
 
 import (
-	"cnaasprom/config"
-	"cnaasprom/metrics"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
+// ServiceName is the name of the systemd unit or Windows service that
+// -install-service installs
+const ServiceName = "cnaasprom"
+
+// Time allowed to send the queued spans on shutdown
+const tracingShutdownTimeout = 5 * time.Second
+
+// ServiceOptions sets up the service -install-service installs. It runs as
+// User, or under systemd as a dynamic user without one, and systemd
+// restarts it when it fails its health checks for WatchdogSec; 0 disables
+// the watchdog.
+type ServiceOptions struct {
+	User        string
+	WatchdogSec time.Duration
+}
+
 type App struct {
 	Config *config.Config
+
+	// File the configuration was loaded from, read again on reloads
+	ConfigFile string
+
+	// The exporter and sources of the current configuration
+	reloadMu sync.Mutex
+	current  atomic.Pointer[instance]
+
+	// The global rate limits, shared by the configurations across reloads
+	rateLimits *metrics.RateLimits
 }
 
 func NewApp(cfg *config.Config) *App {
-	return &App{Config: cfg}
+	return &App{Config: cfg, rateLimits: metrics.NewRateLimits()}
+}
+
+// Validate checks the configuration without starting any listener or source
+func (a *App) Validate() error {
+	exporter, err := metrics.NewExporter(a.Config, metrics.NewCache())
+	if err != nil {
+		return err
+	}
+	for _, output := range a.Config.Outputs {
+		if _, err := metrics.NewOutputSink(output, exporter); err != nil {
+			return err
+		}
+	}
+	store, err := metrics.NewStore(a.Config.Store, a.Config.TLSPolicy)
+	if err != nil {
+		return err
+	}
+	metrics.CloseStore(store)
+	if _, err := parseAllowedNetworks(a.Config.Server.AllowedNetworks); err != nil {
+		return err
+	}
+	if _, err := newProbeAllowlists(a.Config); err != nil {
+		return err
+	}
+	if a.Config.Streaming.Enabled {
+		if _, err := metrics.NewStreamSource(a.Config, metrics.NewCache(), nil); err != nil {
+			return err
+		}
+	}
+	if a.Config.Server.TLS.Enabled() && a.Config.Server.WebConfigFile == "" {
+		if _, err := newServerTLSConfig(a.Config.Server.TLS, a.Config.TLSPolicy); err != nil {
+			return err
+		}
+	}
+	if a.Config.Server.WebConfigFile != "" {
+		if err := web.Validate(a.Config.Server.WebConfigFile); err != nil {
+			return fmt.Errorf("invalid web config file: %v", err)
+		}
+		if err := checkWebConfigPolicy(a.Config.Server.WebConfigFile, a.Config.TLSPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DryRun performs a single collection, optionally from sample files, and
+// prints the name, type, labels and value of every metric that would be exported
+func (a *App) DryRun(w io.Writer, sampleDir string) error {
+	exporter, err := metrics.NewExporter(a.Config, metrics.NewCache())
+	if err != nil {
+		return fmt.Errorf("failed to create exporter: %v", err)
+	}
+	if sampleDir != "" {
+		exporter.UseSampleDir(sampleDir)
+	}
+	return exporter.DryRun(w)
+}
+
+// Once performs a single collection and writes the metrics to w
+func (a *App) Once(w io.Writer) error {
+	exporter, err := metrics.NewExporter(a.Config, metrics.NewCache())
+	if err != nil {
+		return fmt.Errorf("failed to create exporter: %v", err)
+	}
+	return exporter.WriteOnce(w)
 }
 
 func (a *App) Run() error {
-	address := fmt.Sprintf("%s:%d", a.Config.Server.Address, a.Config.Server.Port)
+	return a.RunContext(context.Background())
+}
+
+// RunContext serves the exporter until ctx is done or SIGINT or SIGTERM
+// is received
+func (a *App) RunContext(ctx context.Context) error {
+	// Reloads replace a.Config; the listener keeps the initial settings
+	cfg := a.Config
+	address := config.JoinHostPort(cfg.Server.Address, cfg.Server.Port)
+	if path, ok := cfg.ListenSocketPath(); ok {
+		address = path
+	}
+	if cfg.Server.WebConfigFile != "" {
+		if err := checkWebConfigPolicy(cfg.Server.WebConfigFile, cfg.TLSPolicy); err != nil {
+			return err
+		}
+	}
+
+	// Start the debug listener on its own port
+	if cfg.Debug.Port != 0 {
+		go serveDebug(config.JoinHostPort(cfg.Debug.Address, cfg.Debug.Port))
+	}
 
-	// Set up the metrics handler
-	handler := metrics.MetricsHandler(a.Config.MetricsStatisticsCategory, a.Config.QueryParams, a.Config.RemoteStatisticServer.Address, a.Config.RemoteStatisticServer.Port)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	http.Handle("/metrics", handler)
+	// The store of streamed values outlives reloads of the configuration
+	store, err := metrics.NewStore(cfg.Store, cfg.TLSPolicy)
+	if err != nil {
+		return err
+	}
+	if cfg.Store.Type == "redis" {
+		log.Printf("Keeping streamed values in redis at %s", cfg.Store.Redis.Address)
+	}
+	current, err := a.build(ctx, cfg, store, true)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.Tracing.Endpoint != "" {
+		log.Printf("Exporting traces to %s", cfg.Tracing.Endpoint)
+		shutdownTracing, err = metrics.EnableTracing(cfg.Tracing, cfg.TLSPolicy)
+		if err != nil {
+			return fmt.Errorf("failed to enable tracing: %v", err)
+		}
+	}
+
+	current.run()
+	a.current.Store(current)
+	setReloadResult(true)
+
+	listener, err := a.listen(address)
+	if err != nil {
+		return err
+	}
+	go a.reloadOnSignal(ctx)
+	if cfg.UsesVault() && a.ConfigFile != "" {
+		go a.refreshVault(ctx, cfg.Vault.RefreshInterval)
+	}
+
+	// Tell systemd the exporter is ready once it listens
+	notify("READY=1")
+	go watchdog(ctx, a.healthy)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.current.Load().handler.ServeHTTP(w, r)
+	})}
+
+	// Stop the sources and save the state before closing the server. No
+	// reload may start new sources after that.
+	go func() {
+		<-ctx.Done()
+		notify("STOPPING=1")
+		a.reloadMu.Lock()
+		a.current.Load().stop()
+		metrics.CloseStore(store)
+		if err := config.RevokeVaultToken(); err != nil {
+			log.Print(err)
+		}
+		// Flush the spans of the last scrapes
+		flushCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+		cancel()
+		server.Close()
+	}()
+
+	if cfg.Server.TLS.Enabled() && cfg.Server.WebConfigFile == "" {
+		tlsConfig, err := newServerTLSConfig(cfg.Server.TLS, cfg.TLSPolicy)
+		if err != nil {
+			return err
+		}
+
+		server.TLSConfig = tlsConfig
+		if !http2Allowed(tlsConfig) {
+			log.Printf("Serving HTTP/1.1 only as the TLS policy allows none of the cipher suites HTTP/2 requires")
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		log.Printf("Serving metrics on %s over TLS", address)
+		return serveError(server.ServeTLS(listener, "", ""))
+	}
+
+	// The exporter-toolkit handles TLS and basic auth from the web config file
+	flags := &web.FlagConfig{
+		WebConfigFile: &cfg.Server.WebConfigFile,
+	}
 
 	log.Printf("Serving metrics on %s", address)
-	return http.ListenAndServe(address, nil)
+	return serveError(web.Serve(listener, server, flags, slog.Default()))
+}
+
+// A server closed on shutdown is not an error
+func serveError(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Listen on the configured TCP address, or on a unix socket when the server
+// address is unix:///path/to/socket
+func (a *App) listen(address string) (net.Listener, error) {
+	path, ok := a.Config.ListenSocketPath()
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove a socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	return net.Listen("unix", path)
+}
+
+// Save the collected values at the configured interval until ctx is done
+func persistState(ctx context.Context, exporter *metrics.Exporter, cfg config.PersistenceConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := exporter.SaveState(cfg.File); err != nil {
+				log.Printf("Failed to save state: %v", err)
+			}
+		}
+	}
 }
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The root serves the exporter-toolkit landing page linking to the metrics
+func TestLandingPage(t *testing.T) {
+	cfg := &config.Config{}
+	i, err := NewApp(cfg).build(context.Background(), cfg, metrics.NewCache(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	i.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := recorder.Body.String(); recorder.Code != http.StatusOK || !strings.Contains(body, "CNaaSProm") || !strings.Contains(body, `href="/metrics"`) {
+		t.Errorf("landing page: status %d, body %q", recorder.Code, body)
+	}
+}
+
+// The web config file is only given by --web.config.file
+func TestWebConfigFileNotConfigurable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("Server:\n  webConfigFile: /etc/cnaasprom/web.yml\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.WebConfigFile != "" {
+		t.Errorf("web config file read from the configuration")
+	}
+}
+
+// The health check fails until a configuration is served and when its
+// handler doesn't answer in time
+func TestHealthCheck(t *testing.T) {
+	cfg := &config.Config{}
+	a := NewApp(cfg)
+	if err := a.healthy(context.Background()); err == nil {
+		t.Errorf("healthy before starting")
+	}
+
+	i, err := a.build(context.Background(), cfg, metrics.NewCache(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.current.Store(i)
+	if err := a.healthy(context.Background()); err != nil {
+		t.Errorf("serving configuration unhealthy: %v", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	i.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.healthy(ctx); err == nil {
+		t.Errorf("hung handler healthy")
+	}
+}
+
+// The health check passes the allowed networks without counting as a
+// rejected request
+func TestHealthCheckAllowedNetworks(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.AllowedNetworks = []string{"10.0.20.0/24"}
+	a := NewApp(cfg)
+	i, err := a.build(context.Background(), cfg, metrics.NewCache(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.current.Store(i)
+
+	rejected := func() float64 {
+		var metric dto.Metric
+		if err := rejectedRequests.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before := rejected()
+	for range 3 {
+		if err := a.healthy(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := rejected(); after != before {
+		t.Errorf("rejected requests went from %v to %v on health checks", before, after)
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Protect a handler with the authentication methods configured for the server.
+// A request is accepted when it satisfies any one of the configured methods.
+func authMiddleware(auth config.AuthConfig, next http.Handler) http.Handler {
+	basicAuth := len(auth.BasicAuthUsers) > 0
+	bearerAuth := auth.BearerToken != ""
+	if !basicAuth && !bearerAuth && !auth.ClientCertificate {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basicAuth && checkBasicAuth(auth.BasicAuthUsers, r) ||
+			bearerAuth && checkBearerToken(string(auth.BearerToken), r) ||
+			auth.ClientCertificate && checkClientCertificate(auth.AllowedCommonNames, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if basicAuth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="cnaasprom"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Check basic auth credentials against the configured bcrypt password hashes
+func checkBasicAuth(users map[string]config.Secret, r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, exists := users[username]
+	if !exists {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func checkBearerToken(token string, r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+// Check that the request came with a verified client certificate,
+// optionally restricted to a list of subject common names
+func checkClientCertificate(allowedCommonNames []string, r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	if len(allowedCommonNames) == 0 {
+		return true
+	}
+
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, allowed := range allowedCommonNames {
+		if commonName == allowed {
+			return true
+		}
+	}
+	return false
+}
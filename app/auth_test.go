@@ -0,0 +1,85 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// A request is let through by any one of the configured methods
+func TestAuthMiddleware(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := authMiddleware(config.AuthConfig{
+		BasicAuthUsers:     map[string]config.Secret{"prometheus": config.Secret(hash)},
+		BearerToken:        "token",
+		ClientCertificate:  true,
+		AllowedCommonNames: []string{"prometheus"},
+	}, okHandler)
+	verified := func(commonName string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("prometheus", "guess") }, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusUnauthorized},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, http.StatusOK},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tokens") }, http.StatusUnauthorized},
+		{"token without scheme", func(r *http.Request) { r.Header.Set("Authorization", "token") }, http.StatusUnauthorized},
+		{"client certificate", func(r *http.Request) { r.TLS = verified("prometheus") }, http.StatusOK},
+		{"other common name", func(r *http.Request) { r.TLS = verified("grafana") }, http.StatusUnauthorized},
+		{"unverified certificate", func(r *http.Request) { r.TLS = &tls.ConnectionState{} }, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		tc.setup(r)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, recorder.Code, tc.status)
+		}
+	}
+}
+
+// Probes of a module with credentials need them; other modules don't
+func TestProbeModuleAuth(t *testing.T) {
+	handler := probeGuard(&config.Config{Probe: config.ProbeConfig{Modules: map[string]config.ProbeModuleConfig{
+		"amf": {Auth: config.AuthConfig{BearerToken: "amf-token"}},
+	}}}, okHandler)
+
+	for _, tc := range []struct {
+		module, token string
+		status        int
+	}{
+		{"amf", "", http.StatusUnauthorized},
+		{"amf", "other-token", http.StatusUnauthorized},
+		{"amf", "amf-token", http.StatusOK},
+		{"smf", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/probe?target=10.0.0.1:80&module="+tc.module, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != tc.status {
+			t.Errorf("module %s with token %q: status %d, want %d", tc.module, tc.token, recorder.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Seconds a client rejected for too many concurrent scrapes should wait
+const concurrencyRetryAfter = 5
+
+var rejectedScrapes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cnaasprom_concurrent_scrapes_rejected_total",
+	Help: "Scrapes rejected because the maximum number of concurrent scrapes were served",
+})
+
+func init() {
+	metrics.InternalRegistry.MustRegister(rejectedScrapes)
+}
+
+// Serve at most limit requests at once and reject the others right away,
+// rather than queueing them behind slow upstream fetches
+func concurrencyMiddleware(limit int, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			rejectedScrapes.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+			http.Error(w, "Too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type healthCheckKey struct{}
+
+// Whether a request is the exporter's own health check, which isn't logged
+func isHealthCheck(r *http.Request) bool {
+	return r.Context().Value(healthCheckKey{}) != nil
+}
+
+// Check that the current configuration serves requests by having it answer
+// the landing page within the deadline of ctx. Any answer but a server
+// error will do; auth may refuse the check.
+func (a *App) healthy(ctx context.Context) error {
+	current := a.current.Load()
+	if current == nil {
+		return fmt.Errorf("not started")
+	}
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, healthCheckKey{}, true), http.MethodGet, "/", nil)
+	if err != nil {
+		return err
+	}
+	statuses := make(chan int, 1)
+	go func() {
+		recorder := &statusRecorder{ResponseWriter: &discardResponse{header: make(http.Header)}}
+		current.handler.ServeHTTP(recorder, r)
+		statuses <- recorder.status
+	}()
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("no answer to the health check: %v", ctx.Err())
+	case status := <-statuses:
+		if status >= http.StatusInternalServerError {
+			return fmt.Errorf("health check answered with status %d", status)
+		}
+		return nil
+	}
+}
+
+// ResponseWriter dropping the response to a health check
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(int)             {}
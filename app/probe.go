@@ -0,0 +1,221 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default probe limits: the longest DNS name, and generous bounds for
+// module names and the categories a single probe fetches
+const (
+	defaultMaxProbeHostLength       = 253
+	defaultMaxProbeModuleNameLength = 64
+	defaultMaxProbeCategories       = 100
+)
+
+var probesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cnaasprom_probe_requests_rejected_total",
+	Help: "Probe requests rejected as malformed or beyond the probe limits",
+}, []string{"reason"})
+
+func init() {
+	metrics.InternalRegistry.MustRegister(probesRejected)
+}
+
+// Targets a probe may scrape, by host name or network
+type targetAllowlist struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func newTargetAllowlist(entries []string) (*targetAllowlist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	allowlist := &targetAllowlist{hosts: make(map[string]bool)}
+	var networks []string
+	for _, entry := range entries {
+		entry = strings.Trim(entry, "[]")
+		if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+			networks = append(networks, entry)
+		} else {
+			allowlist.hosts[strings.ToLower(entry)] = true
+		}
+	}
+
+	var err error
+	if allowlist.networks, err = parseAllowedNetworks(networks); err != nil {
+		return nil, err
+	}
+	return allowlist, nil
+}
+
+// Whether the host of a host:port target is allowed; nil allows none
+func (l *targetAllowlist) allows(target string) bool {
+	if l == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range l.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return l.hosts[strings.ToLower(host)]
+}
+
+// probeLimits rejects malformed probe requests and those beyond the limits
+// before they are authorized or fetched
+type probeLimits struct {
+	maxHostLength       int
+	maxModuleNameLength int
+	maxCategories       int
+	// Categories of every module and the number of configured operators
+	categories map[string]int
+	operators  int
+}
+
+func newProbeLimits(cfg *config.Config) *probeLimits {
+	limits := &probeLimits{
+		maxHostLength:       cfg.Probe.Limits.MaxHostLength,
+		maxModuleNameLength: cfg.Probe.Limits.MaxModuleNameLength,
+		maxCategories:       cfg.Probe.Limits.MaxCategories,
+		categories:          make(map[string]int, len(cfg.Modules)),
+		operators:           max(len(cfg.QueryParams.Operators), 1),
+	}
+	if limits.maxHostLength <= 0 {
+		limits.maxHostLength = defaultMaxProbeHostLength
+	}
+	if limits.maxModuleNameLength <= 0 {
+		limits.maxModuleNameLength = defaultMaxProbeModuleNameLength
+	}
+	if limits.maxCategories <= 0 {
+		limits.maxCategories = defaultMaxProbeCategories
+	}
+	for name, module := range cfg.Modules {
+		limits.categories[name] = len(module.Categories)
+	}
+	return limits
+}
+
+// The reason a probe request is rejected and the label it is counted under
+func (l *probeLimits) check(r *http.Request) (string, string) {
+	params := r.URL.Query()
+	if len(params["target"]) != 1 || len(params["module"]) > 1 {
+		return "exactly one target and at most one module parameter are allowed", "parameters"
+	}
+
+	module := params.Get("module")
+	if len(module) > l.maxModuleNameLength {
+		return fmt.Sprintf("module name longer than %d characters", l.maxModuleNameLength), "module"
+	}
+	if strings.ContainsFunc(module, unicode.IsControl) {
+		return "module name contains control characters", "module"
+	}
+
+	host, _, err := net.SplitHostPort(params.Get("target"))
+	if err != nil {
+		return "target is not host:port", "target"
+	}
+	if len(host) > l.maxHostLength {
+		return fmt.Sprintf("target host longer than %d characters", l.maxHostLength), "target"
+	}
+	if host == "" || strings.ContainsFunc(host, invalidHostChar) {
+		return "target host is not a host name or IP address", "target"
+	}
+
+	operators := len(params["operator"])
+	if operators == 0 {
+		operators = l.operators
+	}
+	if categories := l.categories[module] * operators; categories > l.maxCategories {
+		return fmt.Sprintf("probe would fetch %d categories, more than %d", categories, l.maxCategories), "categories"
+	}
+	return "", ""
+}
+
+// Host names, IPv4 and IPv6 addresses, with zones such as fe80::1%eth0
+func invalidHostChar(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._:%", r))
+}
+
+func (l *probeLimits) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason, label := l.check(r); reason != "" {
+			probesRejected.WithLabelValues(label).Inc()
+			http.Error(w, fmt.Sprintf("Invalid probe request: %s", reason), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allowlists of the targets probes may reach besides the configured and
+// discovered ones, per module and global
+type probeAllowlists struct {
+	global  *targetAllowlist
+	modules map[string]*targetAllowlist
+}
+
+func newProbeAllowlists(cfg *config.Config) (*probeAllowlists, error) {
+	global, err := newTargetAllowlist(cfg.Probe.AllowedTargets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid probe allowed targets: %v", err)
+	}
+
+	allowlists := &probeAllowlists{global: global, modules: make(map[string]*targetAllowlist, len(cfg.Probe.Modules))}
+	for name, module := range cfg.Probe.Modules {
+		if _, ok := cfg.Modules[name]; !ok {
+			return nil, fmt.Errorf("probe settings for unknown module %s", name)
+		}
+		allowlist, err := newTargetAllowlist(module.AllowedTargets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe allowed targets of module %s: %v", name, err)
+		}
+		if allowlist != nil {
+			allowlists.modules[name] = allowlist
+		}
+	}
+	return allowlists, nil
+}
+
+// Whether a target may be probed with a module: the module's allowlist
+// replaces the global one
+func (l *probeAllowlists) allows(module string, target string) bool {
+	if allowlist, ok := l.modules[module]; ok {
+		return allowlist.allows(target)
+	}
+	return l.global.allows(target)
+}
+
+// Reject malformed requests and require the credentials of the probed
+// module before the probe handler runs
+func probeGuard(cfg *config.Config, next http.Handler) http.Handler {
+	handlers := make(map[string]http.Handler, len(cfg.Probe.Modules))
+	for name, module := range cfg.Probe.Modules {
+		handlers[name] = authMiddleware(module.Auth, next)
+	}
+
+	return newProbeLimits(cfg).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, ok := handlers[r.URL.Query().Get("module")]; ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
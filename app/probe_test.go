@@ -0,0 +1,66 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+)
+
+// Without allowed targets only configured and discovered targets are probed
+func TestUnconfiguredProbeRefused(t *testing.T) {
+	cfg := &config.Config{
+		Modules: map[string]config.Module{
+			"amf": {Categories: []string{"amf"}, Auth: config.TargetAuth{BearerToken: "secret"}},
+		},
+	}
+	exporter, err := metrics.NewExporter(cfg, metrics.NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowlists, err := newProbeAllowlists(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := probeGuard(cfg, exporter.ProbeHandler(allowlists.allows))
+
+	for _, target := range []string{"127.0.0.1:31004", "nnfcm.example.net:80", "[::1]:80"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/probe?module=amf&target="+target, nil))
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("probe of %s: status %d, want %d", target, recorder.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestProbeAllowlists(t *testing.T) {
+	allowlists, err := newProbeAllowlists(&config.Config{
+		Modules: map[string]config.Module{"amf": {}, "smf": {}},
+		Probe: config.ProbeConfig{
+			AllowedTargets: []string{"10.0.30.0/24", "NNFCM.example.net"},
+			Modules:        map[string]config.ProbeModuleConfig{"smf": {AllowedTargets: []string{"10.0.40.1"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		module, target string
+		allowed        bool
+	}{
+		{"amf", "10.0.30.7:31004", true},
+		{"amf", "nnfcm.example.net:31004", true},
+		{"amf", "10.0.31.7:31004", false},
+		{"amf", "other.example.net:31004", false},
+		{"smf", "10.0.40.1:31004", true},
+		{"smf", "10.0.30.7:31004", false},
+		{"amf", "10.0.30.7", false},
+	} {
+		if got := allowlists.allows(tc.module, tc.target); got != tc.allowed {
+			t.Errorf("allows(%s, %s) = %t, want %t", tc.module, tc.target, got, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+var (
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cnaasprom_config_last_reload_successful",
+		Help: "Whether the last reload of the configuration succeeded",
+	})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cnaasprom_config_last_reload_success_timestamp_seconds",
+		Help: "Time the configuration was last loaded successfully",
+	})
+)
+
+func init() {
+	metrics.InternalRegistry.MustRegister(lastReloadSuccessful, lastReloadSuccess)
+}
+
+func setReloadResult(success bool) {
+	if !success {
+		lastReloadSuccessful.Set(0)
+		return
+	}
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.SetToCurrentTime()
+}
+
+// instance is the exporter, sources and handlers of one configuration. A
+// reload builds the instance of the new configuration, stops the current
+// one and runs the new one in its place.
+type instance struct {
+	config   *config.Config
+	cache    metrics.Store
+	exporter *metrics.Exporter
+	handler  http.Handler
+
+	elector *metrics.LeaderElector
+	kafka   *metrics.KafkaSource
+	sources []func(ctx context.Context)
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// Build the instance of a configuration without starting anything, so an
+// invalid configuration leaves the current instance running. The persisted
+// state is restored on startup only; on reloads the state is in the store.
+func (a *App) build(ctx context.Context, cfg *config.Config, cache metrics.Store, restore bool) (*instance, error) {
+	exporter, err := metrics.NewExporterWithOptions(cfg, cache, metrics.ExporterOptions{RateLimits: a.rateLimits})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exporter: %v", err)
+	}
+	if restore && cfg.Persistence.File != "" {
+		if err := exporter.LoadState(cfg.Persistence.File); err != nil {
+			log.Printf("Starting without persisted state: %v", err)
+		}
+	}
+	i := &instance{config: cfg, cache: cache, exporter: exporter, stopped: make(chan struct{})}
+
+	// Subscribe to the live monitoring streams
+	if cfg.Streaming.Enabled {
+		source, err := metrics.NewStreamSource(cfg, cache, a.rateLimits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create monitoring stream source: %v", err)
+		}
+
+		log.Printf("Streaming %d monitoring categories", len(cfg.MetricsMonitoringCategory))
+		i.sources = append(i.sources, source.Run)
+	}
+
+	// Subscribe to the telemetry of the gNMI targets
+	if gnmi := exporter.GNMI(); gnmi != nil {
+		log.Printf("Subscribing to %d gNMI targets", len(cfg.GNMI.Targets))
+		i.sources = append(i.sources, gnmi.Run)
+	}
+
+	// Poll the upstream categories in the background
+	if scheduler := exporter.Scheduler(); scheduler != nil {
+		log.Printf("Polling %d categories on schedule", scheduler.Categories())
+		i.sources = append(i.sources, scheduler.Run)
+	}
+
+	// Push the collected values to the configured outputs
+	for _, output := range cfg.Outputs {
+		sink, err := metrics.NewOutputSink(output, exporter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create output: %v", err)
+		}
+
+		log.Printf("Pushing metrics to %s output", output.Type)
+		i.sources = append(i.sources, sink.Run)
+	}
+
+	// With leader election only the leader runs the sources. The lease is
+	// released when the instance stops so the other replica takes over
+	// right away.
+	if cfg.LeaderElection.Enabled {
+		i.elector, err = metrics.NewLeaderElector(cfg.LeaderElection, cfg.TLSPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up leader election: %v", err)
+		}
+	}
+
+	i.ctx, i.cancel = context.WithCancel(ctx)
+	if i.handler, err = a.handler(ctx, i); err != nil {
+		i.cancel()
+		return nil, err
+	}
+
+	// Start the Kafka consumer if brokers are configured. It is created
+	// last as it must be closed once created.
+	if len(cfg.Kafka.Brokers) > 0 {
+		i.kafka, err = metrics.NewKafkaSource(cfg.Kafka, cfg.TLSPolicy, cache)
+		if err != nil {
+			i.cancel()
+			return nil, fmt.Errorf("failed to create kafka source: %v", err)
+		}
+
+		log.Printf("Consuming statistics from kafka topic %s", cfg.Kafka.Topic)
+		i.sources = append(i.sources, i.kafka.Run)
+	}
+	return i, nil
+}
+
+// The handler serving the endpoints of an instance. Reloads run in ctx
+// rather than in the context of the instance, which they stop.
+func (a *App) handler(ctx context.Context, i *instance) (http.Handler, error) {
+	cfg := i.config
+	allowedNetworks, err := parseAllowedNetworks(cfg.Server.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	probeAllowlists, err := newProbeAllowlists(cfg)
+	if err != nil {
+		return nil, err
+	}
+	probeHandler := probeGuard(cfg, i.exporter.ProbeHandler(probeAllowlists.allows))
+
+	landingPage, err := web.NewLandingPage(web.LandingConfig{
+		Name:        "CNaaSProm",
+		Description: "Prometheus exporter for CNaaS statistics and monitoring APIs",
+		Links: []web.LandingLinks{
+			{Address: "/metrics", Text: "Metrics"},
+			{Address: "/probe", Text: "Probe a target with ?target=host:port&module=name"},
+			{Address: "/api/v1/values", Text: "Collected values as JSON"},
+			{Address: "/status", Text: "Status of targets and categories"},
+			{Address: "/alerts", Text: "Series breaching threshold rules"},
+			{Address: "/debug/parse-errors", Text: "Recent parse errors"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create landing page: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", landingPage)
+	mux.Handle("/metrics", authMiddleware(cfg.Server.Auth, concurrencyMiddleware(cfg.Server.MaxConcurrentScrapes, i.exporter.MetricsHandler())))
+	mux.Handle("/probe", authMiddleware(cfg.Server.Auth, probeHandler))
+	mux.Handle("/api/v1/values", authMiddleware(cfg.Server.Auth, i.exporter.ValuesHandler()))
+	mux.Handle("/status", authMiddleware(cfg.Server.Auth, i.exporter.StatusHandler()))
+	mux.Handle("/alerts", authMiddleware(cfg.Server.Auth, i.exporter.AlertsHandler()))
+	mux.Handle("/debug/parse-errors", authMiddleware(cfg.Server.Auth, metrics.ParseErrorsHandler()))
+	if cfg.Server.EnableLifecycle {
+		mux.Handle("/-/reload", authMiddleware(cfg.Server.Auth, a.reloadHandler(ctx)))
+		mux.Handle("/-/refresh", authMiddleware(cfg.Server.Auth, i.exporter.RefreshHandler()))
+	}
+	handler := allowlistMiddleware(allowedNetworks, mux)
+
+	// Access to unix sockets is controlled by file permissions instead
+	if _, ok := cfg.ListenSocketPath(); ok && len(allowedNetworks) > 0 {
+		log.Printf("Ignoring allowed networks when listening on a unix socket")
+		handler = mux
+	}
+	return requestLogMiddleware(cfg.Server.AccessLog, cfg.Server.SlowScrapeThreshold, handler), nil
+}
+
+// Start the sources of an instance
+func (i *instance) run() {
+	i.cache.SetTTL(i.config.StaleSeriesTTL)
+
+	runSources := func(ctx context.Context) {
+		for _, run := range i.sources {
+			go run(ctx)
+		}
+		<-ctx.Done()
+	}
+
+	if i.config.Persistence.File != "" && i.config.Persistence.Interval > 0 {
+		go persistState(i.ctx, i.exporter, i.config.Persistence)
+	}
+	// Every replica evaluates the threshold rules for its /alerts
+	if thresholds := i.exporter.Thresholds(); thresholds != nil {
+		go thresholds.Run(i.ctx)
+	}
+
+	go func() {
+		if i.elector != nil {
+			i.elector.Run(i.ctx, runSources)
+		} else {
+			runSources(i.ctx)
+		}
+		if i.config.Persistence.File != "" {
+			if err := i.exporter.SaveState(i.config.Persistence.File); err != nil {
+				log.Printf("Failed to save state: %v", err)
+			}
+		}
+		if i.kafka != nil {
+			i.kafka.Close()
+		}
+		i.exporter.Close()
+		close(i.stopped)
+	}()
+}
+
+// Stop the sources of an instance and wait until its state is saved
+func (i *instance) stop() {
+	i.cancel()
+	<-i.stopped
+}
+
+// Load the configuration file again and run the new configuration in place
+// of the current one, which keeps running if the file is invalid. The
+// listener, its TLS settings, the TLS policy, the debug listener, tracing
+// and the store of streamed values need a restart.
+func (a *App) reload(ctx context.Context) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	notifyReloading()
+	err := a.replace(ctx)
+	notify("READY=1")
+	setReloadResult(err == nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reloaded the configuration from %s", a.ConfigFile)
+	return nil
+}
+
+// Must be called with reloadMu held
+func (a *App) replace(ctx context.Context) error {
+	if a.ConfigFile == "" {
+		return fmt.Errorf("no configuration file to reload")
+	}
+	cfg, err := config.LoadConfig(a.ConfigFile)
+	if err != nil {
+		return err
+	}
+	cfg.Server.Address = a.Config.Server.Address
+	cfg.Server.Port = a.Config.Server.Port
+	cfg.Server.TLS = a.Config.Server.TLS
+	cfg.Server.WebConfigFile = a.Config.Server.WebConfigFile
+	cfg.Debug = a.Config.Debug
+	cfg.Tracing = a.Config.Tracing
+	cfg.TLSPolicy = a.Config.TLSPolicy
+	cfg.Store = a.Config.Store
+
+	current := a.current.Load()
+	next, err := a.build(ctx, cfg, current.cache, false)
+	if err != nil {
+		return err
+	}
+	current.stop()
+	next.run()
+	a.current.Store(next)
+	a.Config = cfg
+	return nil
+}
+
+// Reload the configuration on POST, as Prometheus' /-/reload does
+func (a *App) reloadHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := a.reload(ctx); err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+			http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Reload the configuration on SIGHUP until ctx is done
+func (a *App) reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := a.reload(ctx); err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
+	}
+}
+
+// Renew the Vault token before it expires and read the secrets again every
+// refresh interval, or when the first of their leases expires, until ctx is
+// done, reloading the configuration when one of them was rotated
+func (a *App) refreshVault(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = config.DefaultVaultRefreshInterval
+	}
+	a.reloadMu.Lock()
+	leaseExpiry := a.Config.VaultLeaseExpiry()
+	a.reloadMu.Unlock()
+	refresh := time.Now().Add(interval)
+
+	for {
+		if !leaseExpiry.IsZero() && leaseExpiry.Before(refresh) {
+			refresh = leaseExpiry
+		}
+		next := refresh
+		renewal := config.VaultTokenRenewal()
+		if !renewal.IsZero() && renewal.Before(next) {
+			next = renewal
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !renewal.IsZero() && !time.Now().Before(renewal) {
+			if err := config.RenewVaultToken(); err != nil {
+				log.Printf("Failed to renew the vault token: %v", err)
+			}
+		}
+		if time.Now().Before(refresh) {
+			continue
+		}
+		refresh = time.Now().Add(interval)
+
+		cfg, err := config.LoadConfig(a.ConfigFile)
+		if err != nil {
+			log.Printf("Failed to refresh secrets from vault: %v", err)
+			leaseExpiry = time.Time{}
+			continue
+		}
+		leaseExpiry = cfg.VaultLeaseExpiry()
+		a.reloadMu.Lock()
+		unchanged := cfg.VaultDigest() == a.Config.VaultDigest()
+		a.reloadMu.Unlock()
+		if unchanged {
+			continue
+		}
+
+		log.Printf("Secrets in vault changed, reloading the configuration")
+		if err := a.reload(ctx); err != nil {
+			log.Printf("Failed to reload configuration: %v", err)
+		}
+	}
+}
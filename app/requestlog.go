@@ -0,0 +1,62 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController reach the flusher of the wrapped writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Log the requests and warn about scrapes slower than the threshold, which
+// run into Prometheus' scrape timeout sooner or later
+func requestLogMiddleware(accessLog bool, slowScrape time.Duration, next http.Handler) http.Handler {
+	if !accessLog && slowScrape <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if accessLog && !isHealthCheck(r) {
+			log.Printf("%s %s from %s: %d in %s", r.Method, r.URL.Path, r.RemoteAddr, status, duration)
+		}
+		if slowScrape > 0 && duration > slowScrape && isScrape(r) {
+			log.Printf("Slow scrape: %s from %s took %s, over the %s threshold", r.URL.Path, r.RemoteAddr, duration, slowScrape)
+		}
+	})
+}
+
+func isScrape(r *http.Request) bool {
+	return r.URL.Path == "/metrics" || r.URL.Path == "/probe"
+}
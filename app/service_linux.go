@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const systemdUnitPath = "/etc/systemd/system/" + ServiceName + ".service"
+
+// Tell systemd about the state of the service, as sd_notify does, when it
+// started the exporter with Type=notify
+func notify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract socket addresses start with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
+
+// Tell systemd a reload starts, with the time systemd-notify-reload expects
+func notifyReloading() {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		notify("RELOADING=1")
+		return
+	}
+	notify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", now.Nano()/1000))
+}
+
+// Ping the systemd watchdog at half its timeout until ctx is done, if
+// WatchdogSec is set for the exporter, as long as the health check passes
+// within that time
+func watchdog(ctx context.Context, healthy func(context.Context) error) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			err := healthy(checkCtx)
+			cancel()
+			if err != nil {
+				log.Printf("Not notifying the systemd watchdog: %v", err)
+				continue
+			}
+			notify("WATCHDOG=1")
+		}
+	}
+}
+
+// InstallService writes a systemd unit running the exporter with args and
+// readiness and watchdog notifications
+func InstallService(executable string, args []string, options ServiceOptions) error {
+	if err := os.WriteFile(systemdUnitPath, []byte(systemdUnit(executable, args, options)), 0o644); err != nil {
+		return fmt.Errorf("failed to write systemd unit: %v", err)
+	}
+	log.Printf("Installed %s; start it with: systemctl daemon-reload && systemctl enable --now %s", systemdUnitPath, ServiceName)
+	return nil
+}
+
+// The systemd unit of the service. Without a user it runs as a dynamic
+// user, which can read world-readable files only and writes to its state
+// directory, /var/lib/cnaasprom.
+func systemdUnit(executable string, args []string, options ServiceOptions) string {
+	user := "DynamicUser=yes\nStateDirectory=" + ServiceName
+	if options.User != "" {
+		user = "User=" + options.User
+	}
+	watchdog := ""
+	if options.WatchdogSec > 0 {
+		watchdog = fmt.Sprintf("WatchdogSec=%s\n", options.WatchdogSec)
+	}
+	return fmt.Sprintf(`[Unit]
+Description=CNaaSProm Prometheus exporter
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+ExecReload=/bin/kill -HUP $MAINPID
+%s
+%sRestart=on-failure
+RestartSec=5s
+
+[Install]
+WantedBy=multi-user.target
+`, quoteUnitArgs(append([]string{executable}, args...)), user, watchdog)
+}
+
+// Quote the arguments of a unit's command line where needed
+func quoteUnitArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\$%;") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Outside of the Windows service manager the exporter runs in the foreground
+func (a *App) RunService() (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The unit runs as the given user or a dynamic one, with the watchdog
+// configured
+func TestSystemdUnit(t *testing.T) {
+	unit := systemdUnit("/usr/local/bin/cnaasprom", []string{"serve", "-config", "/etc/cnaas prom/config.yaml"}, ServiceOptions{WatchdogSec: time.Minute})
+	for _, want := range []string{
+		`ExecStart=/usr/local/bin/cnaasprom serve -config "/etc/cnaas prom/config.yaml"` + "\n",
+		"DynamicUser=yes\n",
+		"StateDirectory=cnaasprom\n",
+		"WatchdogSec=1m0s\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit lacks %q:\n%s", want, unit)
+		}
+	}
+
+	unit = systemdUnit("/usr/local/bin/cnaasprom", []string{"serve"}, ServiceOptions{User: "prometheus"})
+	if !strings.Contains(unit, "User=prometheus\n") || strings.Contains(unit, "DynamicUser") || strings.Contains(unit, "WatchdogSec") {
+		t.Errorf("unit of a user without watchdog:\n%s", unit)
+	}
+}
+
+// The watchdog is notified only while the health check passes
+func TestWatchdogHealthCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	var healthy atomic.Bool
+	checks := make(chan struct{}, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchdog(ctx, func(context.Context) error {
+		select {
+		case checks <- struct{}{}:
+		default:
+		}
+		if !healthy.Load() {
+			return errors.New("unhealthy")
+		}
+		return nil
+	})
+
+	<-checks
+	<-checks
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("watchdog notified with %q while unhealthy", buf[:n])
+	}
+
+	healthy.Store(true)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("watchdog notification %q: %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+
+package app
+
+import (
+	"context"
+	"fmt"
+)
+
+// systemd notifications are Linux only
+func notify(state string) {}
+
+func notifyReloading() {}
+
+func watchdog(ctx context.Context, healthy func(context.Context) error) {}
+
+func InstallService(executable string, args []string, options ServiceOptions) error {
+	return fmt.Errorf("installing a service is supported on Linux with systemd and on Windows only")
+}
+
+// Outside of the Windows service manager the exporter runs in the foreground
+func (a *App) RunService() (bool, error) {
+	return false, nil
+}
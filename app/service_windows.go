@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// systemd notifications are Linux only
+func notify(state string) {}
+
+func notifyReloading() {}
+
+func watchdog(ctx context.Context, healthy func(context.Context) error) {}
+
+// InstallService registers the exporter with the Windows service manager,
+// started automatically with args as the given user, LocalSystem by
+// default. The watchdog is systemd's only.
+func InstallService(executable string, args []string, options ServiceOptions) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	service, err := m.CreateService(ServiceName, executable, mgr.Config{
+		DisplayName:      "CNaaSProm",
+		Description:      "Prometheus exporter for CNaaS statistics and monitoring APIs",
+		StartType:        mgr.StartAutomatic,
+		ServiceStartName: options.User,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	defer service.Close()
+
+	// Restart after failures, like Restart=on-failure with systemd
+	actions := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}
+	if err := service.SetRecoveryActions(actions, 86400); err != nil {
+		log.Printf("Failed to set the recovery actions of the service: %v", err)
+	}
+	log.Printf("Installed service %s; start it with: sc start %s", ServiceName, ServiceName)
+	return nil
+}
+
+// RunService runs the exporter under the Windows service manager when it
+// started the process, and reports false otherwise. Stop and shutdown
+// requests stop the exporter; a parameter change reloads the configuration.
+func (a *App) RunService() (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run(ServiceName, &windowsService{app: a})
+}
+
+type windowsService struct {
+	app *App
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.app.RunContext(ctx)
+	}()
+
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("Application failed: %v", err)
+				return false, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.ParamChange:
+				// Nothing to reload before the exporter started
+				if s.app.current.Load() == nil {
+					log.Printf("Ignoring the parameter change during startup")
+					continue
+				}
+				if err := s.app.reload(ctx); err != nil {
+					log.Printf("Failed to reload configuration: %v", err)
+				}
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v3"
+)
+
+// Build the TLS configuration of the exporter's listener, restricted to
+// the TLS policy
+func newServerTLSConfig(cfg config.TLSServerConfig, policy config.TLSPolicy) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("both certFile and keyFile are required for TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		caCert, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if err := policy.Apply(tlsConfig); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// Check that the TLS of a listener configured by an exporter-toolkit web
+// config file complies with the TLS policy. The toolkit applies the file's
+// own settings, so a listener allowing more than the policy is refused
+// rather than silently served.
+func checkWebConfigPolicy(path string, policy config.TLSPolicy) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read web config file: %v", err)
+	}
+	// The toolkit's defaults
+	webConfig := web.Config{TLSConfig: web.TLSConfig{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS13}}
+	if err := yaml.Unmarshal(data, &webConfig); err != nil {
+		return fmt.Errorf("failed to parse web config file: %v", err)
+	}
+	c := webConfig.TLSConfig
+	if c.TLSCert == "" && c.TLSCertPath == "" {
+		// Plain HTTP
+		return nil
+	}
+
+	listener := &tls.Config{MinVersion: uint16(c.MinVersion), MaxVersion: uint16(c.MaxVersion)}
+	for _, suite := range c.CipherSuites {
+		listener.CipherSuites = append(listener.CipherSuites, uint16(suite))
+	}
+	for _, curve := range c.CurvePreferences {
+		listener.CurvePreferences = append(listener.CurvePreferences, tls.CurveID(curve))
+	}
+	required := listener.Clone()
+	if err := policy.Apply(required); err != nil {
+		return fmt.Errorf("web config file %s: %v", path, err)
+	}
+	if listener.MinVersion < required.MinVersion {
+		return fmt.Errorf("web config file %s: min_version is below the TLS policy's", path)
+	}
+	if required.MaxVersion != 0 && listener.MaxVersion > required.MaxVersion {
+		return fmt.Errorf("web config file %s: max_version is above the TLS policy's", path)
+	}
+	if !allowedBy(listener.CipherSuites, required.CipherSuites) {
+		return fmt.Errorf("web config file %s: cipher_suites must be restricted to those of the TLS policy", path)
+	}
+	if !allowedBy(listener.CurvePreferences, required.CurvePreferences) {
+		return fmt.Errorf("web config file %s: curve_preferences must be restricted to those of the TLS policy", path)
+	}
+	return nil
+}
+
+// Whether the configured values stay within the allowed ones. Nothing
+// configured means Go's defaults, which only an unrestricted policy allows.
+func allowedBy[T comparable](configured, allowed []T) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	if len(configured) == 0 {
+		return false
+	}
+	for _, value := range configured {
+		if !slices.Contains(allowed, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// HTTP/2 requires TLS 1.2 connections to offer an AES-128-GCM suite
+func http2Allowed(t *tls.Config) bool {
+	if len(t.CipherSuites) == 0 || t.MinVersion >= tls.VersionTLS13 {
+		return true
+	}
+	for _, id := range t.CipherSuites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
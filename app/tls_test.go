@@ -0,0 +1,111 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// A listener configured by a web config file must comply with the TLS policy
+func TestWebConfigPolicy(t *testing.T) {
+	policy := config.TLSPolicy{
+		MinVersion:   "TLS12",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}
+	fips := config.TLSPolicy{FIPSCipherSuites: true}
+	tlsServer := "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"
+
+	for _, tc := range []struct {
+		name, webConfig string
+		policy          config.TLSPolicy
+		ok              bool
+	}{
+		{"plain HTTP", "basic_auth_users:\n  prometheus: hash\n", policy, true},
+		{"no policy", tlsServer, config.TLSPolicy{}, true},
+		{"default suites", tlsServer, policy, false},
+		{"policy suites", tlsServer + "  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]\n", policy, true},
+		{"other suite", tlsServer + "  cipher_suites: [TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256]\n", policy, false},
+		{"older version", tlsServer + "  min_version: TLS11\n  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]\n", policy, false},
+		{"fips up to TLS 1.3", tlsServer + "  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]\n  curve_preferences: [CurveP256]\n", fips, false},
+		{"fips", tlsServer + "  max_version: TLS12\n  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]\n  curve_preferences: [CurveP256]\n", fips, true},
+		{"fips default curves", tlsServer + "  max_version: TLS12\n  cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384]\n", fips, false},
+	} {
+		path := filepath.Join(t.TempDir(), "web.yml")
+		if err := os.WriteFile(path, []byte(tc.webConfig), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := checkWebConfigPolicy(path, tc.policy)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+// Write a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cnaasprom"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// The listener serves the configured certificate and verifies the client
+// certificates given against the client CA
+func TestServerTLSConfig(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+
+	tlsConfig, err := newServerTLSConfig(config.TLSServerConfig{CertFile: certFile, KeyFile: keyFile}, config.TLSPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.ClientAuth != tls.NoClientCert || tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("TLS config without client CA = %+v", tlsConfig)
+	}
+
+	tlsConfig, err = newServerTLSConfig(config.TLSServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}, config.TLSPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientCAs == nil || tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("client CA not used to verify client certificates")
+	}
+
+	if _, err := newServerTLSConfig(config.TLSServerConfig{CertFile: certFile}, config.TLSPolicy{}); err == nil {
+		t.Errorf("certificate without key accepted")
+	}
+	if _, err := newServerTLSConfig(config.TLSServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, config.TLSPolicy{}); err == nil {
+		t.Errorf("client CA file without certificates accepted")
+	}
+}
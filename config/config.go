@@ -1,47 +1,1240 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config struct to hold application configuration
 type Config struct {
+	// Version of the configuration format, CurrentConfigVersion once loaded
+	ConfigVersion int `yaml:"configVersion"`
+
 	Server struct {
-		Address string `yaml:"address"`
-		Port    uint   `yaml:"port"`
+		Address       string          `yaml:"address"`
+		Port          uint            `yaml:"port"`
+		Auth          AuthConfig      `yaml:"auth"`
+		TLS           TLSServerConfig `yaml:"tls"`
+		WebConfigFile string          `yaml:"-"` // set by --web.config.file
+
+		AllowedNetworks []string `yaml:"allowedNetworks"`
+
+		// Log every request, and warn about scrapes slower than the threshold
+		AccessLog           bool          `yaml:"accessLog"`
+		SlowScrapeThreshold time.Duration `yaml:"slowScrapeThreshold"`
+
+		// Scrapes of /metrics served at once, unlimited when 0
+		MaxConcurrentScrapes int `yaml:"maxConcurrentScrapes"`
+
+		// Serve POST /-/reload and /-/refresh to reload the configuration
+		// and to fetch the targets again
+		EnableLifecycle bool `yaml:"enableLifecycle"`
 	} `yaml:"Server"`
 
-	RemoteStatisticServer struct {
+	// Optional listener for pprof, expvar and Go runtime metrics
+	Debug struct {
 		Address string `yaml:"address"`
 		Port    uint   `yaml:"port"`
-	} `yaml:"RemoteStatisticServer"`
+	} `yaml:"Debug"`
 
-	RemoteMonitoringServer struct {
-		Address string `yaml:"address"`
-		Port    uint   `yaml:"port"`
-	} `yaml:"RemoteMonitoringServer"`
+	RemoteStatisticServer  RemoteServer       `yaml:"RemoteStatisticServer"`
+	RemoteMonitoringServer RemoteServer       `yaml:"RemoteMonitoringServer"`
+	KubernetesSD           KubernetesSDConfig `yaml:"kubernetesSD"`
+
+	// What a scrape serves when the statistics server fails: fail, partial
+	// (default) or serve-cached. Also the default of targets and modules.
+	OnUpstreamError string `yaml:"onUpstreamError"`
+
+	// What to do with values of the same name from several categories: sum
+	// (default), keep-first, error or label-by-source
+	OnMetricConflict string `yaml:"onMetricConflict"`
+
+	// How values of the same name are combined when onMetricConflict sums them
+	CombineRules []CombineRule `yaml:"combineRules"`
+
+	// Additional upstream APIs scraped with the settings of a module. Modules
+	// are also selected by the module parameter of /probe requests.
+	Modules        map[string]Module    `yaml:"modules"`
+	Targets        []Target             `yaml:"targets"`
+	LeaderElection LeaderElectionConfig `yaml:"leaderElection"`
+
+	// Restrict the targets and modules of /probe requests
+	Probe ProbeConfig `yaml:"probe"`
+
+	// Other cnaasprom instances whose metrics are merged into these
+	Federation FederationConfig `yaml:"federation"`
+
+	Kafka     KafkaConfig     `yaml:"Kafka"`
+	Streaming StreamingConfig `yaml:"Streaming"`
+
+	// Push the collected values to Graphite or InfluxDB as well
+	Outputs []OutputConfig `yaml:"outputs"`
+
+	// Notify when an upstream server becomes unreachable or reachable again
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// Legacy devices polled over SNMP on every scrape
+	SNMP SNMPConfig `yaml:"snmp"`
+
+	// Operational state of network devices read over NETCONF on every scrape
+	NETCONF NETCONFConfig `yaml:"netconf"`
+
+	// Telemetry streamed by network devices over gNMI subscriptions
+	GNMI GNMIConfig `yaml:"gnmi"`
+
+	// Device inventory of CNaaS-NMS, used to label and generate device targets
+	CNaaSNMS CNaaSNMSConfig `yaml:"cnaasNMS"`
+
+	MetricsStatisticsCategory []string    `yaml:"MetricsStatisticsCategory"`
+	MetricsMonitoringCategory []string    `yaml:"MetricsMonitoringCategory"`
+	QueryParams               QueryParams `yaml:"queryParams"`
+
+	// Query parameters per category, overriding those of queryParams
+	CategoryQueryParams map[string]map[string]string `yaml:"categoryQueryParams"`
+
+	// Identifier field per category whose response is an array of objects;
+	// it becomes a label with one series per element
+	ArrayIdentifiers map[string]string `yaml:"arrayIdentifiers"`
+
+	// Groups of a category's statistics broken down per network slice or
+	// cell, mapped to their dimension: slice or cell. Each element becomes a
+	// series labelled with snssai, sst and sd, or ncgi and tac.
+	Breakdowns map[string]map[string]string `yaml:"breakdowns"`
+
+	// JSONPath rules per category selecting the metrics and labels of
+	// arbitrary response shapes; they take precedence over arrayIdentifiers
+	ExtractionRules map[string][]ExtractionRule `yaml:"extractionRules"`
+
+	// Parser per category for responses in other formats than JSON, and Go
+	// plugins registering more formats
+	CategoryFormats map[string]FormatConfig `yaml:"categoryFormats"`
+	ParserPlugins   []string                `yaml:"parserPlugins"`
+
+	// Path of the statistics API, overridable per category
+	StatisticsAPI StatisticsAPIConfig `yaml:"statisticsAPI"`
+
+	// Rolling time window and granularity requested from the statistics API
+	TimeWindow TimeWindowConfig `yaml:"timeWindow"`
+
+	// Timestamps of statistics that describe a past interval
+	TimestampOffset TimestampOffsetConfig `yaml:"timestampOffset"`
+
+	// Times upstream reports its data was collected at, exported as its age
+	UpstreamTimestamps UpstreamTimestampsConfig `yaml:"upstreamTimestamps"`
+
+	// Templates of the upstream URLs, for API shapes the defaults do not cover
+	URLTemplates URLTemplatesConfig `yaml:"urlTemplates"`
+
+	// Extra request headers per category, overriding the remote server headers
+	CategoryHeaders map[string]map[string]Secret `yaml:"categoryHeaders"`
 
-	MetricsStatisticsCategory []string `yaml:"MetricsStatisticsCategory"`
-	MetricsMonitoringCategory []string `yaml:"MetricsMonitoringCategory"`
-	QueryParams               string   `yaml:"queryParams"`
+	// HTTP method and request body per category, for APIs not queried with GET
+	CategoryRequests map[string]RequestConfig `yaml:"categoryRequests"`
+
+	// JSON Schema file per statistics category that responses must match
+	ResponseSchemas map[string]string `yaml:"responseSchemas"`
+
+	// Minimum time between upstream fetches; scrapes in between reuse the last result
+	MinFetchInterval time.Duration `yaml:"minFetchInterval"`
+
+	// Poll the upstream categories in the background instead of on scrape
+	Schedule ScheduleConfig `yaml:"schedule"`
+
+	// Subtracted from the scrape timeout sent by Prometheus to leave time for the response
+	ScrapeTimeoutOffset time.Duration `yaml:"scrapeTimeoutOffset"`
+
+	// How the statistics categories of a scrape share its deadline
+	CategoryFetch CategoryFetchConfig `yaml:"categoryFetch"`
+
+	ResponseCache ResponseCacheConfig `yaml:"responseCache"`
+
+	// Export traces of the scrape path to an OTLP/HTTP collector
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// Outbound request rate limits, overall and per upstream server
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+
+	// Stop fetching from servers that keep failing
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuitBreaker"`
+
+	// HMAC signatures of the upstream requests
+	RequestSigning RequestSigningConfig `yaml:"requestSigning"`
+
+	// TLS versions and cipher suites of the listener and upstream connections
+	TLSPolicy TLSPolicy `yaml:"tlsPolicy"`
+
+	// HashiCorp Vault holding the secrets given with valueFrom.vault
+	Vault VaultConfig `yaml:"vault"`
+
+	// Connection pool of the HTTP client kept per upstream server
+	Connections ConnectionsConfig `yaml:"connections"`
+
+	// Resolution of the upstream host names
+	DNS DNSConfig `yaml:"dns"`
+
+	// How upstream redirects, e.g. to a login page, are followed
+	Redirects RedirectConfig `yaml:"redirects"`
+
+	// Largest upstream response body or stream message in bytes, after decompression
+	MaxResponseSize int64 `yaml:"maxResponseSize"`
+
+	// Maximum number of series exported per category and in total
+	SeriesLimits SeriesLimitsConfig `yaml:"seriesLimits"`
+
+	// Streamed values not updated for this long are dropped from /metrics,
+	// e.g. a few poll intervals. Zero keeps them until the next update.
+	StaleSeriesTTL time.Duration `yaml:"staleSeriesTTL"`
+
+	// Periodically save collected values to disk and restore them on startup
+	Persistence PersistenceConfig `yaml:"persistence"`
+
+	// Where streamed values are kept, in memory unless replicas share them
+	Store StoreConfig `yaml:"store"`
+
+	// Namespace and per-category subsystems of the exported metric names
+	Naming NamingConfig `yaml:"naming"`
+
+	// Numeric values of string states in monitoring payloads
+	States StatesConfig `yaml:"states"`
+
+	// Parts of string values in monitoring payloads turned into labels
+	ValueExtractions []ValueExtraction `yaml:"valueExtractions"`
+
+	// Unit conversions applied to the values of matching metrics on export
+	Transforms []ValueTransform `yaml:"transforms"`
+
+	// Thresholds on the collected metrics of the configured operators,
+	// evaluated every ThresholdInterval (30s by default) and reported by
+	// /alerts
+	Thresholds        []ThresholdRule `yaml:"thresholds"`
+	ThresholdInterval time.Duration   `yaml:"thresholdInterval"`
+
+	// Standard 3GPP TS 28.552 names for vendor metrics
+	Measurements []MeasurementMapping `yaml:"measurements"`
+
+	// Keys of a prefix and suffixes, such as throughput.cell1, exported as
+	// one metric with the suffixes as labels
+	SplitRules []SplitRule `yaml:"splitRules"`
+
+	// YAML file mapping metric names to help text, type and unit
+	MetricsMetadataFile string `yaml:"metricsMetadataFile"`
+
+	DerivedMetrics []DerivedMetric `yaml:"derivedMetrics"`
+	Rates          RateConfig      `yaml:"rates"`
+
+	Histograms   []HistogramMapping `yaml:"histograms"`
+	Aggregations []Aggregation      `yaml:"aggregations"`
+
+	// Whether secrets were read from Vault, and a digest of their values
+	usesVault   bool
+	vaultDigest [sha256.Size]byte
+	// When the first lease of those secrets expires
+	vaultLeaseExpiry time.Time
 }
 
-// LoadConfig loads the YAML configuration file
-func LoadConfig(filename string) (*Config, error) {
-	config := &Config{}
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open config file: %v", err)
+// Module holds settings shared by targets, like the modules of the blackbox
+// exporter. DataType is statistics (default), monitoring or a target type;
+// the poll interval is the minimum time between fetches of a target.
+// OnUpstreamError decides what a scrape serves when fetches of the target
+// fail: fail fails the scrape, partial leaves the failed categories out and
+// serve-cached serves their last response.
+type Module struct {
+	Scheme       string            `yaml:"scheme"`
+	DataType     string            `yaml:"dataType"`
+	Categories   []string          `yaml:"categories"`
+	Auth         TargetAuth        `yaml:"auth"`
+	TLS          TLSClientConfig   `yaml:"tls"`
+	ProxyURL     string            `yaml:"proxyURL"`
+	Headers      map[string]Secret `yaml:"headers"`
+	PollInterval time.Duration     `yaml:"pollInterval"`
+
+	OnUpstreamError string `yaml:"onUpstreamError"`
+}
+
+// TargetAuth authenticates the exporter to a target API
+type TargetAuth struct {
+	Username    string `yaml:"username"`
+	Password    Secret `yaml:"password"`
+	BearerToken Secret `yaml:"bearerToken"`
+}
+
+// Target is an upstream API scraped with the named module. Settings given
+// on the target itself override those of the module. A type reads a known
+// upstream: open5gs the metrics endpoint of an Open5GS network function,
+// port 9090 by default; free5gc the UEs registered with a free5GC core from
+// its WebConsole, port 5000 by default; ueransim the status of the UERANSIM
+// gNB or UE named by the address, using nr-cli.
+type Target struct {
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	Address  string            `yaml:"address"`
+	Port     uint              `yaml:"port"`
+	Module   string            `yaml:"module"`
+	Labels   map[string]string `yaml:"labels"`
+	Settings Module            `yaml:",inline"`
+}
+
+// Merge returns the module with the settings of override that are set
+func (m Module) Merge(override Module) Module {
+	if override.Scheme != "" {
+		m.Scheme = override.Scheme
+	}
+	if override.DataType != "" {
+		m.DataType = override.DataType
+	}
+	if len(override.Categories) > 0 {
+		m.Categories = override.Categories
+	}
+	if override.Auth != (TargetAuth{}) {
+		m.Auth = override.Auth
+	}
+	if override.TLS != (TLSClientConfig{}) {
+		m.TLS = override.TLS
+	}
+	if override.ProxyURL != "" {
+		m.ProxyURL = override.ProxyURL
+	}
+	if len(override.Headers) > 0 {
+		headers := make(map[string]Secret, len(m.Headers)+len(override.Headers))
+		for name, value := range m.Headers {
+			headers[name] = value
+		}
+		for name, value := range override.Headers {
+			headers[name] = value
+		}
+		m.Headers = headers
+	}
+	if override.PollInterval != 0 {
+		m.PollInterval = override.PollInterval
+	}
+	if override.OnUpstreamError != "" {
+		m.OnUpstreamError = override.OnUpstreamError
+	}
+	return m
+}
+
+// KubernetesSDConfig discovers the statistics servers from the pods or
+// services matching a label selector. Outside the cluster an API server,
+// e.g. from kubectl proxy, must be given.
+type KubernetesSDConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	APIServer     string `yaml:"apiServer"`
+	Namespace     string `yaml:"namespace"`
+	LabelSelector string `yaml:"labelSelector"`
+	Role          string `yaml:"role"`
+	Port          uint   `yaml:"port"`
+}
+
+// ProbeConfig restricts which targets /probe may scrape, so the exporter
+// cannot be used to reach arbitrary internal services. Targets configured
+// with the probed module and targets discovered in kubernetes are probed with
+// the module's credentials. Other targets must be allowed, and are probed
+// without credentials. Allowed targets are host names, matched exactly, or
+// IP addresses and CIDR networks; a name is not resolved to check its
+// addresses. Without allowed targets only known targets may be probed.
+type ProbeConfig struct {
+	AllowedTargets []string                     `yaml:"allowedTargets"`
+	Modules        map[string]ProbeModuleConfig `yaml:"modules"`
+	Limits         ProbeLimitsConfig            `yaml:"limits"`
+}
+
+// ProbeLimitsConfig bounds what a probe request may ask for, so scanners
+// fuzzing /probe get a 400 with the reason. MaxCategories bounds the
+// category fetches of a request, the module's categories times the
+// operators. Zero takes the default: 253, 64 and 100.
+type ProbeLimitsConfig struct {
+	MaxHostLength       int `yaml:"maxHostLength"`
+	MaxModuleNameLength int `yaml:"maxModuleNameLength"`
+	MaxCategories       int `yaml:"maxCategories"`
+}
+
+// ProbeModuleConfig restricts probes with one module. Its allowed targets
+// replace the global ones, and its auth is required on top of the server's.
+type ProbeModuleConfig struct {
+	AllowedTargets []string   `yaml:"allowedTargets"`
+	Auth           AuthConfig `yaml:"auth"`
+}
+
+// FederationConfig makes the exporter an aggregator of other cnaasprom
+// instances, e.g. per-site collectors. The metrics of every instance are
+// fetched on each scrape and served with those collected here, labelled with
+// the instance name, under Label (exporter by default), and its labels.
+type FederationConfig struct {
+	Label     string               `yaml:"label"`
+	Instances []FederationInstance `yaml:"instances"`
+}
+
+// FederationInstance is a cnaasprom instance scraped on Path, /metrics by
+// default, with the scheme, auth, TLS, proxy and headers of its settings
+type FederationInstance struct {
+	Name     string            `yaml:"name"`
+	Address  string            `yaml:"address"`
+	Port     uint              `yaml:"port"`
+	Path     string            `yaml:"path"`
+	Labels   map[string]string `yaml:"labels"`
+	Settings Module            `yaml:",inline"`
+}
+
+// LeaderElectionConfig lets only one of several exporter replicas run the
+// streaming, polling and kafka sources, using a kubernetes Lease. The
+// identity defaults to the hostname, which is the pod name in kubernetes.
+type LeaderElectionConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	APIServer     string        `yaml:"apiServer"`
+	Namespace     string        `yaml:"namespace"`
+	LeaseName     string        `yaml:"leaseName"`
+	Identity      string        `yaml:"identity"`
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	RetryPeriod   time.Duration `yaml:"retryPeriod"`
+}
+
+// PersistenceConfig sets the state file and how often it is written. The
+// file is also written on shutdown.
+type PersistenceConfig struct {
+	File     string        `yaml:"file"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// StoreConfig selects the store of streamed values and polled results:
+// memory (default) or redis, shared by replicas behind a load balancer so
+// they serve the same data.
+type StoreConfig struct {
+	Type  string      `yaml:"type"`
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// RedisConfig connects to a Redis server at Address, host:port, over TLS
+// when enabled. Keys start with KeyPrefix, cnaasprom by default, so several
+// exporters can share a database. Timeout bounds every request, 2s by
+// default. Keys and the operators and categories listed expire once not
+// updated for the stale series TTL, or for KeyTTL, 24h by default, when
+// there is none.
+type RedisConfig struct {
+	Address   string          `yaml:"address"`
+	Username  string          `yaml:"username"`
+	Password  Secret          `yaml:"password"`
+	DB        int             `yaml:"db"`
+	KeyPrefix string          `yaml:"keyPrefix"`
+	Timeout   time.Duration   `yaml:"timeout"`
+	KeyTTL    time.Duration   `yaml:"keyTTL"`
+	TLS       TLSClientConfig `yaml:"tls"`
+}
+
+// ExtractionRule selects objects with a JSONPath; label and metric paths are
+// relative to each selected object, e.g. $.kpi.throughput. Without metrics
+// every number in the object becomes a metric.
+type ExtractionRule struct {
+	Path    string            `yaml:"path"`
+	Labels  map[string]string `yaml:"labels"`
+	Metrics map[string]string `yaml:"metrics"`
+}
+
+// StatesConfig maps string states to numbers. Metrics matching a state set
+// pattern are exported with a state label per listed state instead, each
+// state needing a value of its own.
+type StatesConfig struct {
+	Values    map[string]float64 `yaml:"values"`
+	StateSets []StateSet         `yaml:"stateSets"`
+}
+
+// StateSet lists the possible states of the metrics matching a regex
+type StateSet struct {
+	Metric string   `yaml:"metric"`
+	States []string `yaml:"states"`
+}
+
+// ValueExtraction parses the string values of the monitoring metrics
+// matching the Metric regex, e.g. "UP since 2024-01-02", with Pattern. The
+// named group value holds the number or state exported as the value; the
+// other named groups become labels of the metric, or of a separate
+// <metric>_info series set to 1 when Info is set.
+type ValueExtraction struct {
+	Metric  string `yaml:"metric"`
+	Pattern string `yaml:"pattern"`
+	Info    bool   `yaml:"info"`
+}
+
+// ValueTransform converts the values of the metrics matching a regex to
+// value * multiply / divide + offset. Unset factors default to 1.
+type ValueTransform struct {
+	Metric   string  `yaml:"metric"`
+	Multiply float64 `yaml:"multiply"`
+	Divide   float64 `yaml:"divide"`
+	Offset   float64 `yaml:"offset"`
+}
+
+// ThresholdRule is breached by the series of metrics matching a regex, and
+// the labels given, whose value compares to Value with Operator: >, >=, <,
+// <=, == or !=. The rule fires once a series breached it for For.
+type ThresholdRule struct {
+	Name     string            `yaml:"name"`
+	Metric   string            `yaml:"metric"`
+	Labels   map[string]string `yaml:"labels"`
+	Operator string            `yaml:"operator"`
+	Value    float64           `yaml:"value"`
+	For      time.Duration     `yaml:"for"`
+	Severity string            `yaml:"severity"`
+	Summary  string            `yaml:"summary"`
+}
+
+// MeasurementMapping exports the metrics matching a regex under a 3GPP TS
+// 28.552 measurement name such as RM.RegisteredSubNbrMean, with the dots
+// replaced by underscores. Label values may refer to groups of the regex,
+// as $1 or ${name}. The vendor metric is dropped unless Keep is set.
+type MeasurementMapping struct {
+	Metric      string            `yaml:"metric"`
+	Measurement string            `yaml:"measurement"`
+	Labels      map[string]string `yaml:"labels"`
+	Keep        bool              `yaml:"keep"`
+}
+
+// CombineRule combines the values of Metric returned by Category and by other
+// categories too with Function: sum, max, min, last or avg. Category is the
+// statistics category that returned the metric first; empty fields match all.
+type CombineRule struct {
+	Category string `yaml:"category"`
+	Metric   string `yaml:"metric"`
+	Function string `yaml:"function"`
+}
+
+// SplitRule exports the values of a category whose keys are the Prefix and
+// suffixes joined by the Delimiter, "." unless set, as the metric of the
+// prefix with a label per suffix. Category is the monitoring category, or a
+// statistics category and group such as amf_registration; empty matches all.
+type SplitRule struct {
+	Category  string   `yaml:"category"`
+	Prefix    string   `yaml:"prefix"`
+	Delimiter string   `yaml:"delimiter"`
+	Labels    []string `yaml:"labels"`
+}
+
+// NamingConfig prefixes every exported metric with a namespace. Subsystems
+// replace the category a metric name starts with, e.g. udmAuthentication: udm.
+// An empty subsystem drops the category.
+type NamingConfig struct {
+	Namespace  string            `yaml:"namespace"`
+	Subsystems map[string]string `yaml:"subsystems"`
+}
+
+// DerivedMetric defines a metric computed from other collected metrics
+type DerivedMetric struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+	Help string `yaml:"help"`
+}
+
+// RemoteServer describes an upstream API server
+type RemoteServer struct {
+	Address  string            `yaml:"address"`
+	Port     uint              `yaml:"port"`
+	ProxyURL string            `yaml:"proxyURL"`
+	Headers  map[string]Secret `yaml:"headers"`
+}
+
+// SocketPath returns the path of a unix socket address such as
+// unix:///var/run/nnfcm.sock
+func (s RemoteServer) SocketPath() (string, bool) {
+	return socketPath(s.Address)
+}
+
+// HostPort joins the server address and port; IPv6 literals may be written
+// with or without brackets
+func (s RemoteServer) HostPort() string {
+	return JoinHostPort(s.Address, s.Port)
+}
+
+// JoinHostPort builds a host:port address, bracketing IPv6 literals
+func JoinHostPort(address string, port uint) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+func socketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(address, "unix://"), true
+}
+
+// AuthConfig protects the exporter's own endpoints. Basic auth passwords
+// are bcrypt hashes; client certificates are only available over TLS.
+type AuthConfig struct {
+	BasicAuthUsers     map[string]Secret `yaml:"basicAuthUsers"`
+	BearerToken        Secret            `yaml:"bearerToken"`
+	ClientCertificate  bool              `yaml:"clientCertificate"`
+	AllowedCommonNames []string          `yaml:"allowedCommonNames"`
+}
+
+// APIPath is the part of a statistics URL before the category:
+// basePath/version/resource/category
+type APIPath struct {
+	BasePath string `yaml:"basePath"`
+	Version  string `yaml:"version"`
+	Resource string `yaml:"resource"`
+}
+
+// StatisticsAPIConfig sets the statistics API path. Fields left empty fall
+// back to /nnfcm-statistics/v2/stats, and per category to the global path.
+type StatisticsAPIConfig struct {
+	APIPath    `yaml:",inline"`
+	Categories map[string]APIPath `yaml:"categories"`
+}
+
+// Path returns the URL path of a statistics category, escaping its name
+func (c StatisticsAPIConfig) Path(category string) string {
+	p := c.Resolve(category)
+	return path.Join("/", p.BasePath, p.Version, p.Resource, EscapeCategory(category))
+}
+
+// EscapeCategory escapes each path segment of a category for use in a URL
+func EscapeCategory(category string) string {
+	segments := strings.Split(category, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Resolve returns the API path settings applying to a category
+func (c StatisticsAPIConfig) Resolve(category string) APIPath {
+	p := APIPath{BasePath: "/nnfcm-statistics", Version: "v2", Resource: "stats"}
+	for _, override := range []APIPath{c.APIPath, c.Categories[category]} {
+		if override.BasePath != "" {
+			p.BasePath = override.BasePath
+		}
+		if override.Version != "" {
+			p.Version = override.Version
+		}
+		if override.Resource != "" {
+			p.Resource = override.Resource
+		}
+	}
+	return p
+}
+
+// TimeWindowConfig adds start, end and granularity parameters to every
+// statistics request, covering the Duration up to the time of the fetch.
+// Granularity is an ISO 8601 duration such as PT5M; with Align the end is
+// rounded down to a multiple of it so only complete periods are requested.
+// Times are formatted as RFC 3339 in UTC unless TimeFormat gives another
+// layout, or unix for seconds since the epoch. Categories override the
+// duration and granularity.
+type TimeWindowConfig struct {
+	TimeWindow       `yaml:",inline"`
+	Align            bool                  `yaml:"align"`
+	TimeFormat       string                `yaml:"timeFormat"`
+	StartParam       string                `yaml:"startParam"`
+	EndParam         string                `yaml:"endParam"`
+	GranularityParam string                `yaml:"granularityParam"`
+	Categories       map[string]TimeWindow `yaml:"categories"`
+}
+
+// TimeWindow is the length and granularity of a statistics time window
+type TimeWindow struct {
+	Duration    time.Duration `yaml:"duration"`
+	Granularity string        `yaml:"granularity"`
+}
+
+// TimestampOffsetConfig exports the samples of the statistics categories
+// with explicit timestamps for statistics aggregated over a past interval:
+// the time upstream collected them less the offset, or without upstream
+// timestamps the start of the interval of the offset before the last
+// boundary. Categories override the offset for any category, 0 exporting it
+// without timestamps.
+type TimestampOffsetConfig struct {
+	Offset     time.Duration            `yaml:"offset"`
+	Categories map[string]time.Duration `yaml:"categories"`
+}
+
+// UpstreamTimestampsConfig reads the time statistics and monitoring
+// responses were collected upstream from the Fields at their top level or
+// in their groups, lastUpdated and collectionTime by default, and exports
+// the age of the oldest as cnaas_<category>_data_age_seconds. The fields are
+// removed before the values are parsed. Formats are tried in order:
+// rfc3339, unix (seconds), unix_ms or a Go time layout, read in Timezone
+// (UTC by default) unless it holds a zone. Categories override the fields,
+// formats and timezone.
+type UpstreamTimestampsConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	TimestampFormat `yaml:",inline"`
+	Categories      map[string]TimestampFormat `yaml:"categories"`
+}
+
+// TimestampFormat tells where an upstream timestamp is and how to parse it
+type TimestampFormat struct {
+	Fields   []string `yaml:"fields"`
+	Formats  []string `yaml:"formats"`
+	Timezone string   `yaml:"timezone"`
+}
+
+// URLTemplatesConfig replaces the statistics and monitoring URL formats.
+// Templates use {name} placeholders: scheme, host, port, address (host:port),
+// category, operator, basePath, version and resource of the statistics API,
+// path (the statistics path, or monitoring or stream for the monitoring API)
+// and the names of Variables.
+type URLTemplatesConfig struct {
+	Statistics string            `yaml:"statistics"`
+	Monitoring string            `yaml:"monitoring"`
+	Variables  map[string]string `yaml:"variables"`
+}
+
+// FormatConfig selects the parser of a category's responses by the name it
+// is registered with. The command format pipes the response body to Command
+// and reads a JSON array of samples from its output. The csv format turns
+// LabelColumns, header names mapped to label names, into labels and the
+// other numeric columns into metrics. The prometheus format reads the text
+// exposition format, keeping histograms as histograms.
+type FormatConfig struct {
+	Format       string            `yaml:"format"`
+	Command      []string          `yaml:"command"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	LabelColumns map[string]string `yaml:"labelColumns"`
+	Delimiter    string            `yaml:"delimiter"`
+}
+
+// RequestConfig sets how a category is requested. Body is a text/template
+// rendered with .Operator and .Category; with a body the method defaults to POST.
+type RequestConfig struct {
+	Method string `yaml:"method"`
+	Body   string `yaml:"body"`
+}
+
+// TracingConfig enables tracing when an endpoint such as
+// http://otel-collector:4318/v1/traces is set. Spans are sent as OTLP/HTTP
+// protobuf.
+type TracingConfig struct {
+	Endpoint      string            `yaml:"endpoint"`
+	Headers       map[string]Secret `yaml:"headers"`
+	SamplingRatio float64           `yaml:"samplingRatio"`
+}
+
+// RateLimit allows a number of requests per second with bursts of up to
+// burst requests. A zero rate does not limit.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+}
+
+// RateLimitConfig limits the requests to all upstream servers together and
+// to each server. Requests wait for their turn unless that would outlast
+// the scrape timeout.
+type RateLimitConfig struct {
+	RateLimit   `yaml:",inline"`
+	PerServer   RateLimit         `yaml:"perServer"`
+	RetryBudget RetryBudgetConfig `yaml:"retryBudget"`
+}
+
+// RetryBudgetConfig retries upstream requests failing with a connection
+// error or a 5xx status up to MaxRetries times (1 by default), as long as
+// the retries to a server stay below Ratio of the requests sent to it.
+// Retries wait for the rate limits like any request. A zero ratio disables
+// retries.
+type RetryBudgetConfig struct {
+	Ratio      float64 `yaml:"ratio"`
+	MaxRetries int     `yaml:"maxRetries"`
+}
+
+// CircuitBreakerConfig opens the circuit of an upstream server after the
+// given number of consecutive failures. Once the cool-down has passed a
+// single request probes the server, closing the circuit when it succeeds.
+// A zero threshold disables the breaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+// RequestSigningConfig signs every upstream HTTP request with an HMAC of the
+// Unix time in seconds, the method, the lowercase host with its port if any,
+// the path with the query and the hex SHA-256 of the body, joined by
+// newlines. The time is sent in TimestampHeader (X-Timestamp by default) and
+// the signature, hex or base64 encoded, in SignatureHeader (X-Signature).
+// hmac-sha256 is the only algorithm supported; the key may come from a file
+// or the environment.
+type RequestSigningConfig struct {
+	Algorithm       string `yaml:"algorithm"`
+	Key             Secret `yaml:"key"`
+	TimestampHeader string `yaml:"timestampHeader"`
+	SignatureHeader string `yaml:"signatureHeader"`
+	Encoding        string `yaml:"encoding"`
+}
+
+// VaultConfig logs in to HashiCorp Vault at Address (VAULT_ADDR by default)
+// to read the secrets given with valueFrom.vault, on startup and again every
+// RefreshInterval (5m by default) or when their lease expires, reloading the
+// configuration when one of them changed. The token of the login is kept,
+// renewed before its TTL runs out and revoked on shutdown. AuthMethod
+// kubernetes, the default, logs in with Role and the service account token;
+// approle with Role as the role ID and SecretID; token with Token, or
+// VAULT_TOKEN. AuthMount is the path the auth method is mounted at, its name
+// by default.
+type VaultConfig struct {
+	Address                 string        `yaml:"address"`
+	Namespace               string        `yaml:"namespace"`
+	AuthMethod              string        `yaml:"authMethod"`
+	AuthMount               string        `yaml:"authMount"`
+	Role                    string        `yaml:"role"`
+	SecretID                Secret        `yaml:"secretID"`
+	Token                   Secret        `yaml:"token"`
+	ServiceAccountTokenFile string        `yaml:"serviceAccountTokenFile"`
+	CAFile                  string        `yaml:"caFile"`
+	RefreshInterval         time.Duration `yaml:"refreshInterval"`
+}
+
+// CategoryFetchConfig fetches up to Concurrency categories of a scrape at
+// once, one after another by default. With ShareDeadline every fetch gets
+// the time left of the scrape divided by the rounds of fetches still to run,
+// so one slow category can't starve the others.
+type CategoryFetchConfig struct {
+	Concurrency   int  `yaml:"concurrency"`
+	ShareDeadline bool `yaml:"shareDeadline"`
+}
+
+// ConnectionsConfig sizes the pool of keep-alive connections to each
+// upstream server. HTTP/2 is negotiated with servers offering it over TLS.
+// Dual-stack servers are dialed over IPv4 when IPv6 hasn't connected after
+// FallbackDelay, 300ms by default; a negative delay disables the fallback.
+type ConnectionsConfig struct {
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	DisableHTTP2        bool          `yaml:"disableHTTP2"`
+	FallbackDelay       time.Duration `yaml:"fallbackDelay"`
+}
+
+// RedirectConfig sets which upstream redirects are followed: follow (the
+// default) follows up to MaxRedirects (10 by default), same-host only those
+// staying on the upstream host, and disallow none.
+type RedirectConfig struct {
+	Policy       string `yaml:"policy"`
+	MaxRedirects int    `yaml:"maxRedirects"`
+}
+
+// DNSConfig controls how upstream host names are resolved. Refresh poll
+// resolves them again before every request, ttl once TTL (30s by default)
+// has passed or a request failed; when the addresses changed, kept-alive
+// connections are closed so requests follow a failover. Resolver queries
+// the given DNS server, host or host:port, instead of the system resolver.
+type DNSConfig struct {
+	Refresh  string        `yaml:"refresh"`
+	TTL      time.Duration `yaml:"ttl"`
+	Resolver string        `yaml:"resolver"`
+}
+
+// SeriesLimitsConfig bounds the series exported by a scrape so a
+// misbehaving upstream cannot overload Prometheus. Zero means unlimited.
+type SeriesLimitsConfig struct {
+	PerCategory int `yaml:"perCategory"`
+	Total       int `yaml:"total"`
+}
+
+// DefaultMaxResponseSize limits upstream responses when maxResponseSize is not set
+const DefaultMaxResponseSize = 8 << 20
+
+// ResponseLimit returns the configured maximum response size or the default
+func (c *Config) ResponseLimit() int64 {
+	if c.MaxResponseSize > 0 {
+		return c.MaxResponseSize
+	}
+	return DefaultMaxResponseSize
+}
+
+// ListenSocketPath returns the unix socket path when the server address is
+// configured as unix:///path/to/socket
+func (c *Config) ListenSocketPath() (string, bool) {
+	return socketPath(c.Server.Address)
+}
+
+// TLSPolicy restricts the TLS of the exporter's listener and of every
+// upstream connection, e.g. to pass a security baseline. MinVersion is
+// named as in the exporter-toolkit web config, TLS10 to TLS13, TLS12 by
+// default for the listener. CipherSuites are the Go names of the suites
+// allowed up to TLS 1.2, such as TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384; Go
+// doesn't restrict TLS 1.3 suites. FIPSCipherSuites only narrows the
+// negotiation to the suites and curves FIPS 140 approves for TLS 1.2, and
+// therefore to TLS 1.2; it doesn't make the cryptography FIPS validated,
+// which needs a FIPS build of Go. A listener configured by a web config
+// file must comply with the policy.
+type TLSPolicy struct {
+	MinVersion       string   `yaml:"minVersion"`
+	CipherSuites     []string `yaml:"cipherSuites"`
+	FIPSCipherSuites bool     `yaml:"fipsCipherSuites"`
+}
+
+// TLSServerConfig enables HTTPS on the exporter's listener. Client
+// certificates are verified against ClientCAFile when given.
+// A web config file, when set, takes precedence over these settings.
+type TLSServerConfig struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+}
+
+// Enabled reports whether a server certificate is configured
+func (t TLSServerConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// KafkaConfig holds the settings of the optional Kafka statistics source
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	GroupID string   `yaml:"groupId"`
+
+	SASL struct {
+		Mechanism string `yaml:"mechanism"`
+		Username  string `yaml:"username"`
+		Password  Secret `yaml:"password"`
+	} `yaml:"sasl"`
+
+	TLS TLSClientConfig `yaml:"tls"`
+}
+
+// OutputConfig pushes the collected values every interval. Graphite
+// outputs send the plaintext protocol to a TCP address; InfluxDB outputs
+// post the line protocol to a write URL, authenticated with an optional token.
+type OutputConfig struct {
+	Type     string        `yaml:"type"`
+	Address  string        `yaml:"address"`
+	URL      string        `yaml:"url"`
+	Token    Secret        `yaml:"token"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// StreamingConfig holds the settings of the live monitoring stream
+type StreamingConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Protocol          string        `yaml:"protocol"`
+	PollInterval      time.Duration `yaml:"pollInterval"`
+	ReconnectInterval time.Duration `yaml:"reconnectInterval"`
+}
+
+// WebhookConfig posts to URL when an upstream server stops answering, or
+// answers again. The body is a text/template over the event, a JSON object by
+// default, sent as ContentType (application/json by default). Notifications
+// of the same server are at least Cooldown (5m by default) apart; a state
+// reached meanwhile is sent when it ends.
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`
+	Template    string            `yaml:"template"`
+	ContentType string            `yaml:"contentType"`
+	Headers     map[string]Secret `yaml:"headers"`
+	Cooldown    time.Duration     `yaml:"cooldown"`
+}
+
+// SNMPConfig maps OIDs to metrics collected from every SNMP target. Metrics
+// with an index label walk the table below their OID, one series per row.
+type SNMPConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"`
+	Metrics []SNMPMetric  `yaml:"metrics"`
+	Targets []SNMPTarget  `yaml:"targets"`
+}
+
+type SNMPMetric struct {
+	Name       string `yaml:"name"`
+	OID        string `yaml:"oid"`
+	IndexLabel string `yaml:"indexLabel"`
+}
+
+// SNMPTarget is a device polled with SNMP version 1, 2c (default) or 3.
+// An address without a port is polled on Port, 161 by default.
+type SNMPTarget struct {
+	Name      string            `yaml:"name"`
+	Address   string            `yaml:"address"`
+	Port      uint              `yaml:"port"`
+	Version   string            `yaml:"version"`
+	Community Secret            `yaml:"community"`
+	V3        SNMPv3Credentials `yaml:"v3"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+// SNMPv3Credentials of the user-based security model. The security level
+// follows from the protocols set: authentication with MD5, SHA, SHA224,
+// SHA256, SHA384 or SHA512 and privacy with DES or AES.
+type SNMPv3Credentials struct {
+	Username     string `yaml:"username"`
+	AuthProtocol string `yaml:"authProtocol"`
+	AuthPassword Secret `yaml:"authPassword"`
+	PrivProtocol string `yaml:"privProtocol"`
+	PrivPassword Secret `yaml:"privPassword"`
+	ContextName  string `yaml:"contextName"`
+}
+
+// NETCONFConfig runs every query against every NETCONF target
+type NETCONFConfig struct {
+	Timeout time.Duration   `yaml:"timeout"`
+	Queries []NETCONFQuery  `yaml:"queries"`
+	Targets []NETCONFTarget `yaml:"targets"`
+}
+
+// NETCONFQuery is a get operation filtered with an XPath expression, or a
+// subtree filter, whose reply is turned into metrics. Path selects elements
+// of the reply data by their slash-separated names; Labels and Metrics map
+// names to child element paths. Without metrics every numeric leaf of a
+// selected element becomes a metric.
+type NETCONFQuery struct {
+	Name       string            `yaml:"name"`
+	XPath      string            `yaml:"xpath"`
+	Subtree    string            `yaml:"subtree"`
+	Namespaces map[string]string `yaml:"namespaces"`
+	Path       string            `yaml:"path"`
+	Labels     map[string]string `yaml:"labels"`
+	Metrics    map[string]string `yaml:"metrics"`
+}
+
+// NETCONFTarget is a device reached over SSH. An address without a port is
+// reached on Port, 830 by default. Host keys are checked against
+// KnownHostsFile unless InsecureSkipVerify is set.
+type NETCONFTarget struct {
+	Name               string            `yaml:"name"`
+	Address            string            `yaml:"address"`
+	Port               uint              `yaml:"port"`
+	Username           string            `yaml:"username"`
+	Password           Secret            `yaml:"password"`
+	PrivateKeyFile     string            `yaml:"privateKeyFile"`
+	KnownHostsFile     string            `yaml:"knownHostsFile"`
+	InsecureSkipVerify bool              `yaml:"insecureSkipVerify"`
+	Labels             map[string]string `yaml:"labels"`
+}
+
+// GNMIConfig subscribes every gNMI target to the configured paths. The
+// latest value of every leaf is exported on scrape.
+type GNMIConfig struct {
+	// Encoding requested from the targets: json, json_ietf (default),
+	// proto or ascii
+	Encoding          string             `yaml:"encoding"`
+	ReconnectInterval time.Duration      `yaml:"reconnectInterval"`
+	Subscriptions     []GNMISubscription `yaml:"subscriptions"`
+	Targets           []GNMITarget       `yaml:"targets"`
+}
+
+// GNMISubscription is a path such as
+// /interfaces/interface[name=*]/state/counters, optionally prefixed with an
+// origin, streamed in sample (default), on_change or target_defined mode
+type GNMISubscription struct {
+	Path              string        `yaml:"path"`
+	Mode              string        `yaml:"mode"`
+	SampleInterval    time.Duration `yaml:"sampleInterval"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+}
+
+// GNMITarget is a device serving gNMI, port 57400 by default. Credentials
+// are sent as username and password metadata.
+type GNMITarget struct {
+	Name     string            `yaml:"name"`
+	Address  string            `yaml:"address"`
+	Username string            `yaml:"username"`
+	Password Secret            `yaml:"password"`
+	TLS      TLSClientConfig   `yaml:"tls"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// CNaaSNMSConfig reads the devices of a CNaaS-NMS API, such as
+// https://cnaas.example.net/api/v1.0. Collections whose MatchLabel (target
+// by default) names a device by hostname or management IP get its hostname,
+// site, device_type, platform and management_ip labels. Devices are listed
+// again after RefreshInterval (5m by default).
+type CNaaSNMSConfig struct {
+	URL             string          `yaml:"url"`
+	Token           Secret          `yaml:"token"`
+	TLS             TLSClientConfig `yaml:"tls"`
+	RefreshInterval time.Duration   `yaml:"refreshInterval"`
+	// Only devices in this state are used, MANAGED by default
+	State      string `yaml:"state"`
+	MatchLabel string `yaml:"matchLabel"`
+
+	// Templates of the targets generated per device, named by its hostname
+	// and addressed by its management IP
+	SNMPTarget    *SNMPTarget    `yaml:"snmpTarget"`
+	NETCONFTarget *NETCONFTarget `yaml:"netconfTarget"`
+}
+
+// RateConfig selects counter-like metrics for which deltas and rates are computed
+type RateConfig struct {
+	Metrics []string `yaml:"metrics"`
+	Delta   bool     `yaml:"delta"`
+	Rate    bool     `yaml:"rate"`
+}
+
+// HistogramMapping assembles bucketed upstream metrics into a histogram.
+// Buckets is a regular expression over exported metric names whose single
+// capture group is the bucket upper bound; Scale converts the bounds and the
+// sum to the histogram's base unit.
+type HistogramMapping struct {
+	Name       string  `yaml:"name"`
+	Help       string  `yaml:"help"`
+	Buckets    string  `yaml:"buckets"`
+	Scale      float64 `yaml:"scale"`
+	Sum        string  `yaml:"sum"`
+	Count      string  `yaml:"count"`
+	Cumulative bool    `yaml:"cumulative"`
+}
+
+// Aggregation combines a metric across categories with sum, avg, min or max.
+// An empty category list aggregates over all categories.
+type Aggregation struct {
+	Name       string   `yaml:"name"`
+	Help       string   `yaml:"help"`
+	Op         string   `yaml:"op"`
+	Metric     string   `yaml:"metric"`
+	Categories []string `yaml:"categories"`
+}
+
+// ScheduleConfig polls each category of the statistics server, and of the
+// monitoring server unless streaming is enabled, every Interval (1m by
+// default), and scrapes serve the latest results. DataTypes overrides the
+// interval of all statistics or monitoring categories, Categories that of
+// single categories. Polls start after a random delay of up to Jitter; with
+// Align they fall on multiples of the interval, e.g. on the minute for 1m,
+// plus that delay.
+type ScheduleConfig struct {
+	Enabled    bool                     `yaml:"enabled"`
+	Interval   time.Duration            `yaml:"interval"`
+	DataTypes  map[string]time.Duration `yaml:"dataTypes"`
+	Categories map[string]time.Duration `yaml:"categories"`
+	Jitter     time.Duration            `yaml:"jitter"`
+	Align      bool                     `yaml:"align"`
+}
+
+// ResponseCacheConfig sets how long upstream responses are reused, with
+// optional per-category overrides of the default TTL
+type ResponseCacheConfig struct {
+	TTL        time.Duration            `yaml:"ttl"`
+	Categories map[string]time.Duration `yaml:"categories"`
+}
+
+// TLSClientConfig holds the TLS settings used when connecting to a remote service
+type TLSClientConfig struct {
+	Enabled            bool         `yaml:"enabled"`
+	CAFile             string       `yaml:"caFile"`
+	CertFile           string       `yaml:"certFile"`
+	KeyFile            string       `yaml:"keyFile"`
+	InsecureSkipVerify bool         `yaml:"insecureSkipVerify"`
+	SPIFFE             SPIFFEConfig `yaml:"spiffe"`
+
+	// PEM encoded in place of the files, e.g. read from Vault
+	CA          Secret `yaml:"ca"`
+	Certificate Secret `yaml:"certificate"`
+	Key         Secret `yaml:"key"`
+}
+
+// SPIFFEConfig takes the client certificate from the SPIFFE Workload API,
+// e.g. of a SPIRE agent, at SocketPath (unix:///path or tcp://host:port,
+// SPIFFE_ENDPOINT_SOCKET by default), following its rotation. ID selects
+// the X.509 SVID when the workload has several, the first by default.
+// Without a CA file servers are verified against the trust bundles of the
+// Workload API and must present ServerID, or any SPIFFE ID of the client's
+// trust domain when unset.
+type SPIFFEConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	SocketPath string `yaml:"socketPath"`
+	ID         string `yaml:"id"`
+	ServerID   string `yaml:"serverID"`
+}
+
+// StringList accepts either a single string or a list of strings
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
 	}
-	defer file.Close()
+	*l = list
+	return nil
+}
+
+// QueryParams holds the operator identifiers, each fetched separately as the
+// operatorIdentifier parameter, and further query parameters added to every
+// upstream URL. It is written as one operator, a list of operators, or a map
+// of parameters whose operatorIdentifier holds the operators:
+//
+//	queryParams:
+//	  operatorIdentifier: ["op1", "op2"]
+//	  region: "eu west"
+type QueryParams struct {
+	Operators  StringList
+	Parameters map[string]string
+}
 
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(config); err != nil {
-		return nil, fmt.Errorf("failed to decode config file: %v", err)
+const operatorIdentifierParam = "operatorIdentifier"
+
+func (q *QueryParams) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return value.Decode(&q.Operators)
 	}
 
+	var params map[string]yaml.Node
+	if err := value.Decode(&params); err != nil {
+		return err
+	}
+	q.Parameters = make(map[string]string, len(params))
+	for name, param := range params {
+		if name == operatorIdentifierParam {
+			if err := param.Decode(&q.Operators); err != nil {
+				return err
+			}
+			continue
+		}
+		var paramValue string
+		if err := param.Decode(&paramValue); err != nil {
+			return fmt.Errorf("query parameter %s: %v", name, err)
+		}
+		q.Parameters[name] = paramValue
+	}
+	return nil
+}
+
+// LoadConfig loads the YAML configuration file, or every *.yaml file of a
+// configuration directory, together with the files they include. The
+// environment overrides the file; without a file name the configuration
+// comes from the environment and the defaults alone.
+func LoadConfig(filename string) (*Config, error) {
+	config := &Config{ConfigVersion: CurrentConfigVersion}
+	if filename != "" {
+		node, err := loadConfigNode(filename)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			if err := node.Decode(config); err != nil {
+				return nil, fmt.Errorf("failed to decode config file: %v", err)
+			}
+		}
+	}
+
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+	applyDefaults(config)
+	if err := resolveVaultSecrets(config); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
+
+// Hash identifies the loaded configuration, with include files and
+// directories merged, so replicas can be checked for running the same one.
+// Only the low 53 bits are kept, which a float64 gauge holds exactly.
+func (c *Config) Hash() (uint64, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode config: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return binary.BigEndian.Uint64(sum[:8]) >> 11, nil
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultConfigFiles are tried in order when no configuration file is given
+// by --config or CNAASPROM_CONFIG
+var DefaultConfigFiles = []string{"config.yaml", "/etc/cnaasprom/config.yaml"}
+
+// DefaultPort is served on when neither the configuration nor the
+// environment sets a port
+const DefaultPort = 8080
+
+// Environment variables setting the configuration file and overriding the
+// settings needed to run without one, e.g. in a container. Lists are comma
+// separated; servers are host:port or unix:///path.
+const (
+	envConfigFile           = "CNAASPROM_CONFIG"
+	envListenAddress        = "CNAASPROM_LISTEN_ADDRESS"
+	envStatisticsServer     = "CNAASPROM_STATISTICS_SERVER"
+	envMonitoringServer     = "CNAASPROM_MONITORING_SERVER"
+	envStatisticsCategories = "CNAASPROM_STATISTICS_CATEGORIES"
+	envMonitoringCategories = "CNAASPROM_MONITORING_CATEGORIES"
+	envOperatorIdentifier   = "CNAASPROM_OPERATOR_IDENTIFIER"
+)
+
+// FindConfigFile returns the file named by CNAASPROM_CONFIG, otherwise the
+// first of the default configuration files that exists. Without any the
+// configuration comes from the environment and the defaults alone.
+func FindConfigFile() (string, bool) {
+	if path := os.Getenv(envConfigFile); path != "" {
+		return path, true
+	}
+	for _, path := range DefaultConfigFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Override the configuration with the environment variables that are set
+func applyEnv(c *Config) error {
+	servers := []struct {
+		name    string
+		address *string
+		port    *uint
+	}{
+		{envListenAddress, &c.Server.Address, &c.Server.Port},
+		{envStatisticsServer, &c.RemoteStatisticServer.Address, &c.RemoteStatisticServer.Port},
+		{envMonitoringServer, &c.RemoteMonitoringServer.Address, &c.RemoteMonitoringServer.Port},
+	}
+	for _, server := range servers {
+		value := os.Getenv(server.name)
+		if value == "" {
+			continue
+		}
+		if _, ok := socketPath(value); ok {
+			*server.address, *server.port = value, 0
+			continue
+		}
+		host, port, err := SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", server.name, err)
+		}
+		*server.address, *server.port = host, port
+	}
+
+	if value := os.Getenv(envStatisticsCategories); value != "" {
+		c.MetricsStatisticsCategory = splitList(value)
+	}
+	if value := os.Getenv(envMonitoringCategories); value != "" {
+		c.MetricsMonitoringCategory = splitList(value)
+	}
+	// Operator identifiers are often JSON, which a comma can't separate
+	if value := os.Getenv(envOperatorIdentifier); value != "" {
+		c.QueryParams.Operators = StringList{value}
+	}
+	return nil
+}
+
+// Apply the built-in defaults of settings left unset
+func applyDefaults(c *Config) {
+	if _, ok := c.ListenSocketPath(); !ok && c.Server.Port == 0 {
+		c.Server.Port = DefaultPort
+	}
+}
+
+// SplitHostPort splits an address such as 127.0.0.1:8080 or [::1]:8080
+func SplitHostPort(hostPort string) (string, uint, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, uint(portNumber), nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key listing files, or glob patterns, merged below the file that names them.
+// Relative paths are resolved against the directory of that file.
+const includeKey = "include"
+
+// Read the configuration files at path, which may be a directory whose
+// *.yaml files are merged in lexical order, into one YAML document
+func loadConfigNode(path string) (*yaml.Node, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.yaml")); err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+	}
+
+	var merged *yaml.Node
+	for _, file := range files {
+		node, err := loadConfigFile(file, make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeNodes(merged, node)
+	}
+	return merged, nil
+}
+
+// Read one file and the files it includes. Included files are merged first
+// so the including file overrides them.
+func loadConfigFile(path string, loading map[string]bool) (*yaml.Node, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if loading[absPath] {
+		return nil, fmt.Errorf("config file %s includes itself", path)
+	}
+	loading[absPath] = true
+	defer delete(loading, absPath)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to decode config file %s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s is not a mapping", path)
+	}
+	if err := migrateConfig(path, root); err != nil {
+		return nil, err
+	}
+
+	var patterns StringList
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != includeKey {
+			continue
+		}
+		if err := root.Content[i+1].Decode(&patterns); err != nil {
+			return nil, fmt.Errorf("invalid include in %s: %v", path, err)
+		}
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		break
+	}
+
+	var merged *yaml.Node
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include %s in %s: %v", pattern, path, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("include %s in %s matches no files", pattern, path)
+		}
+		for _, match := range matches {
+			node, err := loadConfigFile(match, loading)
+			if err != nil {
+				return nil, err
+			}
+			merged = mergeNodes(merged, node)
+		}
+	}
+	return mergeNodes(merged, root), nil
+}
+
+// Merge mappings key by key; any other value of override replaces base
+func mergeNodes(base *yaml.Node, override *yaml.Node) *yaml.Node {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		return base
+	}
+	if base.Kind != yaml.MappingNode || override.Kind != yaml.MappingNode {
+		return override
+	}
+
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				base.Content[j+1] = mergeNodes(base.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			base.Content = append(base.Content, key, value)
+		}
+	}
+	return base
+}
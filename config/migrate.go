@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentConfigVersion is the version of the configuration format. Files
+// without a configVersion are version 1; files of older versions are
+// migrated when loaded.
+const CurrentConfigVersion = 1
+
+const configVersionKey = "configVersion"
+
+// A migration rewrites a file of the previous version in place and returns
+// the deprecated settings it changed
+type migration func(root *yaml.Node) ([]string, error)
+
+// migrations[i] migrates version i+1 to i+2. A change of the format
+// raises CurrentConfigVersion and appends its migration.
+var migrations = []migration{}
+
+// Migrate a configuration file to the current version, logging the
+// deprecated settings it uses. Every file, included ones too, has its own
+// version.
+func migrateConfig(path string, root *yaml.Node) error {
+	return migrateConfigTo(path, root, CurrentConfigVersion)
+}
+
+// Migrate a configuration file to the given latest version
+func migrateConfigTo(path string, root *yaml.Node, latest int) error {
+	version := 1
+	versionIndex := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == configVersionKey {
+			if err := root.Content[i+1].Decode(&version); err != nil {
+				return fmt.Errorf("invalid %s in %s: %v", configVersionKey, path, err)
+			}
+			versionIndex = i
+		}
+	}
+	if version < 1 || version > latest {
+		return fmt.Errorf("unsupported %s %d in %s, the latest is %d", configVersionKey, version, path, latest)
+	}
+
+	for v := version; v < latest; v++ {
+		changes, err := migrations[v-1](root)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s from %s %d: %v", path, configVersionKey, v, err)
+		}
+		for _, change := range changes {
+			log.Printf("Deprecated setting in %s: %s; set %s: %d once updated", path, change, configVersionKey, latest)
+		}
+	}
+
+	current := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(latest)}
+	if versionIndex >= 0 {
+		root.Content[versionIndex+1] = current
+	} else {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: configVersionKey}, current)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func parseConfigNode(t *testing.T, data string) *yaml.Node {
+	t.Helper()
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.Content[0]
+}
+
+// Files without a version are of version 1, and files of later versions
+// than the exporter's are refused
+func TestConfigVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("MetricsStatisticsCategory: [amf]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConfigVersion != CurrentConfigVersion || len(cfg.MetricsStatisticsCategory) != 1 {
+		t.Errorf("loaded version %d with categories %v", cfg.ConfigVersion, cfg.MetricsStatisticsCategory)
+	}
+
+	for _, version := range []string{"0", "99", "two"} {
+		if err := migrateConfig("config.yaml", parseConfigNode(t, "configVersion: "+version+"\n")); err == nil {
+			t.Errorf("configVersion %s accepted", version)
+		}
+	}
+}
+
+// Files of older versions go through every later migration in order
+func TestConfigMigrations(t *testing.T) {
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	var applied []int
+	migrations = nil
+	for v := 1; v < CurrentConfigVersion+2; v++ {
+		v := v
+		migrations = append(migrations, func(root *yaml.Node) ([]string, error) {
+			applied = append(applied, v)
+			return nil, nil
+		})
+	}
+	// Pretend the format is two versions ahead
+	migrate := func(data string) []int {
+		applied = nil
+		root := parseConfigNode(t, data)
+		if err := migrateConfigTo("config.yaml", root, CurrentConfigVersion+2); err != nil {
+			t.Fatal(err)
+		}
+		var version int
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == configVersionKey {
+				root.Content[i+1].Decode(&version)
+			}
+		}
+		if version != CurrentConfigVersion+2 {
+			t.Errorf("migrated to version %d, want %d", version, CurrentConfigVersion+2)
+		}
+		return applied
+	}
+	if got := migrate("Server: {}\n"); len(got) != CurrentConfigVersion+1 || got[0] != 1 {
+		t.Errorf("unversioned file went through migrations %v", got)
+	}
+	if got := migrate("configVersion: 2\n"); len(got) != CurrentConfigVersion || got[0] != 2 {
+		t.Errorf("version 2 went through migrations %v", got)
+	}
+}
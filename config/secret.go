@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret is a credential given inline, with ${ENV_VAR} references replaced
+// by the environment, or read from a file or a HashiCorp Vault secret:
+//
+//	bearerToken:
+//	  valueFrom:
+//	    file: /run/secrets/token
+//
+//	password:
+//	  valueFrom:
+//	    vault:
+//	      path: secret/data/cnaas
+//	      key: password
+type Secret string
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		expanded, err := expandEnv(value.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", value.Line, err)
+		}
+		*s = Secret(expanded)
+		return nil
+	}
+
+	var ref struct {
+		ValueFrom struct {
+			File  string `yaml:"file"`
+			Vault struct {
+				Path string `yaml:"path"`
+				Key  string `yaml:"key"`
+			} `yaml:"vault"`
+		} `yaml:"valueFrom"`
+	}
+	if err := value.Decode(&ref); err != nil {
+		return err
+	}
+	// Vault is read once the whole configuration is decoded
+	if vault := ref.ValueFrom.Vault; vault.Path != "" || vault.Key != "" {
+		if vault.Path == "" || vault.Key == "" {
+			return fmt.Errorf("line %d: vault secret needs a path and a key", value.Line)
+		}
+		*s = vaultReference(vault.Path, vault.Key)
+		return nil
+	}
+	if ref.ValueFrom.File == "" {
+		return fmt.Errorf("line %d: secret needs a value, valueFrom.file or valueFrom.vault", value.Line)
+	}
+	data, err := os.ReadFile(ref.ValueFrom.File)
+	if err != nil {
+		return fmt.Errorf("line %d: failed to read secret: %v", value.Line, err)
+	}
+	// Files written by editors and secret stores often end with a newline
+	*s = Secret(strings.TrimRight(string(data), "\r\n"))
+	return nil
+}
+
+// Only the braced form is expanded so values like bcrypt hashes, which
+// contain $, are left alone
+func expandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
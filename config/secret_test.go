@@ -0,0 +1,47 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Header values of servers, categories and tracing are secrets
+func TestSecretHeaders(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "api-key")
+	if err := os.WriteFile(keyFile, []byte("file-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CNAASPROM_TEST_TOKEN", "env-token")
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(`RemoteStatisticServer:
+  address: "10.0.20.142"
+  headers:
+    X-API-Key:
+      valueFrom:
+        file: `+keyFile+`
+categoryHeaders:
+  amf:
+    X-Tenant-Key: "${CNAASPROM_TEST_TOKEN}"
+tracing:
+  headers:
+    Authorization: "Bearer ${CNAASPROM_TEST_TOKEN}"
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.RemoteStatisticServer.Headers["X-API-Key"]; got != "file-key" {
+		t.Errorf("server header = %q, want the file's", got)
+	}
+	if got := cfg.CategoryHeaders["amf"]["X-Tenant-Key"]; got != "env-token" {
+		t.Errorf("category header = %q, want the environment's", got)
+	}
+	if got := cfg.Tracing.Headers["Authorization"]; got != "Bearer env-token" {
+		t.Errorf("tracing header = %q, want the environment's", got)
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLS versions named as in the exporter-toolkit web config
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// Cipher suites and curves approved by FIPS 140 for TLS 1.2
+var (
+	fipsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+)
+
+// Apply restricts a TLS configuration to the policy. Settings the policy
+// leaves unset are kept.
+func (p TLSPolicy) Apply(t *tls.Config) error {
+	if p.MinVersion != "" {
+		version, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("invalid TLS policy minVersion %q, use TLS10, TLS11, TLS12 or TLS13", p.MinVersion)
+		}
+		t.MinVersion = version
+	}
+
+	if len(p.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		// Insecure suites are allowed when named explicitly
+		for _, suite := range tls.InsecureCipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		t.CipherSuites = nil
+		for _, name := range p.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite %q in TLS policy", name)
+			}
+			t.CipherSuites = append(t.CipherSuites, id)
+		}
+	}
+
+	if p.FIPSCipherSuites {
+		if t.MinVersion == tls.VersionTLS13 {
+			return fmt.Errorf("TLS policy fipsCipherSuites allows TLS 1.2 only, its TLS 1.3 cipher suites can't be restricted")
+		}
+		if t.MinVersion < tls.VersionTLS12 {
+			t.MinVersion = tls.VersionTLS12
+		}
+		t.MaxVersion = tls.VersionTLS12
+		if len(t.CipherSuites) == 0 {
+			t.CipherSuites = fipsCipherSuites
+		}
+		for _, id := range t.CipherSuites {
+			if !fipsApproved(id) {
+				return fmt.Errorf("cipher suite %s is not FIPS approved", tls.CipherSuiteName(id))
+			}
+		}
+		t.CurvePreferences = fipsCurves
+	}
+	return nil
+}
+
+func fipsApproved(id uint16) bool {
+	for _, approved := range fipsCipherSuites {
+		if id == approved {
+			return true
+		}
+	}
+	return false
+}
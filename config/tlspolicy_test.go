@@ -0,0 +1,38 @@
+package config
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	c := &tls.Config{}
+	policy := TLSPolicy{MinVersion: "TLS12", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}
+	if err := policy.Apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS12 || !slices.Equal(c.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}) || c.MaxVersion != 0 {
+		t.Errorf("policy applied as %+v", c)
+	}
+
+	// FIPS cipher suites limit the connection to TLS 1.2 and approved curves
+	c = &tls.Config{MinVersion: tls.VersionTLS10}
+	if err := (TLSPolicy{FIPSCipherSuites: true}).Apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS12 || c.MaxVersion != tls.VersionTLS12 || !slices.Equal(c.CipherSuites, fipsCipherSuites) || !slices.Equal(c.CurvePreferences, fipsCurves) {
+		t.Errorf("FIPS policy applied as %+v", c)
+	}
+
+	for name, invalid := range map[string]TLSPolicy{
+		"unknown version":   {MinVersion: "SSL3"},
+		"unknown suite":     {CipherSuites: []string{"TLS_NULL"}},
+		"unapproved suite":  {FIPSCipherSuites: true, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"}},
+		"FIPS with TLS 1.3": {FIPSCipherSuites: true, MinVersion: "TLS13"},
+	} {
+		if err := invalid.Apply(&tls.Config{}); err == nil {
+			t.Errorf("%s: policy accepted", name)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the Vault client unless configured
+const (
+	DefaultVaultRefreshInterval = 5 * time.Minute
+	defaultVaultTokenFile       = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultTimeout                = 10 * time.Second
+)
+
+// Secrets read from Vault hold a reference until the configuration is
+// decoded and the Vault settings are known. The NUL bytes can't come from
+// YAML scalars.
+const vaultReferencePrefix = "\x00vault\x00"
+
+func vaultReference(path, key string) Secret {
+	return Secret(vaultReferencePrefix + path + "\x00" + key)
+}
+
+func parseVaultReference(s Secret) (path, key string, ok bool) {
+	ref, ok := strings.CutPrefix(string(s), vaultReferencePrefix)
+	if !ok {
+		return "", "", false
+	}
+	path, key, ok = strings.Cut(ref, "\x00")
+	return path, key, ok
+}
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// The Vault login shared by every load of the configuration, so reloads and
+// refreshes read with the same token. RenewVaultToken keeps it valid and
+// RevokeVaultToken revokes it on shutdown.
+var vault vaultSession
+
+type vaultSession struct {
+	mu       sync.Mutex
+	settings VaultConfig
+	policy   TLSPolicy
+	address  string
+	client   *http.Client
+	token    string
+	// Whether the token was issued by a login, rather than configured, and
+	// may be revoked
+	issued    bool
+	renewable bool
+	ttl       time.Duration
+	// When the token expires and is due to be renewed; zero if it doesn't
+	// expire
+	expires time.Time
+	renewAt time.Time
+}
+
+// vaultResolver replaces the Vault references of a configuration by the
+// values read with the session's token, reading each path once
+type vaultResolver struct {
+	cfg    VaultConfig
+	policy TLSPolicy
+	paths  map[string]map[string]interface{}
+	values map[string]string
+	// When the first lease of the secrets read expires; zero if none does
+	leaseExpiry time.Time
+}
+
+// Replace every Vault reference of the configuration by its value and
+// remember a digest of the values for reloads to detect rotated secrets.
+// Without references Vault isn't contacted.
+func resolveVaultSecrets(c *Config) error {
+	for _, s := range []Secret{c.Vault.Token, c.Vault.SecretID} {
+		if _, _, ok := parseVaultReference(s); ok {
+			return fmt.Errorf("vault credentials can't be read from vault")
+		}
+	}
+
+	r := &vaultResolver{cfg: c.Vault, policy: c.TLSPolicy, paths: make(map[string]map[string]interface{}), values: make(map[string]string)}
+	vault.mu.Lock()
+	err := r.resolve(reflect.ValueOf(c).Elem())
+	vault.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	refs := make([]string, 0, len(r.values))
+	for ref := range r.values {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	digest := sha256.New()
+	for _, ref := range refs {
+		fmt.Fprintf(digest, "%s\x00%s\x00", ref, r.values[ref])
+	}
+	copy(c.vaultDigest[:], digest.Sum(nil))
+	c.usesVault = len(refs) > 0
+	c.vaultLeaseExpiry = r.leaseExpiry
+	return nil
+}
+
+func (r *vaultResolver) resolve(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			return r.resolve(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := r.resolve(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := r.resolve(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map values aren't addressable, so each is resolved in a copy
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(iter.Value())
+			if err := r.resolve(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.String:
+		if v.Type() != secretType {
+			return nil
+		}
+		path, key, ok := parseVaultReference(Secret(v.String()))
+		if !ok {
+			return nil
+		}
+		value, err := r.read(path, key)
+		if err != nil {
+			return err
+		}
+		r.values[path+"#"+key] = value
+		v.SetString(value)
+	}
+	return nil
+}
+
+// Read a key of a secret, logging in unless the session holds a valid
+// token for the configured settings. Must be called with vault.mu held.
+func (r *vaultResolver) read(path, key string) (string, error) {
+	data, ok := r.paths[path]
+	if !ok {
+		if err := vault.use(r.cfg, r.policy); err != nil {
+			return "", err
+		}
+		var lease time.Duration
+		var err error
+		if data, lease, err = vault.readPath(path); err != nil {
+			return "", fmt.Errorf("failed to read vault secret %s: %v", path, err)
+		}
+		if lease > 0 {
+			if expiry := time.Now().Add(lease); r.leaseExpiry.IsZero() || expiry.Before(r.leaseExpiry) {
+				r.leaseExpiry = expiry
+			}
+		}
+		r.paths[path] = data
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, key)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("key %s of vault secret %s is not a string", key, path)
+	}
+	return s, nil
+}
+
+// Keep the token of the session when the settings are unchanged and it
+// hasn't expired; log in again otherwise. Must be called with s.mu held.
+func (s *vaultSession) use(cfg VaultConfig, policy TLSPolicy) error {
+	if s.client != nil && s.settings == cfg && reflect.DeepEqual(s.policy, policy) {
+		if s.expires.IsZero() || time.Now().Before(s.expires) {
+			return nil
+		}
+		if !s.issued {
+			return fmt.Errorf("vault token expired")
+		}
+	} else if s.client != nil {
+		s.revoke()
+	}
+	s.settings, s.policy = cfg, policy
+	return s.login()
+}
+
+// Log in with the configured auth method: a Kubernetes service account
+// token, an AppRole or a token given directly
+func (s *vaultSession) login() error {
+	s.client, s.token, s.issued = nil, "", false
+	cfg := s.settings
+	s.address = strings.TrimSuffix(cfg.Address, "/")
+	if s.address == "" {
+		s.address = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if s.address == "" {
+		return fmt.Errorf("secrets are read from vault but no vault address is configured")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	if err := s.policy.Apply(transport.TLSClientConfig); err != nil {
+		return err
+	}
+	if cfg.CAFile != "" {
+		caCert, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read vault CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in vault CA file %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	client := &http.Client{Transport: transport, Timeout: vaultTimeout}
+	s.client = client
+
+	method := cfg.AuthMethod
+	if method == "" {
+		method = "kubernetes"
+	}
+	mount := cfg.AuthMount
+	if mount == "" {
+		mount = method
+	}
+
+	var body map[string]string
+	switch method {
+	case "token":
+		s.token = string(cfg.Token)
+		if s.token == "" {
+			s.token = os.Getenv("VAULT_TOKEN")
+		}
+		if s.token == "" {
+			s.client = nil
+			return fmt.Errorf("vault token auth needs a token or VAULT_TOKEN")
+		}
+		// The TTL of a given token is only known by looking it up
+		var response struct {
+			Data struct {
+				TTL       int64 `json:"ttl"`
+				Renewable bool  `json:"renewable"`
+			} `json:"data"`
+		}
+		if err := s.do(http.MethodGet, "auth/token/lookup-self", nil, &response); err != nil {
+			s.client, s.token = nil, ""
+			return fmt.Errorf("failed to look up vault token: %v", err)
+		}
+		s.setTTL(time.Duration(response.Data.TTL)*time.Second, response.Data.Renewable)
+		return nil
+	case "kubernetes":
+		tokenFile := cfg.ServiceAccountTokenFile
+		if tokenFile == "" {
+			tokenFile = defaultVaultTokenFile
+		}
+		jwt, err := os.ReadFile(tokenFile)
+		if err != nil {
+			s.client = nil
+			return fmt.Errorf("failed to read service account token: %v", err)
+		}
+		body = map[string]string{"role": cfg.Role, "jwt": strings.TrimSpace(string(jwt))}
+	case "approle":
+		body = map[string]string{"role_id": cfg.Role, "secret_id": string(cfg.SecretID)}
+	default:
+		s.client = nil
+		return fmt.Errorf("unsupported vault auth method %q, use kubernetes, approle or token", method)
+	}
+
+	var response vaultAuthResponse
+	if err := s.do(http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", body, &response); err != nil {
+		s.client = nil
+		return fmt.Errorf("failed to log in to vault: %v", err)
+	}
+	if response.Auth.ClientToken == "" {
+		s.client = nil
+		return fmt.Errorf("failed to log in to vault: no client token in response")
+	}
+	s.token, s.issued = response.Auth.ClientToken, true
+	s.setTTL(time.Duration(response.Auth.LeaseDuration)*time.Second, response.Auth.Renewable)
+	return nil
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// Remember when the token expires; it is renewed at two thirds of its TTL
+func (s *vaultSession) setTTL(ttl time.Duration, renewable bool) {
+	s.renewable, s.ttl = renewable, ttl
+	if ttl <= 0 {
+		s.expires, s.renewAt = time.Time{}, time.Time{}
+		return
+	}
+	now := time.Now()
+	s.expires = now.Add(ttl)
+	s.renewAt = now.Add(ttl * 2 / 3)
+}
+
+// Revoke a token issued by a login. Must be called with s.mu held.
+func (s *vaultSession) revoke() error {
+	defer func() { s.client, s.token, s.issued = nil, "", false }()
+	if !s.issued || s.token == "" {
+		return nil
+	}
+	if err := s.do(http.MethodPost, "auth/token/revoke-self", nil, nil); err != nil {
+		return fmt.Errorf("failed to revoke vault token: %v", err)
+	}
+	return nil
+}
+
+// VaultTokenRenewal returns when the Vault token is due to be renewed with
+// RenewVaultToken, zero without a token that expires
+func VaultTokenRenewal() time.Time {
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	if vault.client == nil {
+		return time.Time{}
+	}
+	return vault.renewAt
+}
+
+// RenewVaultToken extends the TTL of the Vault token. A token that can't be
+// renewed any more, having reached its maximum TTL, is replaced by logging
+// in again.
+func RenewVaultToken() error {
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	if vault.client == nil || vault.expires.IsZero() {
+		return nil
+	}
+
+	if vault.renewable {
+		var response vaultAuthResponse
+		if err := vault.do(http.MethodPost, "auth/token/renew-self", map[string]string{}, &response); err != nil {
+			if !vault.issued {
+				return fmt.Errorf("failed to renew vault token: %v", err)
+			}
+		} else {
+			// Vault caps the TTL at the token's maximum. A token of a login
+			// that wasn't extended by its full TTL is replaced instead.
+			ttl := time.Duration(response.Auth.LeaseDuration) * time.Second
+			if !vault.issued || ttl >= vault.ttl {
+				vault.setTTL(ttl, response.Auth.Renewable)
+				return nil
+			}
+		}
+	}
+	if !vault.issued {
+		return fmt.Errorf("vault token expires at %s and can't be renewed", vault.expires.Format(time.RFC3339))
+	}
+	vault.revoke()
+	return vault.login()
+}
+
+// RevokeVaultToken revokes the token the configuration was read with, on
+// shutdown. Tokens configured with the token auth method are left alone.
+func RevokeVaultToken() error {
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	if vault.client == nil {
+		return nil
+	}
+	return vault.revoke()
+}
+
+// Read the data of a secret and its lease duration. KV version 2 secrets,
+// read at <mount>/data/<name>, nest their data in another data object.
+func (s *vaultSession) readPath(path string) (map[string]interface{}, time.Duration, error) {
+	var response struct {
+		LeaseDuration int64                  `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := s.do(http.MethodGet, strings.Trim(path, "/"), nil, &response); err != nil {
+		return nil, 0, err
+	}
+	lease := time.Duration(response.LeaseDuration) * time.Second
+	if nested, ok := response.Data["data"].(map[string]interface{}); ok {
+		if _, ok := response.Data["metadata"]; ok {
+			return nested, lease, nil
+		}
+	}
+	return response.Data, lease, nil
+}
+
+func (s *vaultSession) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, s.address+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if s.token != "" {
+		req.Header.Set("X-Vault-Token", s.token)
+	}
+	if s.settings.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.settings.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// Revoking answers 204 No Content
+	if resp.StatusCode == http.StatusNoContent && out == nil {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("status %d: %s", resp.StatusCode, strings.Join(failure.Errors, "; "))
+		}
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// UsesVault tells whether any secret of the configuration was read from Vault
+func (c *Config) UsesVault() bool {
+	return c.usesVault
+}
+
+// VaultLeaseExpiry returns when the first lease of the secrets read from
+// Vault expires, zero if none has a lease. They are read again by then.
+func (c *Config) VaultLeaseExpiry() time.Time {
+	return c.vaultLeaseExpiry
+}
+
+// VaultDigest identifies the values read from Vault, so a refresh can tell
+// whether a secret was rotated
+func (c *Config) VaultDigest() [sha256.Size]byte {
+	return c.vaultDigest
+}
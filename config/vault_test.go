@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Vault answering AppRole logins, token renewals and revocations and reads
+// of secret/data/cnaasprom, recording the requests it received
+type fakeVault struct {
+	url string
+
+	mu       sync.Mutex
+	logins   int
+	requests []string
+	revoked  []string
+	// TTL granted by logins and renewals, in seconds
+	ttl int
+	// Lease of the secret, in seconds
+	lease int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	t.Helper()
+	v := &fakeVault{ttl: 3600}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		token := r.Header.Get("X-Vault-Token")
+		v.requests = append(v.requests, r.Method+" "+r.URL.Path+" "+token)
+
+		auth := func(token string) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+				"client_token": token, "lease_duration": v.ttl, "renewable": true,
+			}})
+		}
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			v.logins++
+			auth(fmt.Sprintf("token-%d", v.logins))
+		case "/v1/auth/token/renew-self":
+			auth(token)
+		case "/v1/auth/token/revoke-self":
+			v.revoked = append(v.revoked, token)
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/auth/token/lookup-self":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": 0}})
+		case "/v1/secret/data/cnaasprom":
+			if token == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"lease_duration": v.lease,
+				"data":           map[string]interface{}{"data": map[string]interface{}{"token": "s3cret"}, "metadata": map[string]interface{}{}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	v.url = server.URL
+	t.Cleanup(func() {
+		RevokeVaultToken()
+		vault.mu.Lock()
+		vault.client, vault.token, vault.settings = nil, "", VaultConfig{}
+		vault.mu.Unlock()
+		server.Close()
+	})
+	return v
+}
+
+func (v *fakeVault) configFile(t *testing.T, auth string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := fmt.Sprintf(`
+vault:
+  address: %q
+%s
+modules:
+  amf:
+    auth:
+      bearerToken:
+        valueFrom:
+          vault: {path: "secret/data/cnaasprom", key: "token"}
+`, v.url, auth)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func (v *fakeVault) count(request string) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n := 0
+	for _, r := range v.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+// Loads of the configuration share one login, renewed and revoked
+func TestVaultSession(t *testing.T) {
+	v := newFakeVault(t)
+	v.lease = 60
+	path := v.configFile(t, "  authMethod: approle\n  role: cnaasprom\n  secretID: id")
+
+	for i := 0; i < 3; i++ {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cfg.Modules["amf"].Auth.BearerToken; got != "s3cret" {
+			t.Fatalf("bearer token = %q, want the vault secret", got)
+		}
+		if expiry := time.Until(cfg.VaultLeaseExpiry()); expiry <= 0 || expiry > time.Minute {
+			t.Errorf("lease expires in %s, want the secret's lease", expiry)
+		}
+	}
+	if v.logins != 1 {
+		t.Errorf("logged in %d times, want once", v.logins)
+	}
+
+	renewal := time.Until(VaultTokenRenewal())
+	if renewal < 39*time.Minute || renewal > 40*time.Minute {
+		t.Errorf("renewal due in %s, want two thirds of the TTL", renewal)
+	}
+	if err := RenewVaultToken(); err != nil {
+		t.Fatal(err)
+	}
+	if n := v.count("POST /v1/auth/token/renew-self token-1"); n != 1 {
+		t.Errorf("renewed %d times, want once", n)
+	}
+	if v.logins != 1 {
+		t.Errorf("logged in again although the token was renewed")
+	}
+
+	// A token renewed for less than its TTL reached its maximum and is
+	// replaced by a login
+	v.mu.Lock()
+	v.ttl = 60
+	v.mu.Unlock()
+	if err := RenewVaultToken(); err != nil {
+		t.Fatal(err)
+	}
+	if v.logins != 2 || len(v.revoked) != 1 || v.revoked[0] != "token-1" {
+		t.Errorf("logins %d, revoked %q: want the capped token revoked and replaced", v.logins, v.revoked)
+	}
+
+	if err := RevokeVaultToken(); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.revoked) != 2 || v.revoked[1] != "token-2" {
+		t.Errorf("revoked %q, want the token revoked on shutdown", v.revoked)
+	}
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if v.logins != 3 {
+		t.Errorf("logged in %d times, want a new login after revoking", v.logins)
+	}
+}
+
+// Tokens given in the configuration are not revoked
+func TestVaultConfiguredToken(t *testing.T) {
+	v := newFakeVault(t)
+	path := v.configFile(t, "  authMethod: token\n  token: configured")
+
+	if _, err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if !VaultTokenRenewal().IsZero() {
+		t.Errorf("renewal scheduled for a token without TTL")
+	}
+	if err := RevokeVaultToken(); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.revoked) != 0 {
+		t.Errorf("revoked %q, want the configured token kept", v.revoked)
+	}
+}
@@ -1,21 +1,204 @@
 package main
 
 import (
-	"cnaasprom/app"
-	"cnaasprom/config"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/app"
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/mockserver"
+	"github.com/prometheus/common/version"
 )
 
+const usage = `Usage: cnaasprom [command] [flags]
+
+Commands:
+  serve       Serve metrics over HTTP (default)
+  validate    Check the configuration and exit
+  once        Perform one collection and print the metrics to stdout
+  version     Print build information
+  mockserver  Serve mock nnfcm statistics and monitoring APIs for development
+`
+
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		serve(args)
+	case "validate":
+		validate(args)
+	case "once":
+		once(args)
+	case "mockserver":
+		mock(args)
+	case "version":
+		// Build information is injected at link time, e.g.
+		// go build -ldflags "-X github.com/prometheus/common/version.Version=1.0.0"
+		fmt.Println(version.Print("cnaasprom"))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// Parse the flags of a command and load the configuration, returning it
+// along with the path it was loaded from
+func loadConfig(flags *flag.FlagSet, args []string) (*config.Config, string) {
+	configFile := flags.String("config", "", "Path to the configuration file or a directory of *.yaml files (default $CNAASPROM_CONFIG, ./config.yaml or /etc/cnaasprom/config.yaml)")
+	flags.Parse(args)
+
+	// Without a configuration file the exporter is configured by the
+	// CNAASPROM_* environment variables, e.g. in a container
+	path := *configFile
+	if path == "" {
+		var found bool
+		if path, found = config.FindConfigFile(); !found {
+			log.Printf("No configuration file found; configuring from the environment")
+		}
+	}
+
 	// Load configuration
-	loadedConfig, err := config.LoadConfig("config.yaml")
+	loadedConfig, err := config.LoadConfig(path)
 	if err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
+	return loadedConfig, path
+}
+
+// Revoke the Vault token of commands done once the configuration is loaded
+func revokeVaultToken() {
+	if err := config.RevokeVaultToken(); err != nil {
+		log.Print(err)
+	}
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listenAddress := flags.String("web.listen-address", "", "Address to listen on, overriding the Server section of the configuration")
+	webConfigFile := flags.String("web.config.file", "", "Path to an exporter-toolkit web configuration file enabling TLS or authentication")
+	dryRun := flags.Bool("dry-run", false, "Collect once, print the metrics that would be exported and exit")
+	sampleDir := flags.String("sample-dir", "", "Read statistics from <category>.json files in this directory during a dry run")
+	installService := flags.Bool("install-service", false, "Install a systemd unit or Windows service serving with these flags and exit")
+	serviceUser := flags.String("service-user", "", "User the installed service runs as (default a systemd dynamic user, or LocalSystem on Windows)")
+	serviceWatchdog := flags.Duration("service-watchdog", 30*time.Second, "Restart the installed systemd service when its health checks fail for this long, 0 to disable")
+	loadedConfig, configFile := loadConfig(flags, args)
+	if *installService || *dryRun {
+		revokeVaultToken()
+	}
+
+	if *installService {
+		options := app.ServiceOptions{User: *serviceUser, WatchdogSec: *serviceWatchdog}
+		if err := installAsService(configFile, *listenAddress, *webConfigFile, options); err != nil {
+			log.Fatalf("Failed to install service: %v", err)
+		}
+		return
+	}
+
+	if *dryRun {
+		if err := app.NewApp(loadedConfig).DryRun(os.Stdout, *sampleDir); err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		return
+	}
+
+	// Command line flags take precedence over the configuration file
+	if *listenAddress != "" {
+		host, port, err := config.SplitHostPort(*listenAddress)
+		if err != nil {
+			log.Fatalf("Invalid listen address %q: %v", *listenAddress, err)
+		}
+		loadedConfig.Server.Address = host
+		loadedConfig.Server.Port = port
+	}
+	if *webConfigFile != "" {
+		loadedConfig.Server.WebConfigFile = *webConfigFile
+	}
 
 	// Initialize and run the application
 	application := app.NewApp(loadedConfig)
+	application.ConfigFile = configFile
+	if isService, err := application.RunService(); isService || err != nil {
+		if err != nil {
+			log.Fatalf("Service failed: %v", err)
+		}
+		return
+	}
 	if err := application.Run(); err != nil {
 		log.Fatalf("Application failed: %v", err)
 	}
 }
+
+// Install a service running this executable with the configuration and
+// serve flags given, by absolute path as services don't start in the
+// current directory
+func installAsService(configFile string, listenAddress string, webConfigFile string, options app.ServiceOptions) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Without a configuration file the service reads the environment
+	args := []string{"serve"}
+	if configFile != "" {
+		configFile, err = filepath.Abs(configFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-config", configFile)
+	}
+	if listenAddress != "" {
+		args = append(args, "-web.listen-address", listenAddress)
+	}
+	if webConfigFile != "" {
+		webConfigFile, err = filepath.Abs(webConfigFile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-web.config.file", webConfigFile)
+	}
+	return app.InstallService(executable, args, options)
+}
+
+func validate(args []string) {
+	loadedConfig, _ := loadConfig(flag.NewFlagSet("validate", flag.ExitOnError), args)
+	revokeVaultToken()
+
+	if err := app.NewApp(loadedConfig).Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	fmt.Println("Configuration is valid")
+}
+
+func once(args []string) {
+	loadedConfig, _ := loadConfig(flag.NewFlagSet("once", flag.ExitOnError), args)
+	revokeVaultToken()
+
+	if err := app.NewApp(loadedConfig).Once(os.Stdout); err != nil {
+		log.Fatalf("Collection failed: %v", err)
+	}
+}
+
+func mock(args []string) {
+	flags := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	listenAddress := flags.String("listen-address", "127.0.0.1:31004", "Address to serve the mock APIs on")
+	options := mockserver.Options{}
+	flags.StringVar(&options.FixturesDir, "fixtures", "", "Directory with statistics/<category>.json and monitoring/<category>.json fixtures")
+	flags.DurationVar(&options.Latency, "latency", 0, "Delay added to every response")
+	flags.Float64Var(&options.ErrorRate, "error-rate", 0, "Fraction of requests answered with HTTP 500")
+	flags.DurationVar(&options.StreamInterval, "stream-interval", 5*time.Second, "Interval between monitoring stream messages")
+	flags.Parse(args)
+
+	if err := mockserver.New(options).ListenAndServe(*listenAddress); err != nil {
+		log.Fatalf("Mock server failed: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Aggregation combines the same metric across several categories into a
+// single value, e.g. the sum of sessions over all gNB categories
+type Aggregation struct {
+	Name       string
+	Help       string
+	op         string
+	metric     string
+	categories []string
+}
+
+// ParseAggregations validates the configured aggregation rules
+func ParseAggregations(defs []config.Aggregation) ([]*Aggregation, error) {
+	aggregations := make([]*Aggregation, 0, len(defs))
+	for _, def := range defs {
+		if def.Name == "" || def.Metric == "" {
+			return nil, fmt.Errorf("aggregation rules need both a name and a metric")
+		}
+		switch def.Op {
+		case "sum", "avg", "min", "max":
+		default:
+			return nil, fmt.Errorf("unsupported operation %q for aggregation %s", def.Op, def.Name)
+		}
+
+		help := def.Help
+		if help == "" {
+			help = fmt.Sprintf("%s of metric %s across categories", def.Op, def.Metric)
+		}
+		aggregations = append(aggregations, &Aggregation{
+			Name:       def.Name,
+			Help:       help,
+			op:         def.Op,
+			metric:     def.Metric,
+			categories: def.Categories,
+		})
+	}
+	return aggregations, nil
+}
+
+// Evaluate aggregates the metric over the matching categories. It reports
+// false when no category provided the metric.
+func (a *Aggregation) Evaluate(data map[string]map[string]float64) (float64, bool) {
+	var result float64
+	var count int
+	for category, metrics := range data {
+		value, ok := metrics[a.metric]
+		if !ok || !a.matches(category) {
+			continue
+		}
+
+		switch {
+		case count == 0:
+			result = value
+		case a.op == "min":
+			result = math.Min(result, value)
+		case a.op == "max":
+			result = math.Max(result, value)
+		default:
+			result += value
+		}
+		count++
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+	if a.op == "avg" {
+		result /= float64(count)
+	}
+	return result, true
+}
+
+// A category matches when it is one of the configured categories or was
+// prefixed with one of them while combining statistics
+func (a *Aggregation) matches(category string) bool {
+	if len(a.categories) == 0 {
+		return true
+	}
+	for _, configured := range a.categories {
+		if category == configured || strings.HasPrefix(category, configured+"_") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Values of one element of an array response, labelled with its identifier,
+// and the histograms parsed with them by category
+type labeledData struct {
+	Labels     prometheus.Labels                      `json:"labels"`
+	Data       map[string]map[string]float64          `json:"data"`
+	Histograms map[string]map[string]*SampleHistogram `json:"histograms,omitempty"`
+}
+
+// Parse a response such as [{"cellId":"1","throughput":5}, ...] into one
+// labelled set of values per element. Numeric fields become metrics of the
+// category; objects of numbers become metrics of category_field.
+func parseArrayData(MetricsCategory string, identifier string, body []byte) ([]labeledData, error) {
+	// Elements are decoded one at a time into the same map
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	token, err := decoder.Token()
+	if err == nil && token == nil {
+		return nil, nil
+	}
+	if err != nil || token != json.Delim('[') {
+		if err == nil {
+			err = fmt.Errorf("expected an array")
+		}
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, fmt.Errorf("failed to parse JSON array: %v", err)
+	}
+
+	labelName := sanitizeMetricName(identifier)
+	var series []labeledData
+	element := make(map[string]interface{})
+	for decoder.More() {
+		clear(element)
+		if err := decoder.Decode(&element); err != nil {
+			recordParseFailure(MetricsCategory, "", "", err)
+			return nil, fmt.Errorf("failed to parse JSON array: %v", err)
+		}
+
+		id, ok := identifierValue(element[identifier])
+		if !ok {
+			recordParseFailure(MetricsCategory, identifier, fmt.Sprint(element[identifier]), fmt.Errorf("missing or invalid identifier"))
+			continue
+		}
+
+		data := make(map[string]map[string]float64)
+		for field, value := range element {
+			if field == identifier {
+				continue
+			}
+			switch v := value.(type) {
+			case float64:
+				if data[MetricsCategory] == nil {
+					data[MetricsCategory] = make(map[string]float64)
+				}
+				data[MetricsCategory][field] = v
+			case map[string]interface{}:
+				category := MetricsCategory + "_" + field
+				for name, nested := range v {
+					if number, ok := nested.(float64); ok {
+						if data[category] == nil {
+							data[category] = make(map[string]float64)
+						}
+						data[category][name] = number
+					}
+				}
+			}
+		}
+		series = append(series, labeledData{Labels: prometheus.Labels{labelName: id}, Data: data})
+	}
+	if _, err := decoder.Token(); err != nil {
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, fmt.Errorf("failed to parse JSON array: %v", err)
+	}
+	return series, nil
+}
+
+// Categories whose responses are parsed into labelled series rather than
+// the category/metric map of the statistics API
+func (e *Exporter) isSeriesCategory(MetricsCategory string) bool {
+	_, extracted := e.extractions[MetricsCategory]
+	_, array := e.config.ArrayIdentifiers[MetricsCategory]
+	_, parsed := e.parsers[MetricsCategory]
+	_, broken := e.config.Breakdowns[MetricsCategory]
+	return extracted || array || parsed || broken
+}
+
+// Parse a response into labelled series using the category's parser,
+// extraction rules, breakdowns, or its array identifier
+func (e *Exporter) parseSeries(MetricsCategory string, body []byte) ([]labeledData, error) {
+	if parser, ok := e.parsers[MetricsCategory]; ok {
+		return parseWithParser(MetricsCategory, parser, body)
+	}
+	if rules, ok := e.extractions[MetricsCategory]; ok {
+		return extractData(MetricsCategory, rules, body)
+	}
+	if groups, ok := e.config.Breakdowns[MetricsCategory]; ok {
+		return parseBreakdowns(MetricsCategory, groups, body)
+	}
+	return parseArrayData(MetricsCategory, e.config.ArrayIdentifiers[MetricsCategory], body)
+}
+
+// Identifiers may be strings or numbers
+func identifierValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func mergeLabels(labels ...prometheus.Labels) prometheus.Labels {
+	merged := prometheus.Labels{}
+	for _, l := range labels {
+		for name, value := range l {
+			merged[name] = value
+		}
+	}
+	return merged
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit states as exported by cnaasprom_circuit_state
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+var circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cnaasprom_circuit_state",
+	Help: "Circuit breaker state per upstream server: 0 closed, 1 open, 2 half-open",
+}, []string{"server"})
+
+func init() {
+	registerInternal(circuitState)
+}
+
+// circuitBreaker tracks consecutive failures per upstream server. A nil
+// breaker lets every request through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(cfg config.CircuitBreakerConfig) *circuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{threshold: cfg.FailureThreshold, cooldown: cooldown, circuits: make(map[string]*circuit)}
+}
+
+// Reject requests while the circuit is open. After the cool-down one request
+// is let through to probe the server.
+func (b *circuitBreaker) allow(server string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[server]
+	if !ok {
+		return nil
+	}
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < b.cooldown {
+			return errCircuitOpen
+		}
+		b.setState(server, c, circuitHalfOpen)
+		return nil
+	case circuitHalfOpen:
+		return errCircuitOpen
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(server string, success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[server]
+	if !ok {
+		c = &circuit{}
+		b.circuits[server] = c
+	}
+
+	if success {
+		c.failures = 0
+		b.setState(server, c, circuitClosed)
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || c.failures >= b.threshold {
+		c.openedAt = time.Now()
+		b.setState(server, c, circuitOpen)
+	}
+}
+
+// Forget a request given up by its caller, which says nothing about the
+// server. A probe given up lets the next request probe again.
+func (b *circuitBreaker) abandon(server string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.circuits[server]; ok && c.state == circuitHalfOpen {
+		b.setState(server, c, circuitOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(server string, c *circuit, state int) {
+	c.state = state
+	circuitState.WithLabelValues(server).Set(float64(state))
+}
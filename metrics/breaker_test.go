@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func circuitStateOf(t *testing.T, server string) float64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := circuitState.WithLabelValues(server).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+// Requests given up by the caller don't open the circuit, and the circuit is
+// labelled with the configured server
+func TestCircuitBreaker(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() { close(release) })
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	// Named differently from the requests' host
+	server := config.RemoteServer{Address: "localhost", Port: uint(p)}
+	client, err := newHTTPClient(server, newClientOptions(&config.Config{
+		CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: time.Hour},
+	}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(ctx context.Context, path string) error {
+		_, err := openBody(ctx, client, upstream.URL+path, upstreamRequest{})
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := get(ctx, "/slow"); err == nil {
+		t.Fatal("request outliving its context succeeded")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	get(ctx, "/slow")
+	if err := get(context.Background(), "/"); err != nil {
+		t.Fatalf("circuit opened by requests given up by the caller: %v", err)
+	}
+
+	get(context.Background(), "/fail")
+	if err := get(context.Background(), "/"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("request after a failure: %v, want the circuit open", err)
+	}
+	if state := circuitStateOf(t, "localhost:"+port); state != circuitOpen {
+		t.Errorf("circuit state of the configured server = %v, want open", state)
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// fetchBudget runs the category fetches of a scrape, concurrency at a time,
+// within the deadline of the scrape. With shareDeadline, a fetch gets the
+// time left divided by the rounds of fetches still to run, so one slow
+// category can't use up the time of the categories after it. Time left by
+// fast categories goes to the later ones.
+type fetchBudget struct {
+	concurrency   int
+	shareDeadline bool
+
+	mu      sync.Mutex
+	pending int
+}
+
+func newFetchBudget(concurrency int, shareDeadline bool, pending int) *fetchBudget {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &fetchBudget{concurrency: concurrency, shareDeadline: shareDeadline, pending: pending}
+}
+
+// The context of the next fetch to start
+func (b *fetchBudget) start(ctx context.Context) (context.Context, context.CancelFunc) {
+	b.mu.Lock()
+	rounds := (b.pending + b.concurrency - 1) / b.concurrency
+	b.pending--
+	b.mu.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !b.shareDeadline || !ok || rounds <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(rounds))
+}
+
+// Run fetch for every index below n and return the results in index order
+func (b *fetchBudget) run(ctx context.Context, n int, fetch func(ctx context.Context, i int) scheduledResult) []scheduledResult {
+	results := make([]scheduledResult, n)
+	slots := make(chan struct{}, b.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			fetchCtx, cancel := b.start(ctx)
+			defer cancel()
+			results[i] = fetch(fetchCtx, i)
+		}()
+	}
+	wg.Wait()
+	return results
+}
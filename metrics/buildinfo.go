@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"log"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+var (
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cnaasprom_build_info",
+		Help: "Version of the exporter, always 1",
+	}, []string{"version", "revision", "goversion"})
+	configHash = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cnaasprom_config_hash",
+		Help: "Hash of the loaded configuration",
+	})
+)
+
+func init() {
+	registerInternal(buildInfo, configHash)
+	buildInfo.WithLabelValues(version.Version, version.GetRevision(), version.GoVersion).Set(1)
+}
+
+// Export the hash of the configuration the exporter was created with
+func setConfigHash(cfg *config.Config) {
+	hash, err := cfg.Hash()
+	if err != nil {
+		log.Printf("Failed to hash configuration: %v", err)
+		return
+	}
+	configHash.Set(float64(hash))
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var expiredSeries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cnaasprom_expired_series_total",
+	Help: "Streamed values dropped for not being updated within the stale series TTL",
+})
+
+func init() {
+	registerInternal(expiredSeries)
+}
+
+// Cache holds the latest metric values pushed by streaming sources, per
+// operator identifier, in memory. Sources that do not know the operator use "".
+type Cache struct {
+	mu   sync.RWMutex
+	data map[string]map[string]map[string]cachedValue
+	ttl  time.Duration
+}
+
+// A value and when it was last updated
+type cachedValue struct {
+	value   float64
+	updated time.Time
+}
+
+func NewCache() *Cache {
+	return &Cache{data: make(map[string]map[string]map[string]cachedValue)}
+}
+
+// SetTTL makes values that are not updated within ttl, e.g. of a cell that
+// disappeared upstream, drop out of snapshots. Zero keeps values forever.
+func (c *Cache) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+// Update stores the given metric values for a category, replacing previous values
+func (c *Cache) Update(operator string, category string, metrics map[string]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.store(operator, category, metrics, time.Now())
+}
+
+func (c *Cache) store(operator string, category string, metrics map[string]float64, updated time.Time) {
+	if _, exists := c.data[operator]; !exists {
+		c.data[operator] = make(map[string]map[string]cachedValue)
+	}
+	if _, exists := c.data[operator][category]; !exists {
+		c.data[operator][category] = make(map[string]cachedValue)
+	}
+	for metricName, value := range metrics {
+		c.data[operator][category][metricName] = cachedValue{value: value, updated: updated}
+	}
+}
+
+// Snapshot returns a copy of the cached metric values of an operator,
+// dropping values older than the TTL
+func (c *Cache) Snapshot(operator string) map[string]map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(operator)
+	snapshot := make(map[string]map[string]float64, len(c.data[operator]))
+	for category, metrics := range c.data[operator] {
+		snapshot[category] = make(map[string]float64, len(metrics))
+		for metricName, cached := range metrics {
+			snapshot[category][metricName] = cached.value
+		}
+	}
+	return snapshot
+}
+
+func (c *Cache) expire(operator string) {
+	if c.ttl <= 0 {
+		return
+	}
+	for category, metrics := range c.data[operator] {
+		for metricName, cached := range metrics {
+			if time.Since(cached.updated) > c.ttl {
+				delete(metrics, metricName)
+				expiredSeries.Inc()
+			}
+		}
+		if len(metrics) == 0 {
+			delete(c.data[operator], category)
+		}
+	}
+}
+
+// Restore replaces the cached values, e.g. with values persisted before a
+// restart. Restored values expire like values updated now.
+func (c *Cache) Restore(data map[string]map[string]map[string]float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for operator, categories := range data {
+		for category, metrics := range categories {
+			if c.data[operator] != nil {
+				delete(c.data[operator], category)
+			}
+			c.store(operator, category, metrics, now)
+		}
+	}
+}
+
+// Operators returns the operator identifiers with cached values
+func (c *Cache) Operators() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	operators := make([]string, 0, len(c.data))
+	for operator := range c.data {
+		operators = append(operators, operator)
+	}
+	return operators
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	seriesLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cnaasprom_series_limit_exceeded",
+		Help: "Series dropped by the last scrape for exceeding the series limits, per category",
+	}, []string{"category"})
+
+	// Categories whose dropped series have been logged
+	loggedSeriesLimits sync.Map
+)
+
+func init() {
+	registerInternal(seriesLimitExceeded)
+}
+
+// Drop the samples exceeding the per-category and total limits, zero
+// meaning unlimited. Samples are kept in order of metric name and labels so
+// the same series survive every scrape. Metrics added with addMetric count
+// every series they expose, such as the _bucket, _sum and _count series of a
+// histogram, and are kept or dropped as a whole. Returns the dropped series
+// per category.
+func (s *sampleSet) limit(perCategory int, total int) map[string]int {
+	dropped := make(map[string]int)
+	if perCategory <= 0 && total <= 0 {
+		return dropped
+	}
+
+	// Built metrics by name, in order of their labels and target
+	built := make(map[string][]limitedMetric)
+	for target, metrics := range s.metrics {
+		for i, metric := range metrics {
+			var out dto.Metric
+			if err := metric.Write(&out); err != nil {
+				// Dropped when gathered anyway
+				continue
+			}
+			built[metric.name] = append(built[metric.name], limitedMetric{target: target, index: i, category: metric.category, key: labelPairsKey(out.Label) + target, series: seriesCount(&out)})
+		}
+	}
+	names := make([]string, 0, len(s.families)+len(built))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	for name := range built {
+		if _, ok := s.families[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	kept := 0
+	perCategoryKept := make(map[string]int)
+	// Whether n more series of the category fit the limits
+	fits := func(category string, n int) bool {
+		return (perCategory <= 0 || perCategoryKept[category]+n <= perCategory) && (total <= 0 || kept+n <= total)
+	}
+	keptMetrics := make(map[string]map[int]bool)
+	for _, name := range names {
+		if family, ok := s.families[name]; ok {
+			keys := make([]string, 0, len(family.samples))
+			for key := range family.samples {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				if !fits(family.category, 1) {
+					delete(family.samples, key)
+					dropped[family.category]++
+					continue
+				}
+				perCategoryKept[family.category]++
+				kept++
+			}
+			if len(family.samples) == 0 {
+				delete(s.families, name)
+			}
+		}
+
+		metrics := built[name]
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].key < metrics[j].key })
+		for _, m := range metrics {
+			if !fits(m.category, m.series) {
+				dropped[m.category] += m.series
+				continue
+			}
+			perCategoryKept[m.category] += m.series
+			kept += m.series
+			if keptMetrics[m.target] == nil {
+				keptMetrics[m.target] = make(map[int]bool)
+			}
+			keptMetrics[m.target][m.index] = true
+		}
+	}
+	for target, metrics := range s.metrics {
+		var remaining []builtMetric
+		for i, metric := range metrics {
+			if keptMetrics[target][i] {
+				remaining = append(remaining, metric)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(s.metrics, target)
+		} else {
+			s.metrics[target] = remaining
+		}
+	}
+
+	for category, count := range dropped {
+		if _, logged := loggedSeriesLimits.LoadOrStore(category, true); !logged {
+			log.Printf("Series limit exceeded for category %q, dropped %d series; later drops are reported by cnaasprom_series_limit_exceeded", category, count)
+		}
+	}
+	return dropped
+}
+
+// A metric added with addMetric, by its position in the set
+type limitedMetric struct {
+	target   string
+	index    int
+	category string
+	key      string
+	series   int
+}
+
+// Series a built metric is exposed as: a histogram has one per bucket,
+// +Inf included, and its _sum and _count, a summary one per quantile and
+// its _sum and _count
+func seriesCount(m *dto.Metric) int {
+	switch {
+	case m.Histogram != nil:
+		buckets := m.Histogram.GetBucket()
+		n := len(buckets) + 2
+		if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+			n++
+		}
+		return n
+	case m.Summary != nil:
+		return len(m.Summary.GetQuantile()) + 2
+	}
+	return 1
+}
+
+// Stable key identifying the label pairs of a built metric
+func labelPairsKey(pairs []*dto.LabelPair) string {
+	labels := make(prometheus.Labels, len(pairs))
+	for _, pair := range pairs {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labelsKey(labels)
+}
+
+// Report the series dropped by the last scrape
+func reportSeriesLimits(dropped map[string]int) {
+	seriesLimitExceeded.Reset()
+	for category, count := range dropped {
+		seriesLimitExceeded.WithLabelValues(category).Set(float64(count))
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Histograms count every _bucket, _sum and _count series against the limits
+func TestSeriesLimitsCountHistograms(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	desc := prometheus.NewDesc("amf_latency", "Latency", nil, nil)
+	newSet := func() *sampleSet {
+		set := newSampleSet(nil, newMetricNamer(config.NamingConfig{}))
+		set.add("amf_attempts", "", prometheus.Labels{}, 1)
+		set.families["amf_attempts"].category = "amf"
+		// Buckets 1, 5 and +Inf, the sum and the count
+		set.addMetric("amf_latency", "amf", prometheus.MustNewConstHistogram(desc, 3, 7, map[float64]uint64{1: 1, 5: 2}))
+		return set
+	}
+
+	for _, tc := range []struct {
+		name               string
+		perCategory, total int
+		histogram          bool
+		dropped            int
+	}{
+		{"within the category limit", 6, 0, true, 0},
+		{"above the category limit", 5, 0, false, 5},
+		{"within the total limit", 0, 6, true, 0},
+		{"above the total limit", 0, 3, false, 5},
+	} {
+		set := newSet()
+		dropped := set.limit(tc.perCategory, tc.total)
+		if dropped["amf"] != tc.dropped {
+			t.Errorf("%s: dropped %v, want %d amf series", tc.name, dropped, tc.dropped)
+		}
+		families, err := set.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hasFamily(families, "amf_latency") != tc.histogram || !hasFamily(families, "amf_attempts") {
+			t.Errorf("%s: gathered %d families, want the histogram %t", tc.name, len(families), tc.histogram)
+		}
+	}
+}
+
+func hasFamily(families []*dto.MetricFamily, name string) bool {
+	for _, family := range families {
+		if family.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
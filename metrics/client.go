@@ -0,0 +1,388 @@
+package metrics
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errResponseTooLarge = errors.New("response exceeds the maximum response size")
+
+	responsesTooLarge = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_responses_too_large_total",
+		Help: "Upstream responses discarded for exceeding the maximum response size",
+	}, []string{"server"})
+)
+
+func init() {
+	registerInternal(responsesTooLarge)
+}
+
+// Host used in upstream URLs. Servers listening on a unix socket, configured
+// as unix:///path/to/socket, are addressed with a placeholder host.
+func serverHost(server config.RemoteServer) string {
+	if _, ok := server.SocketPath(); ok {
+		return "localhost"
+	}
+	return server.HostPort()
+}
+
+// Name of a server in the labels of the exporter's own metrics: the
+// configured address and port, or the unix socket URL. Requests may name
+// another host, e.g. a socket's placeholder or a redirect target.
+func serverName(server config.RemoteServer) string {
+	if path, ok := server.SocketPath(); ok {
+		return "unix://" + path
+	}
+	return server.HostPort()
+}
+
+// Idle connections kept per upstream server unless configured; enough for
+// the categories of a scrape to be fetched without new connections
+const defaultMaxIdleConnsPerHost = 16
+
+// Bytes of an unread response body discarded on close so the connection
+// can be reused
+const maxDrainSize = 64 << 10
+
+// Settings shared by the HTTP clients of all upstream servers
+type clientOptions struct {
+	maxResponseSize int64
+	circuitBreaker  config.CircuitBreakerConfig
+	connections     config.ConnectionsConfig
+	rateLimit       config.RateLimitConfig
+	dns             config.DNSConfig
+	redirects       config.RedirectConfig
+	signing         config.RequestSigningConfig
+	tlsPolicy       config.TLSPolicy
+	spiffe          *spiffeSources
+	rateLimits      *RateLimits
+}
+
+func newClientOptions(cfg *config.Config, spiffe *spiffeSources, rateLimits *RateLimits) clientOptions {
+	return clientOptions{maxResponseSize: cfg.ResponseLimit(), circuitBreaker: cfg.CircuitBreaker, connections: cfg.Connections, rateLimit: cfg.RateLimit, dns: cfg.DNS, redirects: cfg.Redirects, signing: cfg.RequestSigning, tlsPolicy: cfg.TLSPolicy, spiffe: spiffe, rateLimits: rateLimits}
+}
+
+// Build the HTTP client used to reach a remote server. Without an explicit
+// proxy URL the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables apply.
+// Responses are requested compressed and their decompressed size is limited.
+// Failing servers are skipped by a circuit breaker when one is configured
+// and requests wait for the configured rate limits. Servers answering 429
+// are not contacted again before their Retry-After has passed. Failed
+// requests are retried within the retry budget.
+// The client keeps its connections alive, so one is built per server and
+// reused for every request; with DNS refresh they are dropped when the
+// server's addresses change. Redirects are followed as the redirect policy
+// allows. Requests are signed when request signing is configured.
+func newHTTPClient(server config.RemoteServer, options clientOptions) (*http.Client, error) {
+	if err := checkRedirectPolicy(options.redirects); err != nil {
+		return nil, err
+	}
+	signer, err := newRequestSigner(options.signing)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxyFunc(server)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newDNSResolver(options.dns)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newPolicyTransport(options.tlsPolicy)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+	transport.DialContext = newDialer(resolver, options.connections.FallbackDelay).DialContext
+	if path, ok := server.SocketPath(); ok {
+		transport.DialContext = unixDialer(path)
+	}
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if options.connections.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = options.connections.MaxIdleConnsPerHost
+	}
+	if options.connections.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = options.connections.IdleConnTimeout
+	}
+	transport.ForceAttemptHTTP2 = !options.connections.DisableHTTP2
+	return &http.Client{CheckRedirect: redirectPolicy(options.redirects), Transport: &decodingTransport{
+		server:          serverName(server),
+		base:            transport,
+		traced:          tracedTransport(transport),
+		maxResponseSize: options.maxResponseSize,
+		breaker:         newCircuitBreaker(options.circuitBreaker),
+		limiter:         newRateLimiter(options.rateLimit, options.rateLimits),
+		retries:         newRetryBudget(options.rateLimit.RetryBudget),
+		throttle:        newThrottle(),
+		dns:             newDNSRefresher(options.dns, resolver, transport.CloseIdleConnections),
+		signer:          signer,
+	}}, nil
+}
+
+// Name of the server a client built by newHTTPClient reaches, or the host
+// of the request for other clients
+func clientServer(client *http.Client, req *http.Request) string {
+	if t, ok := client.Transport.(*decodingTransport); ok {
+		return t.server
+	}
+	return req.URL.Host
+}
+
+// The HTTP transport of a client built by newHTTPClient
+func baseTransport(client *http.Client) *http.Transport {
+	return client.Transport.(*decodingTransport).base
+}
+
+// Build the websocket dialer used to reach a remote server
+func newWebsocketDialer(server config.RemoteServer, options clientOptions) (*websocket.Dialer, error) {
+	proxy, err := proxyFunc(server)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newDNSResolver(options.dns)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := withTLSPolicy(nil, options.tlsPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = proxy
+	dialer.TLSClientConfig = tlsConfig
+	dialer.NetDialContext = newDialer(resolver, options.connections.FallbackDelay).DialContext
+	if path, ok := server.SocketPath(); ok {
+		dialer.NetDialContext = unixDialer(path)
+	}
+	return &dialer, nil
+}
+
+// Dialer racing IPv6 and IPv4 connection attempts (happy eyeballs) for
+// dual-stack upstreams after the fallback delay, resolving with the given
+// resolver unless nil
+func newDialer(resolver *net.Resolver, fallbackDelay time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       30 * time.Second,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: fallbackDelay,
+		Resolver:      resolver,
+	}
+}
+
+// Dial function connecting to a unix socket regardless of the requested address
+func unixDialer(path string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+func proxyFunc(server config.RemoteServer) (func(*http.Request) (*url.URL, error), error) {
+	if _, ok := server.SocketPath(); ok {
+		return nil, nil
+	}
+	if server.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(server.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %v", server.ProxyURL, err)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// Headers sent to a remote server; category headers override server headers
+func requestHeaders(server config.RemoteServer, categoryHeaders map[string]config.Secret) map[string]string {
+	headers := make(map[string]string, len(server.Headers)+len(categoryHeaders))
+	for name, value := range server.Headers {
+		headers[name] = string(value)
+	}
+	for name, value := range categoryHeaders {
+		headers[name] = string(value)
+	}
+	return headers
+}
+
+// decodingTransport requests compressed responses, decompresses them and
+// limits the size of the decompressed body
+type decodingTransport struct {
+	// Configured name of the server, see serverName
+	server          string
+	base            *http.Transport
+	traced          http.RoundTripper
+	maxResponseSize int64
+	breaker         *circuitBreaker
+	limiter         *rateLimiter
+	retries         *retryBudget
+	throttle        *throttle
+	dns             *dnsRefresher
+	signer          *requestSigner
+}
+
+func (t *decodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	server := t.server
+	t.retries.deposit()
+	resp, sent, err := t.send(req)
+	for retry := 1; t.retryable(req, resp, sent, err) && t.retries.withdraw(retry); retry++ {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		upstreamRetries.WithLabelValues(server).Inc()
+		again := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if again.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, sent, err = t.send(again)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := decompressBody(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Body = &limitedBody{ReadCloser: body, remaining: t.maxResponseSize, server: server}
+	return resp, nil
+}
+
+// Send a request once it passes the throttle, the rate limits and the
+// circuit breaker, reporting whether it was sent
+func (t *decodingTransport) send(req *http.Request) (*http.Response, bool, error) {
+	server := t.server
+	if err := t.throttle.allow(server); err != nil {
+		return nil, false, err
+	}
+	if err := t.limiter.wait(req.Context(), server); err != nil {
+		return nil, false, err
+	}
+	if err := t.breaker.allow(server); err != nil {
+		t.limiter.release(server)
+		return nil, false, err
+	}
+
+	t.dns.refresh(req.Context(), req.URL.Hostname())
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	// Signed after waiting for the limits so the timestamp is current
+	if err := t.signer.sign(req); err != nil {
+		t.breaker.abandon(server)
+		t.limiter.release(server)
+		return nil, false, err
+	}
+
+	resp, err := t.traced.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		// Cancelled or timed out by the caller
+		t.breaker.abandon(server)
+	} else {
+		t.breaker.record(server, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
+	if err != nil {
+		t.dns.expire(req.URL.Hostname())
+		return nil, true, err
+	}
+	t.throttle.record(server, resp)
+	return resp, true, nil
+}
+
+// Whether a sent request failed upstream and can be sent again: its body
+// can be replayed and the caller is still waiting for it
+func (t *decodingTransport) retryable(req *http.Request, resp *http.Response, sent bool, err error) bool {
+	if !sent || req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// Wrap the response body in a decompressor matching its Content-Encoding.
+// Closing the returned reader closes the response body.
+func decompressBody(resp *http.Response) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip":
+		reader, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress response: %v", err)
+	}
+	return &decompressedBody{ReadCloser: reader, body: resp.Body}, nil
+}
+
+type decompressedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (d *decompressedBody) Close() error {
+	d.ReadCloser.Close()
+	return d.body.Close()
+}
+
+// limitedBody fails with errResponseTooLarge once more than the allowed
+// number of bytes has been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	server    string
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	// Read one byte past the limit to tell a body of exactly the limit apart
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		responsesTooLarge.WithLabelValues(l.server).Inc()
+		return 0, errResponseTooLarge
+	}
+	return n, err
+}
+
+// Discard what is left of a partly read body, e.g. the trailing newline
+// after a streamed JSON document, so the connection returns to the pool
+func (l *limitedBody) Close() error {
+	io.CopyN(io.Discard, l.ReadCloser, maxDrainSize)
+	return l.ReadCloser.Close()
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Upstreams configured by bracketed IPv6 literals are reached, with the
+// IPv4 fallback disabled or delayed as configured
+func TestIPv6Upstream(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"amf": {"attempts": 1}}`)
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	p, _ := strconv.ParseUint(port, 10, 32)
+
+	for _, delay := range []time.Duration{0, -1} {
+		server := config.RemoteServer{Address: "[::1]", Port: uint(p)}
+		client, err := newHTTPClient(server, newClientOptions(&config.Config{Connections: config.ConnectionsConfig{FallbackDelay: delay}}, nil, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get("http://" + server.HostPort() + "/")
+		if err != nil {
+			t.Fatalf("fallback delay %s: %v", delay, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("fallback delay %s: status %d", delay, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Functions combining values of the same name returned by several
+// statistics categories
+const (
+	combineSum  = "sum"
+	combineMax  = "max"
+	combineMin  = "min"
+	combineLast = "last"
+	combineAvg  = "avg"
+)
+
+// combineRules choose how values of the same name are combined when
+// onMetricConflict sums them. Summing suits counters, but not gauges such as
+// the current utilization.
+type combineRules []combineRule
+
+type combineRule struct {
+	category string
+	metric   string
+	function string
+}
+
+func newCombineRules(defs []config.CombineRule) (combineRules, error) {
+	var rules combineRules
+	for _, def := range defs {
+		switch def.Function {
+		case combineSum, combineMax, combineMin, combineLast, combineAvg:
+		default:
+			return nil, fmt.Errorf("unsupported combine function %q, use sum, max, min, last or avg", def.Function)
+		}
+		rules = append(rules, combineRule{category: def.Category, metric: def.Metric, function: def.Function})
+	}
+	return rules, nil
+}
+
+// The function combining a metric that a category returned first. The first
+// matching rule applies; values are summed unless a rule matches.
+func (r combineRules) function(category string, metricName string) string {
+	for _, rule := range r {
+		if (rule.category == "" || rule.category == category) && (rule.metric == "" || rule.metric == metricName) {
+			return rule.function
+		}
+	}
+	return combineSum
+}
+
+// Combine a value with the current one, the combination of count values
+func combine(function string, current float64, value float64, count int) float64 {
+	switch function {
+	case combineMax:
+		return math.Max(current, value)
+	case combineMin:
+		return math.Min(current, value)
+	case combineLast:
+		return value
+	case combineAvg:
+		return current + (value-current)/float64(count+1)
+	default:
+		return current + value
+	}
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies for values of the same name returned by several categories, set
+// by onMetricConflict
+const (
+	conflictSum           = "sum"
+	conflictKeepFirst     = "keep-first"
+	conflictError         = "error"
+	conflictLabelBySource = "label-by-source"
+)
+
+// Label of the category conflicting values come from, with label-by-source
+const sourceCategoryLabel = "source_category"
+
+var errMetricConflict = errors.New("metric conflict")
+
+var (
+	metricConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_metric_conflicts_total",
+		Help: "Values returned by a statistics category under a name another category already returned",
+	}, []string{"category"})
+
+	// Conflicting names that have been logged
+	loggedConflicts sync.Map
+)
+
+func init() {
+	registerInternal(metricConflicts)
+}
+
+func checkConflictPolicy(policy string) error {
+	switch policy {
+	case "", conflictSum, conflictKeepFirst, conflictError, conflictLabelBySource:
+		return nil
+	}
+	return fmt.Errorf("unsupported onMetricConflict %q, use sum, keep-first, error or label-by-source", policy)
+}
+
+// categoryMerger combines the data of the categories of a fetch under the
+// names prefixed with their category. A category's group may prefix to the
+// name of another's, e.g. amf with group reg_x and amf_reg with group x; the
+// values of such names are handled by the conflict policy.
+type categoryMerger struct {
+	policy  string
+	combine combineRules
+	data    map[string]map[string]float64
+	// Category of every value, by prefixed group and metric name
+	sources map[string]map[string]string
+	// Number of values combined into a value, if more than one
+	counts map[string]int
+	// Conflicting values by their category, with label-by-source
+	labelled map[string]map[string]map[string]float64
+	errs     []error
+}
+
+func newCategoryMerger(policy string, combine combineRules) *categoryMerger {
+	return &categoryMerger{
+		policy:   policy,
+		combine:  combine,
+		data:     make(map[string]map[string]float64),
+		sources:  make(map[string]map[string]string),
+		counts:   make(map[string]int),
+		labelled: make(map[string]map[string]map[string]float64),
+	}
+}
+
+func (m *categoryMerger) merge(MetricsCategory string, data map[string]map[string]float64) {
+	for category, metrics := range data {
+		prefixedCategory := fmt.Sprintf("%s_%s", MetricsCategory, category)
+		if _, exists := m.data[prefixedCategory]; !exists {
+			m.data[prefixedCategory] = make(map[string]float64)
+			m.sources[prefixedCategory] = make(map[string]string)
+		}
+		for metricName, value := range metrics {
+			source, exists := m.sources[prefixedCategory][metricName]
+			if !exists {
+				m.data[prefixedCategory][metricName] = value
+				m.sources[prefixedCategory][metricName] = MetricsCategory
+				continue
+			}
+			m.conflict(prefixedCategory, metricName, MetricsCategory, source, value)
+		}
+	}
+}
+
+func (m *categoryMerger) conflict(prefixedCategory string, metricName string, MetricsCategory string, source string, value float64) {
+	metricConflicts.WithLabelValues(MetricsCategory).Inc()
+	name := prefixedCategory + "_" + metricName
+	function := m.combine.function(source, metricName)
+	if _, logged := loggedConflicts.LoadOrStore(name, true); !logged {
+		switch m.policy {
+		case "", conflictSum:
+			log.Printf("Category %s returned %s, which category %s already returned; combined by %s", MetricsCategory, name, source, function)
+		default:
+			log.Printf("Category %s returned %s, which category %s already returned; handled by onMetricConflict %s", MetricsCategory, name, source, m.policy)
+		}
+	}
+
+	switch m.policy {
+	case conflictKeepFirst:
+	case conflictError:
+		m.errs = append(m.errs, fmt.Errorf("%w: category %s returned %s, which category %s already returned", errMetricConflict, MetricsCategory, name, source))
+	case conflictLabelBySource:
+		// The first value is moved to the series of its category
+		if first, ok := m.data[prefixedCategory][metricName]; ok {
+			m.label(source, prefixedCategory, metricName, first)
+			delete(m.data[prefixedCategory], metricName)
+		}
+		m.label(MetricsCategory, prefixedCategory, metricName, value)
+	default:
+		count, ok := m.counts[name]
+		if !ok {
+			count = 1
+		}
+		m.data[prefixedCategory][metricName] = combine(function, m.data[prefixedCategory][metricName], value, count)
+		m.counts[name] = count + 1
+	}
+}
+
+func (m *categoryMerger) label(source string, prefixedCategory string, metricName string, value float64) {
+	if _, ok := m.labelled[source]; !ok {
+		m.labelled[source] = make(map[string]map[string]float64)
+	}
+	if _, ok := m.labelled[source][prefixedCategory]; !ok {
+		m.labelled[source][prefixedCategory] = make(map[string]float64)
+	}
+	m.labelled[source][prefixedCategory][metricName] = value
+}
+
+// The combined data, the series of the values labelled by their category and
+// the conflicts with the error policy
+func (m *categoryMerger) result() (map[string]map[string]float64, []labeledData, error) {
+	var series []labeledData
+	for source, data := range m.labelled {
+		series = append(series, labeledData{Labels: prometheus.Labels{sourceCategoryLabel: source}, Data: data})
+	}
+	return m.data, series, errors.Join(m.errs...)
+}
@@ -0,0 +1,233 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// DerivedMetric is a metric computed from an arithmetic expression over
+// collected metrics, e.g. "amf_session_success / amf_session_attempts".
+type DerivedMetric struct {
+	Name string
+	Help string
+	expr expression
+}
+
+// ParseDerivedMetrics compiles the configured derived metric expressions
+func ParseDerivedMetrics(defs []config.DerivedMetric) ([]*DerivedMetric, error) {
+	derived := make([]*DerivedMetric, 0, len(defs))
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, fmt.Errorf("derived metric with expression %q has no name", def.Expr)
+		}
+		expr, err := parseExpression(def.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression for derived metric %s: %v", def.Name, err)
+		}
+		help := def.Help
+		if help == "" {
+			help = fmt.Sprintf("Derived metric %s = %s", def.Name, def.Expr)
+		}
+		derived = append(derived, &DerivedMetric{Name: def.Name, Help: help, expr: expr})
+	}
+	return derived, nil
+}
+
+// Evaluate computes the metric value from the collected values
+func (d *DerivedMetric) Evaluate(values map[string]float64) (float64, error) {
+	return d.expr.eval(values)
+}
+
+type expression interface {
+	eval(values map[string]float64) (float64, error)
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type metricExpr string
+
+func (m metricExpr) eval(values map[string]float64) (float64, error) {
+	value, ok := values[string(m)]
+	if !ok {
+		return 0, fmt.Errorf("metric %s not found", string(m))
+	}
+	return value, nil
+}
+
+type unaryExpr struct {
+	operand expression
+}
+
+func (u unaryExpr) eval(values map[string]float64) (float64, error) {
+	value, err := u.operand.eval(values)
+	return -value, err
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expression
+}
+
+func (b binaryExpr) eval(values map[string]float64) (float64, error) {
+	left, err := b.left.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	right, err := b.right.eval(values)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	default:
+		return left / right, nil
+	}
+}
+
+// Recursive descent parser for + - * / expressions with parentheses
+type expressionParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseExpression(input string) (expression, error) {
+	tokens, err := tokenizeExpression(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &expressionParser{tokens: tokens}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+// Number with a signed exponent such as 1e-3, whose sign would otherwise be
+// taken for an operator. Unsigned exponents are read like names.
+var signedExponentNumber = regexp.MustCompile(`^(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)[eE][+-][0-9]+`)
+
+func tokenizeExpression(input string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(input); {
+		c := rune(input[i])
+		if number := signedExponentNumber.FindString(input[i:]); number != "" {
+			tokens = append(tokens, number)
+			i += len(number)
+			continue
+		}
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/()", c):
+			tokens = append(tokens, string(c))
+			i++
+		case c == '_' || c == ':' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			start := i
+			for i < len(input) && (input[i] == '_' || input[i] == ':' || input[i] == '.' ||
+				unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i]))) {
+				i++
+			}
+			tokens = append(tokens, input[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *expressionParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *expressionParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "+" || p.next() == "-" {
+		op := p.next()[0]
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseProduct() (expression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for p.next() == "*" || p.next() == "/" {
+		op := p.next()[0]
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseOperand() (expression, error) {
+	token := p.next()
+	p.pos++
+
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "-":
+		operand, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{operand: operand}, nil
+	case token == "(":
+		expr, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	case strings.ContainsAny(token[:1], "+*/)"):
+		return nil, fmt.Errorf("unexpected %q", token)
+	}
+
+	if number, err := strconv.ParseFloat(token, 64); err == nil {
+		return numberExpr(number), nil
+	}
+	return metricExpr(token), nil
+}
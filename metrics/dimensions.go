@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dimensions of the breakdowns in statistics responses: network slices,
+// labelled with snssai, sst and sd, and cells, labelled with ncgi and tac
+const (
+	dimensionSlice = "slice"
+	dimensionCell  = "cell"
+)
+
+// Fields identifying the slice or cell of a breakdown element rather than
+// holding a value
+var dimensionFields = map[string]bool{
+	"snssai": true, "sNssai": true, "sst": true, "sd": true,
+	"ncgi": true, "nci": true, "nrCellId": true, "cellId": true, "tac": true, "tai": true,
+}
+
+func validateBreakdowns(breakdowns map[string]map[string]string) error {
+	for category, groups := range breakdowns {
+		for group, dimension := range groups {
+			if dimension != dimensionSlice && dimension != dimensionCell {
+				return fmt.Errorf("breakdown %s of category %s has unknown dimension %q", group, category, dimension)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse a statistics response whose groups may break values down per slice
+// or cell, such as {"slices": [{"snssai": {"sst": 1, "sd": "010203"},
+// "sessions": 5}]}. A breakdown is an array of objects or an object of
+// objects keyed by their slice or cell; each element becomes a labelled
+// series of category_group. Other groups are returned unlabelled.
+func parseBreakdowns(MetricsCategory string, groups map[string]string, body []byte) ([]labeledData, error) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	totals := make(map[string]map[string]float64)
+	var series []labeledData
+	for group, raw := range response {
+		category := fmt.Sprintf("%s_%s", MetricsCategory, group)
+		dimension, ok := groups[group]
+		if !ok {
+			var values map[string]float64
+			if err := json.Unmarshal(raw, &values); err != nil {
+				recordParseFailure(MetricsCategory, group, "", err)
+				continue
+			}
+			totals[category] = values
+			continue
+		}
+
+		elements, err := breakdownElements(raw)
+		if err != nil {
+			recordParseFailure(MetricsCategory, group, "", err)
+			continue
+		}
+		for key, element := range elements {
+			var labels prometheus.Labels
+			if dimension == dimensionSlice {
+				labels, ok = sliceLabels(element, key)
+			} else {
+				labels, ok = cellLabels(element, key)
+			}
+			if !ok {
+				recordParseFailure(MetricsCategory, group, key, fmt.Errorf("missing or invalid %s identifier", dimension))
+				continue
+			}
+			series = append(series, labeledData{Labels: labels, Data: breakdownValues(category, element)})
+		}
+	}
+
+	if len(totals) > 0 {
+		series = append([]labeledData{{Labels: prometheus.Labels{}, Data: totals}}, series...)
+	}
+	return series, nil
+}
+
+// Elements of a breakdown keyed by their key in an object, or by their
+// index in an array, where the key identifies nothing
+func breakdownElements(raw json.RawMessage) (map[string]map[string]interface{}, error) {
+	var list []map[string]interface{}
+	if err := json.Unmarshal(raw, &list); err == nil {
+		elements := make(map[string]map[string]interface{}, len(list))
+		for i, element := range list {
+			elements["#"+strconv.Itoa(i)] = element
+		}
+		return elements, nil
+	}
+	var elements map[string]map[string]interface{}
+	if err := json.Unmarshal(raw, &elements); err != nil {
+		return nil, fmt.Errorf("breakdown is neither an array nor an object of objects")
+	}
+	return elements, nil
+}
+
+// Numeric fields of an element, and objects of numbers as category_field
+func breakdownValues(category string, element map[string]interface{}) map[string]map[string]float64 {
+	data := make(map[string]map[string]float64)
+	for field, value := range element {
+		if dimensionFields[field] {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			if data[category] == nil {
+				data[category] = make(map[string]float64)
+			}
+			data[category][field] = v
+		case map[string]interface{}:
+			nestedCategory := fmt.Sprintf("%s_%s", category, field)
+			for name, nested := range v {
+				if number, ok := nested.(float64); ok {
+					if data[nestedCategory] == nil {
+						data[nestedCategory] = make(map[string]float64)
+					}
+					data[nestedCategory][name] = number
+				}
+			}
+		}
+	}
+	return data
+}
+
+// The S-NSSAI of an element: an snssai object of sst and sd, a string such
+// as 1-010203 or 01010203, top-level sst and sd fields, or the element key
+func sliceLabels(element map[string]interface{}, key string) (prometheus.Labels, bool) {
+	snssai := element["snssai"]
+	if snssai == nil {
+		snssai = element["sNssai"]
+	}
+
+	var sst, sd string
+	switch v := snssai.(type) {
+	case map[string]interface{}:
+		sst, _ = identifierValue(v["sst"])
+		sd, _ = v["sd"].(string)
+	case string:
+		sst, sd = splitSNSSAI(v)
+	case float64:
+		sst, _ = identifierValue(v)
+	case nil:
+		if id, ok := identifierValue(element["sst"]); ok {
+			sst = id
+			sd, _ = element["sd"].(string)
+		} else if !strings.HasPrefix(key, "#") {
+			sst, sd = splitSNSSAI(key)
+		}
+	}
+	if _, err := strconv.ParseUint(sst, 10, 8); err != nil {
+		return nil, false
+	}
+
+	sd = strings.ToLower(sd)
+	labels := prometheus.Labels{"sst": sst, "sd": sd, "snssai": sst}
+	if sd != "" && sd != "ffffff" {
+		labels["snssai"] = sst + "-" + sd
+	}
+	return labels, true
+}
+
+// Split an S-NSSAI written as sst-sd, sst:sd, sst alone, or as the eight
+// hex digits of sst and sd
+func splitSNSSAI(s string) (string, string) {
+	if sst, sd, found := strings.Cut(strings.ReplaceAll(s, ":", "-"), "-"); found {
+		return sst, sd
+	}
+	if len(s) == 8 {
+		if sst, err := strconv.ParseUint(s[:2], 16, 8); err == nil {
+			return strconv.FormatUint(sst, 10), s[2:]
+		}
+	}
+	return s, ""
+}
+
+// The cell of an element: its NCGI, given as a string, as an object of
+// plmnId and nrCellId, or by the cell identity alone, and its TAC
+func cellLabels(element map[string]interface{}, key string) (prometheus.Labels, bool) {
+	labels := prometheus.Labels{}
+
+	switch v := element["ncgi"].(type) {
+	case string:
+		labels["ncgi"] = v
+	case map[string]interface{}:
+		cell, _ := identifierValue(v["nrCellId"])
+		if plmn, ok := v["plmnId"].(map[string]interface{}); ok {
+			mcc, _ := plmn["mcc"].(string)
+			mnc, _ := plmn["mnc"].(string)
+			cell = mcc + mnc + cell
+		}
+		if cell != "" {
+			labels["ncgi"] = strings.ToLower(cell)
+		}
+	}
+	if labels["ncgi"] == "" {
+		for _, field := range []string{"nci", "nrCellId", "cellId"} {
+			if id, ok := identifierValue(element[field]); ok {
+				labels["ncgi"] = strings.ToLower(id)
+				break
+			}
+		}
+	}
+	if labels["ncgi"] == "" && !strings.HasPrefix(key, "#") {
+		labels["ncgi"] = key
+	}
+
+	tac, ok := identifierValue(element["tac"])
+	if tai, isObject := element["tai"].(map[string]interface{}); !ok && isObject {
+		tac, ok = identifierValue(tai["tac"])
+	}
+	if ok {
+		labels["tac"] = tac
+	}
+	return labels, labels["ncgi"] != "" || labels["tac"] != ""
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+const (
+	defaultDNSTTL    = 30 * time.Second
+	dnsLookupTimeout = 5 * time.Second
+	defaultDNSPort   = "53"
+	dnsRefreshPoll   = "poll"
+	dnsRefreshTTL    = "ttl"
+)
+
+// Check the DNS settings and return the resolver of the pinned DNS server,
+// nil for the system resolver
+func newDNSResolver(cfg config.DNSConfig) (*net.Resolver, error) {
+	switch cfg.Refresh {
+	case "", dnsRefreshPoll, dnsRefreshTTL:
+	default:
+		return nil, fmt.Errorf("unsupported dns refresh %q, use poll or ttl", cfg.Refresh)
+	}
+	if cfg.Resolver == "" {
+		return nil, nil
+	}
+
+	address := cfg.Resolver
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), defaultDNSPort)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid dns resolver %q: %v", cfg.Resolver, err)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}, nil
+}
+
+// dnsRefresher resolves the host names of a transport's requests again
+// before every request, or once their TTL passed, and closes its idle
+// connections when the addresses changed. New connections resolve the name
+// anyway; this keeps requests from reusing connections to addresses that
+// went away on a failover.
+type dnsRefresher struct {
+	resolver *net.Resolver
+	poll     bool
+	ttl      time.Duration
+	close    func()
+
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	addresses []string
+	expires   time.Time
+}
+
+// Nil unless the configuration asks for refreshing
+func newDNSRefresher(cfg config.DNSConfig, resolver *net.Resolver, closeIdle func()) *dnsRefresher {
+	if cfg.Refresh == "" {
+		return nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = defaultDNSTTL
+	}
+	return &dnsRefresher{
+		resolver: resolver,
+		poll:     cfg.Refresh == dnsRefreshPoll,
+		ttl:      ttl,
+		close:    closeIdle,
+		hosts:    make(map[string]*resolvedHost),
+	}
+}
+
+// Resolve host again when it is due. Lookup failures keep the connections;
+// the request reports the failure if the host is really gone.
+func (r *dnsRefresher) refresh(ctx context.Context, host string) {
+	if r == nil || host == "" || net.ParseIP(host) != nil {
+		return
+	}
+
+	r.mu.Lock()
+	known, ok := r.hosts[host]
+	due := !ok || r.poll || time.Now().After(known.expires)
+	r.mu.Unlock()
+	if !due {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	addresses, err := r.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return
+	}
+	slices.Sort(addresses)
+
+	r.mu.Lock()
+	known, ok = r.hosts[host]
+	r.hosts[host] = &resolvedHost{addresses: addresses, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	if ok && !slices.Equal(known.addresses, addresses) {
+		log.Printf("Addresses of %s changed from %s to %s, closing idle connections", host, strings.Join(known.addresses, ","), strings.Join(addresses, ","))
+		r.close()
+	}
+}
+
+// Resolve host again on the next request, e.g. after a connection failed
+func (r *dnsRefresher) expire(host string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known, ok := r.hosts[host]; ok {
+		known.expires = time.Time{}
+	}
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// UseSampleDir makes the exporter read statistics from <category>.json files
+// in dir instead of fetching them from the remote statistics server
+func (e *Exporter) UseSampleDir(dir string) {
+	e.sampleDir = dir
+}
+
+// Read the sample statistics of all categories, combined like upstream responses
+func (e *Exporter) loadSampleData() (map[string]map[string]float64, []labeledData, error) {
+	merger := newCategoryMerger(e.config.OnMetricConflict, e.combine)
+	var series []labeledData
+	for _, MetricsCategory := range e.config.MetricsStatisticsCategory {
+		filename := filepath.Join(e.sampleDir, MetricsCategory+".json")
+		data, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read sample file: %v", err)
+		}
+
+		if e.isSeriesCategory(MetricsCategory) {
+			elements, err := e.parseSeries(MetricsCategory, data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse sample file %s: %v", filename, err)
+			}
+			series = append(series, elements...)
+			continue
+		}
+
+		var stats map[string]map[string]float64
+		if err := json.Unmarshal(data, &stats); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse sample file %s: %v", filename, err)
+		}
+
+		merger.merge(MetricsCategory, stats)
+	}
+	combinedData, labelled, err := merger.result()
+	return combinedData, append(series, labelled...), err
+}
+
+// DryRun performs a single collection and prints every metric that would be
+// exported with its type, labels and value
+func (e *Exporter) DryRun(w io.Writer) error {
+	operators, multiTenant := e.configuredOperators()
+	collections, err := e.collectAll(context.Background(), operators, multiTenant)
+	if err != nil {
+		return fmt.Errorf("failed to fetch and combine JSON data: %v", err)
+	}
+
+	gatherer, err := e.gatherer(collections)
+	if err != nil {
+		return fmt.Errorf("failed to register metrics: %v", err)
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tTYPE\tLABELS\tVALUE")
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\n",
+				family.GetName(),
+				strings.ToLower(family.GetType().String()),
+				formatLabels(metric.GetLabel()),
+				formatValue(metric),
+			)
+		}
+	}
+	return table.Flush()
+}
+
+func formatLabels(pairs []*dto.LabelPair) string {
+	labels := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		labels = append(labels, fmt.Sprintf("%s=%q", pair.GetName(), pair.GetValue()))
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatValue(metric *dto.Metric) string {
+	switch {
+	case metric.Gauge != nil:
+		return fmt.Sprint(metric.Gauge.GetValue())
+	case metric.Counter != nil:
+		return fmt.Sprint(metric.Counter.GetValue())
+	case metric.Histogram != nil:
+		return fmt.Sprintf("count=%d sum=%g buckets=%d", metric.Histogram.GetSampleCount(), metric.Histogram.GetSampleSum(), len(metric.Histogram.GetBucket()))
+	case metric.Untyped != nil:
+		return fmt.Sprint(metric.Untyped.GetValue())
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Policies for upstream errors, set by onUpstreamError
+const (
+	onErrorFail        = "fail"
+	onErrorPartial     = "partial"
+	onErrorServeCached = "serve-cached"
+)
+
+func checkErrorPolicy(policy string) error {
+	switch policy {
+	case "", onErrorFail, onErrorPartial, onErrorServeCached:
+		return nil
+	}
+	return fmt.Errorf("unsupported onUpstreamError %q, use fail, partial or serve-cached", policy)
+}
+
+// Whether a failed fetch of the target fails the scrape: with the fail
+// policy, and for metric conflicts with the error conflict policy
+func (t *scrapeTarget) failsOn(err error) bool {
+	return err != nil && (t.module.OnUpstreamError == onErrorFail || errors.Is(err, errMetricConflict))
+}
+
+// The last response of a URL to serve instead of a failed fetch: while the
+// server throttles requests, or after any error if the target serves its
+// cached responses
+func (e *Exporter) fallbackFor(t *scrapeTarget, apiURL string, err error) (interface{}, bool) {
+	if isThrottled(err) {
+		data, ok := e.fallback.get(apiURL, err)
+		if ok {
+			log.Printf("Serving the last response of %s while the server throttles requests", apiURL)
+		}
+		return data, ok
+	}
+	if t.module.OnUpstreamError != onErrorServeCached {
+		return nil, false
+	}
+
+	data, ok := e.fallback.last(apiURL)
+	if ok {
+		log.Printf("Serving the last response of %s after a failed fetch: %v", apiURL, err)
+	}
+	return data, ok
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ExtractionRule selects objects from a response body with a JSONPath and
+// turns fields relative to each object into labels and metrics
+type ExtractionRule struct {
+	path    jsonPath
+	labels  map[string]jsonPath
+	metrics map[string]jsonPath
+}
+
+// ParseExtractionRules compiles the extraction rules of every category
+func ParseExtractionRules(defs map[string][]config.ExtractionRule) (map[string][]*ExtractionRule, error) {
+	rules := make(map[string][]*ExtractionRule, len(defs))
+	for category, categoryDefs := range defs {
+		for _, def := range categoryDefs {
+			path, err := compileJSONPath(def.Path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extraction rule for %s: %v", category, err)
+			}
+
+			rule := &ExtractionRule{path: path, labels: make(map[string]jsonPath), metrics: make(map[string]jsonPath)}
+			for name, expr := range def.Labels {
+				if rule.labels[sanitizeMetricName(name)], err = compileJSONPath(expr); err != nil {
+					return nil, fmt.Errorf("invalid label %s for %s: %v", name, category, err)
+				}
+			}
+			for name, expr := range def.Metrics {
+				if rule.metrics[name], err = compileJSONPath(expr); err != nil {
+					return nil, fmt.Errorf("invalid metric %s for %s: %v", name, category, err)
+				}
+			}
+			rules[category] = append(rules[category], rule)
+		}
+	}
+	return rules, nil
+}
+
+// Apply the rules of a category to a response body. Without configured
+// metrics every number in the selected object becomes a metric.
+func extractData(MetricsCategory string, rules []*ExtractionRule, body []byte) ([]labeledData, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	var series []labeledData
+	for _, rule := range rules {
+		for _, selected := range rule.path.Select(doc) {
+			labels := prometheus.Labels{}
+			for name, path := range rule.labels {
+				if values := path.Select(selected); len(values) > 0 {
+					labels[name] = labelValue(values[0])
+				}
+			}
+
+			values := make(map[string]float64)
+			if len(rule.metrics) == 0 {
+				flattenNumbers("", selected, values)
+			}
+			for name, path := range rule.metrics {
+				matches := path.Select(selected)
+				if len(matches) == 0 {
+					continue
+				}
+				value, ok := numberValue(matches[0])
+				if !ok {
+					recordParseFailure(MetricsCategory, name, fmt.Sprint(matches[0]), fmt.Errorf("not a number"))
+					continue
+				}
+				values[name] = value
+			}
+
+			if len(values) > 0 {
+				series = append(series, labeledData{Labels: labels, Data: map[string]map[string]float64{MetricsCategory: values}})
+			}
+		}
+	}
+	return series, nil
+}
+
+// Collect the numbers below value, naming them by their joined field names
+func flattenNumbers(prefix string, value interface{}, values map[string]float64) {
+	switch v := value.(type) {
+	case float64:
+		if prefix != "" {
+			values[prefix] = v
+		}
+	case map[string]interface{}:
+		for key, nested := range v {
+			name := key
+			if prefix != "" {
+				name = prefix + "_" + key
+			}
+			flattenNumbers(name, nested, values)
+		}
+	}
+}
+
+func labelValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// Numbers may also be sent as numeric strings
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	defaultFederationLabel = "exporter"
+	defaultFederationPath  = "/metrics"
+)
+
+var federationUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cnaasprom_federation_up",
+	Help: "Whether the metrics of a federated cnaasprom instance were fetched in the last scrape",
+}, []string{"exporter"})
+
+func init() {
+	registerInternal(federationUp)
+}
+
+// federation fetches the metrics of the downstream cnaasprom instances
+type federation struct {
+	instances []*federatedInstance
+}
+
+type federatedInstance struct {
+	target *scrapeTarget
+	url    string
+	// Label pairs added to every metric of the instance, sorted by name
+	labels []*dto.LabelPair
+}
+
+func newFederation(cfg config.FederationConfig, options clientOptions) (*federation, error) {
+	if len(cfg.Instances) == 0 {
+		return nil, nil
+	}
+	label := cfg.Label
+	if label == "" {
+		label = defaultFederationLabel
+	}
+	if !model.LabelName(label).IsValid() {
+		return nil, fmt.Errorf("invalid federation label %q", label)
+	}
+
+	f := &federation{}
+	seen := make(map[string]bool)
+	for _, def := range cfg.Instances {
+		if def.Name == "" || def.Address == "" {
+			return nil, fmt.Errorf("federated instances need a name and an address")
+		}
+		if seen[def.Name] {
+			return nil, fmt.Errorf("duplicate federated instance %s", def.Name)
+		}
+		seen[def.Name] = true
+
+		server := config.RemoteServer{Address: def.Address, Port: def.Port}
+		target, err := newScrapeTarget(def.Name, server, def.Settings, nil, options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid federated instance %s: %v", def.Name, err)
+		}
+		path := def.Path
+		if path == "" {
+			path = defaultFederationPath
+		}
+
+		labels := []*dto.LabelPair{{Name: &label, Value: &def.Name}}
+		for name, value := range def.Labels {
+			if !model.LabelName(name).IsValid() || name == label {
+				return nil, fmt.Errorf("invalid label %q of federated instance %s", name, def.Name)
+			}
+			labels = append(labels, &dto.LabelPair{Name: &name, Value: &value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+		f.instances = append(f.instances, &federatedInstance{
+			target: target,
+			url:    fmt.Sprintf("%s://%s%s", target.module.Scheme, config.JoinHostPort(def.Address, def.Port), path),
+			labels: labels,
+		})
+	}
+	return f, nil
+}
+
+// Fetch every instance at once and return a gatherer serving their metrics
+// along with those of local. Instances that fail are left out.
+func (f *federation) merge(ctx context.Context, local prometheus.Gatherer) prometheus.Gatherer {
+	if f == nil {
+		return local
+	}
+
+	fetched := make([][]*dto.MetricFamily, len(f.instances))
+	var wg sync.WaitGroup
+	for i, instance := range f.instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families, err := instance.fetch(ctx)
+			if err != nil {
+				log.Printf("Error fetching federated instance %s from %s: %v", instance.target.name, instance.url, err)
+				federationUp.WithLabelValues(instance.target.name).Set(0)
+				return
+			}
+			federationUp.WithLabelValues(instance.target.name).Set(1)
+			fetched[i] = families
+		}()
+	}
+	wg.Wait()
+	return federatedGatherer{local: local, fetched: fetched}
+}
+
+// Fetch the metrics of an instance and add its labels. Labels the instance
+// already uses are renamed to exported_<name>, as Prometheus does.
+func (i *federatedInstance) fetch(ctx context.Context) ([]*dto.MetricFamily, error) {
+	headers := requestHeaders(i.target.server, map[string]config.Secret{"Accept": config.Secret(expfmt.NewFormat(expfmt.TypeTextPlain))})
+	body, release, err := fetchBody(ctx, i.target.client, i.url, upstreamRequest{headers: headers})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metrics: %v", err)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, family := range parsed {
+		for _, metric := range family.Metric {
+			metric.Label = i.relabel(metric.Label)
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+func (i *federatedInstance) relabel(pairs []*dto.LabelPair) []*dto.LabelPair {
+	labels := make([]*dto.LabelPair, 0, len(pairs)+len(i.labels))
+	for _, pair := range pairs {
+		for _, added := range i.labels {
+			if pair.GetName() == added.GetName() {
+				exported := "exported_" + pair.GetName()
+				pair = &dto.LabelPair{Name: &exported, Value: pair.Value}
+				break
+			}
+		}
+		labels = append(labels, pair)
+	}
+	labels = append(labels, i.labels...)
+	sort.Slice(labels, func(a, b int) bool { return labels[a].GetName() < labels[b].GetName() })
+	return labels
+}
+
+// federatedGatherer merges the metrics of the instances into the local
+// families of the same name. A family whose type differs from the one
+// already gathered is left out.
+type federatedGatherer struct {
+	local   prometheus.Gatherer
+	fetched [][]*dto.MetricFamily
+}
+
+func (g federatedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.local.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	for _, instance := range g.fetched {
+		for _, family := range instance {
+			existing, ok := byName[family.GetName()]
+			if !ok {
+				byName[family.GetName()] = family
+				families = append(families, family)
+				continue
+			}
+			if existing.GetType() != family.GetType() {
+				log.Printf("Skipping federated metric %s of type %s, already gathered as %s", family.GetName(), family.GetType(), existing.GetType())
+				continue
+			}
+			existing.Metric = append(existing.Metric, family.Metric...)
+		}
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, nil
+}
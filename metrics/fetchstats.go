@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Histograms of the upstream fetches by server, category and result, to
+// plan the capacity of the upstream APIs and see payloads grow before
+// scrapes time out. They are native histograms, with classic exponential
+// buckets for Prometheus servers that don't scrape native histograms. The
+// server is the configured one and the category is empty for federation and
+// network function metrics endpoints. The result is success, error, timeout
+// for fetches the scrape gave up, or incomplete for bodies closed before
+// their end; sizes are those of the bodies read, up to where they were closed.
+var (
+	upstreamResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:                            "cnaasprom_upstream_response_size_bytes",
+		Help:                            "Size of upstream response bodies after decompression",
+		Buckets:                         prometheus.ExponentialBuckets(1<<10, 4, 10),
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  100,
+		NativeHistogramMinResetDuration: time.Hour,
+	}, []string{"server", "category", "result"})
+	upstreamFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:                            "cnaasprom_upstream_fetch_duration_seconds",
+		Help:                            "Time from sending an upstream request until its response body was read, it failed or was given up",
+		Buckets:                         prometheus.ExponentialBuckets(0.005, 2, 14),
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  100,
+		NativeHistogramMinResetDuration: time.Hour,
+	}, []string{"server", "category", "result"})
+)
+
+// Results of upstream fetches
+const (
+	fetchSucceeded  = "success"
+	fetchFailed     = "error"
+	fetchTimedOut   = "timeout"
+	fetchIncomplete = "incomplete"
+)
+
+func init() {
+	registerInternal(upstreamResponseSize, upstreamFetchDuration)
+}
+
+// Result of a fetch failing with err
+func fetchResult(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fetchTimedOut
+	}
+	return fetchFailed
+}
+
+// Observe a fetch that failed before its body could be read. Requests
+// refused before reaching the server aren't fetches.
+func observeFailedFetch(server string, category string, start time.Time, err error) {
+	if errors.Is(err, errThrottled) || errors.Is(err, errCircuitOpen) {
+		return
+	}
+	upstreamFetchDuration.WithLabelValues(server, category, fetchResult(err)).Observe(time.Since(start).Seconds())
+}
+
+// measuredBody observes the size and fetch duration of a response once its
+// body was read to the end, failed to be read or was closed
+type measuredBody struct {
+	io.ReadCloser
+	server   string
+	category string
+	start    time.Time
+	size     int64
+	result   string
+	observed bool
+}
+
+func newMeasuredBody(body io.ReadCloser, server string, category string, start time.Time) *measuredBody {
+	return &measuredBody{ReadCloser: body, server: server, category: category, start: start}
+}
+
+func (b *measuredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	switch {
+	case err == io.EOF:
+		b.observe(fetchSucceeded)
+	case err != nil:
+		b.observe(fetchResult(err))
+	}
+	return n, err
+}
+
+func (b *measuredBody) Close() error {
+	b.observe(fetchIncomplete)
+	return b.ReadCloser.Close()
+}
+
+func (b *measuredBody) observe(result string) {
+	if b.observed {
+		return
+	}
+	b.observed = true
+	upstreamResponseSize.WithLabelValues(b.server, b.category, result).Observe(float64(b.size))
+	upstreamFetchDuration.WithLabelValues(b.server, b.category, result).Observe(time.Since(b.start).Seconds())
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func fetchDurationCount(t *testing.T, server, category, result string) uint64 {
+	t.Helper()
+	var metric dto.Metric
+	if err := upstreamFetchDuration.WithLabelValues(server, category, result).(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+// Every fetch is observed under the configured server with its result
+func TestFetchStats(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			<-r.Context().Done()
+		default:
+			io.WriteString(w, strings.Repeat(`{"amf": {"attempts": 1}}`, 1000))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	server := "localhost:" + port
+	client, err := newHTTPClient(config.RemoteServer{Address: "localhost", Port: uint(p)}, newClientOptions(&config.Config{}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(ctx context.Context, path string, read bool) {
+		body, err := openBody(ctx, client, upstream.URL+path, upstreamRequest{category: "amf"})
+		if err != nil {
+			return
+		}
+		if read {
+			io.ReadAll(body)
+		} else {
+			body.Read(make([]byte, 10))
+		}
+		body.Close()
+	}
+
+	fetch(context.Background(), "/", true)
+	fetch(context.Background(), "/", false)
+	fetch(context.Background(), "/fail", true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	fetch(ctx, "/slow", true)
+
+	for _, result := range []string{fetchSucceeded, fetchIncomplete, fetchFailed, fetchTimedOut} {
+		if n := fetchDurationCount(t, server, "amf", result); n != 1 {
+			t.Errorf("%d fetches observed with result %s, want 1", n, result)
+		}
+	}
+}
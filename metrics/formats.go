@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// csvParser reads a CSV document with a header row. Label columns become
+// labels, the other columns metrics named after their header; cells that
+// are not numbers are skipped.
+type csvParser struct {
+	labels    map[string]string
+	delimiter rune
+}
+
+func newCSVParser(cfg config.FormatConfig) (Parser, error) {
+	p := &csvParser{labels: make(map[string]string, len(cfg.LabelColumns)), delimiter: ','}
+	if cfg.Delimiter != "" {
+		delimiter, size := utf8.DecodeRuneInString(cfg.Delimiter)
+		if size != len(cfg.Delimiter) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' {
+			return nil, fmt.Errorf("invalid csv delimiter %q", cfg.Delimiter)
+		}
+		p.delimiter = delimiter
+	}
+	for column, label := range cfg.LabelColumns {
+		if label == "" {
+			label = column
+		}
+		p.labels[column] = sanitizeMetricName(label)
+	}
+	return p, nil
+}
+
+func (p *csvParser) Parse(data []byte) ([]Sample, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = p.delimiter
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %v", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var samples []Sample
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv: %v", err)
+		}
+
+		labels := make(map[string]string)
+		for i, column := range header {
+			if label, ok := p.labels[column]; ok {
+				labels[label] = record[i]
+			}
+		}
+		for i, column := range header {
+			if _, ok := p.labels[column]; ok {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+			if err != nil {
+				continue
+			}
+			samples = append(samples, Sample{Name: column, Labels: labels, Value: value})
+		}
+	}
+}
+
+// prometheusParser reads the Prometheus text exposition format. Histograms
+// are exported as histograms again; summaries are split into their
+// quantile, _sum and _count series.
+type prometheusParser struct{}
+
+func newPrometheusParser(config.FormatConfig) (Parser, error) {
+	return prometheusParser{}, nil
+}
+
+func (prometheusParser) Parse(data []byte) ([]Sample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+
+			switch {
+			case metric.Histogram != nil:
+				histogram := &SampleHistogram{Count: metric.Histogram.GetSampleCount(), Sum: metric.Histogram.GetSampleSum()}
+				for _, bucket := range metric.Histogram.GetBucket() {
+					histogram.Buckets = append(histogram.Buckets, HistogramBucket{UpperBound: bucket.GetUpperBound(), Count: bucket.GetCumulativeCount()})
+				}
+				samples = append(samples, Sample{Name: name, Labels: labels, Histogram: histogram})
+			case metric.Summary != nil:
+				for _, quantile := range metric.Summary.GetQuantile() {
+					q := strconv.FormatFloat(quantile.GetQuantile(), 'g', -1, 64)
+					samples = append(samples, Sample{Name: name, Labels: withLabel(labels, "quantile", q), Value: quantile.GetValue()})
+				}
+				samples = append(samples,
+					Sample{Name: name + "_sum", Labels: labels, Value: metric.Summary.GetSampleSum()},
+					Sample{Name: name + "_count", Labels: labels, Value: float64(metric.Summary.GetSampleCount())},
+				)
+			default:
+				samples = append(samples, Sample{Name: name, Labels: labels, Value: metricValue(metric)})
+			}
+		}
+	}
+	return samples, nil
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	switch {
+	case metric.Counter != nil:
+		return metric.Counter.GetValue()
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue()
+	}
+	return metric.Untyped.GetValue()
+}
+
+func withLabel(labels map[string]string, name string, value string) map[string]string {
+	merged := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		merged[k] = v
+	}
+	merged[name] = value
+	return merged
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Histograms of Prometheus text responses are exported as histograms of the
+// category, next to the other samples
+func TestPrometheusFormatHistograms(t *testing.T) {
+	body := []byte(`# TYPE latency_seconds histogram
+latency_seconds_bucket{interface="n3",le="0.1"} 2
+latency_seconds_bucket{interface="n3",le="0.5"} 5
+latency_seconds_bucket{interface="n3",le="+Inf"} 6
+latency_seconds_sum{interface="n3"} 1.5
+latency_seconds_count{interface="n3"} 6
+# TYPE sessions gauge
+sessions{interface="n3"} 12
+`)
+	parser, _ := newPrometheusParser(config.FormatConfig{})
+	series, err := parseWithParser("upf", parser, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newTestExporter(t)
+	set := newSampleSet(nil, newMetricNamer(config.NamingConfig{}))
+	exporter.addCollection(set, &collection{labels: prometheus.Labels{"operator": "op1"}, series: series})
+	families, err := set.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	if family := byName["upf_sessions"]; family == nil || family.GetMetric()[0].GetGauge().GetValue() != 12 {
+		t.Errorf("upf_sessions = %v, want the gauge 12", family)
+	}
+	family := byName["upf_latency_seconds"]
+	if family == nil || family.GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("upf_latency_seconds = %v, want a histogram", family)
+	}
+	histogram := family.GetMetric()[0].GetHistogram()
+	buckets := histogram.GetBucket()
+	if histogram.GetSampleCount() != 6 || histogram.GetSampleSum() != 1.5 || len(buckets) != 2 ||
+		buckets[0].GetUpperBound() != 0.1 || buckets[0].GetCumulativeCount() != 2 || buckets[1].GetCumulativeCount() != 5 {
+		t.Errorf("histogram = %v, want count 6, sum 1.5 and the buckets 0.1 and 0.5", histogram)
+	}
+	for _, name := range []string{"upf_latency_seconds_bucket", "upf_latency_seconds_sum", "upf_latency_seconds_count"} {
+		if byName[name] != nil {
+			t.Errorf("histogram flattened into %s", name)
+		}
+	}
+	if labels := family.GetMetric()[0].GetLabel(); len(labels) != 2 {
+		t.Errorf("histogram labels = %v, want interface and operator", labels)
+	}
+}
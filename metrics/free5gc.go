@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+const (
+	// The free5GC WebConsole lists the UEs registered with the AMF, with
+	// their PDU sessions, on this path, port 5000 by default
+	free5gcUEContextPath = "/api/registered-ue-context"
+	free5gcDefaultPort   = 5000
+	free5gcCategory      = "free5gc"
+)
+
+type free5gcUEContext struct {
+	CmState     string `json:"CmState"`
+	PduSessions []struct {
+		Dnn string `json:"Dnn"`
+		Sst string `json:"Sst"`
+		Sd  string `json:"Sd"`
+	} `json:"PduSessions"`
+}
+
+// Fetch the registered UEs of a free5GC core from its WebConsole. They are
+// counted as free5gc_registered_ues per CM state and
+// free5gc_pdu_sessions per DNN and slice. WebConsoles that require a login
+// take its token from the Token header of the target.
+func (e *Exporter) fetchFree5GC(ctx context.Context, t *scrapeTarget, operator string) ([]labeledData, error) {
+	port := t.server.Port
+	if port == 0 {
+		port = free5gcDefaultPort
+	}
+	apiURL := fmt.Sprintf("%s://%s%s", t.module.Scheme, config.JoinHostPort(t.server.Address, port), free5gcUEContextPath)
+
+	body, release, err := fetchBody(ctx, t.client, apiURL, upstreamRequest{headers: requestHeaders(t.server, nil)})
+	var contexts []free5gcUEContext
+	if err == nil {
+		if err = json.Unmarshal(body, &contexts); err != nil {
+			err = fmt.Errorf("failed to parse JSON: %v", err)
+		}
+		release()
+	}
+	e.status.record(t, operator, free5gcCategory, apiURL, len(contexts), err)
+	if err != nil {
+		log.Printf("Error fetching data from %s: %v", apiURL, err)
+		return nil, err
+	}
+
+	ues := make(map[string]float64)
+	type slice struct{ dnn, sst, sd string }
+	sessions := make(map[slice]float64)
+	for _, ue := range contexts {
+		ues[ue.CmState]++
+		for _, session := range ue.PduSessions {
+			sessions[slice{session.Dnn, session.Sst, session.Sd}]++
+		}
+	}
+
+	var samples []Sample
+	for state, count := range ues {
+		samples = append(samples, Sample{Name: "registered_ues", Labels: map[string]string{"cm_state": state}, Value: count})
+	}
+	for s, count := range sessions {
+		samples = append(samples, Sample{Name: "pdu_sessions", Labels: map[string]string{"dnn": s.dnn, "sst": s.sst, "sd": s.sd}, Value: count})
+	}
+	return groupSamples(free5gcCategory, samples), nil
+}
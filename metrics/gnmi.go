@@ -0,0 +1,396 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	protov1 "github.com/golang/protobuf/proto"
+	gnmipb "github.com/openconfig/gnmi/proto/gnmi"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	defaultGNMIReconnectInterval = 30 * time.Second
+	defaultGNMISampleInterval    = 10 * time.Second
+	gnmiDialTimeout              = 10 * time.Second
+)
+
+// GNMICollector subscribes to telemetry paths on network devices over gNMI
+// and keeps the latest value of every streamed leaf. Leaves are exported as
+// gnmi_<path> with the path keys as labels and a target label naming the
+// device; deleted paths and the values of dropped subscriptions disappear.
+type GNMICollector struct {
+	request   *gnmipb.SubscribeRequest
+	reconnect time.Duration
+	maxSize   int64
+	targets   []*gnmiTarget
+}
+
+type gnmiTarget struct {
+	name        string
+	address     string
+	username    string
+	password    string
+	labels      prometheus.Labels
+	credentials credentials.TransportCredentials
+
+	mu     sync.Mutex
+	leaves map[string]gnmiLeaf
+}
+
+// A streamed leaf, keyed by its path
+type gnmiLeaf struct {
+	path   string
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+func NewGNMICollector(cfg config.GNMIConfig, maxSize int64, policy config.TLSPolicy, spiffe *spiffeSources) (*GNMICollector, error) {
+	encoding := cfg.Encoding
+	if encoding == "" {
+		encoding = "json_ietf"
+	}
+	encodingValue, ok := gnmiEncodings[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported gnmi encoding: %s", encoding)
+	}
+
+	if len(cfg.Subscriptions) == 0 {
+		return nil, fmt.Errorf("no gnmi subscriptions configured")
+	}
+	list := &gnmipb.SubscriptionList{Mode: gnmipb.SubscriptionList_STREAM, Encoding: encodingValue}
+	for _, def := range cfg.Subscriptions {
+		subscription, err := newGNMISubscription(def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gnmi subscription %s: %v", def.Path, err)
+		}
+		list.Subscription = append(list.Subscription, subscription)
+	}
+
+	c := &GNMICollector{
+		request:   &gnmipb.SubscribeRequest{Request: &gnmipb.SubscribeRequest_Subscribe{Subscribe: list}},
+		reconnect: cfg.ReconnectInterval,
+		maxSize:   maxSize,
+	}
+	if c.reconnect <= 0 {
+		c.reconnect = defaultGNMIReconnectInterval
+	}
+	for _, def := range cfg.Targets {
+		target, err := newGNMITarget(def, policy, spiffe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gnmi target %s: %v", def.Name, err)
+		}
+		c.targets = append(c.targets, target)
+	}
+	return c, nil
+}
+
+func newGNMISubscription(def config.GNMISubscription) (*gnmipb.Subscription, error) {
+	path, err := parseGNMIPath(def.Path)
+	if err != nil {
+		return nil, err
+	}
+	modeName := def.Mode
+	if modeName == "" {
+		modeName = "sample"
+	}
+	mode, ok := gnmiSubscriptionModes[modeName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported mode: %s", def.Mode)
+	}
+	interval := def.SampleInterval
+	if modeName == "sample" && interval <= 0 {
+		interval = defaultGNMISampleInterval
+	}
+	return &gnmipb.Subscription{
+		Path:              path.proto(),
+		Mode:              mode,
+		SampleInterval:    uint64(interval.Nanoseconds()),
+		HeartbeatInterval: uint64(def.HeartbeatInterval.Nanoseconds()),
+	}, nil
+}
+
+func newGNMITarget(def config.GNMITarget, policy config.TLSPolicy, spiffe *spiffeSources) (*gnmiTarget, error) {
+	if def.Name == "" || def.Address == "" {
+		return nil, fmt.Errorf("a name and address are required")
+	}
+	address := def.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = config.JoinHostPort(address, 57400)
+	}
+
+	// Without TLS the connection speaks HTTP/2 in cleartext (h2c)
+	transportCredentials := insecure.NewCredentials()
+	if def.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(def.TLS, policy, spiffe)
+		if err != nil {
+			return nil, err
+		}
+		transportCredentials = credentials.NewTLS(tlsConfig)
+	}
+
+	labels := prometheus.Labels{"target": def.Name}
+	for name, value := range def.Labels {
+		labels[sanitizeMetricName(name)] = value
+	}
+	return &gnmiTarget{
+		name:        def.Name,
+		address:     address,
+		username:    def.Username,
+		password:    string(def.Password),
+		labels:      labels,
+		credentials: transportCredentials,
+		leaves:      make(map[string]gnmiLeaf),
+	}, nil
+}
+
+// Run keeps a subscription open to every target until the context is cancelled
+func (c *GNMICollector) Run(ctx context.Context) {
+	for _, t := range c.targets {
+		go c.runTarget(ctx, t)
+	}
+	<-ctx.Done()
+}
+
+// Keep a subscription open to a target until the context is cancelled.
+// The connection is closed when the collector stops running, e.g. when
+// this replica loses the leadership.
+func (c *GNMICollector) runTarget(ctx context.Context, t *gnmiTarget) {
+	conn, err := grpc.NewClient(t.address,
+		grpc.WithTransportCredentials(t.credentials),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 15 * time.Second}),
+		grpc.WithConnectParams(grpc.ConnectParams{MinConnectTimeout: gnmiDialTimeout}),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(int(c.maxSize))),
+	)
+	if err != nil {
+		log.Printf("Invalid gNMI target %s: %v", t.name, err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		err := c.subscribe(ctx, gnmipb.NewGNMIClient(conn), t)
+		t.reset()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("gNMI subscription to %s dropped: %v, reconnecting in %s", t.name, err, c.reconnect)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.reconnect):
+		}
+	}
+}
+
+// Subscribe to a target, blocking while the stream is open. The sending
+// side stays open as closing it would end a streaming subscription.
+func (c *GNMICollector) subscribe(ctx context.Context, client gnmipb.GNMIClient, t *gnmiTarget) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if t.username != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "username", t.username, "password", t.password)
+	}
+
+	stream, err := client.Subscribe(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", t.address, err)
+	}
+	// Targets are subscribed concurrently, each with its own copy as
+	// marshalling the request caches its size in it
+	if err := stream.Send(protov1.Clone(c.request).(*gnmipb.SubscribeRequest)); err != nil {
+		// The status of the stream tells why it failed
+		if _, recvErr := stream.Recv(); recvErr != nil && !errors.Is(recvErr, io.EOF) {
+			err = recvErr
+		}
+		return fmt.Errorf("failed to subscribe: %v", err)
+	}
+
+	log.Printf("Subscribed to gNMI target %s", t.name)
+	for {
+		response, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("stream closed by target")
+		}
+		if err != nil {
+			return err
+		}
+
+		switch r := response.Response.(type) {
+		case *gnmipb.SubscribeResponse_Update:
+			t.apply(r.Update)
+		case *gnmipb.SubscribeResponse_SyncResponse:
+			if r.SyncResponse {
+				log.Printf("Initial gNMI sync of %s complete", t.name)
+			}
+		case *gnmipb.SubscribeResponse_Error:
+			return fmt.Errorf("subscription error: %s", r.Error.GetMessage())
+		}
+	}
+}
+
+// Apply the deletes and updates of a notification to the leaves of the target
+func (t *gnmiTarget) apply(n *gnmipb.Notification) {
+	if n == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	notificationPrefix := gnmiPathOf(n.Prefix)
+	for _, deleted := range n.Delete {
+		prefix := notificationPrefix.join(gnmiPathOf(deleted)).String()
+		for key, leaf := range t.leaves {
+			if leaf.path == prefix || strings.HasPrefix(leaf.path, prefix+"/") {
+				delete(t.leaves, key)
+			}
+		}
+	}
+
+	for _, update := range n.Update {
+		value, ok := gnmiValueOf(update.Val)
+		if !ok {
+			continue
+		}
+		path := notificationPrefix.join(gnmiPathOf(update.Path))
+		name, labels := gnmiMetric(path)
+		switch {
+		case value.isNumber:
+			t.set(path.String(), name, labels, value.number)
+		case value.json != nil:
+			decoder := json.NewDecoder(bytes.NewReader(value.json))
+			decoder.UseNumber()
+			var decoded interface{}
+			if err := decoder.Decode(&decoded); err != nil {
+				log.Printf("Invalid JSON value from gNMI target %s at %s: %v", t.name, path, err)
+				continue
+			}
+			t.setJSON(path.String(), name, labels, decoded)
+		default:
+			if number, ok := xmlNumber(strings.TrimSpace(value.text)); ok {
+				t.set(path.String(), name, labels, number)
+			}
+		}
+	}
+}
+
+func (t *gnmiTarget) set(path string, name string, labels map[string]string, value float64) {
+	t.leaves[path] = gnmiLeaf{path: path, name: name, labels: labels, value: value}
+}
+
+// Every numeric leaf of a JSON value, named by its path below the update.
+// Lists are skipped; subscribe to their entries to export them.
+func (t *gnmiTarget) setJSON(path string, name string, labels map[string]string, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			t.setJSON(path+"/"+key, name+"_"+gnmiName(key), labels, child)
+		}
+	case json.Number:
+		if number, err := v.Float64(); err == nil {
+			t.set(path, name, labels, number)
+		}
+	case string:
+		// JSON_IETF encodes 64-bit integers as strings
+		if number, ok := xmlNumber(v); ok {
+			t.set(path, name, labels, number)
+		}
+	case bool:
+		if v {
+			t.set(path, name, labels, 1)
+		} else {
+			t.set(path, name, labels, 0)
+		}
+	}
+}
+
+// Drop the values of a closed subscription; they are streamed again on
+// reconnect
+func (t *gnmiTarget) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leaves = make(map[string]gnmiLeaf)
+}
+
+func (t *gnmiTarget) samples() []Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples := make([]Sample, 0, len(t.leaves))
+	for _, leaf := range t.leaves {
+		samples = append(samples, Sample{Name: leaf.name, Labels: leaf.labels, Value: leaf.value})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+	return samples
+}
+
+// The metric name of a path joins its element names; the keys of its
+// elements become labels, prefixed with the element name when a key name
+// repeats
+func gnmiMetric(path gnmiPath) (string, map[string]string) {
+	names := make([]string, 0, len(path.elems))
+	labels := make(map[string]string)
+	for _, elem := range path.elems {
+		name := gnmiName(elem.name)
+		names = append(names, name)
+		for key, value := range elem.keys {
+			label := sanitizeMetricName(gnmiName(key))
+			if _, ok := labels[label]; ok {
+				label = sanitizeMetricName(name + "_" + gnmiName(key))
+			}
+			labels[label] = value
+		}
+	}
+	return sanitizeMetricName(strings.Join(names, "_")), labels
+}
+
+// Strip the YANG module prefix of a name, as in openconfig-interfaces:interfaces
+func gnmiName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// Collections of the gNMI targets, labelled with the target name
+func (e *Exporter) collectGNMI() []*collection {
+	if e.gnmi == nil {
+		return nil
+	}
+
+	var collections []*collection
+	for _, t := range e.gnmi.targets {
+		samples := t.samples()
+		if len(samples) == 0 {
+			continue
+		}
+		c := e.newCollection("gnmi/"+t.name, t.labels, map[string]map[string]float64{})
+		c.target = t.name
+		c.series = groupSamples("gnmi", samples)
+		collections = append(collections, c)
+	}
+	return collections
+}
+
+// GNMI returns the gNMI collector to run, nil without gNMI targets
+func (e *Exporter) GNMI() *GNMICollector {
+	return e.gnmi
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	protov1 "github.com/golang/protobuf/proto"
+	gnmipb "github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gNMI target passing the subscription it receives to the test and
+// streaming the responses the test hands it
+type fakeGNMI struct {
+	subscriptions chan *gnmipb.SubscribeRequest
+	metadata      chan metadata.MD
+	responses     chan *gnmipb.SubscribeResponse
+}
+
+func (f *fakeGNMI) Capabilities(context.Context, *gnmipb.CapabilityRequest) (*gnmipb.CapabilityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+func (f *fakeGNMI) Get(context.Context, *gnmipb.GetRequest) (*gnmipb.GetResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+func (f *fakeGNMI) Set(context.Context, *gnmipb.SetRequest) (*gnmipb.SetResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+func (f *fakeGNMI) Subscribe(stream gnmipb.GNMI_SubscribeServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	f.metadata <- md
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	f.subscriptions <- request
+	for {
+		select {
+		case response := <-f.responses:
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func startGNMITarget(t *testing.T) (*fakeGNMI, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &fakeGNMI{
+		subscriptions: make(chan *gnmipb.SubscribeRequest, 1),
+		metadata:      make(chan metadata.MD, 1),
+		responses:     make(chan *gnmipb.SubscribeResponse),
+	}
+	server := grpc.NewServer()
+	gnmipb.RegisterGNMIServer(server, target)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return target, listener.Addr().String()
+}
+
+func gnmiTestPath(t *testing.T, s string) *gnmipb.Path {
+	t.Helper()
+	path, err := parseGNMIPath(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path.proto()
+}
+
+// Wait until the target holds the given number of leaves and return them
+// by path
+func waitForLeaves(t *testing.T, target *gnmiTarget, n int) map[string]gnmiLeaf {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		target.mu.Lock()
+		leaves := make(map[string]gnmiLeaf, len(target.leaves))
+		for path, leaf := range target.leaves {
+			leaves[path] = leaf
+		}
+		target.mu.Unlock()
+		if len(leaves) == n {
+			return leaves
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leaves = %v, want %d", leaves, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGNMISubscription(t *testing.T) {
+	fake, address := startGNMITarget(t)
+	collector, err := NewGNMICollector(config.GNMIConfig{
+		Subscriptions: []config.GNMISubscription{{Path: "/interfaces/interface[name=*]/state/counters", SampleInterval: time.Second}},
+		Targets:       []config.GNMITarget{{Name: "sw1", Address: address, Username: "monitor", Password: "s3cret"}},
+	}, 1<<20, config.TLSPolicy{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go collector.Run(ctx)
+
+	md := <-fake.metadata
+	if got := md.Get("username"); len(got) != 1 || got[0] != "monitor" || md.Get("password")[0] != "s3cret" {
+		t.Errorf("metadata = %v, want the credentials", md)
+	}
+	list := (<-fake.subscriptions).GetSubscribe()
+	if list.GetMode() != gnmipb.SubscriptionList_STREAM || list.GetEncoding() != gnmipb.Encoding_JSON_IETF || len(list.GetSubscription()) != 1 {
+		t.Fatalf("subscription list = %v", list)
+	}
+	subscription := list.GetSubscription()[0]
+	if got := gnmiPathOf(subscription.GetPath()).String(); got != "/interfaces/interface[name=*]/state/counters" {
+		t.Errorf("subscribed path = %s", got)
+	}
+	if subscription.GetMode() != gnmipb.SubscriptionMode_SAMPLE || subscription.GetSampleInterval() != uint64(time.Second) {
+		t.Errorf("subscription = %v, want sampled every second", subscription)
+	}
+
+	// double_val is newer than the generated code and arrives as an
+	// unknown field
+	double := &gnmipb.TypedValue{}
+	rate := protowire.AppendTag(nil, 14, protowire.Fixed64Type)
+	rate = protowire.AppendFixed64(rate, math.Float64bits(1.5))
+	protov1.MessageReflect(double).SetUnknown(rate)
+
+	fake.responses <- &gnmipb.SubscribeResponse{Response: &gnmipb.SubscribeResponse_Update{Update: &gnmipb.Notification{
+		Prefix: gnmiTestPath(t, "/interfaces/interface[name=eth0]/state/counters"),
+		Update: []*gnmipb.Update{
+			{Path: gnmiTestPath(t, "in-octets"), Val: &gnmipb.TypedValue{Value: &gnmipb.TypedValue_UintVal{UintVal: 42}}},
+			{Path: gnmiTestPath(t, "errors"), Val: &gnmipb.TypedValue{Value: &gnmipb.TypedValue_JsonIetfVal{JsonIetfVal: []byte(`{"in-errors": "3", "up": true}`)}}},
+			{Path: gnmiTestPath(t, "rate"), Val: double},
+			{Path: gnmiTestPath(t, "description"), Val: &gnmipb.TypedValue{Value: &gnmipb.TypedValue_StringVal{StringVal: "uplink"}}},
+		},
+	}}}
+	fake.responses <- &gnmipb.SubscribeResponse{Response: &gnmipb.SubscribeResponse_SyncResponse{SyncResponse: true}}
+
+	target := collector.targets[0]
+	leaves := waitForLeaves(t, target, 4)
+	for path, want := range map[string]float64{
+		"/interfaces/interface[name=eth0]/state/counters/in-octets":        42,
+		"/interfaces/interface[name=eth0]/state/counters/errors/in-errors": 3,
+		"/interfaces/interface[name=eth0]/state/counters/errors/up":        1,
+		"/interfaces/interface[name=eth0]/state/counters/rate":             1.5,
+	} {
+		leaf, ok := leaves[path]
+		if !ok || leaf.value != want || leaf.labels["name"] != "eth0" {
+			t.Errorf("leaf %s = %+v, want %v labelled name=eth0", path, leaf, want)
+		}
+	}
+	if leaf := leaves["/interfaces/interface[name=eth0]/state/counters/in-octets"]; leaf.name != "interfaces_interface_state_counters_in_octets" {
+		t.Errorf("metric name = %s", leaf.name)
+	}
+
+	fake.responses <- &gnmipb.SubscribeResponse{Response: &gnmipb.SubscribeResponse_Update{Update: &gnmipb.Notification{
+		Prefix: gnmiTestPath(t, "/interfaces/interface[name=eth0]/state/counters"),
+		Delete: []*gnmipb.Path{gnmiTestPath(t, "errors")},
+	}}}
+	waitForLeaves(t, target, 2)
+
+	// Errors of the target end the subscription and drop its values
+	fake.responses <- &gnmipb.SubscribeResponse{Response: &gnmipb.SubscribeResponse_Error{Error: &gnmipb.Error{Message: "overloaded"}}}
+	waitForLeaves(t, target, 0)
+}
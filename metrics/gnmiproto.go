@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	protov1 "github.com/golang/protobuf/proto"
+	gnmipb "github.com/openconfig/gnmi/proto/gnmi"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Subscription modes and encodings of gnmi.proto
+var (
+	gnmiSubscriptionModes = map[string]gnmipb.SubscriptionMode{
+		"target_defined": gnmipb.SubscriptionMode_TARGET_DEFINED,
+		"on_change":      gnmipb.SubscriptionMode_ON_CHANGE,
+		"sample":         gnmipb.SubscriptionMode_SAMPLE,
+	}
+	gnmiEncodings = map[string]gnmipb.Encoding{
+		"json":      gnmipb.Encoding_JSON,
+		"bytes":     gnmipb.Encoding_BYTES,
+		"proto":     gnmipb.Encoding_PROTO,
+		"ascii":     gnmipb.Encoding_ASCII,
+		"json_ietf": gnmipb.Encoding_JSON_IETF,
+	}
+)
+
+// gnmiPathElem is an element of a gNMI path with its keys, such as
+// interface[name=Ethernet1]
+type gnmiPathElem struct {
+	name string
+	keys map[string]string
+}
+
+type gnmiPath struct {
+	origin string
+	elems  []gnmiPathElem
+}
+
+// Parse a path such as /interfaces/interface[name=Ethernet1]/state;
+// brackets may hold slashes
+func parseGNMIPath(s string) (gnmiPath, error) {
+	var path gnmiPath
+	if i := strings.Index(s, ":/"); i > 0 && !strings.ContainsAny(s[:i], "/[") {
+		path.origin, s = s[:i], s[i+1:]
+	}
+	s = strings.TrimPrefix(s, "/")
+	for s != "" {
+		end := 0
+		for depth := 0; end < len(s) && (depth > 0 || s[end] != '/'); end++ {
+			switch s[end] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+		}
+		elem, err := parseGNMIPathElem(s[:end])
+		if err != nil {
+			return gnmiPath{}, err
+		}
+		path.elems = append(path.elems, elem)
+		s = strings.TrimPrefix(s[end:], "/")
+	}
+	return path, nil
+}
+
+func parseGNMIPathElem(s string) (gnmiPathElem, error) {
+	name, keys, _ := strings.Cut(s, "[")
+	if name == "" {
+		return gnmiPathElem{}, fmt.Errorf("invalid path element %q", s)
+	}
+	elem := gnmiPathElem{name: name}
+	for keys != "" {
+		pair, rest, ok := strings.Cut(keys, "]")
+		key, value, found := strings.Cut(pair, "=")
+		if !ok || !found || key == "" {
+			return gnmiPathElem{}, fmt.Errorf("invalid path element %q", s)
+		}
+		if elem.keys == nil {
+			elem.keys = make(map[string]string)
+		}
+		elem.keys[key] = value
+		keys = strings.TrimPrefix(rest, "[")
+	}
+	return elem, nil
+}
+
+func (p gnmiPath) String() string {
+	var b strings.Builder
+	for _, elem := range p.elems {
+		b.WriteString("/" + elem.name)
+		keys := make([]string, 0, len(elem.keys))
+		for key := range elem.keys {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.WriteString("[" + key + "=" + elem.keys[key] + "]")
+		}
+	}
+	return b.String()
+}
+
+func (p gnmiPath) join(other gnmiPath) gnmiPath {
+	elems := make([]gnmiPathElem, 0, len(p.elems)+len(other.elems))
+	return gnmiPath{origin: p.origin, elems: append(append(elems, p.elems...), other.elems...)}
+}
+
+func (p gnmiPath) proto() *gnmipb.Path {
+	path := &gnmipb.Path{Origin: p.origin}
+	for _, elem := range p.elems {
+		path.Elem = append(path.Elem, &gnmipb.PathElem{Name: elem.name, Key: elem.keys})
+	}
+	return path
+}
+
+// The path of a notification; targets still sending the deprecated string
+// elements get them as elements without keys
+func gnmiPathOf(path *gnmipb.Path) gnmiPath {
+	if path == nil {
+		return gnmiPath{}
+	}
+	p := gnmiPath{origin: path.Origin}
+	for _, name := range path.Element {
+		p.elems = append(p.elems, gnmiPathElem{name: name})
+	}
+	for _, elem := range path.Elem {
+		p.elems = append(p.elems, gnmiPathElem{name: elem.Name, keys: elem.Key})
+	}
+	return p
+}
+
+// The value of a TypedValue. Numbers are returned as is, JSON values as
+// raw JSON and strings as text for the caller to interpret.
+type gnmiValue struct {
+	number   float64
+	isNumber bool
+	json     []byte
+	text     string
+}
+
+func gnmiValueOf(v *gnmipb.TypedValue) (gnmiValue, bool) {
+	if v == nil {
+		return gnmiValue{}, false
+	}
+	switch value := v.Value.(type) {
+	case *gnmipb.TypedValue_StringVal:
+		return gnmiValue{text: value.StringVal}, true
+	case *gnmipb.TypedValue_AsciiVal:
+		return gnmiValue{text: value.AsciiVal}, true
+	case *gnmipb.TypedValue_IntVal:
+		return gnmiValue{number: float64(value.IntVal), isNumber: true}, true
+	case *gnmipb.TypedValue_UintVal:
+		return gnmiValue{number: float64(value.UintVal), isNumber: true}, true
+	case *gnmipb.TypedValue_BoolVal:
+		if value.BoolVal {
+			return gnmiValue{number: 1, isNumber: true}, true
+		}
+		return gnmiValue{number: 0, isNumber: true}, true
+	case *gnmipb.TypedValue_FloatVal:
+		return gnmiValue{number: float64(value.FloatVal), isNumber: true}, true
+	case *gnmipb.TypedValue_DecimalVal:
+		if value.DecimalVal == nil {
+			return gnmiValue{}, false
+		}
+		number, err := strconv.ParseFloat(strconv.FormatInt(value.DecimalVal.Digits, 10)+"e-"+strconv.FormatUint(uint64(value.DecimalVal.Precision), 10), 64)
+		return gnmiValue{number: number, isNumber: true}, err == nil
+	case *gnmipb.TypedValue_JsonVal:
+		return gnmiValue{json: value.JsonVal}, true
+	case *gnmipb.TypedValue_JsonIetfVal:
+		return gnmiValue{json: value.JsonIetfVal}, true
+	case nil:
+		return gnmiDoubleValue(v)
+	}
+	return gnmiValue{}, false
+}
+
+// double_val (field 14) was added to TypedValue after the generated code
+// in use, so it is read from the unknown fields
+func gnmiDoubleValue(v *gnmipb.TypedValue) (gnmiValue, bool) {
+	b := protov1.MessageReflect(v).GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return gnmiValue{}, false
+		}
+		b = b[n:]
+		if num == 14 && typ == protowire.Fixed64Type {
+			bits, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return gnmiValue{}, false
+			}
+			return gnmiValue{number: math.Float64frombits(bits), isNumber: true}, true
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return gnmiValue{}, false
+		}
+		b = b[n:]
+	}
+	return gnmiValue{}, false
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistogramMapping reassembles bucketed upstream metrics such as
+// latency_lt_10ms, latency_lt_50ms into a single Prometheus histogram
+type HistogramMapping struct {
+	name       string
+	help       string
+	buckets    *regexp.Regexp
+	scale      float64
+	sum        string
+	count      string
+	cumulative bool
+}
+
+// ParseHistogramMappings compiles the configured histogram mappings
+func ParseHistogramMappings(defs []config.HistogramMapping) ([]*HistogramMapping, error) {
+	mappings := make([]*HistogramMapping, 0, len(defs))
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, fmt.Errorf("histogram with bucket pattern %q has no name", def.Buckets)
+		}
+		re, err := regexp.Compile("^(?:" + def.Buckets + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern for histogram %s: %v", def.Name, err)
+		}
+		if re.NumSubexp() != 1 {
+			return nil, fmt.Errorf("bucket pattern for histogram %s must have exactly one capture group for the upper bound", def.Name)
+		}
+
+		mapping := &HistogramMapping{
+			name:       def.Name,
+			help:       def.Help,
+			buckets:    re,
+			scale:      def.Scale,
+			sum:        def.Sum,
+			count:      def.Count,
+			cumulative: def.Cumulative,
+		}
+		if mapping.help == "" {
+			mapping.help = fmt.Sprintf("Histogram %s assembled from upstream buckets", def.Name)
+		}
+		if mapping.scale == 0 {
+			mapping.scale = 1
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// Build creates the histogram from the collected values. Values without a
+// matching bucket produce no histogram.
+func (h *HistogramMapping) Build(values map[string]float64, labels prometheus.Labels) (prometheus.Metric, error) {
+	type bucket struct {
+		upperBound float64
+		count      float64
+	}
+
+	var buckets []bucket
+	for name, value := range values {
+		match := h.buckets.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		bound, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bound in %s: %v", name, err)
+		}
+		buckets = append(buckets, bucket{upperBound: bound * h.scale, count: value})
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no buckets found")
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+
+	bucketCounts := make(map[float64]uint64, len(buckets))
+	var running float64
+	for _, b := range buckets {
+		if h.cumulative {
+			running = b.count
+		} else {
+			running += b.count
+		}
+		if !math.IsInf(b.upperBound, 1) {
+			bucketCounts[b.upperBound] = uint64(running)
+		}
+	}
+
+	count := running
+	if h.count != "" {
+		if value, ok := values[h.count]; ok {
+			count = value
+		}
+	}
+	sum := values[h.sum] * h.scale
+
+	return prometheus.NewConstHistogram(
+		prometheus.NewDesc(h.name, h.help, nil, labels),
+		uint64(count), sum, bucketCounts,
+	)
+}
+
+// Category of the bucket metrics, whose series limit the histogram counts
+// against
+func (h *HistogramMapping) category(data map[string]map[string]float64) string {
+	for category, metrics := range data {
+		for metricName := range metrics {
+			if h.buckets.MatchString(sanitizeMetricName(category + "_" + metricName)) {
+				return category
+			}
+		}
+	}
+	return ""
+}
+
+// Add the histograms parsed from upstream responses to the sample set,
+// named after their category like the other metrics
+func addParsedHistograms(set *sampleSet, histograms map[string]map[string]*SampleHistogram, labels prometheus.Labels) {
+	for category, metrics := range histograms {
+		for metricName, histogram := range metrics {
+			name := sanitizeMetricName(category + "_" + metricName)
+			buckets := make(map[float64]uint64, len(histogram.Buckets))
+			for _, bucket := range histogram.Buckets {
+				if !math.IsInf(bucket.UpperBound, 1) {
+					buckets[bucket.UpperBound] = bucket.Count
+				}
+			}
+			metric, err := prometheus.NewConstHistogram(
+				prometheus.NewDesc(name, fmt.Sprintf("Histogram %s from category %s", metricName, category), nil, labels),
+				histogram.Count, histogram.Sum, buckets,
+			)
+			if err != nil {
+				log.Printf("Skipping histogram %s: %v", name, err)
+				continue
+			}
+			set.addMetric(name, category, metric)
+		}
+	}
+}
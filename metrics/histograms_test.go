@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Histograms assembled from upstream buckets are served as classic
+// histograms, also to scrapes negotiating protobuf
+func TestHistogramProtobufScrape(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"latency": {"lt_10": 2, "lt_50": 3, "sum": 80, "count": 6}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf"},
+		Histograms: []config.HistogramMapping{{
+			Name:    "amf_latency_ms",
+			Buckets: `amf_latency_lt_(\d+)`,
+			Sum:     "amf_latency_sum",
+			Count:   "amf_latency_count",
+		}},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	recorder := httptest.NewRecorder()
+	exporter.MetricsHandler().ServeHTTP(recorder, r)
+	format := expfmt.ResponseFormat(recorder.Header())
+	if format.FormatType() != expfmt.TypeProtoDelim {
+		t.Fatalf("served %s, want delimited protobuf", format)
+	}
+
+	decoder := expfmt.NewDecoder(recorder.Body, format)
+	for {
+		var family dto.MetricFamily
+		if err := decoder.Decode(&family); err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatal(err)
+		}
+		if family.GetName() != "amf_latency_ms" {
+			continue
+		}
+		histogram := family.GetMetric()[0].GetHistogram()
+		if len(histogram.GetBucket()) != 2 || histogram.GetSampleCount() != 6 || histogram.GetSampleSum() != 80 {
+			t.Errorf("histogram = %v, want the upstream buckets", histogram)
+		}
+		if histogram.Schema != nil || len(histogram.GetPositiveSpan()) > 0 {
+			t.Errorf("histogram has synthesized native buckets: %v", histogram)
+		}
+		return
+	}
+	t.Fatal("histogram not served")
+}
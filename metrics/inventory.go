@@ -0,0 +1,259 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultInventoryRefresh = 5 * time.Minute
+	inventoryPageSize       = 500
+)
+
+// Inventory lists the devices managed by CNaaS-NMS. It labels the
+// collections of known devices and generates SNMP and NETCONF targets for
+// them. The device list is refreshed on scrape once it is older than the
+// refresh interval; when that fails the previous list stays in use. Scrapes
+// use the previous list while it is being refreshed.
+type Inventory struct {
+	config  config.CNaaSNMSConfig
+	client  *http.Client
+	timeout time.Duration
+	maxSize int64
+
+	mu         sync.Mutex
+	updated    time.Time
+	refreshing bool
+	devices    map[string]prometheus.Labels
+	snmp       []*snmpTarget
+	netconf    []*netconfTarget
+}
+
+type inventoryDevice struct {
+	Hostname     string `json:"hostname"`
+	ManagementIP string `json:"management_ip"`
+	DeviceType   string `json:"device_type"`
+	Platform     string `json:"platform"`
+	SiteID       *int   `json:"site_id"`
+}
+
+func NewInventory(cfg *config.Config, spiffe *spiffeSources) (*Inventory, error) {
+	inventory := cfg.CNaaSNMS
+	if inventory.URL == "" {
+		return nil, fmt.Errorf("no CNaaS-NMS url configured")
+	}
+	if inventory.RefreshInterval <= 0 {
+		inventory.RefreshInterval = defaultInventoryRefresh
+	}
+	if inventory.State == "" {
+		inventory.State = "MANAGED"
+	}
+	if inventory.MatchLabel == "" {
+		inventory.MatchLabel = "target"
+	}
+
+	transport, err := newPolicyTransport(cfg.TLSPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if inventory.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(inventory.TLS, cfg.TLSPolicy, spiffe)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	timeout := cfg.NETCONF.Timeout
+	if timeout <= 0 {
+		timeout = defaultNETCONFTimeout
+	}
+	return &Inventory{
+		config:  inventory,
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		timeout: timeout,
+		maxSize: cfg.ResponseLimit(),
+	}, nil
+}
+
+// Refresh the device list when it is due and no other scrape refreshes it
+func (i *Inventory) refresh(ctx context.Context) {
+	i.mu.Lock()
+	if i.refreshing || time.Since(i.updated) < i.config.RefreshInterval {
+		i.mu.Unlock()
+		return
+	}
+	i.refreshing = true
+	snmp, netconf := i.snmp, i.netconf
+	i.mu.Unlock()
+
+	devices, err := i.listDevices(ctx)
+	var labels map[string]prometheus.Labels
+	if err == nil {
+		labels, snmp, netconf = i.build(devices, snmp, netconf)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.refreshing = false
+	if err != nil {
+		log.Printf("Error listing CNaaS-NMS devices: %v", err)
+		// Retry on the next scrape once a list was loaded, not on every one
+		if i.devices != nil {
+			i.updated = time.Now()
+		}
+		return
+	}
+	i.devices, i.snmp, i.netconf = labels, snmp, netconf
+	i.updated = time.Now()
+}
+
+// List the devices in the configured state, page by page
+func (i *Inventory) listDevices(ctx context.Context) ([]inventoryDevice, error) {
+	var devices []inventoryDevice
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("filter[state]", i.config.State)
+		query.Set("per_page", strconv.Itoa(inventoryPageSize))
+		query.Set("page", strconv.Itoa(page))
+		requestURL := strings.TrimSuffix(i.config.URL, "/") + "/devices?" + query.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if i.config.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+string(i.config.Token))
+		}
+		resp, err := i.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, i.maxSize+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		if int64(len(body)) > i.maxSize {
+			return nil, errResponseTooLarge
+		}
+
+		var response struct {
+			Status string `json:"status"`
+			Data   struct {
+				Devices []inventoryDevice `json:"devices"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		if response.Status != "success" {
+			return nil, fmt.Errorf("unexpected response status: %s", response.Status)
+		}
+		devices = append(devices, response.Data.Devices...)
+		if len(response.Data.Devices) < inventoryPageSize {
+			return devices, nil
+		}
+	}
+}
+
+// Index the labels of the devices by hostname and management IP and build
+// their targets. The previous targets of devices whose address did not
+// change are kept, along with their SNMPv3 engine state.
+func (i *Inventory) build(devices []inventoryDevice, previousSNMP []*snmpTarget, previousNETCONF []*netconfTarget) (map[string]prometheus.Labels, []*snmpTarget, []*netconfTarget) {
+	snmp := make(map[string]*snmpTarget, len(previousSNMP))
+	for _, t := range previousSNMP {
+		snmp[t.name] = t
+	}
+	netconf := make(map[string]*netconfTarget, len(previousNETCONF))
+	for _, t := range previousNETCONF {
+		netconf[t.name] = t
+	}
+
+	labelsByDevice := make(map[string]prometheus.Labels, 2*len(devices))
+	var snmpTargets []*snmpTarget
+	var netconfTargets []*netconfTarget
+	for _, device := range devices {
+		if device.Hostname == "" {
+			continue
+		}
+		labels := prometheus.Labels{
+			"hostname":      device.Hostname,
+			"device_type":   device.DeviceType,
+			"platform":      device.Platform,
+			"management_ip": device.ManagementIP,
+		}
+		if device.SiteID != nil {
+			labels["site"] = strconv.Itoa(*device.SiteID)
+		}
+		labelsByDevice[device.Hostname] = labels
+		if device.ManagementIP == "" {
+			continue
+		}
+		labelsByDevice[device.ManagementIP] = labels
+
+		if template := i.config.SNMPTarget; template != nil {
+			def := *template
+			def.Name, def.Address = device.Hostname, device.ManagementIP
+			if t, ok := snmp[def.Name]; ok && t.address == snmpAddress(def) {
+				snmpTargets = append(snmpTargets, t)
+			} else if t, err := newSNMPTarget(def); err != nil {
+				log.Printf("Invalid snmp target for device %s: %v", def.Name, err)
+			} else {
+				snmpTargets = append(snmpTargets, t)
+			}
+		}
+		if template := i.config.NETCONFTarget; template != nil {
+			def := *template
+			def.Name, def.Address = device.Hostname, device.ManagementIP
+			if t, ok := netconf[def.Name]; ok && t.address == netconfAddress(def) {
+				netconfTargets = append(netconfTargets, t)
+			} else if t, err := newNETCONFTarget(def, i.timeout); err != nil {
+				log.Printf("Invalid netconf target for device %s: %v", def.Name, err)
+			} else {
+				netconfTargets = append(netconfTargets, t)
+			}
+		}
+	}
+	return labelsByDevice, snmpTargets, netconfTargets
+}
+
+func (i *Inventory) snmpTargets() []*snmpTarget {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.snmp
+}
+
+func (i *Inventory) netconfTargets() []*netconfTarget {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.netconf
+}
+
+// Add the labels of the device named by the match label of each collection.
+// Labels the collection already has take precedence.
+func (i *Inventory) label(collections []*collection) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, c := range collections {
+		if labels, ok := i.devices[c.labels[i.config.MatchLabel]]; ok {
+			c.labels = mergeLabels(labels, c.labels)
+		}
+	}
+}
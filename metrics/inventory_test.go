@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The device list is fetched without holding up scrapes, and the targets of
+// unchanged devices are kept across refreshes
+func TestInventoryRefresh(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	nms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-release
+		io.WriteString(w, `{"status": "success", "data": {"devices": [
+			{"hostname": "eosdist1", "management_ip": "10.100.3.101", "device_type": "DIST", "platform": "eos"}
+		]}}`)
+	}))
+	t.Cleanup(nms.Close)
+
+	inventory, err := NewInventory(&config.Config{CNaaSNMS: config.CNaaSNMSConfig{
+		URL:        nms.URL,
+		SNMPTarget: &config.SNMPTarget{Community: "public", Port: 1161},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed := make(chan struct{})
+	go func() {
+		inventory.refresh(context.Background())
+		close(refreshed)
+	}()
+	<-requested
+
+	// Scrapes meanwhile neither wait for the refresh nor start another
+	scraped := make(chan struct{})
+	go func() {
+		inventory.refresh(context.Background())
+		inventory.label([]*collection{{labels: prometheus.Labels{"target": "eosdist1"}}})
+		inventory.snmpTargets()
+		close(scraped)
+	}()
+	select {
+	case <-scraped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape blocked by the inventory refresh")
+	}
+	close(release)
+	<-refreshed
+
+	targets := inventory.snmpTargets()
+	if len(targets) != 1 || targets[0].address != "10.100.3.101:1161" {
+		t.Fatalf("snmp targets = %v, want eosdist1 on the template's port", targets)
+	}
+	collections := []*collection{{labels: prometheus.Labels{"target": "10.100.3.101"}}}
+	inventory.label(collections)
+	if collections[0].labels["hostname"] != "eosdist1" {
+		t.Errorf("labels = %v, want those of eosdist1", collections[0].labels)
+	}
+
+	inventory.mu.Lock()
+	inventory.updated = time.Time{}
+	inventory.mu.Unlock()
+	inventory.refresh(context.Background())
+	<-requested
+	if again := inventory.snmpTargets(); len(again) != 1 || again[0] != targets[0] {
+		t.Errorf("target of the unchanged device rebuilt on refresh")
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// KafkaSource consumes statistics messages from a Kafka topic into the cache.
+// Message values use the same JSON layout as the statistics API; the message
+// key, when set, is the statistics category used to prefix the metric names,
+// and an optional operatorIdentifier header selects the operator.
+type KafkaSource struct {
+	reader messageReader
+	spiffe *spiffeSources
+	cache  Store
+}
+
+// The part of the Kafka reader the source uses
+type messageReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	Close() error
+}
+
+// Wait before reading again after a read error
+const kafkaRetryDelay = time.Second
+
+func NewKafkaSource(cfg config.KafkaConfig, policy config.TLSPolicy, cache Store) (*KafkaSource, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka topic is not configured")
+	}
+
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+	}
+
+	spiffe := newSPIFFESources()
+	if cfg.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(cfg.TLS, policy, spiffe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure kafka TLS: %v", err)
+		}
+		dialer.TLS = tlsConfig
+	}
+
+	if cfg.SASL.Mechanism != "" {
+		mechanism, err := newSASLMechanism(cfg.SASL.Mechanism, cfg.SASL.Username, string(cfg.SASL.Password))
+		if err != nil {
+			return nil, err
+		}
+		dialer.SASLMechanism = mechanism
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.Brokers,
+		Topic:   cfg.Topic,
+		GroupID: cfg.GroupID,
+		Dialer:  dialer,
+	})
+
+	return &KafkaSource{reader: reader, spiffe: spiffe, cache: cache}, nil
+}
+
+func newSASLMechanism(name, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToUpper(name) {
+	case "PLAIN":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unsupported kafka SASL mechanism: %s", name)
+	}
+}
+
+// Run reads messages until the context is cancelled
+func (k *KafkaSource) Run(ctx context.Context) {
+	for {
+		msg, err := k.reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error reading kafka message: %v", err)
+			timer := time.NewTimer(kafkaRetryDelay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+
+		if err := k.consume(msg); err != nil {
+			log.Printf("Error parsing kafka message at offset %d: %v", msg.Offset, err)
+		}
+	}
+}
+
+// Store the statistics of a message in the cache
+func (k *KafkaSource) consume(msg kafka.Message) error {
+	var stats map[string]map[string]float64
+	if err := json.Unmarshal(msg.Value, &stats); err != nil {
+		return err
+	}
+
+	operator := ""
+	for _, header := range msg.Headers {
+		if header.Key == "operatorIdentifier" {
+			operator = string(header.Value)
+		}
+	}
+
+	for category, metrics := range stats {
+		if len(msg.Key) > 0 {
+			category = fmt.Sprintf("%s_%s", msg.Key, category)
+		}
+		k.cache.Update(operator, category, metrics)
+	}
+	return nil
+}
+
+func (k *KafkaSource) Close() error {
+	return errors.Join(k.reader.Close(), k.spiffe.Close())
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Reader handing out the messages and errors sent to it
+type fakeReader struct {
+	reads chan fakeRead
+}
+
+type fakeRead struct {
+	msg kafka.Message
+	err error
+}
+
+func (f *fakeReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case read := <-f.reads:
+		return read.msg, read.err
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (f *fakeReader) Close() error { return nil }
+
+// Messages are stored under the category of their key and the operator of
+// their header; malformed messages are skipped and read errors don't hold
+// up cancellation
+func TestKafkaSource(t *testing.T) {
+	reader := &fakeReader{reads: make(chan fakeRead)}
+	cache := NewCache()
+	source := &KafkaSource{reader: reader, spiffe: newSPIFFESources(), cache: cache}
+	t.Cleanup(func() { source.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		source.Run(ctx)
+		close(done)
+	}()
+
+	for _, msg := range []kafka.Message{
+		{Key: []byte("amf"), Value: []byte(`{"registration": {"attempts": 3}}`), Headers: []kafka.Header{{Key: "operatorIdentifier", Value: []byte("op1")}}},
+		{Value: []byte(`{"smf_sessions": {"active": 7}}`)},
+		{Key: []byte("amf"), Value: []byte(`{"registration": {"attempts": "many"}}`), Offset: 3},
+		{Key: []byte("amf"), Value: []byte(`not json`), Offset: 4},
+	} {
+		reader.reads <- fakeRead{msg: msg}
+	}
+	// Received once the messages before it are consumed
+	reader.reads <- fakeRead{err: errors.New("broker unavailable")}
+
+	if values := cache.Snapshot("op1")["amf_registration"]; values["attempts"] != 3 {
+		t.Errorf("operator op1 amf_registration = %v, want attempts 3", values)
+	}
+	if values := cache.Snapshot("")["smf_sessions"]; values["active"] != 7 {
+		t.Errorf("smf_sessions = %v, want active 7", values)
+	}
+	if _, ok := cache.Snapshot("")["amf_registration"]; ok {
+		t.Errorf("malformed message stored")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(kafkaRetryDelay / 2):
+		t.Fatal("run waited out the retry delay after cancellation")
+	}
+}
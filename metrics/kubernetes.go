@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client for the Kubernetes API using the pod's service account, or the
+// configured API server when running outside the cluster. The projected
+// service account token is rotated by the kubelet, so its file is read for
+// every request.
+type kubernetesClient struct {
+	apiServer string
+	tokenFile string
+	client    *http.Client
+}
+
+func newKubernetesClient(apiServer string, policy config.TLSPolicy) (*kubernetesClient, error) {
+	inCluster := apiServer == ""
+	if inCluster {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a kubernetes cluster and no API server configured")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	transport, err := newPolicyTransport(policy)
+	if err != nil {
+		return nil, err
+	}
+	k := &kubernetesClient{
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		client:    &http.Client{Transport: transport},
+	}
+	if !inCluster {
+		return k, nil
+	}
+
+	k.tokenFile = serviceAccountDir + "/token"
+	if _, err := k.token(); err != nil {
+		return nil, err
+	}
+
+	caCert, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in service account CA")
+	}
+	transport.TLSClientConfig, err = withTLSPolicy(&tls.Config{RootCAs: pool}, policy)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// The current service account token
+func (k *kubernetesClient) token() (string, error) {
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %v", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// Send a GET request to the API server and decode the JSON response into out
+func (k *kubernetesClient) get(ctx context.Context, path string, out interface{}) error {
+	status, err := k.do(ctx, http.MethodGet, path, nil, out)
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("kubernetes API returned status %d for %s", status, path)
+	}
+	return err
+}
+
+// Send a request to the API server. Responses with a 2xx status are decoded
+// into out; other statuses are returned for the caller to handle.
+func (k *kubernetesClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.apiServer+path, reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.tokenFile != "" {
+		token, err := k.token()
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("kubernetes API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || out == nil {
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("failed to decode kubernetes API response: %v", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// KubernetesDiscovery lists the pods or services serving the statistics API
+type KubernetesDiscovery struct {
+	config config.KubernetesSDConfig
+	client *kubernetesClient
+}
+
+func NewKubernetesDiscovery(cfg config.KubernetesSDConfig, policy config.TLSPolicy) (*KubernetesDiscovery, error) {
+	switch cfg.Role {
+	case "", "pod", "service":
+	default:
+		return nil, fmt.Errorf("unknown kubernetes SD role %q", cfg.Role)
+	}
+	if cfg.Namespace == "" {
+		return nil, fmt.Errorf("kubernetes SD requires a namespace")
+	}
+
+	client, err := newKubernetesClient(cfg.APIServer, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &KubernetesDiscovery{config: cfg, client: client}, nil
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type serviceList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			ClusterIP string `json:"clusterIP"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// Targets lists the running pods, or the services, matching the label
+// selector. Each target inherits the port, client and headers of base.
+func (d *KubernetesDiscovery) Targets(ctx context.Context, base *scrapeTarget) ([]*scrapeTarget, error) {
+	namespace := d.config.Namespace
+	port := base.server.Port
+	if d.config.Port != 0 {
+		port = d.config.Port
+	}
+
+	query := ""
+	if d.config.LabelSelector != "" {
+		query = "?labelSelector=" + url.QueryEscape(d.config.LabelSelector)
+	}
+
+	var targets []*scrapeTarget
+	if d.config.Role == "service" {
+		var services serviceList
+		path := fmt.Sprintf("/api/v1/namespaces/%s/services%s", url.PathEscape(namespace), query)
+		if err := d.client.get(ctx, path, &services); err != nil {
+			return nil, err
+		}
+		for _, service := range services.Items {
+			if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == "None" {
+				continue
+			}
+			labels := prometheus.Labels{"service": service.Metadata.Name, "namespace": namespace}
+			targets = append(targets, base.withAddress(namespace+"/"+service.Metadata.Name, service.Spec.ClusterIP, port, labels))
+		}
+		return targets, nil
+	}
+
+	var pods podList
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods%s", url.PathEscape(namespace), query)
+	if err := d.client.get(ctx, path, &pods); err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		labels := prometheus.Labels{"pod": pod.Metadata.Name, "namespace": namespace}
+		targets = append(targets, base.withAddress(namespace+"/"+pod.Metadata.Name, pod.Status.PodIP, port, labels))
+	}
+	return targets, nil
+}
@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kubernetes MicroTime format used by Lease objects
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+var isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cnaasprom_leader",
+	Help: "Whether this replica holds the leader election lease",
+})
+
+func init() {
+	registerInternal(isLeader)
+}
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// LeaderElector holds a kubernetes Lease while this replica is the leader
+type LeaderElector struct {
+	config   config.LeaderElectionConfig
+	client   *kubernetesClient
+	identity string
+}
+
+func NewLeaderElector(cfg config.LeaderElectionConfig, policy config.TLSPolicy) (*LeaderElector, error) {
+	if cfg.Namespace == "" || cfg.LeaseName == "" {
+		return nil, fmt.Errorf("leader election requires a namespace and lease name")
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = 15 * time.Second
+	}
+	if cfg.RetryPeriod == 0 {
+		cfg.RetryPeriod = 2 * time.Second
+	}
+	if cfg.RetryPeriod >= cfg.LeaseDuration {
+		return nil, fmt.Errorf("leader election retry period must be shorter than the lease duration")
+	}
+
+	identity := cfg.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine leader election identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	client, err := newKubernetesClient(cfg.APIServer, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{config: cfg, client: client, identity: identity}, nil
+}
+
+// Run campaigns for the lease until ctx is done. lead is started with a
+// context that is cancelled as soon as the lease is lost. The lease is
+// released on shutdown so the other replica takes over immediately.
+func (l *LeaderElector) Run(ctx context.Context, lead func(ctx context.Context)) {
+	ticker := time.NewTicker(l.config.RetryPeriod)
+	defer ticker.Stop()
+
+	var cancel context.CancelFunc
+	var lastRenew time.Time
+	for {
+		acquired, err := l.tryAcquireOrRenew(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Leader election failed: %v", err)
+		}
+		if acquired {
+			lastRenew = time.Now()
+		}
+
+		// Keep leading through API errors, stepping down before the lease expires
+		leading := acquired || (err != nil && time.Since(lastRenew) < l.config.LeaseDuration-l.config.RetryPeriod)
+		switch {
+		case leading && cancel == nil:
+			log.Printf("Became leader as %s", l.identity)
+			isLeader.Set(1)
+			var leaderCtx context.Context
+			leaderCtx, cancel = context.WithCancel(ctx)
+			go lead(leaderCtx)
+		case !leading && cancel != nil:
+			log.Printf("Lost leadership as %s", l.identity)
+			isLeader.Set(0)
+			cancel()
+			cancel = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if cancel != nil {
+				cancel()
+				isLeader.Set(0)
+				l.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *LeaderElector) leasePath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s",
+		url.PathEscape(l.config.Namespace), url.PathEscape(l.config.LeaseName))
+}
+
+// Take the lease if it is free, expired or already ours
+func (l *LeaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+
+	var current lease
+	status, err := l.client.do(ctx, http.MethodGet, l.leasePath(), nil, &current)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		return l.create(ctx, now)
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("kubernetes API returned status %d reading lease", status)
+	}
+
+	holder := current.Spec.HolderIdentity
+	if holder != "" && holder != l.identity {
+		renewTime, err := time.Parse(microTimeFormat, current.Spec.RenewTime)
+		duration := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+		if err == nil && now.Before(renewTime.Add(duration)) {
+			return false, nil
+		}
+	}
+
+	if holder != l.identity {
+		current.Spec.AcquireTime = now.Format(microTimeFormat)
+		current.Spec.LeaseTransitions++
+	}
+	current.Spec.HolderIdentity = l.identity
+	current.Spec.LeaseDurationSeconds = int(l.config.LeaseDuration / time.Second)
+	current.Spec.RenewTime = now.Format(microTimeFormat)
+
+	// The resource version makes the update fail if another replica won the race
+	status, err = l.client.do(ctx, http.MethodPut, l.leasePath(), &current, nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("kubernetes API returned status %d updating lease", status)
+	}
+}
+
+func (l *LeaderElector) create(ctx context.Context, now time.Time) (bool, error) {
+	var created lease
+	created.APIVersion = "coordination.k8s.io/v1"
+	created.Kind = "Lease"
+	created.Metadata.Name = l.config.LeaseName
+	created.Metadata.Namespace = l.config.Namespace
+	created.Spec.HolderIdentity = l.identity
+	created.Spec.LeaseDurationSeconds = int(l.config.LeaseDuration / time.Second)
+	created.Spec.AcquireTime = now.Format(microTimeFormat)
+	created.Spec.RenewTime = now.Format(microTimeFormat)
+
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", url.PathEscape(l.config.Namespace))
+	status, err := l.client.do(ctx, http.MethodPost, path, &created, nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusCreated, http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("kubernetes API returned status %d creating lease", status)
+	}
+}
+
+// Give up the lease so the other replica does not wait for it to expire
+func (l *LeaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.config.RetryPeriod)
+	defer cancel()
+
+	var current lease
+	status, err := l.client.do(ctx, http.MethodGet, l.leasePath(), nil, &current)
+	if err != nil || status != http.StatusOK || current.Spec.HolderIdentity != l.identity {
+		return
+	}
+
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	current.Spec.RenewTime = time.Now().Format(microTimeFormat)
+	if _, err := l.client.do(ctx, http.MethodPut, l.leasePath(), &current, nil); err != nil {
+		log.Printf("Failed to release leader election lease: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Measurement names of 3GPP TS 28.552 are a family and a name separated by
+// dots, such as RM.RegisteredSubNbrMean or SM.PduSessionCreationReq
+var measurementName = regexp.MustCompile(`^[A-Za-z0-9]+(\.[A-Za-z0-9_]+)+$`)
+
+// MeasurementMapper exports vendor metrics under standard 3GPP TS 28.552
+// measurement names with standardized labels, so dashboards work across
+// vendors
+type MeasurementMapper struct {
+	rules []*measurementRule
+}
+
+type measurementRule struct {
+	pattern *regexp.Regexp
+	metric  string
+	help    string
+	labels  map[string]string
+	keep    bool
+}
+
+func NewMeasurementMapper(defs []config.MeasurementMapping) (*MeasurementMapper, error) {
+	m := &MeasurementMapper{}
+	for _, def := range defs {
+		if !measurementName.MatchString(def.Measurement) {
+			return nil, fmt.Errorf("invalid 3GPP measurement name %q", def.Measurement)
+		}
+		pattern, err := regexp.Compile("^(?:" + def.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid measurement pattern %q: %v", def.Metric, err)
+		}
+
+		labels := make(map[string]string, len(def.Labels))
+		for name, value := range def.Labels {
+			labels[sanitizeMetricName(name)] = value
+		}
+		m.rules = append(m.rules, &measurementRule{
+			pattern: pattern,
+			metric:  sanitizeMetricName(strings.ReplaceAll(def.Measurement, ".", "_")),
+			help:    fmt.Sprintf("3GPP TS 28.552 measurement %s", def.Measurement),
+			labels:  labels,
+			keep:    def.Keep,
+		})
+	}
+	return m, nil
+}
+
+// The first rule matching the metric name, nil if none does
+func (m *MeasurementMapper) match(name string) *measurementRule {
+	for _, rule := range m.rules {
+		if rule.pattern.MatchString(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Labels of the measurement, expanding the groups of the matched name
+func (r *measurementRule) labelsFor(name string) prometheus.Labels {
+	labels := make(prometheus.Labels, len(r.labels))
+	match := r.pattern.FindStringSubmatchIndex(name)
+	for label, template := range r.labels {
+		labels[label] = string(r.pattern.ExpandString(nil, template, name, match))
+	}
+	return labels
+}
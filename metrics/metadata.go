@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v3"
+)
+
+// MetricMetadata overrides the generated HELP text and type of an exported
+// metric and declares its unit
+type MetricMetadata struct {
+	Help string `yaml:"help"`
+	Type string `yaml:"type"`
+	Unit string `yaml:"unit"`
+}
+
+// LoadMetricsMetadata reads a YAML file mapping metric names to their metadata
+func LoadMetricsMetadata(filename string) (map[string]MetricMetadata, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics metadata file: %v", err)
+	}
+
+	metadata := make(map[string]MetricMetadata)
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode metrics metadata file: %v", err)
+	}
+
+	for name, meta := range metadata {
+		if _, err := valueType(meta.Type); err != nil {
+			return nil, fmt.Errorf("invalid metadata for %s: %v", name, err)
+		}
+	}
+	return metadata, nil
+}
+
+func valueType(name string) (prometheus.ValueType, error) {
+	switch name {
+	case "", "gauge":
+		return prometheus.GaugeValue, nil
+	case "counter":
+		return prometheus.CounterValue, nil
+	case "untyped":
+		return prometheus.UntypedValue, nil
+	default:
+		return 0, fmt.Errorf("unsupported metric type %q", name)
+	}
+}
+
+// Gatherer setting the declared units on the gathered metric families
+type unitGatherer struct {
+	prometheus.Gatherer
+	metadata map[string]MetricMetadata
+}
+
+func (g unitGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		if meta, ok := g.metadata[family.GetName()]; ok && meta.Unit != "" {
+			unit := meta.Unit
+			family.Unit = &unit
+		}
+	}
+	return families, err
+}
@@ -1,120 +1,1213 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 
+	"github.com/AbdallahRustom/CNaaSProm/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
-	metricsRegistry = prometheus.NewRegistry()
+	// InternalRegistry holds the exporter's own metrics, kept across scrapes.
+	// Exporters serve it unless given another registry.
+	InternalRegistry = prometheus.NewRegistry()
+
+	// Collectors of the exporter's own metrics
+	internalCollectors []prometheus.Collector
+
+	invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
 )
 
-// Fetch JSON data from a single URL
-func fetchJSONData(apiURL string) (map[string]map[string]int, error) {
+// Add collectors of the exporter's own metrics
+func registerInternal(collectors ...prometheus.Collector) {
+	internalCollectors = append(internalCollectors, collectors...)
+	InternalRegistry.MustRegister(collectors...)
+}
+
+// RegisterInternalMetrics registers the exporter's own metrics, such as the
+// upstream fetch durations, with a registry other than InternalRegistry.
+// Metrics the registry already has are skipped.
+func RegisterInternalMetrics(r prometheus.Registerer) error {
+	for _, c := range internalCollectors {
+		if err := r.Register(c); err != nil {
+			var registered prometheus.AlreadyRegisteredError
+			if !errors.As(err, &registered) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Categories of the statistics and monitoring servers, modules and targets
+func configuredCategories(cfg *config.Config) []string {
+	categories := append(append([]string{}, cfg.MetricsStatisticsCategory...), cfg.MetricsMonitoringCategory...)
+	for _, module := range cfg.Modules {
+		categories = append(categories, module.Categories...)
+	}
+	for _, target := range cfg.Targets {
+		categories = append(categories, target.Settings.Categories...)
+	}
+	return categories
+}
+
+// Open the response body of a single URL
+func openBody(ctx context.Context, client *http.Client, apiURL string, request upstreamRequest) (io.ReadCloser, error) {
 	log.Printf("Fetching data from URL: %s", apiURL)
 
-	resp, err := http.Get(apiURL)
+	method := request.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if request.body != nil {
+		body = bytes.NewReader(request.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch JSON data: %v", err)
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for name, value := range request.headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	server := clientServer(client, req)
+	resp, err := client.Do(req)
+	if err != nil {
+		observeFailedFetch(server, request.category, start, err)
+		if errors.Is(err, errThrottled) {
+			return nil, errThrottled
+		}
+		var redirectErr *redirectError
+		if errors.As(err, &redirectErr) {
+			return nil, redirectErr
+		}
+		return nil, &fetchError{err: err}
+	}
+	if err := checkRedirectedResponse(req, resp); err != nil {
+		resp.Body.Close()
+		observeFailedFetch(server, request.category, start, err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		resp.Body.Close()
+		err := &statusError{code: resp.StatusCode}
+		observeFailedFetch(server, request.category, start, err)
+		return nil, err
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	return newMeasuredBody(resp.Body, server, request.category, start), nil
+}
+
+// Largest buffer kept for reuse; buffers grown by larger responses are dropped
+const maxPooledBodySize = 4 << 20
+
+// Buffers the response bodies are read into, reused across fetches
+var bodyBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Fetch the response body from a single URL into a pooled buffer. Callers
+// call release once the body is parsed and must not keep references to it.
+func fetchBody(ctx context.Context, client *http.Client, apiURL string, request upstreamRequest) ([]byte, func(), error) {
+	body, err := openBody(ctx, client, apiURL, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	release := func() {
+		if buffer.Cap() <= maxPooledBodySize {
+			buffer.Reset()
+			bodyBuffers.Put(buffer)
+		}
+	}
+	if _, err := buffer.ReadFrom(body); err != nil {
+		release()
+		return nil, nil, fmt.Errorf("failed to read response body: %v", err)
 	}
 
-	var stats map[string]map[string]int
-	err = json.Unmarshal(data, &stats)
+	return buffer.Bytes(), release, nil
+}
+
+// Fetch JSON data from a single URL, decoding the body as it is received
+func fetchJSONData(ctx context.Context, client *http.Client, MetricsCategory string, apiURL string, request upstreamRequest) (map[string]map[string]float64, error) {
+	body, err := openBody(ctx, client, apiURL, request)
 	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	_, span := startSpan(ctx, "parse", attribute.String("category", MetricsCategory))
+	defer span.End()
+
+	var stats map[string]map[string]float64
+	if err := json.NewDecoder(body).Decode(&stats); err != nil {
+		setSpanError(span, err)
+		if ctx.Err() != nil || errors.Is(err, errResponseTooLarge) {
+			return nil, fmt.Errorf("failed to read response body: %v", err)
+		}
+		recordParseFailure(MetricsCategory, "", "", err)
 		return nil, fmt.Errorf("failed to parse JSON: %v", err)
 	}
+	// Read the rest, usually a newline, so the response is measured
+	io.Copy(io.Discard, body)
 
 	return stats, nil
 }
 
-// Combine JSON data from multiple URLs
-func fetchAndCombineJSONData(MetricsCategories []string, queryParams string, StatisticServerAddr string, StatisticServerPort uint) (map[string]map[string]int, error) {
-	combinedData := make(map[string]map[string]int)
-	baseURL := fmt.Sprintf("http://%s:%d/nnfcm-statistics/v2/stats", StatisticServerAddr, StatisticServerPort)
+// Fetch JSON data from a single URL, validated against the schema of its
+// category and stripped of its upstream timestamps before it is decoded.
+// The oldest upstream timestamp is returned along with the data.
+func fetchBufferedJSONData(ctx context.Context, client *http.Client, MetricsCategory string, apiURL string, request upstreamRequest, schemas responseSchemas, times *upstreamTimes) (map[string]map[string]float64, time.Time, bool, error) {
+	data, release, err := fetchBody(ctx, client, apiURL, request)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer release()
+
+	_, span := startSpan(ctx, "parse", attribute.String("category", MetricsCategory))
+	defer span.End()
+
+	if err := schemas.validate(MetricsCategory, data); err != nil {
+		setSpanError(span, err)
+		return nil, time.Time{}, false, err
+	}
+	data, collected, timestamped := times.strip(MetricsCategory, data)
+	var stats map[string]map[string]float64
+	if err := json.Unmarshal(data, &stats); err != nil {
+		setSpanError(span, err)
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, time.Time{}, false, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+	return stats, collected, timestamped, nil
+}
+
+// Combine JSON data from multiple URLs. Categories that cannot be fetched
+// before the context is done are skipped, returning partial results along
+// with their errors. Categories answering with arrays return one labelled
+// series per element.
+func (e *Exporter) fetchAndCombineJSONData(ctx context.Context, t *scrapeTarget, queryParams string) (map[string]map[string]float64, []labeledData, error) {
+	merger := newCategoryMerger(e.config.OnMetricConflict, e.combine)
+	var series []labeledData
+	var errs []error
+
+	// Categories polled by the scheduler are served from its last poll, the
+	// others are fetched within the scrape deadline
+	results := make([]scheduledResult, len(t.module.Categories))
+	var fetched []int
+	for i, MetricsCategory := range t.module.Categories {
+		var ok bool
+		if results[i], ok = e.scheduler.latest(t, queryParams, MetricsCategory); !ok {
+			fetched = append(fetched, i)
+		}
+	}
+	budget := newFetchBudget(e.config.CategoryFetch.Concurrency, e.config.CategoryFetch.ShareDeadline, len(fetched))
+	for j, result := range budget.run(ctx, len(fetched), func(ctx context.Context, j int) scheduledResult {
+		var result scheduledResult
+		result.data, result.series, result.err = e.fetchCategory(ctx, t, queryParams, t.module.Categories[fetched[j]])
+		return result
+	}) {
+		results[fetched[j]] = result
+	}
+
+	// Merged in the configured order, which conflicts are handled by
+	for i, result := range results {
+		MetricsCategory := t.module.Categories[i]
+		if result.err != nil {
+			errs = append(errs, fmt.Errorf("category %s: %v", MetricsCategory, result.err))
+		}
+		series = append(series, result.series...)
+		merger.merge(MetricsCategory, result.data)
+	}
 
-	for _, MetricsCategory := range MetricsCategories {
+	combinedData, labelled, conflicts := merger.result()
+	return combinedData, append(series, labelled...), errors.Join(append(errs, conflicts)...)
+}
+
+// Fetch one category, as values or as labelled series. Failures are logged
+// and leave both empty, unless the last response is served instead.
+func (e *Exporter) fetchCategory(ctx context.Context, t *scrapeTarget, queryParams string, MetricsCategory string) (map[string]map[string]float64, []labeledData, error) {
+	server := t.server
+	fullURL := e.urls.statisticsURL(t.module.Scheme, server, MetricsCategory, queryParams)
+	// Responses are cached and kept for fallback by the URL without the time window
+	requestURL := e.windows.apply(fullURL, MetricsCategory, time.Now())
 
-		fullURL := fmt.Sprintf("%s/%s?operatorIdentifier=%s", baseURL, MetricsCategory, queryParams)
+	request, err := e.requests.build(MetricsCategory, queryParams, e.categoryHeaders(t, MetricsCategory))
+	if err != nil {
+		log.Printf("Error fetching data from %s: %v", requestURL, err)
+		return nil, nil, err
+	}
 
-		data, err := fetchJSONData(fullURL)
+	cachedResponse, cached := e.responses.Get(MetricsCategory, fullURL)
+	if e.isSeriesCategory(MetricsCategory) {
+		if cached {
+			return nil, cachedResponse.([]labeledData), nil
+		}
+		elements, err := e.fetchSeries(ctx, t.client, MetricsCategory, requestURL, request)
+		count := 0
+		for _, element := range elements {
+			count += countMetrics(element.Data)
+		}
+		e.status.record(t, queryParams, MetricsCategory, requestURL, count, err)
 		if err != nil {
-			log.Printf("Error fetching data from %s: %v", fullURL, err)
-			continue
+			fallback, ok := e.fallbackFor(t, fullURL, err)
+			if !ok {
+				log.Printf("Error fetching data from %s: %v", requestURL, err)
+				return nil, nil, err
+			}
+			elements = fallback.([]labeledData)
+		} else {
+			e.responses.Put(MetricsCategory, fullURL, elements)
+			e.fallback.put(fullURL, elements)
 		}
+		return nil, elements, nil
+	}
 
-		for category, metrics := range data {
-			prefixedCategory := fmt.Sprintf("%s_%s", MetricsCategory, category)
-			if _, exists := combinedData[prefixedCategory]; !exists {
-				combinedData[prefixedCategory] = make(map[string]int)
+	var data map[string]map[string]float64
+	if cached {
+		data = cachedResponse.(map[string]map[string]float64)
+	} else {
+		if _, ok := e.schemas[MetricsCategory]; ok || e.upstreamTimes != nil {
+			var collected time.Time
+			var timestamped bool
+			data, collected, timestamped, err = fetchBufferedJSONData(ctx, t.client, MetricsCategory, requestURL, request, e.schemas, e.upstreamTimes)
+			if timestamped {
+				e.upstreamTimes.record(t, queryParams, MetricsCategory, collected)
 			}
-			for metricName, value := range metrics {
-				combinedData[prefixedCategory][metricName] += value
+		} else {
+			data, err = fetchJSONData(ctx, t.client, MetricsCategory, requestURL, request)
+		}
+		e.status.record(t, queryParams, MetricsCategory, requestURL, countMetrics(data), err)
+		if err != nil {
+			fallback, ok := e.fallbackFor(t, fullURL, err)
+			if !ok {
+				log.Printf("Error fetching data from %s: %v", requestURL, err)
+				return nil, nil, err
 			}
+			data = fallback.(map[string]map[string]float64)
+		} else {
+			e.responses.Put(MetricsCategory, fullURL, data)
+			e.fallback.put(fullURL, data)
 		}
 	}
+	return data, nil, nil
+}
 
-	return combinedData, nil
+// Fetch labelled series from a single URL
+func (e *Exporter) fetchSeries(ctx context.Context, client *http.Client, MetricsCategory string, apiURL string, request upstreamRequest) ([]labeledData, error) {
+	data, release, err := fetchBody(ctx, client, apiURL, request)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	_, span := startSpan(ctx, "parse", attribute.String("category", MetricsCategory))
+	defer span.End()
+	if err := e.schemas.validate(MetricsCategory, data); err != nil {
+		setSpanError(span, err)
+		return nil, err
+	}
+	series, err := e.parseSeries(MetricsCategory, data)
+	setSpanError(span, err)
+	return series, err
 }
 
-func registerMetricsFromJSON(data map[string]map[string]int) error {
+// Add the collected statistics to the sample set
+func addMetricsFromJSON(set *sampleSet, states *StateMapper, transforms *Transformer, measurements *MeasurementMapper, splits splitRules, data map[string]map[string]float64, labels prometheus.Labels) {
 	for category, metrics := range data {
 		for metricName, value := range metrics {
-			metric := prometheus.NewGauge(prometheus.GaugeOpts{
-				Name: fmt.Sprintf("%s_%s", category, metricName),
-				Help: fmt.Sprintf("Metric %s from category %s", metricName, category),
-			})
+			metricLabels := labels
+			if prefix, suffixLabels, ok := splits.split(category, metricName); ok {
+				metricName, metricLabels = prefix, mergeLabels(labels, suffixLabels)
+			}
+			name := sanitizeMetricName(category + "_" + metricName)
+			value = transforms.Apply(name, value)
+			if rule := measurements.match(name); rule != nil {
+				set.add(rule.metric, rule.help, mergeLabels(metricLabels, rule.labelsFor(name)), value)
+				set.families[rule.metric].category = category
+				if !rule.keep {
+					continue
+				}
+			}
+			// The help text is only kept for the first sample of a family
+			help := ""
+			if _, exists := set.families[name]; !exists {
+				help = fmt.Sprintf("Metric %s from category %s", metricName, category)
+			}
+			states.add(set, name, help, metricLabels, value)
+			set.families[name].category = category
+		}
+	}
+}
 
-			metric.Set(float64(value))
+// Flatten combined data into values keyed by their exported metric name
+func flattenMetrics(data map[string]map[string]float64) map[string]float64 {
+	size := 0
+	for _, metrics := range data {
+		size += len(metrics)
+	}
+	values := make(map[string]float64, size)
+	for category, metrics := range data {
+		for metricName, value := range metrics {
+			values[sanitizeMetricName(category+"_"+metricName)] = value
+		}
+	}
+	return values
+}
 
-			err := metricsRegistry.Register(metric)
-			if err != nil {
-				if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-					existingMetric := are.ExistingCollector.(prometheus.Gauge)
-					existingMetric.Set(float64(value))
-				} else {
-					log.Printf("Error registering metric %s: %v", metricName, err)
+// Replace characters that are not valid in Prometheus metric names. Most
+// names are valid already and are returned without allocating.
+func sanitizeMetricName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if !validMetricChar(name[i]) {
+			if !isASCII(name) {
+				// Replace multi-byte characters with a single underscore
+				return invalidMetricChars.ReplaceAllString(name, "_")
+			}
+			sanitized := []byte(name)
+			for j := i; j < len(sanitized); j++ {
+				if !validMetricChar(sanitized[j]) {
+					sanitized[j] = '_'
 				}
 			}
+			return string(sanitized)
 		}
 	}
-	return nil
+	return name
+}
+
+func validMetricChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Exporter serves the collected statistics as Prometheus metrics
+type Exporter struct {
+	config        *config.Config
+	cache         Store
+	polls         PollStore
+	derived       []*DerivedMetric
+	rates         *RateTracker
+	histograms    []*HistogramMapping
+	aggregations  []*Aggregation
+	responses     *ResponseCache
+	sampleDir     string
+	metadata      map[string]MetricMetadata
+	namer         *metricNamer
+	extractions   map[string][]*ExtractionRule
+	states        *StateMapper
+	values        *ValueExtractor
+	transforms    *Transformer
+	measurements  *MeasurementMapper
+	splits        splitRules
+	combine       combineRules
+	schemas       responseSchemas
+	upstreamTimes *upstreamTimes
+	thresholds    *ThresholdEvaluator
+	requests      *RequestBuilder
+	urls          *urlBuilder
+	windows       *timeWindows
+	offsets       timestampOffsets
+	federation    *federation
+	parsers       map[string]Parser
+	snmp          *SNMPCollector
+	netconf       *NETCONFCollector
+	gnmi          *GNMICollector
+	scheduler     *Scheduler
+	inventory     *Inventory
+	discovery     *KubernetesDiscovery
+	status        *statusLog
+	fallback      *fallbackResponses
+	spiffe        *spiffeSources
+	registry      prometheus.Gatherer
+	rateLimits    *RateLimits
+
+	// The statistics server of the flat configuration, configured targets
+	// and the per-module targets used by /probe
+	defaultTarget *scrapeTarget
+	targets       []*scrapeTarget
+	modules       map[string]*scrapeTarget
+
+	fetchGroup singleflight.Group
+	mu         sync.Mutex
+	fetched    map[string]fetchedCollections
+
+	// Collections restored by LoadState, by group, until fetched
+	restored map[string]*collection
+}
+
+// Close disconnects the exporter from the SPIFFE Workload API once its
+// sources stopped
+func (e *Exporter) Close() error {
+	return e.spiffe.Close()
+}
+
+// Key of the collections of the configured operators in Exporter.fetched
+const defaultFetchKey = "collect"
+
+// Bound of a shared fetch started by a scrape without a deadline, and the
+// time a shared fetch ends ahead of the deadline of the scrape that started
+// it so its partial result still reaches the scrape
+const (
+	sharedFetchTimeout = time.Minute
+	sharedFetchMargin  = 250 * time.Millisecond
+)
+
+// Collections reused within the minimum fetch interval
+type fetchedCollections struct {
+	collections []*collection
+	time        time.Time
+}
+
+// Remember fetched collections, dropping those of other operators that are
+// too old to be reused. Must be called with e.mu held.
+func (e *Exporter) storeFetched(key string, collections []*collection, fetchTime time.Time) {
+	for other, fetched := range e.fetched {
+		if other != defaultFetchKey && time.Since(fetched.time) >= e.config.MinFetchInterval {
+			delete(e.fetched, other)
+		}
+	}
+	if key == defaultFetchKey || e.config.MinFetchInterval > 0 {
+		e.fetched[key] = fetchedCollections{collections: collections, time: fetchTime}
+	}
+}
+
+// ExporterOptions are what an exporter shares with the process embedding it
+type ExporterOptions struct {
+	// Registry of the exporter's own metrics, served along with the
+	// collected ones. InternalRegistry when nil.
+	Registry prometheus.Gatherer
+	// Global rate limits shared with the other exporters given the same.
+	// The exporter has its own when nil.
+	RateLimits *RateLimits
+}
+
+// NewExporter builds an exporter serving InternalRegistry with rate limits
+// of its own
+func NewExporter(cfg *config.Config, cache Store) (*Exporter, error) {
+	return NewExporterWithOptions(cfg, cache, ExporterOptions{})
+}
+
+func NewExporterWithOptions(cfg *config.Config, cache Store, opts ExporterOptions) (*Exporter, error) {
+	if err := cfg.TLSPolicy.Apply(&tls.Config{}); err != nil {
+		return nil, err
+	}
+	registry := opts.Registry
+	if registry == nil {
+		registry = InternalRegistry
+	}
+	rateLimits := opts.RateLimits
+	if rateLimits == nil {
+		rateLimits = NewRateLimits()
+	}
+
+	// Workload API sources of the upstream connections, connected on
+	// first use and closed by Close
+	spiffe := newSPIFFESources()
+
+	derived, err := ParseDerivedMetrics(cfg.DerivedMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := NewRateTracker(cfg.Rates, configuredCategories(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	histograms, err := ParseHistogramMappings(cfg.Histograms)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregations, err := ParseAggregations(cfg.Aggregations)
+	if err != nil {
+		return nil, err
+	}
+
+	extractions, err := ParseExtractionRules(cfg.ExtractionRules)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := NewStateMapper(cfg.States)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := NewValueExtractor(cfg.ValueExtractions)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamTimes, err := newUpstreamTimes(cfg.UpstreamTimestamps)
+	if err != nil {
+		return nil, err
+	}
+
+	transforms, err := NewTransformer(cfg.Transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := newTimeWindows(cfg.TimeWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := newTimestampOffsets(cfg.TimestampOffset, cfg.MetricsStatisticsCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	federation, err := newFederation(cfg.Federation, newClientOptions(cfg, spiffe, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks, err := newWebhookNotifier(cfg.Webhooks, cfg.TLSPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds, err := NewThresholdEvaluator(cfg.Thresholds, cfg.ThresholdInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateBreakdowns(cfg.Breakdowns); err != nil {
+		return nil, err
+	}
+
+	measurements, err := NewMeasurementMapper(cfg.Measurements)
+	if err != nil {
+		return nil, err
+	}
+
+	splits, err := newSplitRules(cfg.SplitRules)
+	if err != nil {
+		return nil, err
+	}
+
+	combine, err := newCombineRules(cfg.CombineRules)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas, err := newResponseSchemas(cfg.ResponseSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	requests, err := NewRequestBuilder(cfg.CategoryRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := newURLBuilder(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	parsers, err := newParsers(cfg.ParserPlugins, cfg.CategoryFormats)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string]MetricMetadata
+	if cfg.MetricsMetadataFile != "" {
+		metadata, err = LoadMetricsMetadata(cfg.MetricsMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Histograms are built with their final name
+	namer := newMetricNamer(cfg.Naming)
+	for _, mapping := range histograms {
+		mapping.name = namer.name(mapping.name)
+	}
+
+	if err := checkErrorPolicy(cfg.OnUpstreamError); err != nil {
+		return nil, err
+	}
+	if err := checkConflictPolicy(cfg.OnMetricConflict); err != nil {
+		return nil, err
+	}
+	defaultTarget, err := newScrapeTarget("", cfg.RemoteStatisticServer, config.Module{Categories: cfg.MetricsStatisticsCategory, OnUpstreamError: cfg.OnUpstreamError}, nil, newClientOptions(cfg, spiffe, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := newScrapeTargets(cfg, newClientOptions(cfg, spiffe, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+
+	modules, err := newModuleTargets(cfg.Modules, cfg.OnUpstreamError, newClientOptions(cfg, spiffe, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+
+	var snmp *SNMPCollector
+	if len(cfg.SNMP.Targets) > 0 || cfg.CNaaSNMS.SNMPTarget != nil {
+		snmp, err = NewSNMPCollector(cfg.SNMP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var netconf *NETCONFCollector
+	if len(cfg.NETCONF.Targets) > 0 || cfg.CNaaSNMS.NETCONFTarget != nil {
+		netconf, err = NewNETCONFCollector(cfg.NETCONF, cfg.ResponseLimit())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var gnmi *GNMICollector
+	if len(cfg.GNMI.Targets) > 0 {
+		gnmi, err = NewGNMICollector(cfg.GNMI, cfg.ResponseLimit(), cfg.TLSPolicy, spiffe)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var inventory *Inventory
+	if cfg.CNaaSNMS.URL != "" {
+		inventory, err = NewInventory(cfg, spiffe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the CNaaS-NMS inventory: %v", err)
+		}
+	}
+
+	var discovery *KubernetesDiscovery
+	if cfg.KubernetesSD.Enabled {
+		discovery, err = NewKubernetesDiscovery(cfg.KubernetesSD, cfg.TLSPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up kubernetes discovery: %v", err)
+		}
+	}
+
+	polls, _ := cache.(PollStore)
+	e := &Exporter{
+		config:        cfg,
+		cache:         cache,
+		polls:         polls,
+		derived:       derived,
+		rates:         rates,
+		histograms:    histograms,
+		aggregations:  aggregations,
+		responses:     NewResponseCache(cfg.ResponseCache),
+		metadata:      metadata,
+		namer:         namer,
+		extractions:   extractions,
+		states:        states,
+		values:        values,
+		transforms:    transforms,
+		measurements:  measurements,
+		splits:        splits,
+		combine:       combine,
+		schemas:       schemas,
+		upstreamTimes: upstreamTimes,
+		thresholds:    thresholds,
+		requests:      requests,
+		urls:          urls,
+		windows:       windows,
+		offsets:       offsets,
+		federation:    federation,
+		parsers:       parsers,
+		snmp:          snmp,
+		netconf:       netconf,
+		gnmi:          gnmi,
+		inventory:     inventory,
+		discovery:     discovery,
+		status:        newStatusLog(webhooks),
+		fallback:      newFallbackResponses(),
+		spiffe:        spiffe,
+		registry:      registry,
+		rateLimits:    rateLimits,
+
+		defaultTarget: defaultTarget,
+		targets:       targets,
+		modules:       modules,
+
+		fetched: make(map[string]fetchedCollections),
+	}
+	thresholds.collect = e.collectedSet
+
+	if cfg.Schedule.Enabled {
+		// Streamed monitoring categories are kept current by their stream
+		var monitoring *scrapeTarget
+		if len(cfg.MetricsMonitoringCategory) > 0 && !cfg.Streaming.Enabled {
+			module := config.Module{DataType: "monitoring", Categories: cfg.MetricsMonitoringCategory, OnUpstreamError: cfg.OnUpstreamError}
+			if monitoring, err = newScrapeTarget("", cfg.RemoteMonitoringServer, module, nil, newClientOptions(cfg, spiffe, rateLimits)); err != nil {
+				return nil, err
+			}
+		}
+		e.scheduler, err = newScheduler(e, cfg.Schedule, monitoring)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setConfigHash(cfg)
+	return e, nil
 }
 
 // HTTP handler for Prometheus metrics
-func MetricsHandler(MetricsCategories []string, queryParams string, StatisticServerAddr string, StatisticServerPort uint) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Fetch and combine JSON data from all URLs
-		combinedData, err := fetchAndCombineJSONData(MetricsCategories, queryParams, StatisticServerAddr, StatisticServerPort)
+func (e *Exporter) MetricsHandler() http.Handler {
+	return tracedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		ctx, cancel := e.scrapeContext(r)
+		defer cancel()
+
+		operators, multiTenant, err := e.scrapeOperators(r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collections, err := e.fetchCollections(ctx, operators, multiTenant)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch and combine JSON data: %v", err), http.StatusInternalServerError)
+			setSpanError(span, err)
+			writeError(w, fmt.Sprintf("Failed to fetch and combine JSON data: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Clear the registry and re-register metrics
-		metricsRegistry = prometheus.NewRegistry()
-		err = registerMetricsFromJSON(combinedData)
+		_, registerSpan := startSpan(ctx, "register")
+		gatherer, err := e.gatherer(collections)
+		setSpanError(registerSpan, err)
+		registerSpan.End()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to register metrics: %v", err), http.StatusInternalServerError)
+			writeError(w, fmt.Sprintf("Failed to register metrics: %v", err), http.StatusInternalServerError)
 			return
 		}
+		gatherer = e.federation.merge(ctx, gatherer)
 
 		// Serve metrics
-		promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}), "scrape")
+}
+
+// Gather performs a single collection of the configured operators and
+// returns the metric families that a scrape would export
+func (e *Exporter) Gather(ctx context.Context) ([]*dto.MetricFamily, error) {
+	operators, multiTenant := e.configuredOperators()
+	collections, err := e.collectAll(ctx, operators, multiTenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch and combine JSON data: %v", err)
+	}
+
+	gatherer, err := e.gatherer(collections)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %v", err)
+	}
+	families, err := e.federation.merge(ctx, gatherer).Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	return families, nil
+}
+
+// WriteOnce performs a single collection and writes the metrics in the text
+// exposition format
+func (e *Exporter) WriteOnce(w io.Writer) error {
+	families, err := e.Gather(context.Background())
+	if err != nil {
+		return err
+	}
+
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build a gatherer for the collected data. Every call gets its own sample
+// set so concurrent scrapes never share one.
+func (e *Exporter) gatherer(collections []*collection) (prometheus.Gatherer, error) {
+	set := newSampleSet(e.metadata, e.namer)
+	set.offsets = e.offsets
+	for _, c := range collections {
+		e.addCollection(set, c)
+	}
+	reportSeriesLimits(set.limit(e.config.SeriesLimits.PerCategory, e.config.SeriesLimits.Total))
+
+	return unitGatherer{prometheus.Gatherers{e.registry, set}, e.namer.metadata(e.metadata)}, nil
+}
+
+// Data collected for one operator. It is shared between concurrent scrapes
+// and must not be modified once the fetch completed.
+type collection struct {
+	group  string
+	target string
+	labels prometheus.Labels
+	data   map[string]map[string]float64
+	series []labeledData
+	rates  map[string]float64
+	time   time.Time
+
+	// Times upstream collected the data of each category at
+	upstreamTimes map[string]time.Time
+}
+
+// Bound the upstream fetch time by the scrape timeout announced by Prometheus,
+// less the configured offset, so partial results are returned in time
+func (e *Exporter) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return context.WithCancel(r.Context())
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		log.Printf("Ignoring invalid scrape timeout header %q: %v", header, err)
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - e.config.ScrapeTimeoutOffset
+	if timeout <= 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// The configured operator identifiers. With several of them every series
+// gets an operator label.
+func (e *Exporter) configuredOperators() ([]string, bool) {
+	operators := e.config.QueryParams.Operators
+	if len(operators) == 0 {
+		operators = []string{""}
+	}
+	return operators, len(operators) > 1
+}
+
+// The operators of a scrape: those of the operator parameters, e.g. set by
+// the params of a Prometheus scrape config, or else the configured ones.
+// Operators passed as parameters always get an operator label so scrapes of
+// different operators do not produce the same series.
+func (e *Exporter) scrapeOperators(r *http.Request) ([]string, bool, error) {
+	operators := r.URL.Query()["operator"]
+	if len(operators) == 0 {
+		operators, multiTenant := e.configuredOperators()
+		return operators, multiTenant, nil
+	}
+	for _, operator := range operators {
+		if operator == "" || strings.ContainsFunc(operator, unicode.IsControl) {
+			return nil, false, fmt.Errorf("invalid operator %q", operator)
+		}
+	}
+	return operators, true, nil
+}
+
+// Return the collected data, coalescing concurrent scrapes into one upstream
+// fetch and reusing the last result within the minimum fetch interval. The
+// shared fetch outlives the scrape that started it, up to that scrape's
+// deadline, and each scrape waits for it only as long as its own context
+// allows. Results of fetches cut short are returned but not reused.
+// Scrapes of other operators than the configured ones are cached separately.
+func (e *Exporter) fetchCollections(ctx context.Context, operators []string, multiTenant bool) ([]*collection, error) {
+	key := defaultFetchKey
+	if configured, configuredMultiTenant := e.configuredOperators(); multiTenant != configuredMultiTenant || !slices.Equal(operators, configured) {
+		key = fmt.Sprintf("operators/%t/%s", multiTenant, strings.Join(operators, "\x00"))
+	}
+
+	e.mu.Lock()
+	last, ok := e.fetched[key]
+	e.mu.Unlock()
+	if ok && time.Since(last.time) < e.config.MinFetchInterval {
+		return last.collections, nil
+	}
+	if shared, ok := e.sharedPoll(fetchedPollKey(key)); ok && time.Since(shared.Time) < e.config.MinFetchInterval {
+		collections := sharedCollections(shared.Collections)
+		e.mu.Lock()
+		e.storeFetched(key, collections, shared.Time)
+		e.mu.Unlock()
+		return collections, nil
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sharedFetchTimeout)
+	} else if time.Until(deadline) > 2*sharedFetchMargin {
+		deadline = deadline.Add(-sharedFetchMargin)
+	}
+	results := e.fetchGroup.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		defer cancel()
+		collections, err := e.collectAll(fetchCtx, operators, multiTenant)
+		if err != nil {
+			return nil, err
+		}
+
+		if fetchCtx.Err() == nil {
+			now := time.Now()
+			e.mu.Lock()
+			e.storeFetched(key, collections, now)
+			e.mu.Unlock()
+			e.sharePoll(fetchedPollKey(key), sharedPoll{Time: now, Collections: shareCollections(collections)}, e.config.MinFetchInterval)
+		}
+		return collections, nil
 	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.([]*collection), nil
+	}
+}
+
+// Key of the collections of a fetch shared through the store
+func fetchedPollKey(key string) string {
+	return "fetched/" + key
+}
+
+// Fetch the statistics of every operator and merge the streamed values
+func (e *Exporter) collectAll(ctx context.Context, operators []string, multiTenant bool) ([]*collection, error) {
+	ctx, span := startSpan(ctx, "collect")
+	defer span.End()
+
+	var collections []*collection
+	var err error
+	if e.discovery != nil && e.sampleDir == "" {
+		collections, err = e.collectDiscovered(ctx, operators, multiTenant)
+	} else {
+		collections, err = e.collectDefault(ctx, operators, multiTenant)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.sampleDir == "" {
+		if e.inventory != nil {
+			e.inventory.refresh(ctx)
+		}
+		targets, err := e.collectTargets(ctx, operators, multiTenant)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, targets...)
+		collections = append(collections, e.collectSNMP(ctx)...)
+		collections = append(collections, e.collectNETCONF(ctx)...)
+		collections = append(collections, e.collectGNMI()...)
+		if e.inventory != nil {
+			e.inventory.label(collections)
+		}
+	}
+	return collections, nil
+}
+
+// Fetch the statistics of every operator from the configured statistics server
+func (e *Exporter) collectDefault(ctx context.Context, operators []string, multiTenant bool) ([]*collection, error) {
+	var collections []*collection
+	for _, operator := range operators {
+		// Fetch and combine JSON data from all URLs
+		var combinedData map[string]map[string]float64
+		var series []labeledData
+		if e.sampleDir != "" {
+			var err error
+			combinedData, series, err = e.loadSampleData()
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			var err error
+			combinedData, series, err = e.fetchAndCombineJSONData(ctx, e.defaultTarget, operator)
+			// Along with the monitoring categories polled on schedule
+			if monitoring := e.scheduler.monitoringTarget(); monitoring != nil {
+				data, monitoringSeries, monitoringErr := e.fetchMonitoringCategories(ctx, monitoring, operator)
+				mergeMetrics(combinedData, data)
+				series = append(series, monitoringSeries...)
+				err = errors.Join(err, monitoringErr)
+			}
+			combinedData, series, err = e.withRestored(operator, combinedData, series, err)
+			if e.defaultTarget.failsOn(err) {
+				return nil, fmt.Errorf("failed to fetch statistics: %v", err)
+			}
+		}
+
+		// Merge values received from streaming sources
+		mergeMetrics(combinedData, e.cache.Snapshot(operator))
+		if !multiTenant {
+			mergeMetrics(combinedData, e.cache.Snapshot(""))
+		}
+
+		c := e.newCollection(operator, operatorLabels(operator, multiTenant), combinedData)
+		c.series = series
+		c.upstreamTimes = e.upstreamTimes.lookup(e.defaultTarget, operator)
+		if monitoring := e.scheduler.monitoringTarget(); monitoring != nil {
+			for category, collected := range e.upstreamTimes.lookup(monitoring, operator) {
+				c.upstreamTimes[category] = collected
+			}
+		}
+		collections = append(collections, c)
+	}
+
+	// Streamed values without an operator get their own unlabeled series
+	if multiTenant {
+		collections = append(collections, e.newCollection("", prometheus.Labels{}, e.cache.Snapshot("")))
+	}
+
+	return collections, nil
+}
+
+// Fetch the statistics of every operator from each discovered pod or
+// service. Streamed values are not tied to a target and are kept separate.
+func (e *Exporter) collectDiscovered(ctx context.Context, operators []string, multiTenant bool) ([]*collection, error) {
+	targets, err := e.discovery.Targets(ctx, e.defaultTarget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover statistics servers: %v", err)
+	}
+
+	var collections []*collection
+	for _, operator := range operators {
+		labels := operatorLabels(operator, multiTenant)
+		for _, target := range targets {
+			data, series, err := e.fetchAndCombineJSONData(ctx, target, operator)
+			data, series, err = e.withRestored(operator+"/"+target.name, data, series, err)
+			if target.failsOn(err) {
+				return nil, fmt.Errorf("failed to fetch statistics from %s: %v", target.name, err)
+			}
+			c := e.newCollection(operator+"/"+target.name, mergeLabels(labels, target.labels), data)
+			c.target = target.name
+			c.series = series
+			c.upstreamTimes = e.upstreamTimes.lookup(target, operator)
+			collections = append(collections, c)
+		}
+
+		streamed := e.cache.Snapshot(operator)
+		if !multiTenant {
+			mergeMetrics(streamed, e.cache.Snapshot(""))
+		}
+		collections = append(collections, e.newCollection(operator, labels, streamed))
+	}
+
+	if multiTenant {
+		collections = append(collections, e.newCollection("", prometheus.Labels{}, e.cache.Snapshot("")))
+	}
+
+	return collections, nil
+}
+
+func operatorLabels(operator string, multiTenant bool) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if multiTenant {
+		labels["operator"] = operator
+	}
+	return labels
+}
+
+// Rates are tracked per group, identifying the operator and target
+func (e *Exporter) newCollection(group string, labels prometheus.Labels, data map[string]map[string]float64) *collection {
+	now := time.Now()
+	return &collection{
+		group:  group,
+		labels: labels,
+		data:   data,
+		rates:  e.rates.Observe(group, data, now),
+		time:   now,
+	}
+}
+
+// Add the collected data of one operator and everything computed from it to the sample set
+func (e *Exporter) addCollection(set *sampleSet, c *collection) {
+	set.target = c.target
+	set.collected = c.upstreamTimes
+	addMetricsFromJSON(set, e.states, e.transforms, e.measurements, e.splits, c.data, c.labels)
+	for _, element := range c.series {
+		labels := mergeLabels(c.labels, element.Labels)
+		addMetricsFromJSON(set, e.states, e.transforms, e.measurements, e.splits, element.Data, labels)
+		addParsedHistograms(set, element.Histograms, labels)
+	}
+
+	// Age of the data as reported by upstream
+	for category, collected := range c.upstreamTimes {
+		set.add(dataAgeName(category), "Seconds since upstream collected the data of the "+category+" category", c.labels, c.time.Sub(collected).Seconds())
+	}
+
+	// Deltas and rates of counter-like metrics
+	values := flattenMetrics(c.data)
+	for name, value := range c.rates {
+		set.add(name, rateHelp(name), c.labels, value)
+		values[name] = value
+	}
+
+	// Aggregate metrics across categories
+	for _, aggregation := range e.aggregations {
+		value, ok := aggregation.Evaluate(c.data)
+		if !ok {
+			continue
+		}
+		set.add(aggregation.Name, aggregation.Help, c.labels, value)
+		values[aggregation.Name] = value
+	}
+
+	// Evaluate derived metrics over the collected values
+	for _, derived := range e.derived {
+		value, err := derived.Evaluate(values)
+		if err != nil {
+			log.Printf("Skipping derived metric %s: %v", derived.Name, err)
+			continue
+		}
+		set.add(derived.Name, derived.Help, c.labels, value)
+	}
+
+	// Assemble histograms from bucketed metrics
+	for _, mapping := range e.histograms {
+		histogram, err := mapping.Build(values, c.labels)
+		if err != nil {
+			log.Printf("Skipping histogram %s: %v", mapping.name, err)
+			continue
+		}
+		set.addMetric(mapping.name, mapping.category(c.data), histogram)
+	}
+}
+
+// Merge metric values into combined data, replacing existing values
+func mergeMetrics(combinedData map[string]map[string]float64, data map[string]map[string]float64) {
+	for category, metrics := range data {
+		if _, exists := combinedData[category]; !exists {
+			combinedData[category] = make(map[string]float64)
+		}
+		for metricName, value := range metrics {
+			combinedData[category][metricName] = value
+		}
+	}
 }
@@ -0,0 +1,536 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Statistics server answering every category with the same counters
+func newStatisticsServer(t *testing.T) *config.RemoteServer {
+	t.Helper()
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		fmt.Fprintf(w, `{"registration": {"attempts": %d, "success": %d}}`, n, n/2)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	return &config.RemoteServer{Address: host, Port: uint(p)}
+}
+
+func newTestExporter(t *testing.T) *Exporter {
+	t.Helper()
+	cfg := &config.Config{
+		RemoteStatisticServer:     *newStatisticsServer(t),
+		MetricsStatisticsCategory: []string{"amf", "smf"},
+		Rates:                     config.RateConfig{Metrics: []string{".*_attempts"}, Delta: true, Rate: true},
+		Thresholds: []config.ThresholdRule{
+			{Name: "attempts", Metric: ".*_attempts", Operator: ">", Value: 1},
+		},
+	}
+	exporter, err := NewExporter(cfg, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exporter
+}
+
+// Scrapes of several Prometheus servers, for the configured operators and
+// others, run concurrently with the other handlers. Run with -race.
+func TestConcurrentScrapes(t *testing.T) {
+	exporter := newTestExporter(t)
+	handlers := map[string]http.Handler{
+		"/metrics":          exporter.MetricsHandler(),
+		"/metrics?operator": exporter.MetricsHandler(),
+		"/status":           exporter.StatusHandler(),
+		"/alerts":           exporter.AlertsHandler(),
+		"/api/v1/values":    exporter.ValuesHandler(),
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		for path, handler := range handlers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 10; i++ {
+					target := path
+					if strings.HasSuffix(path, "?operator") {
+						target = fmt.Sprintf("%s=op%d", path, (worker+i)%3)
+					}
+					recorder := httptest.NewRecorder()
+					handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+					if recorder.Code != http.StatusOK {
+						t.Errorf("GET %s: status %d: %s", target, recorder.Code, recorder.Body)
+						return
+					}
+					if strings.HasPrefix(target, "/metrics") && !strings.Contains(recorder.Body.String(), "amf_registration_attempts") {
+						t.Errorf("GET %s: missing amf_registration_attempts", target)
+						return
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// A scrape cancelled while its fetch is shared doesn't fail the scrapes
+// waiting for the same fetch
+func TestSharedFetchOutlivesCancelledScrape(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"registration": {"attempts": 1}}`)
+	}))
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 32)
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf"},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := exporter.fetchCollections(first, []string{""}, false)
+		firstDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	secondDone := make(chan []*collection)
+	go func() {
+		collections, err := exporter.fetchCollections(context.Background(), []string{""}, false)
+		if err != nil {
+			t.Errorf("waiting scrape failed: %v", err)
+		}
+		secondDone <- collections
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	if err := <-firstDone; err != context.Canceled {
+		t.Errorf("cancelled scrape: got %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	collections := <-secondDone
+	if len(collections) == 0 || collections[0].data["amf_registration"]["attempts"] != 1 {
+		t.Errorf("waiting scrape got %+v", collections)
+	}
+}
+
+// Restored statistics are served while the upstream is down, whatever the
+// minimum fetch interval
+func TestRestoredStateServedUntilFetched(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+	saved := newTestExporter(t)
+	if _, err := saved.fetchCollections(context.Background(), []string{""}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.SaveState(path); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("%d files left next to the state, want only the state", len(files))
+	}
+
+	var up atomic.Bool
+	up.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"registration": {"attempts": 7}}`)
+	}))
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 32)
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf", "smf"},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := func() float64 {
+		collections, err := exporter.fetchCollections(context.Background(), []string{""}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return collections[0].data["amf_registration"]["attempts"]
+	}
+	up.Store(false)
+	if got := attempts(); got != 1 {
+		t.Errorf("upstream down: got %v attempts, want the restored 1", got)
+	}
+	up.Store(true)
+	if got := attempts(); got != 7 {
+		t.Errorf("upstream up: got %v attempts, want 7", got)
+	}
+	up.Store(false)
+	if got := attempts(); got != 0 {
+		t.Errorf("upstream down after a fetch: got %v attempts, want none", got)
+	}
+}
+
+// Each gatherer serves the collections it was built from, even while other
+// gatherers are built
+func TestGatherersAreIndependent(t *testing.T) {
+	exporter := newTestExporter(t)
+	first := exporter.newCollection("first", nil, map[string]map[string]float64{"amf_registration": {"attempts": 1}})
+	second := exporter.newCollection("second", nil, map[string]map[string]float64{"smf_registration": {"attempts": 2}})
+
+	firstGatherer, err := exporter.gatherer([]*collection{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exporter.gatherer([]*collection{second}); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := firstGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "smf_registration_attempts" {
+			t.Errorf("gatherer of the first collection serves %s", family.GetName())
+		}
+	}
+}
+
+// A target whose metrics fail to gather, or clash with another target's,
+// leaves the metrics of the other targets in place
+func TestTargetPartitions(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	desc := prometheus.NewDesc("latency", "Latency", []string{"target"}, nil)
+	histogram := func(target string) prometheus.Metric {
+		return prometheus.MustNewConstHistogram(desc, 1, 1, map[float64]uint64{1: 1}, target)
+	}
+	set := newSampleSet(nil, newMetricNamer(config.NamingConfig{}))
+	set.target = "broken"
+	set.add("attempts", "", prometheus.Labels{"target": "broken"}, 1)
+	set.add("shared", "", prometheus.Labels{}, 1)
+	set.addMetric("latency", "", histogram("broken"))
+	set.addMetric("latency", "", histogram("broken"))
+	set.target = "good"
+	set.add("attempts", "", prometheus.Labels{"target": "good"}, 2)
+	set.add("shared", "", prometheus.Labels{}, 2)
+	set.addMetric("latency", "", histogram("good"))
+
+	families, err := set.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]int)
+	for _, family := range families {
+		series[family.GetName()] = len(family.Metric)
+		for _, metric := range family.Metric {
+			if family.GetName() == "shared" && metric.GetGauge().GetValue() != 1 {
+				t.Errorf("shared was replaced by the value of another target: %v", metric)
+			}
+			for _, pair := range metric.Label {
+				if family.GetName() == "latency" && pair.GetValue() != "good" {
+					t.Errorf("latency of the broken target gathered: %v", metric)
+				}
+			}
+		}
+	}
+	if series["attempts"] != 2 || series["shared"] != 1 || series["latency"] != 1 {
+		t.Errorf("unexpected series per family %v", series)
+	}
+}
+
+func TestResponseSchemas(t *testing.T) {
+	schema, err := compileSchema([]byte(`{
+		"$defs": {"counter": {"type": "integer", "minimum": 0}},
+		"type": "object",
+		"propertyNames": {"pattern": "^[a-z]+$"},
+		"additionalProperties": {
+			"type": "object",
+			"required": ["attempts"],
+			"properties": {"state": {"enum": ["up", "down"]}},
+			"patternProperties": {"^rate": {"type": "number", "maximum": 1}},
+			"additionalProperties": {"$ref": "#/$defs/counter"}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := responseSchemas{"amf": schema}
+
+	for body, valid := range map[string]bool{
+		`{"registration": {"attempts": 3, "rateSuccess": 0.5, "state": "up"}}`: true,
+		`{"registration": {"success": 3}}`:                                     false,
+		`{"registration": {"attempts": -1}}`:                                   false,
+		`{"registration": {"attempts": 1.5}}`:                                  false,
+		`{"registration": {"attempts": 1, "rateSuccess": 2}}`:                  false,
+		`{"registration": {"attempts": 1, "state": "unknown"}}`:                false,
+		`{"registration": []}`:                                                 false,
+		`{"Registration": {"attempts": 1}}`:                                    false,
+		`not json`:                                                             false,
+	} {
+		if err := schemas.validate("amf", []byte(body)); (err == nil) != valid {
+			t.Errorf("validating %s: got %v, want valid %t", body, err, valid)
+		}
+	}
+	if err := schemas.validate("smf", []byte(`[]`)); err != nil {
+		t.Errorf("category without schema validated: %v", err)
+	}
+}
+
+// Schema files refer to others next to them
+func TestResponseSchemaFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/counter.json", []byte(`{"type": "integer", "minimum": 0}`), 0o644)
+	os.WriteFile(dir+"/amf.json", []byte(`{"additionalProperties": {"additionalProperties": {"$ref": "counter.json"}}}`), 0o644)
+	schemas, err := newResponseSchemas(map[string]string{"amf": dir + "/amf.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schemas.validate("amf", []byte(`{"registration": {"attempts": 3}}`)); err != nil {
+		t.Errorf("valid response rejected: %v", err)
+	}
+	if err := schemas.validate("amf", []byte(`{"registration": {"attempts": -3}}`)); err == nil {
+		t.Errorf("response breaking the referenced schema accepted")
+	}
+}
+
+func TestUpstreamTimestamps(t *testing.T) {
+	times, err := newUpstreamTimes(config.UpstreamTimestampsConfig{
+		Enabled:    true,
+		Categories: map[string]config.TimestampFormat{"smf": {Fields: []string{"reportTime"}, Formats: []string{"2006-01-02 15:04"}, Timezone: "Europe/Berlin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		category string
+		body     string
+		want     string
+		stripped string
+	}{
+		{"amf", `{"lastUpdated": "2024-01-02T10:00:00Z", "reg": {"a": 1, "collectionTime": 1704189600.5}}`, "2024-01-02T10:00:00Z", `{"reg":{"a":1}}`},
+		{"amf", `{"reg": {"a": 1}}`, "", `{"reg": {"a": 1}}`},
+		{"smf", `{"reportTime": "2024-01-02 11:00", "lastUpdated": 1, "g": {"b": 2}}`, "2024-01-02T10:00:00Z", `{"g":{"b":2},"lastUpdated":1}`},
+	} {
+		body, collected, ok := times.strip(test.category, []byte(test.body))
+		if string(body) != test.stripped {
+			t.Errorf("stripping %s: got %s, want %s", test.body, body, test.stripped)
+		}
+		if ok != (test.want != "") || ok && collected.UTC().Format(time.RFC3339) != test.want {
+			t.Errorf("timestamp of %s: got %v (%t), want %s", test.body, collected, ok, test.want)
+		}
+	}
+}
+
+func TestDerivedExpressions(t *testing.T) {
+	values := map[string]float64{"a": 2, "b": 4}
+	for expr, want := range map[string]float64{
+		"a / b":           0.5,
+		"a * 1e3":         2000,
+		"a * 1e-3":        0.002,
+		"a * 2.5E+2-b":    496,
+		"-(a - b) * .5e1": 10,
+	} {
+		derived, err := ParseDerivedMetrics([]config.DerivedMetric{{Name: "d", Expr: expr}})
+		if err != nil {
+			t.Errorf("parsing %s: %v", expr, err)
+			continue
+		}
+		if got, err := derived[0].Evaluate(values); err != nil || got != want {
+			t.Errorf("evaluating %s: got %v, %v, want %v", expr, got, err, want)
+		}
+	}
+}
+
+// Statistics of groups × metrics values, as served by a large deployment
+func largeStatistics(groups int, metrics int) []byte {
+	var body strings.Builder
+	body.WriteString("{")
+	for g := 0; g < groups; g++ {
+		if g > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `"group%d": {`, g)
+		for m := 0; m < metrics; m++ {
+			if m > 0 {
+				body.WriteString(",")
+			}
+			fmt.Fprintf(&body, `"metric-%d": %d.5`, m, g*metrics+m)
+		}
+		body.WriteString("}")
+	}
+	body.WriteString("}")
+	return []byte(body.String())
+}
+
+// An array of elements identified by cellId, each with metrics values
+func largeArray(elements int, metrics int) []byte {
+	var body strings.Builder
+	body.WriteString("[")
+	for e := 0; e < elements; e++ {
+		if e > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"cellId": "cell-%d"`, e)
+		for m := 0; m < metrics; m++ {
+			fmt.Fprintf(&body, `, "metric%d": %d`, m, m)
+		}
+		body.WriteString(`, "traffic": {"ul": 1, "dl": 2}}`)
+	}
+	body.WriteString("]")
+	return []byte(body.String())
+}
+
+func serveBody(b *testing.B, body []byte) string {
+	b.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	b.Cleanup(server.Close)
+	return server.URL
+}
+
+func BenchmarkFetchJSONData(b *testing.B) {
+	url := serveBody(b, largeStatistics(100, 100))
+	client := &http.Client{}
+	ctx := context.Background()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fetchJSONData(ctx, client, "amf", url, upstreamRequest{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFetchSeries(b *testing.B) {
+	url := serveBody(b, largeArray(1000, 20))
+	exporter, err := NewExporter(&config.Config{ArrayIdentifiers: map[string]string{"cells": "cellId"}}, NewCache())
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := &http.Client{}
+	ctx := context.Background()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := exporter.fetchSeries(ctx, client, "cells", url, upstreamRequest{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseArrayData(b *testing.B) {
+	body := largeArray(1000, 20)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseArrayData("cells", "cellId", body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGather(b *testing.B) {
+	exporter, err := NewExporter(&config.Config{}, NewCache())
+	if err != nil {
+		b.Fatal(err)
+	}
+	var stats map[string]map[string]float64
+	if err := json.Unmarshal(largeStatistics(100, 100), &stats); err != nil {
+		b.Fatal(err)
+	}
+	merger := newCategoryMerger("", nil)
+	merger.merge("amf", stats)
+	data, _, _ := merger.result()
+	series, err := parseArrayData("cells", "cellId", largeArray(1000, 20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	c := exporter.newCollection("", prometheus.Labels{}, data)
+	c.series = series
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gatherer, err := exporter.gatherer([]*collection{c})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := gatherer.Gather(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScrape(b *testing.B) {
+	url := serveBody(b, largeStatistics(100, 100))
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(url, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 32)
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf"},
+	}, NewCache())
+	if err != nil {
+		b.Fatal(err)
+	}
+	handler := exporter.MetricsHandler()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("status %d", recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The values and labelled series parsed from a monitoring payload, and the
+// time upstream collected them at if it reported one
+type monitoringData struct {
+	values      map[string]float64
+	series      []labeledData
+	collected   time.Time
+	timestamped bool
+}
+
+// Fetch monitoring data for a single URL
+func fetchMonitoringData(ctx context.Context, client *http.Client, states *StateMapper, extractions *ValueExtractor, times *upstreamTimes, category string, apiURL string, request upstreamRequest) (monitoringData, error) {
+	data, release, err := fetchBody(ctx, client, apiURL, request)
+	if err != nil {
+		return monitoringData{}, err
+	}
+	defer release()
+
+	_, span := startSpan(ctx, "parse", attribute.String("category", category))
+	defer span.End()
+	var monitoring monitoringData
+	data, monitoring.collected, monitoring.timestamped = times.strip(category, data)
+	monitoring.values, monitoring.series, err = parseMonitoringData(states, extractions, category, data)
+	setSpanError(span, err)
+	return monitoring, err
+}
+
+// Parse a monitoring payload into flat metric values. Nested objects are
+// joined with underscores; string values are parsed as numbers or mapped
+// states, booleans become 1 or 0. String values with extracted labels are
+// returned as labelled series.
+func parseMonitoringData(states *StateMapper, extractions *ValueExtractor, category string, data []byte) (map[string]float64, []labeledData, error) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		recordParseFailure(category, "", "", err)
+		return nil, nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	p := &monitoringParser{states: states, extractions: extractions, category: category, values: make(map[string]float64)}
+	for key, value := range payload {
+		p.flatten(key, value)
+	}
+	return p.values, p.series, nil
+}
+
+type monitoringParser struct {
+	states      *StateMapper
+	extractions *ValueExtractor
+	category    string
+	values      map[string]float64
+	series      []labeledData
+}
+
+func (p *monitoringParser) flatten(name string, value interface{}) {
+	switch v := value.(type) {
+	case float64:
+		p.values[name] = v
+	case bool:
+		p.values[name] = 0
+		if v {
+			p.values[name] = 1
+		}
+	case string:
+		metric := sanitizeMetricName(fmt.Sprintf("%s_%s", p.category, name))
+		if extracted, ok := p.extractions.extract(metric, v); ok {
+			p.flattenExtracted(metric, name, extracted)
+			return
+		}
+		if parsed, ok := p.parseString(metric, name, v); ok {
+			p.values[name] = parsed
+		}
+	case map[string]interface{}:
+		for key, nested := range v {
+			p.flatten(fmt.Sprintf("%s_%s", name, key), nested)
+		}
+	default:
+		log.Printf("Skipping unsupported value for %s: %v", name, v)
+		recordParseFailure(p.category, name, fmt.Sprint(v), fmt.Errorf("unsupported value type %T", v))
+	}
+}
+
+// Export the value extracted from a string with its labels, or unlabelled
+// next to an info series carrying them
+func (p *monitoringParser) flattenExtracted(metric string, name string, extracted extractedValue) {
+	if extracted.info {
+		p.addSeries(extracted.labels, name+"_info", 1)
+	}
+	if !extracted.hasValue {
+		return
+	}
+	value, ok := p.parseString(metric, name, extracted.value)
+	if !ok {
+		return
+	}
+	if extracted.info {
+		p.values[name] = value
+		return
+	}
+	p.addSeries(extracted.labels, name, value)
+}
+
+func (p *monitoringParser) addSeries(labels prometheus.Labels, name string, value float64) {
+	p.series = append(p.series, labeledData{Labels: labels, Data: map[string]map[string]float64{p.category: {name: value}}})
+}
+
+// Parse a string value as a mapped state or a number
+func (p *monitoringParser) parseString(metric string, name string, s string) (float64, bool) {
+	if state, ok := p.states.Value(metric, s); ok {
+		return state, true
+	}
+	parsed, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		log.Printf("Skipping non-numeric value for %s: %q", name, s)
+		recordParseFailure(p.category, name, s, err)
+		return 0, false
+	}
+	return parsed, true
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// metricNamer turns internal metric names, which start with the raw category
+// name, into exported names with the configured namespace and subsystems.
+// Derived metrics, rates and metadata keep referring to the internal names.
+type metricNamer struct {
+	namespace  string
+	subsystems []categorySubsystem
+}
+
+type categorySubsystem struct {
+	prefix    string
+	subsystem string
+}
+
+func newMetricNamer(cfg config.NamingConfig) *metricNamer {
+	namer := &metricNamer{namespace: sanitizeMetricName(strings.TrimSuffix(cfg.Namespace, "_"))}
+	for category, subsystem := range cfg.Subsystems {
+		namer.subsystems = append(namer.subsystems, categorySubsystem{
+			prefix:    sanitizeMetricName(category) + "_",
+			subsystem: sanitizeMetricName(strings.TrimSuffix(subsystem, "_")),
+		})
+	}
+
+	// Prefer the longest category when one is a prefix of another
+	sort.Slice(namer.subsystems, func(i, j int) bool {
+		return len(namer.subsystems[i].prefix) > len(namer.subsystems[j].prefix)
+	})
+	return namer
+}
+
+func (n *metricNamer) name(name string) string {
+	for _, s := range n.subsystems {
+		if strings.HasPrefix(name, s.prefix) {
+			name = strings.TrimPrefix(name, s.prefix)
+			if s.subsystem != "" {
+				name = s.subsystem + "_" + name
+			}
+			break
+		}
+	}
+	if n.namespace != "" {
+		name = n.namespace + "_" + name
+	}
+	return name
+}
+
+// Metadata keyed by the exported metric names
+func (n *metricNamer) metadata(metadata map[string]MetricMetadata) map[string]MetricMetadata {
+	exported := make(map[string]MetricMetadata, len(metadata))
+	for name, meta := range metadata {
+		exported[n.name(name)] = meta
+	}
+	return exported
+}
@@ -0,0 +1,306 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultNETCONFTimeout = 10 * time.Second
+
+// NETCONFCollector reads operational state, such as interface counters or
+// BGP sessions, from network devices with NETCONF get operations. Each query
+// exports netconf_<query>_<metric> with a target label naming the device.
+type NETCONFCollector struct {
+	timeout time.Duration
+	maxSize int64
+	queries []*netconfQuery
+	targets []*netconfTarget
+}
+
+type netconfQuery struct {
+	name      string
+	category  string
+	operation string
+	path      string
+	labels    map[string]string
+	metrics   map[string]string
+}
+
+type netconfTarget struct {
+	name    string
+	address string
+	labels  prometheus.Labels
+	ssh     *ssh.ClientConfig
+}
+
+func NewNETCONFCollector(cfg config.NETCONFConfig, maxSize int64) (*NETCONFCollector, error) {
+	c := &NETCONFCollector{timeout: cfg.Timeout, maxSize: maxSize}
+	if c.timeout <= 0 {
+		c.timeout = defaultNETCONFTimeout
+	}
+
+	for _, def := range cfg.Queries {
+		query, err := newNETCONFQuery(def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid netconf query %s: %v", def.Name, err)
+		}
+		c.queries = append(c.queries, query)
+	}
+	for _, def := range cfg.Targets {
+		target, err := newNETCONFTarget(def, c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid netconf target %s: %v", def.Name, err)
+		}
+		c.targets = append(c.targets, target)
+	}
+	return c, nil
+}
+
+func newNETCONFQuery(def config.NETCONFQuery) (*netconfQuery, error) {
+	if def.Name == "" || def.Path == "" {
+		return nil, fmt.Errorf("a name and path are required")
+	}
+	if def.XPath != "" && def.Subtree != "" {
+		return nil, fmt.Errorf("xpath and subtree filters are exclusive")
+	}
+
+	var filter bytes.Buffer
+	switch {
+	case def.XPath != "":
+		filter.WriteString(`<filter type="xpath"`)
+		prefixes := make([]string, 0, len(def.Namespaces))
+		for prefix := range def.Namespaces {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			filter.WriteString(` xmlns:` + prefix + `="`)
+			xml.EscapeText(&filter, []byte(def.Namespaces[prefix]))
+			filter.WriteString(`"`)
+		}
+		filter.WriteString(` select="`)
+		xml.EscapeText(&filter, []byte(def.XPath))
+		filter.WriteString(`"/>`)
+	case def.Subtree != "":
+		if err := xml.Unmarshal([]byte("<filter>"+def.Subtree+"</filter>"), new(struct{})); err != nil {
+			return nil, fmt.Errorf("invalid subtree filter: %v", err)
+		}
+		filter.WriteString(`<filter type="subtree">` + def.Subtree + `</filter>`)
+	}
+
+	labels := make(map[string]string, len(def.Labels))
+	for name, path := range def.Labels {
+		labels[sanitizeMetricName(name)] = path
+	}
+	metrics := make(map[string]string, len(def.Metrics))
+	for name, path := range def.Metrics {
+		metrics[sanitizeMetricName(name)] = path
+	}
+	return &netconfQuery{
+		name:      def.Name,
+		category:  sanitizeMetricName("netconf_" + def.Name),
+		operation: "<get>" + filter.String() + "</get>",
+		path:      def.Path,
+		labels:    labels,
+		metrics:   metrics,
+	}, nil
+}
+
+// The address of a target, on its port or 830 unless the address has one
+func netconfAddress(def config.NETCONFTarget) string {
+	if _, _, err := net.SplitHostPort(def.Address); err == nil {
+		return def.Address
+	}
+	if def.Port == 0 {
+		return config.JoinHostPort(def.Address, 830)
+	}
+	return config.JoinHostPort(def.Address, def.Port)
+}
+
+func newNETCONFTarget(def config.NETCONFTarget, timeout time.Duration) (*netconfTarget, error) {
+	if def.Name == "" || def.Address == "" || def.Username == "" {
+		return nil, fmt.Errorf("a name, address and username are required")
+	}
+	address := netconfAddress(def)
+
+	var auth []ssh.AuthMethod
+	if def.PrivateKeyFile != "" {
+		key, err := os.ReadFile(def.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if def.Password != "" {
+		password := string(def.Password)
+		auth = append(auth, ssh.Password(password), ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("a password or private key is required")
+	}
+
+	hostKeys := ssh.InsecureIgnoreHostKey()
+	if !def.InsecureSkipVerify {
+		if def.KnownHostsFile == "" {
+			return nil, fmt.Errorf("a known hosts file is required unless insecureSkipVerify is set")
+		}
+		var err error
+		if hostKeys, err = knownhosts.New(def.KnownHostsFile); err != nil {
+			return nil, fmt.Errorf("failed to read known hosts: %v", err)
+		}
+	}
+
+	labels := prometheus.Labels{"target": def.Name}
+	for name, value := range def.Labels {
+		labels[sanitizeMetricName(name)] = value
+	}
+	return &netconfTarget{
+		name:    def.Name,
+		address: address,
+		labels:  labels,
+		ssh:     &ssh.ClientConfig{User: def.Username, Auth: auth, HostKeyCallback: hostKeys, Timeout: timeout},
+	}, nil
+}
+
+// Series read from a target, one per selected element
+type netconfValues struct {
+	target *netconfTarget
+	series []labeledData
+}
+
+// Query the configured targets and those given. Targets that fail are
+// logged and skipped.
+func (c *NETCONFCollector) collect(ctx context.Context, targets []*netconfTarget) []netconfValues {
+	var results []netconfValues
+	for _, t := range append(c.targets[:len(c.targets):len(c.targets)], targets...) {
+		series, err := c.collectTarget(ctx, t)
+		if err != nil {
+			log.Printf("Error querying netconf target %s: %v", t.name, err)
+			continue
+		}
+		results = append(results, netconfValues{target: t, series: series})
+	}
+	return results
+}
+
+func (c *NETCONFCollector) collectTarget(ctx context.Context, t *netconfTarget) ([]labeledData, error) {
+	session, err := dialNETCONF(ctx, t.address, t.ssh, c.timeout, c.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer session.close()
+
+	var series []labeledData
+	for _, query := range c.queries {
+		reply, err := session.rpc(query.operation)
+		if err != nil {
+			return nil, fmt.Errorf("query %s failed: %v", query.name, err)
+		}
+		data := reply.child("data")
+		if data == nil {
+			return nil, fmt.Errorf("query %s failed: reply without data", query.name)
+		}
+		series = append(series, query.extract(data)...)
+	}
+	return series, nil
+}
+
+// One labelled series per element selected by the query path
+func (q *netconfQuery) extract(data *xmlNode) []labeledData {
+	var series []labeledData
+	for _, element := range data.find(q.path) {
+		labels := prometheus.Labels{}
+		for name, path := range q.labels {
+			if nodes := element.find(path); len(nodes) > 0 {
+				labels[name] = nodes[0].text
+			}
+		}
+
+		values := make(map[string]float64)
+		if len(q.metrics) == 0 {
+			collectNumericLeaves(element, "", values)
+		}
+		for name, path := range q.metrics {
+			if nodes := element.find(path); len(nodes) > 0 {
+				if value, ok := xmlNumber(nodes[0].text); ok {
+					values[name] = value
+				}
+			}
+		}
+		if len(values) > 0 {
+			series = append(series, labeledData{Labels: labels, Data: map[string]map[string]float64{q.category: values}})
+		}
+	}
+	return series
+}
+
+// Every numeric leaf below node, named by its path joined with underscores
+func collectNumericLeaves(node *xmlNode, prefix string, values map[string]float64) {
+	for _, child := range node.children {
+		name := sanitizeMetricName(child.name)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if len(child.children) > 0 {
+			collectNumericLeaves(child, name, values)
+		} else if value, ok := xmlNumber(child.text); ok {
+			values[name] = value
+		}
+	}
+}
+
+// YANG numbers, and booleans as 1 or 0
+func xmlNumber(text string) (float64, bool) {
+	switch text {
+	case "true":
+		return 1, true
+	case "false":
+		return 0, true
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	return value, err == nil
+}
+
+// Collections of the NETCONF targets, labelled with the target name
+func (e *Exporter) collectNETCONF(ctx context.Context) []*collection {
+	if e.netconf == nil {
+		return nil
+	}
+
+	var generated []*netconfTarget
+	if e.inventory != nil {
+		generated = e.inventory.netconfTargets()
+	}
+
+	var collections []*collection
+	for _, values := range e.netconf.collect(ctx, generated) {
+		c := e.newCollection("netconf/"+values.target.name, values.target.labels, map[string]map[string]float64{})
+		c.target = values.target.name
+		c.series = values.series
+		collections = append(collections, c)
+	}
+	return collections
+}
@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	netconfNamespace    = "urn:ietf:params:xml:ns:netconf:base:1.0"
+	netconfBase10       = "urn:ietf:params:netconf:base:1.0"
+	netconfBase11       = "urn:ietf:params:netconf:base:1.1"
+	netconfEndOfMessage = "]]>]]>"
+	// Largest chunk accepted with the chunked framing of base:1.1
+	netconfMaxChunk = 64 << 20
+)
+
+// netconfSession is a NETCONF session over the netconf subsystem of an SSH
+// connection. Messages are framed with end-of-message markers, or chunks
+// when both peers support base:1.1.
+type netconfSession struct {
+	client    *ssh.Client
+	session   *ssh.Session
+	stdin     io.WriteCloser
+	reader    *bufio.Reader
+	chunked   bool
+	messageID int
+	maxSize   int64
+}
+
+// Connect and exchange hello messages. The deadline of ctx, or timeout,
+// bounds the whole session.
+func dialNETCONF(ctx context.Context, address string, sshConfig *ssh.ClientConfig, timeout time.Duration, maxSize int64) (*netconfSession, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	s := &netconfSession{client: client, maxSize: maxSize}
+	if err := s.open(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *netconfSession) open() error {
+	var err error
+	if s.session, err = s.client.NewSession(); err != nil {
+		return err
+	}
+	if s.stdin, err = s.session.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := s.session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.reader = bufio.NewReader(stdout)
+	if err := s.session.RequestSubsystem("netconf"); err != nil {
+		return fmt.Errorf("failed to start the netconf subsystem: %v", err)
+	}
+
+	hello := `<?xml version="1.0" encoding="UTF-8"?><hello xmlns="` + netconfNamespace + `"><capabilities>` +
+		`<capability>` + netconfBase10 + `</capability><capability>` + netconfBase11 + `</capability>` +
+		`</capabilities></hello>`
+	if _, err := io.WriteString(s.stdin, hello+netconfEndOfMessage); err != nil {
+		return err
+	}
+	reply, err := s.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read the server hello: %v", err)
+	}
+	var serverHello struct {
+		Capabilities []string `xml:"capabilities>capability"`
+	}
+	if err := xml.Unmarshal(reply, &serverHello); err != nil {
+		return fmt.Errorf("invalid server hello: %v", err)
+	}
+	for _, capability := range serverHello.Capabilities {
+		if strings.TrimSpace(capability) == netconfBase11 {
+			s.chunked = true
+		}
+	}
+	return nil
+}
+
+// Send an operation and return the reply. Replies with an rpc-error fail.
+func (s *netconfSession) rpc(operation string) (*xmlNode, error) {
+	s.messageID++
+	request := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><rpc message-id="%d" xmlns="%s">%s</rpc>`, s.messageID, netconfNamespace, operation)
+	if err := s.writeMessage([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	data, err := s.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := parseXMLTree(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc reply: %v", err)
+	}
+	for _, rpcError := range reply.children {
+		if rpcError.name != "rpc-error" {
+			continue
+		}
+		if severity := rpcError.child("error-severity"); severity != nil && severity.text == "warning" {
+			continue
+		}
+		message := "unknown error"
+		if tag := rpcError.child("error-tag"); tag != nil {
+			message = tag.text
+		}
+		if text := rpcError.child("error-message"); text != nil {
+			message += ": " + text.text
+		}
+		return nil, fmt.Errorf("rpc error: %s", message)
+	}
+	return reply, nil
+}
+
+func (s *netconfSession) writeMessage(data []byte) error {
+	if s.chunked {
+		_, err := fmt.Fprintf(s.stdin, "\n#%d\n%s\n##\n", len(data), data)
+		return err
+	}
+	_, err := s.stdin.Write(append(data, netconfEndOfMessage...))
+	return err
+}
+
+func (s *netconfSession) readMessage() ([]byte, error) {
+	if s.chunked {
+		return s.readChunks()
+	}
+
+	var message []byte
+	for {
+		line, err := s.reader.ReadSlice('>')
+		message = append(message, line...)
+		if bytes.HasSuffix(message, []byte(netconfEndOfMessage)) {
+			return message[:len(message)-len(netconfEndOfMessage)], nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if int64(len(message)) > s.maxSize {
+			return nil, errResponseTooLarge
+		}
+	}
+}
+
+// Read the chunks of a message: \n#<size>\n<data> ... \n##\n
+func (s *netconfSession) readChunks() ([]byte, error) {
+	var message []byte
+	for {
+		header, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if header == "\n" {
+			if header, err = s.reader.ReadString('\n'); err != nil {
+				return nil, err
+			}
+		}
+		header = strings.TrimSuffix(header, "\n")
+		if header == "##" {
+			return message, nil
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(header, "#"))
+		if !strings.HasPrefix(header, "#") || err != nil || size <= 0 || size > netconfMaxChunk {
+			return nil, fmt.Errorf("invalid chunk header %q", header)
+		}
+		if int64(len(message)+size) > s.maxSize {
+			return nil, errResponseTooLarge
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(s.reader, chunk); err != nil {
+			return nil, err
+		}
+		message = append(message, chunk...)
+	}
+}
+
+// Close the session politely, then the connection
+func (s *netconfSession) close() {
+	if s.session != nil {
+		s.writeMessage([]byte(`<?xml version="1.0" encoding="UTF-8"?><rpc message-id="close" xmlns="` + netconfNamespace + `"><close-session/></rpc>`))
+		s.session.Close()
+	}
+	s.client.Close()
+}
+
+// xmlNode is an element of a parsed XML document, named without namespace
+type xmlNode struct {
+	name     string
+	text     string
+	children []*xmlNode
+}
+
+func parseXMLTree(data []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	root.trim()
+	return root, nil
+}
+
+func (n *xmlNode) trim() {
+	n.text = strings.TrimSpace(n.text)
+	for _, child := range n.children {
+		child.trim()
+	}
+}
+
+func (n *xmlNode) child(name string) *xmlNode {
+	for _, child := range n.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Elements below n along a slash-separated path of element names
+func (n *xmlNode) find(path string) []*xmlNode {
+	nodes := []*xmlNode{n}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var next []*xmlNode
+		for _, node := range nodes {
+			for _, child := range node.children {
+				if child.name == name {
+					next = append(next, child)
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
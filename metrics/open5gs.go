@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+const (
+	// Open5GS network functions serve their metrics in the Prometheus text
+	// format on this path, port 9090 by default
+	open5gsMetricsPath = "/metrics"
+	open5gsDefaultPort = 9090
+	open5gsCategory    = "open5gs"
+)
+
+// Fetch the metrics endpoint of an Open5GS network function. Its metrics,
+// such as ues_active or fivegs_amffunction_rm_reginitreq, are exported as
+// open5gs_<name> with the labels Open5GS attaches to them.
+func (e *Exporter) fetchOpen5GS(ctx context.Context, t *scrapeTarget, operator string) ([]labeledData, error) {
+	port := t.server.Port
+	if port == 0 {
+		port = open5gsDefaultPort
+	}
+	apiURL := fmt.Sprintf("%s://%s%s", t.module.Scheme, config.JoinHostPort(t.server.Address, port), open5gsMetricsPath)
+
+	body, release, err := fetchBody(ctx, t.client, apiURL, upstreamRequest{headers: requestHeaders(t.server, nil)})
+	var series []labeledData
+	if err == nil {
+		series, err = parseWithParser(open5gsCategory, prometheusParser{}, body)
+		release()
+	}
+	count := 0
+	for _, element := range series {
+		count += countMetrics(element.Data)
+	}
+	e.status.record(t, operator, open5gsCategory, apiURL, count, err)
+	if err != nil {
+		log.Printf("Error fetching data from %s: %v", apiURL, err)
+		return nil, err
+	}
+	return series, nil
+}
@@ -0,0 +1,265 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Interval between pushes when an output does not set one
+const defaultOutputInterval = time.Minute
+
+// OutputSink pushes the collected values to a Graphite or InfluxDB server
+// on every poll, for tooling that does not scrape Prometheus endpoints
+type OutputSink struct {
+	exporter *Exporter
+	cfg      config.OutputConfig
+	interval time.Duration
+	client   *http.Client
+}
+
+func NewOutputSink(cfg config.OutputConfig, exporter *Exporter) (*OutputSink, error) {
+	switch cfg.Type {
+	case "graphite":
+		if cfg.Address == "" {
+			return nil, fmt.Errorf("graphite output needs an address")
+		}
+	case "influxdb":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("influxdb output needs a url")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported output type %q", cfg.Type)
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultOutputInterval
+	}
+	transport, err := newPolicyTransport(exporter.config.TLSPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return &OutputSink{
+		exporter: exporter,
+		cfg:      cfg,
+		interval: interval,
+		client:   &http.Client{Transport: transport, Timeout: interval},
+	}, nil
+}
+
+// Run pushes the values every interval until the context is done
+func (o *OutputSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := o.push(ctx); err != nil {
+			log.Printf("Failed to push metrics to %s output: %v", o.cfg.Type, err)
+		}
+	}
+}
+
+func (o *OutputSink) push(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, o.interval)
+	defer cancel()
+
+	families, err := o.exporter.gatherCollected(ctx)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	if o.cfg.Type == "graphite" {
+		writeGraphite(&buf, o.cfg.Prefix, families, now)
+		return o.sendGraphite(ctx, buf.Bytes())
+	}
+	writeInflux(&buf, families, now)
+	return o.sendInflux(ctx, buf.Bytes())
+}
+
+func (o *OutputSink) sendGraphite(ctx context.Context, data []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", o.cfg.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+func (o *OutputSink) sendInflux(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+string(o.cfg.Token))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// Collect the data and gather the resulting metric families without the
+// exporter's own metrics
+func (e *Exporter) gatherCollected(ctx context.Context) ([]*dto.MetricFamily, error) {
+	set, err := e.collectedSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return prometheus.Gatherers{set}.Gather()
+}
+
+// The samples of the configured operators, reusing the collections fetched
+// within the minimum fetch interval
+func (e *Exporter) collectedSet(ctx context.Context) (*sampleSet, error) {
+	operators, multiTenant := e.configuredOperators()
+	collections, err := e.fetchCollections(ctx, operators, multiTenant)
+	if err != nil {
+		return nil, err
+	}
+
+	set := newSampleSet(e.metadata, e.namer)
+	for _, c := range collections {
+		e.addCollection(set, c)
+	}
+	set.limit(e.config.SeriesLimits.PerCategory, e.config.SeriesLimits.Total)
+	return set, nil
+}
+
+// A value of a metric family; histograms are split into the bucket, sum and
+// count series of the Prometheus exposition format
+type point struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// The finite values of a family. Neither Graphite nor the InfluxDB line
+// protocol accepts NaN or infinite values, which would fail the whole push.
+func familyPoints(family *dto.MetricFamily) []point {
+	points := allPoints(family)
+	finite := points[:0]
+	for _, p := range points {
+		if !math.IsNaN(p.value) && !math.IsInf(p.value, 0) {
+			finite = append(finite, p)
+		}
+	}
+	return finite
+}
+
+func allPoints(family *dto.MetricFamily) []point {
+	var points []point
+	for _, metric := range family.GetMetric() {
+		labels := make(map[string]string, len(metric.GetLabel()))
+		for _, pair := range metric.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+
+		name := family.GetName()
+		switch {
+		case metric.Histogram != nil:
+			for _, bucket := range metric.Histogram.GetBucket() {
+				bucketLabels := map[string]string{"le": strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)}
+				for k, v := range labels {
+					bucketLabels[k] = v
+				}
+				points = append(points, point{name + "_bucket", bucketLabels, float64(bucket.GetCumulativeCount())})
+			}
+			points = append(points,
+				point{name + "_sum", labels, metric.Histogram.GetSampleSum()},
+				point{name + "_count", labels, float64(metric.Histogram.GetSampleCount())},
+			)
+		case metric.Counter != nil:
+			points = append(points, point{name, labels, metric.Counter.GetValue()})
+		case metric.Gauge != nil:
+			points = append(points, point{name, labels, metric.Gauge.GetValue()})
+		case metric.Untyped != nil:
+			points = append(points, point{name, labels, metric.Untyped.GetValue()})
+		}
+	}
+	return points
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var graphiteEscaper = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "=", "_")
+
+// Write the families in the Graphite plaintext protocol, with labels as tags:
+// prefix.name;label=value value timestamp
+func writeGraphite(w io.Writer, prefix string, families []*dto.MetricFamily, now time.Time) {
+	for _, family := range families {
+		for _, p := range familyPoints(family) {
+			path := p.name
+			if prefix != "" {
+				path = strings.TrimSuffix(prefix, ".") + "." + path
+			}
+			for _, name := range sortedLabelNames(p.labels) {
+				if p.labels[name] != "" {
+					path += ";" + name + "=" + graphiteEscaper.Replace(p.labels[name])
+				}
+			}
+			fmt.Fprintf(w, "%s %s %d\n", path, strconv.FormatFloat(p.value, 'g', -1, 64), now.Unix())
+		}
+	}
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// Write the families in the InfluxDB line protocol with the metric name as
+// measurement and labels as tags: name,label=value value=1 timestamp
+func writeInflux(w io.Writer, families []*dto.MetricFamily, now time.Time) {
+	for _, family := range families {
+		for _, p := range familyPoints(family) {
+			line := influxEscaper.Replace(p.name)
+			for _, name := range sortedLabelNames(p.labels) {
+				if p.labels[name] != "" {
+					line += "," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(p.labels[name])
+				}
+			}
+			fmt.Fprintf(w, "%s value=%s %d\n", line, strconv.FormatFloat(p.value, 'g', -1, 64), now.UnixNano())
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// NaN and infinite values are left out of Graphite and InfluxDB pushes
+func TestOutputsSkipNonFinite(t *testing.T) {
+	var families []*dto.MetricFamily
+	for name, value := range map[string]float64{"amf_ratio": 0.5, "amf_nan": math.NaN(), "amf_inf": math.Inf(1), "amf_neg_inf": math.Inf(-1)} {
+		var metric dto.Metric
+		if err := prometheus.MustNewConstMetric(prometheus.NewDesc(name, "", nil, nil), prometheus.GaugeValue, value).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		families = append(families, &dto.MetricFamily{Name: &name, Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{&metric}})
+	}
+	now := time.Unix(1700000000, 0)
+
+	var graphite, influx strings.Builder
+	writeGraphite(&graphite, "cnaas", families, now)
+	writeInflux(&influx, families, now)
+	if want := "cnaas.amf_ratio 0.5 1700000000\n"; graphite.String() != want {
+		t.Errorf("graphite wrote %q, want %q", graphite.String(), want)
+	}
+	if want := "amf_ratio value=0.5 1700000000000000000\n"; influx.String() != want {
+		t.Errorf("influx wrote %q, want %q", influx.String(), want)
+	}
+}
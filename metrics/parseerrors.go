@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Number of recent parse failures kept for troubleshooting
+const maxParseFailures = 100
+
+var (
+	parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_parse_errors_total",
+		Help: "Upstream values or payloads that could not be parsed",
+	}, []string{"category", "metric"})
+
+	recentParseFailures = &parseFailureLog{}
+)
+
+func init() {
+	registerInternal(parseErrors)
+}
+
+// ParseFailure describes an upstream value that could not be parsed
+type ParseFailure struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Metric   string    `json:"metric,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Error    string    `json:"error"`
+}
+
+// Bounded log of the most recent parse failures
+type parseFailureLog struct {
+	mu       sync.Mutex
+	failures []ParseFailure
+}
+
+func (l *parseFailureLog) add(failure ParseFailure) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failures = append(l.failures, failure)
+	if len(l.failures) > maxParseFailures {
+		l.failures = l.failures[len(l.failures)-maxParseFailures:]
+	}
+}
+
+// Return the failures, most recent first
+func (l *parseFailureLog) list() []ParseFailure {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	failures := make([]ParseFailure, len(l.failures))
+	for i, failure := range l.failures {
+		failures[len(l.failures)-1-i] = failure
+	}
+	return failures
+}
+
+// Count a parse failure and remember it. An empty metric name means the
+// whole payload of the category could not be parsed.
+func recordParseFailure(category string, metric string, value string, err error) {
+	parseErrors.WithLabelValues(category, metric).Inc()
+	recentParseFailures.add(ParseFailure{
+		Time:     time.Now(),
+		Category: category,
+		Metric:   metric,
+		Value:    value,
+		Error:    err.Error(),
+	})
+}
+
+// ParseErrorsHandler lists the recent parse failures as JSON
+func ParseErrorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recentParseFailures.list())
+	})
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Time an external parser command may run unless configured
+const defaultParserTimeout = 10 * time.Second
+
+// Sample is a value parsed from a response. Its name is prefixed with the
+// category on export. A sample with a histogram is exported as that
+// histogram rather than its value.
+type Sample struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Histogram *SampleHistogram  `json:"histogram,omitempty"`
+}
+
+// SampleHistogram is a histogram with cumulative bucket counts
+type SampleHistogram struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+// HistogramBucket counts the observations up to its upper bound
+type HistogramBucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// Parser turns the response body of a category into samples. The body is
+// reused once Parse returns, so parsers must not keep references to it.
+type Parser interface {
+	Parse(data []byte) ([]Sample, error)
+}
+
+// ParserFactory builds the parser of a category from its format settings
+type ParserFactory func(cfg config.FormatConfig) (Parser, error)
+
+var (
+	parserFactoriesMu sync.Mutex
+	parserFactories   = map[string]ParserFactory{
+		"command":    newCommandParser,
+		"csv":        newCSVParser,
+		"prometheus": newPrometheusParser,
+	}
+)
+
+// RegisterParser makes a format available to categoryFormats. Parser plugins
+// call it from their init function.
+func RegisterParser(format string, factory ParserFactory) {
+	parserFactoriesMu.Lock()
+	defer parserFactoriesMu.Unlock()
+	parserFactories[format] = factory
+}
+
+// Load the parser plugins and build the parser of every category with a format
+func newParsers(plugins []string, formats map[string]config.FormatConfig) (map[string]Parser, error) {
+	for _, path := range plugins {
+		// Opening a plugin runs its init functions, registering its formats
+		if _, err := plugin.Open(path); err != nil {
+			return nil, fmt.Errorf("failed to load parser plugin %s: %v", path, err)
+		}
+	}
+
+	parsers := make(map[string]Parser, len(formats))
+	for category, cfg := range formats {
+		parserFactoriesMu.Lock()
+		factory, ok := parserFactories[cfg.Format]
+		parserFactoriesMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown format %q for category %s", cfg.Format, category)
+		}
+
+		parser, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format settings for category %s: %v", category, err)
+		}
+		parsers[category] = parser
+	}
+	return parsers, nil
+}
+
+// Parse a response with the parser of its category, grouping the samples
+// into one labelled series per label set
+func parseWithParser(MetricsCategory string, parser Parser, body []byte) ([]labeledData, error) {
+	samples, err := parser.Parse(body)
+	if err != nil {
+		recordParseFailure(MetricsCategory, "", "", err)
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return groupSamples(MetricsCategory, samples), nil
+}
+
+// One series of the category per distinct label set of the samples
+func groupSamples(MetricsCategory string, samples []Sample) []labeledData {
+	var series []labeledData
+	index := make(map[string]int)
+	for _, sample := range samples {
+		labels := prometheus.Labels{}
+		for name, value := range sample.Labels {
+			labels[sanitizeMetricName(name)] = value
+		}
+		key := labelSetKey(labels)
+		i, ok := index[key]
+		if !ok {
+			i = len(series)
+			index[key] = i
+			series = append(series, labeledData{Labels: labels, Data: map[string]map[string]float64{MetricsCategory: {}}})
+		}
+		if sample.Histogram != nil {
+			if series[i].Histograms == nil {
+				series[i].Histograms = map[string]map[string]*SampleHistogram{MetricsCategory: {}}
+			}
+			series[i].Histograms[MetricsCategory][sample.Name] = sample.Histogram
+			continue
+		}
+		series[i].Data[MetricsCategory][sample.Name] = sample.Value
+	}
+	return series
+}
+
+func labelSetKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "\x00" + labels[name] + "\x00")
+	}
+	return key.String()
+}
+
+// commandParser runs an external command with the response body on stdin;
+// it writes the samples to stdout as a JSON array
+type commandParser struct {
+	command []string
+	timeout time.Duration
+}
+
+func newCommandParser(cfg config.FormatConfig) (Parser, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("the command format needs a command")
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultParserTimeout
+	}
+	return &commandParser{command: cfg.Command, timeout: timeout}, nil
+}
+
+func (p *commandParser) Parse(data []byte) ([]Sample, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("parser command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var samples []Sample
+	if err := json.Unmarshal(stdout.Bytes(), &samples); err != nil {
+		return nil, fmt.Errorf("invalid parser command output: %v", err)
+	}
+	return samples, nil
+}
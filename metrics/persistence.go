@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collected values written to disk so a restarted exporter can serve them
+// before the first fetch completes
+type persistedState struct {
+	Time        time.Time                                `json:"time"`
+	Streamed    map[string]map[string]map[string]float64 `json:"streamed"`
+	Collections []persistedCollection                    `json:"collections"`
+}
+
+type persistedCollection struct {
+	Group  string                        `json:"group"`
+	Labels prometheus.Labels             `json:"labels"`
+	Data   map[string]map[string]float64 `json:"data"`
+	Series []labeledData                 `json:"series,omitempty"`
+}
+
+// SaveState writes the streamed values and the last collected statistics to
+// path. The file is synced and replaced atomically so a crash never leaves it
+// truncated or empty.
+func (e *Exporter) SaveState(path string) error {
+	state := persistedState{
+		Time:     time.Now(),
+		Streamed: make(map[string]map[string]map[string]float64),
+	}
+	for _, operator := range e.cache.Operators() {
+		state.Streamed[operator] = e.cache.Snapshot(operator)
+	}
+
+	e.mu.Lock()
+	fetched, ok := e.fetched[defaultFetchKey]
+	e.mu.Unlock()
+	if ok {
+		state.Time = fetched.time
+	}
+	for _, c := range fetched.collections {
+		state.Collections = append(state.Collections, persistedCollection{Group: c.group, Labels: c.labels, Data: c.data, Series: c.series})
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync state directory: %v", err)
+	}
+	return nil
+}
+
+// Sync a directory so a rename within it survives a crash. Directories
+// cannot be synced on Windows.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// LoadState restores the values saved by SaveState. The restored statistics
+// count as fetched at the time they were saved, so they are served until the
+// minimum fetch interval since then has passed, and after that in place of
+// failed fetches until a fetch of their target succeeds. A missing file is
+// not an error.
+func (e *Exporter) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+
+	e.cache.Restore(state.Streamed)
+
+	var collections []*collection
+	restored := make(map[string]*collection)
+	for _, c := range state.Collections {
+		if c.Labels == nil {
+			c.Labels = prometheus.Labels{}
+		}
+		collection := &collection{group: c.Group, labels: c.Labels, data: c.Data, series: c.Series}
+		collections = append(collections, collection)
+		restored[c.Group] = collection
+	}
+
+	e.mu.Lock()
+	if collections != nil {
+		e.storeFetched(defaultFetchKey, collections, state.Time)
+	}
+	e.restored = restored
+	e.mu.Unlock()
+	return nil
+}
+
+// Complete the statistics of a collection whose fetch failed with err with
+// its restored statistics. They are dropped once a fetch succeeds.
+func (e *Exporter) withRestored(group string, data map[string]map[string]float64, series []labeledData, err error) (map[string]map[string]float64, []labeledData, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.restored[group]
+	if !ok || errors.Is(err, errMetricConflict) {
+		return data, series, err
+	}
+	if err == nil {
+		delete(e.restored, group)
+		return data, series, nil
+	}
+
+	merged := make(map[string]map[string]float64, len(c.data))
+	mergeMetrics(merged, c.data)
+	mergeMetrics(merged, data)
+	if len(series) == 0 {
+		series = c.series
+	}
+	return merged, series, nil
+}
@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProbeHandler scrapes the target given by the target parameter, as
+// host:port, with the settings of the module parameter, in the style of the
+// blackbox exporter. Only the metrics of that target are returned.
+// Configured targets of the module and targets discovered in kubernetes are
+// probed with the module's credentials and keep their state across probes.
+// Any other target is probed only if allowed reports it may be, without
+// credentials, and nothing of it is kept after the probe.
+func (e *Exporter) ProbeHandler(allowed func(module string, target string) bool) http.Handler {
+	return tracedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		moduleName := params.Get("module")
+		module, ok := e.modules[moduleName]
+		if !ok {
+			writeError(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+			return
+		}
+
+		address := params.Get("target")
+		host, portParam, err := net.SplitHostPort(address)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Invalid target %q: %v", address, err), http.StatusBadRequest)
+			return
+		}
+		port, err := strconv.ParseUint(portParam, 10, 16)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Invalid target port %q", portParam), http.StatusBadRequest)
+			return
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("target", address), attribute.String("module", moduleName))
+
+		ctx, cancel := e.scrapeContext(r)
+		defer cancel()
+
+		operators, multiTenant, err := e.scrapeOperators(r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		target, err := e.knownProbeTarget(ctx, module, address)
+		if err != nil {
+			setSpanError(span, err)
+			writeError(w, fmt.Sprintf("Failed to discover targets: %v", err), http.StatusBadGateway)
+			return
+		}
+		if target == nil {
+			// nr-cli is run with the target as node name, which only
+			// configured UERANSIM targets may set
+			if module.module.DataType == "ueransim" || allowed == nil || !allowed(moduleName, address) {
+				log.Printf("Rejected probe of %q with module %s from %s", address, moduleName, r.RemoteAddr)
+				writeError(w, fmt.Sprintf("Target %q is not allowed", address), http.StatusForbidden)
+				return
+			}
+			target, err = e.anonymousProbeTarget(module, address, host, uint(port))
+			if err != nil {
+				writeError(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer e.forgetTarget(target, operators)
+		}
+
+		start := time.Now()
+		set := newSampleSet(e.metadata, e.namer)
+		set.offsets = e.offsets
+		success := 0.0
+		for _, operator := range operators {
+			group := probeGroup(target, operator)
+			data, series, err := e.collectTarget(ctx, target, group, operator)
+			if target.failsOn(err) {
+				writeError(w, fmt.Sprintf("Failed to fetch target: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if len(data) > 0 || len(series) > 0 {
+				success = 1
+			}
+
+			c := e.newCollection(group, operatorLabels(operator, multiTenant), data)
+			c.series = series
+			c.upstreamTimes = e.upstreamTimes.lookup(target, operator)
+			e.addCollection(set, c)
+		}
+		set.limit(e.config.SeriesLimits.PerCategory, e.config.SeriesLimits.Total)
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cnaasprom_probe_success",
+			Help: "Whether data was fetched from the probed target",
+		})
+		probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "cnaasprom_probe_duration_seconds",
+			Help: "Time taken to fetch the probed target",
+		})
+		probeSuccess.Set(success)
+		probeDuration.Set(time.Since(start).Seconds())
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeSuccess, probeDuration)
+
+		gatherer := prometheus.Gatherers{registry, set}
+		promhttp.HandlerFor(unitGatherer{gatherer, e.namer.metadata(e.metadata)}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}), "probe")
+}
+
+// Group the rates of a probed target are tracked under
+func probeGroup(t *scrapeTarget, operator string) string {
+	return "probe/" + t.name + "/" + operator
+}
+
+// The configured target of the module at address, or else the one
+// discovered in kubernetes; nil if there is neither
+func (e *Exporter) knownProbeTarget(ctx context.Context, module *scrapeTarget, address string) (*scrapeTarget, error) {
+	for _, t := range e.targets {
+		if t.moduleName == module.moduleName && serverHost(t.server) == address {
+			return t, nil
+		}
+	}
+	if e.discovery == nil {
+		return nil, nil
+	}
+
+	discovered, err := e.discovery.Targets(ctx, module)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range discovered {
+		if serverHost(t.server) == address {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+// A target at address with the settings of the module but none of its
+// credentials. It gets its own client, so that connections and the state of
+// its limits go away with it.
+func (e *Exporter) anonymousProbeTarget(module *scrapeTarget, address string, host string, port uint) (*scrapeTarget, error) {
+	options := newClientOptions(e.config, e.spiffe, e.rateLimits)
+	options.signing = config.RequestSigningConfig{}
+	server := config.RemoteServer{Address: host, Port: port}
+	target, err := newScrapeTarget(address, server, withoutCredentials(module.module), prometheus.Labels{}, options)
+	if err != nil {
+		return nil, err
+	}
+	target.moduleName = module.moduleName
+	target.anonymous = true
+	return target, nil
+}
+
+// Drop what was kept of a probed target that is not probed again
+func (e *Exporter) forgetTarget(t *scrapeTarget, operators []string) {
+	baseTransport(t.client).CloseIdleConnections()
+	e.status.forget(t)
+	e.responses.forget(serverHost(t.server))
+	for _, operator := range operators {
+		e.rates.forget(probeGroup(t, operator))
+		e.upstreamTimes.forget(t, operator)
+	}
+}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Statistics server recording the Authorization and X-Token headers it receives
+type credentialsServer struct {
+	address string
+	port    uint
+
+	mu      sync.Mutex
+	headers []string
+}
+
+func newCredentialsServer(t *testing.T) *credentialsServer {
+	t.Helper()
+	s := &credentialsServer{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.headers = append(s.headers, r.Header.Get("Authorization")+"|"+r.Header.Get("X-Token"))
+		s.mu.Unlock()
+		fmt.Fprint(w, `{"registration": {"attempts": 1}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 16)
+	s.address, s.port = host, uint(p)
+	return s
+}
+
+func (s *credentialsServer) target() string {
+	return net.JoinHostPort(s.address, strconv.Itoa(int(s.port)))
+}
+
+func (s *credentialsServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.headers...)
+}
+
+func probe(handler http.Handler, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/probe?module=amf&target="+target, nil))
+	return recorder
+}
+
+// Only configured targets get the module's credentials; others are probed
+// without any when allowed, and nothing of them is kept
+func TestProbeCredentials(t *testing.T) {
+	configured := newCredentialsServer(t)
+	other := newCredentialsServer(t)
+	exporter, err := NewExporter(&config.Config{
+		Modules: map[string]config.Module{
+			"amf": {Categories: []string{"amf"}, Auth: config.TargetAuth{BearerToken: "secret"}},
+		},
+		Targets: []config.Target{
+			{Name: "core", Address: configured.address, Port: configured.port, Module: "amf"},
+		},
+		CategoryHeaders: map[string]map[string]config.Secret{"amf": {"X-Token": "category-secret"}},
+		Rates:           config.RateConfig{Metrics: []string{".*_attempts"}, Delta: true},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := false
+	handler := exporter.ProbeHandler(func(module string, target string) bool { return allowed })
+
+	if recorder := probe(handler, configured.target()); recorder.Code != http.StatusOK {
+		t.Fatalf("probe of the configured target: status %d: %s", recorder.Code, recorder.Body)
+	}
+	if got := configured.received(); len(got) != 1 || got[0] != "Bearer secret|category-secret" {
+		t.Errorf("configured target received %q, want the module and category credentials", got)
+	}
+
+	if recorder := probe(handler, other.target()); recorder.Code != http.StatusForbidden {
+		t.Errorf("probe of a target not allowed: status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	if got := other.received(); len(got) != 0 {
+		t.Errorf("target not allowed was fetched: %q", got)
+	}
+
+	allowed = true
+	recorder := probe(handler, other.target())
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "amf_registration_attempts 1") {
+		t.Fatalf("probe of an allowed target: status %d: %s", recorder.Code, recorder.Body)
+	}
+	if got := other.received(); len(got) != 1 || got[0] != "|" {
+		t.Errorf("allowed target received %q, want no credentials", got)
+	}
+
+	for _, status := range exporter.status.list() {
+		if status.Server == other.target() {
+			t.Errorf("status of the allowed target kept after the probe: %+v", status)
+		}
+	}
+	for key := range exporter.rates.previous {
+		if strings.Contains(key, other.target()) {
+			t.Errorf("rate state of the allowed target kept after the probe: %q", key)
+		}
+	}
+}
+
+// UERANSIM modules run nr-cli with the target, so only configured targets
+// are probed
+func TestProbeRejectsUnconfiguredUERANSIMTarget(t *testing.T) {
+	exporter, err := NewExporter(&config.Config{
+		Modules: map[string]config.Module{"amf": {DataType: "ueransim"}},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := exporter.ProbeHandler(func(module string, target string) bool { return true })
+	if recorder := probe(handler, "UERANSIM-gnb-1:1"); recorder.Code != http.StatusForbidden {
+		t.Errorf("probe of an unconfigured UERANSIM node: status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
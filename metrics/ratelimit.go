@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errRateLimited = errors.New("request rate limit would be exceeded before the deadline")
+
+	rateLimitWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_rate_limit_wait_seconds_total",
+		Help: "Time upstream requests waited for the request rate limits",
+	}, []string{"server"})
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_upstream_retries_total",
+		Help: "Failed upstream requests retried within the retry budget",
+	}, []string{"server"})
+)
+
+// Retries a budget saves up at most, so a burst of failures after a quiet
+// period still retries only a few requests
+const maxRetryBalance = 10
+
+func init() {
+	registerInternal(rateLimitWait, upstreamRetries)
+}
+
+// tokenBucket allows rate requests per second with bursts of up to burst
+// requests. A nil bucket does not limit.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg config.RateLimit) *tokenBucket {
+	if cfg.RequestsPerSecond <= 0 {
+		return nil
+	}
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: cfg.RequestsPerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Take a token, waiting for one to become available. Fails right away when
+// the wait would outlast the deadline of ctx.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && delay > 0 && now.Add(delay).After(deadline) {
+		b.mu.Unlock()
+		b.release()
+		return 0, errRateLimited
+	}
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		b.release()
+		return 0, ctx.Err()
+	}
+}
+
+// Give back a token taken for a request that was not sent
+func (b *tokenBucket) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// rateLimiter applies the global limit shared by every upstream client and
+// a limit per server
+type rateLimiter struct {
+	global    *tokenBucket
+	perServer config.RateLimit
+
+	mu      sync.Mutex
+	servers map[string]*tokenBucket
+}
+
+// RateLimits hold the buckets of the global rate limit. Exporters given the
+// same RateLimits, such as those of successive configurations, share the
+// bucket of a limit instead of each allowing the full rate.
+type RateLimits struct {
+	mu      sync.Mutex
+	buckets map[config.RateLimit]*tokenBucket
+}
+
+func NewRateLimits() *RateLimits {
+	return &RateLimits{buckets: make(map[config.RateLimit]*tokenBucket)}
+}
+
+// The bucket of a global limit, one of its own without RateLimits
+func (r *RateLimits) bucket(limit config.RateLimit) *tokenBucket {
+	if r == nil {
+		return newTokenBucket(limit)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	bucket, ok := r.buckets[limit]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		r.buckets[limit] = bucket
+	}
+	return bucket
+}
+
+// Clients built from the same settings and limits share the global bucket
+func newRateLimiter(cfg config.RateLimitConfig, limits *RateLimits) *rateLimiter {
+	if cfg.RequestsPerSecond <= 0 && cfg.PerServer.RequestsPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{global: limits.bucket(cfg.RateLimit), perServer: cfg.PerServer, servers: make(map[string]*tokenBucket)}
+}
+
+func (l *rateLimiter) bucket(server string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.servers[server]
+	if !ok {
+		bucket = newTokenBucket(l.perServer)
+		l.servers[server] = bucket
+	}
+	return bucket
+}
+
+// Take a token of the server and a global one. No token is kept when
+// either can't be had.
+func (l *rateLimiter) wait(ctx context.Context, server string) error {
+	if l == nil {
+		return nil
+	}
+
+	bucket := l.bucket(server)
+	waited, err := bucket.wait(ctx)
+	if err != nil {
+		return err
+	}
+	globalWait, err := l.global.wait(ctx)
+	if waited += globalWait; waited > 0 {
+		rateLimitWait.WithLabelValues(server).Add(waited.Seconds())
+	}
+	if err != nil {
+		bucket.release()
+	}
+	return err
+}
+
+// Give back the tokens taken by wait for a request that was not sent
+func (l *rateLimiter) release(server string) {
+	if l == nil {
+		return
+	}
+	l.bucket(server).release()
+	l.global.release()
+}
+
+// retryBudget lets failed requests be retried as long as retries stay below
+// ratio of the requests. Every request adds ratio to the balance and every
+// retry takes one. A nil budget never retries.
+type retryBudget struct {
+	ratio      float64
+	maxRetries int
+
+	mu      sync.Mutex
+	balance float64
+}
+
+func newRetryBudget(cfg config.RetryBudgetConfig) *retryBudget {
+	if cfg.Ratio <= 0 {
+		return nil
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries < 1 {
+		maxRetries = 1
+	}
+	return &retryBudget{ratio: cfg.Ratio, maxRetries: maxRetries}
+}
+
+// Count a request sent for the first time
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.balance = min(b.balance+b.ratio, maxRetryBalance)
+	b.mu.Unlock()
+}
+
+// Whether the given retry of a request may be sent
+func (b *retryBudget) withdraw(retry int) bool {
+	if b == nil || retry > b.maxRetries {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// A request failing the global limit gives back the token of its server
+func TestRateLimiterReleasesTokens(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimitConfig{
+		RateLimit: config.RateLimit{RequestsPerSecond: 0.01, Burst: 1},
+		PerServer: config.RateLimit{RequestsPerSecond: 0.01, Burst: 1},
+	}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := limiter.wait(ctx, "amf:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.wait(ctx, "smf:8080"); err != errRateLimited {
+		t.Fatalf("second request: got %v, want %v", err, errRateLimited)
+	}
+	if tokens := limiter.servers["smf:8080"].tokens; tokens != 1 {
+		t.Errorf("server left with %v tokens, want its token back", tokens)
+	}
+
+	limiter.release("amf:8080")
+	if err := limiter.wait(ctx, "amf:8080"); err != nil {
+		t.Errorf("tokens of an unsent request not released: %v", err)
+	}
+}
+
+// Failed requests are retried only as far as the budget saved up by the
+// requests before them allows
+func TestRetryBudget(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	client, err := newHTTPClient(config.RemoteServer{}, newClientOptions(&config.Config{
+		RateLimit: config.RateLimitConfig{RetryBudget: config.RetryBudgetConfig{Ratio: 0.5}},
+	}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() int {
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Half a retry saved up
+	if status := get(); status != http.StatusServiceUnavailable || requests.Load() != 1 {
+		t.Errorf("first request: status %d after %d requests, want no retry", status, requests.Load())
+	}
+	requests.Store(0)
+	if status := get(); status != http.StatusOK || requests.Load() != 2 {
+		t.Errorf("second request: status %d after %d requests, want one retry", status, requests.Load())
+	}
+}
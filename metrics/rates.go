@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var counterResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cnaasprom_upstream_restarts_total",
+	Help: "Polls in which counters of a category decreased, e.g. after the network function restarted",
+}, []string{"category"})
+
+func init() {
+	registerInternal(counterResets)
+}
+
+// RateTracker keeps the previous value of counter-like metrics between polls
+// and computes per-interval deltas and per-second rates from them
+type RateTracker struct {
+	mu       sync.Mutex
+	patterns []*regexp.Regexp
+	delta    bool
+	rate     bool
+	previous map[string]rateSample
+	// Configured categories, whose restarts are counted
+	categories map[string]bool
+}
+
+type rateSample struct {
+	value     float64
+	timestamp time.Time
+	// Set when observed for a poll, whose derived values the scrapes serving
+	// the polled value reuse
+	polled bool
+	// Increase and seconds since the previous sample, unless it is the first
+	derived bool
+	delta   float64
+	elapsed float64
+}
+
+// NewRateTracker tracks the metrics of the given configured categories
+func NewRateTracker(cfg config.RateConfig, categories []string) (*RateTracker, error) {
+	tracker := &RateTracker{
+		delta:      cfg.Delta,
+		rate:       cfg.Rate,
+		previous:   make(map[string]rateSample),
+		categories: make(map[string]bool, len(categories)),
+	}
+	for _, category := range categories {
+		tracker.categories[category] = true
+	}
+
+	for _, pattern := range cfg.Metrics {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate metric pattern %q: %v", pattern, err)
+		}
+		tracker.patterns = append(tracker.patterns, re)
+	}
+
+	return tracker, nil
+}
+
+// Observe records the current values of a series group (such as an operator)
+// and returns the derived delta and rate series, keyed by metric name. A value
+// lower than the previous one is treated as a counter reset, in which case the
+// new value is the increase, and counts as one restart of its configured
+// category per poll however many of its groups and values decreased.
+// Values recorded by ObservePoll are not observed again while unchanged; their
+// derived series are those of the poll.
+func (t *RateTracker) Observe(group string, data map[string]map[string]float64, now time.Time) map[string]float64 {
+	return t.observe(group, data, now, false)
+}
+
+// ObservePoll records the values of a group polled in the background at the
+// time of the poll, once per poll however often they are served
+func (t *RateTracker) ObservePoll(group string, data map[string]map[string]float64, polled time.Time) {
+	t.observe(group, data, polled, true)
+}
+
+func (t *RateTracker) observe(group string, data map[string]map[string]float64, now time.Time, poll bool) map[string]float64 {
+	if len(t.patterns) == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	derived := make(map[string]float64)
+	resets := make(map[string]bool)
+	for category, metrics := range data {
+		for metricName, value := range metrics {
+			name := sanitizeMetricName(category + "_" + metricName)
+			if !t.matches(name) {
+				continue
+			}
+
+			key := group + "\xff" + name
+			prev, seen := t.previous[key]
+			if seen && (poll && !now.After(prev.timestamp) || !poll && prev.polled && value == prev.value) {
+				t.addDerived(derived, name, prev)
+				continue
+			}
+
+			sample := rateSample{value: value, timestamp: now, polled: poll}
+			if seen {
+				sample.derived = true
+				sample.delta = value - prev.value
+				if sample.delta < 0 {
+					sample.delta = value
+					resets[t.category(category)] = true
+				}
+				sample.elapsed = now.Sub(prev.timestamp).Seconds()
+			}
+			t.previous[key] = sample
+			t.addDerived(derived, name, sample)
+		}
+	}
+	for category := range resets {
+		counterResets.WithLabelValues(category).Inc()
+	}
+	return derived
+}
+
+// Configured category of a key of the observed data. Statistics are keyed by
+// the category and the group within it, e.g. amf_registration.
+func (t *RateTracker) category(key string) string {
+	category := key
+	for !t.categories[category] {
+		i := strings.LastIndexByte(category, '_')
+		if i < 0 {
+			return key
+		}
+		category = category[:i]
+	}
+	return category
+}
+
+func (t *RateTracker) addDerived(derived map[string]float64, name string, sample rateSample) {
+	if !sample.derived {
+		return
+	}
+	if t.delta {
+		derived[name+"_delta"] = sample.delta
+	}
+	if t.rate && sample.elapsed > 0 {
+		derived[name+"_rate"] = sample.delta / sample.elapsed
+	}
+}
+
+// Drop the previous values of a series group
+func (t *RateTracker) forget(group string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.previous {
+		if strings.HasPrefix(key, group+"\xff") {
+			delete(t.previous, key)
+		}
+	}
+}
+
+func (t *RateTracker) matches(name string) bool {
+	for _, re := range t.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Help text for a series returned by Observe
+func rateHelp(name string) string {
+	if strings.HasSuffix(name, "_rate") {
+		return fmt.Sprintf("Per-second rate of %s between the last two polls", strings.TrimSuffix(name, "_rate"))
+	}
+	return fmt.Sprintf("Increase of %s between the last two polls", strings.TrimSuffix(name, "_delta"))
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Scrapes serving the values of the scheduler's last poll get the rates of
+// that poll, however many scrapes there are between polls
+func TestScheduledRatesOncePerPoll(t *testing.T) {
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     *newStatisticsServer(t),
+		MetricsStatisticsCategory: []string{"amf"},
+		Rates:                     config.RateConfig{Metrics: []string{".*_attempts"}, Delta: true, Rate: true},
+		Schedule:                  config.ScheduleConfig{Enabled: true, Interval: time.Hour},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := exporter.Scheduler()
+	scheduler.results = make(map[string]scheduledResult)
+
+	// The statistics server counts the attempts up by one per request
+	ctx := context.Background()
+	scheduler.poll(ctx, scheduler.polls[0])
+	time.Sleep(10 * time.Millisecond)
+	scheduler.poll(ctx, scheduler.polls[0])
+
+	var rate float64
+	for i := 0; i < 3; i++ {
+		collections, err := exporter.collectAll(ctx, []string{""}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rates := collections[0].rates
+		if rates["amf_registration_attempts_delta"] != 1 {
+			t.Errorf("scrape %d: delta = %v, want the increase between the polls", i, rates["amf_registration_attempts_delta"])
+		}
+		if i == 0 {
+			rate = rates["amf_registration_attempts_rate"]
+		} else if rates["amf_registration_attempts_rate"] != rate {
+			t.Errorf("scrape %d: rate = %v, want %v as of the last poll", i, rates["amf_registration_attempts_rate"], rate)
+		}
+	}
+	if rate <= 0 {
+		t.Errorf("rate = %v, want the rate between the polls", rate)
+	}
+}
+
+// Values that changed since the poll, e.g. once the scheduler stopped and
+// scrapes fetch again, are observed by the scrapes
+func TestObserveAfterPoll(t *testing.T) {
+	tracker, err := NewRateTracker(config.RateConfig{Metrics: []string{".*"}, Delta: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	tracker.ObservePoll("op", map[string]map[string]float64{"amf": {"attempts": 10}}, start)
+	tracker.ObservePoll("op", map[string]map[string]float64{"amf": {"attempts": 15}}, start.Add(time.Minute))
+	// A repeated poll result is not observed again
+	tracker.ObservePoll("op", map[string]map[string]float64{"amf": {"attempts": 15}}, start.Add(time.Minute))
+
+	if got := tracker.Observe("op", map[string]map[string]float64{"amf": {"attempts": 15}}, start.Add(2*time.Minute)); got["amf_attempts_delta"] != 5 {
+		t.Errorf("delta of the polled value = %v, want 5", got["amf_attempts_delta"])
+	}
+	if got := tracker.Observe("op", map[string]map[string]float64{"amf": {"attempts": 18}}, start.Add(3*time.Minute)); got["amf_attempts_delta"] != 3 {
+		t.Errorf("delta of a fetched value = %v, want 3", got["amf_attempts_delta"])
+	}
+}
+
+// A poll in which several groups of a category decrease counts as one
+// restart of the configured category
+func TestCounterResetsPerCategory(t *testing.T) {
+	tracker, err := NewRateTracker(config.RateConfig{Metrics: []string{".*"}, Delta: true}, []string{"amf", "amf_n2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets := func(category string) float64 {
+		var metric dto.Metric
+		if err := counterResets.WithLabelValues(category).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	before, beforeN2 := resets("amf"), resets("amf_n2")
+
+	start := time.Now()
+	tracker.Observe("", map[string]map[string]float64{
+		"amf_registration": {"attempts": 10, "success": 8},
+		"amf_session":      {"attempts": 5},
+		"amf_n2_setup":     {"attempts": 3},
+	}, start)
+	tracker.Observe("", map[string]map[string]float64{
+		"amf_registration": {"attempts": 1, "success": 1},
+		"amf_session":      {"attempts": 1},
+		"amf_n2_setup":     {"attempts": 4},
+	}, start.Add(time.Minute))
+
+	if n := resets("amf") - before; n != 1 {
+		t.Errorf("%v restarts of amf counted, want one", n)
+	}
+	if n := resets("amf_n2") - beforeN2; n != 0 {
+		t.Errorf("%v restarts of amf_n2 counted, want none", n)
+	}
+	if n := resets("amf_registration"); n != 0 {
+		t.Errorf("restarts counted under the group amf_registration")
+	}
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies for upstream redirects, set by redirects.policy
+const (
+	redirectFollow   = "follow"
+	redirectSameHost = "same-host"
+	redirectDisallow = "disallow"
+)
+
+// Redirects followed unless configured, as by the default HTTP client
+const defaultMaxRedirects = 10
+
+// Reasons a redirect fails a fetch
+const (
+	redirectReasonDisallowed = "disallowed"
+	redirectReasonCrossHost  = "cross_host"
+	redirectReasonTooMany    = "too_many"
+	redirectReasonHTML       = "html"
+)
+
+var upstreamRedirectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cnaasprom_upstream_redirect_errors_total",
+	Help: "Upstream fetches failed by a redirect, by reason",
+}, []string{"server", "reason"})
+
+func init() {
+	registerInternal(upstreamRedirectErrors)
+}
+
+// redirectError is returned for fetches failed by a redirect: one the
+// policy doesn't follow, or one ending at an HTML page instead of the API,
+// usually the login page of an expired session
+type redirectError struct {
+	code     int
+	location string
+	reason   string
+}
+
+func (e *redirectError) Error() string {
+	switch e.reason {
+	case redirectReasonDisallowed:
+		return fmt.Sprintf("upstream redirected with status %d to %s; redirects are disallowed", e.code, e.location)
+	case redirectReasonCrossHost:
+		return fmt.Sprintf("upstream redirected with status %d to another host, %s", e.code, e.location)
+	case redirectReasonTooMany:
+		return fmt.Sprintf("upstream redirected with status %d to %s after too many redirects", e.code, e.location)
+	}
+	return fmt.Sprintf("upstream redirected to %s, which returned an HTML page instead of the API response; the session may have expired", e.location)
+}
+
+func checkRedirectPolicy(cfg config.RedirectConfig) error {
+	switch cfg.Policy {
+	case "", redirectFollow, redirectSameHost, redirectDisallow:
+	default:
+		return fmt.Errorf("unsupported redirects policy %q, use follow, same-host or disallow", cfg.Policy)
+	}
+	if cfg.MaxRedirects < 0 {
+		return fmt.Errorf("redirects maxRedirects must not be negative")
+	}
+	return nil
+}
+
+// The CheckRedirect function of the upstream clients enforcing the policy
+func redirectPolicy(cfg config.RedirectConfig) func(req *http.Request, via []*http.Request) error {
+	maxRedirects := defaultMaxRedirects
+	if cfg.MaxRedirects > 0 {
+		maxRedirects = cfg.MaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		reason := ""
+		switch {
+		case cfg.Policy == redirectDisallow:
+			reason = redirectReasonDisallowed
+		case cfg.Policy == redirectSameHost && req.URL.Host != via[0].URL.Host:
+			reason = redirectReasonCrossHost
+		case len(via) > maxRedirects:
+			reason = redirectReasonTooMany
+		default:
+			return nil
+		}
+		upstreamRedirectErrors.WithLabelValues(via[0].URL.Host, reason).Inc()
+		return &redirectError{code: req.Response.StatusCode, location: req.URL.String(), reason: reason}
+	}
+}
+
+// Fail a response that was redirected to an HTML page, which no upstream
+// API serves, rather than leaving it to fail parsing
+func checkRedirectedResponse(req *http.Request, resp *http.Response) error {
+	if resp.Request == nil || resp.Request.URL.String() == req.URL.String() {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	upstreamRedirectErrors.WithLabelValues(req.URL.Host, redirectReasonHTML).Inc()
+	return &redirectError{code: resp.StatusCode, location: resp.Request.URL.String(), reason: redirectReasonHTML}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// The same-host policy doesn't follow redirects to other hosts, which
+// would get the request's credentials
+func TestSameHostRedirects(t *testing.T) {
+	var reached atomic.Bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Store(true)
+	}))
+	t.Cleanup(other.Close)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/stats", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, other.URL+"/stats", http.StatusFound)
+		case "/login":
+			http.Redirect(w, r, "/login.html", http.StatusFound)
+		case "/login.html":
+			w.Header().Set("Content-Type", "text/html")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	client, err := newHTTPClient(config.RemoteServer{}, newClientOptions(&config.Config{Redirects: config.RedirectConfig{Policy: "same-host"}}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(path string) error {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkRedirectedResponse(req, resp)
+	}
+
+	if err := fetch("/moved"); err != nil {
+		t.Errorf("redirect on the same host: %v", err)
+	}
+	var redirect *redirectError
+	if err := fetch("/away"); !errors.As(err, &redirect) || redirect.reason != redirectReasonCrossHost || reached.Load() {
+		t.Errorf("redirect to another host: %v", err)
+	}
+	if err := fetch("/login"); !errors.As(err, &redirect) || redirect.reason != redirectReasonHTML {
+		t.Errorf("redirect to a login page: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisKeyPrefix = "cnaasprom"
+	defaultRedisKeyTTL    = 24 * time.Hour
+)
+
+var storeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cnaasprom_store_errors_total",
+	Help: "Failed operations on the store of streamed values",
+}, []string{"operation"})
+
+func init() {
+	registerInternal(storeErrors)
+}
+
+// RedisStore keeps the streamed values and polled results in Redis so that
+// replicas share them. The values of a category are a hash of metric names
+// to the value and the time it was updated; sorted sets list the operators
+// and their categories, scored by the time they were last updated.
+//
+//	<prefix>:index:operators                operators
+//	<prefix>:index:categories:<operator>    categories of an operator
+//	<prefix>:values:<operator>:<category>   metric -> "<value> <unix ms>"
+//	<prefix>:polled:<key>                   encoded poll result
+//
+// Operators, categories and poll keys are query-escaped in the keys. Keys
+// and listed members expire once not updated for the key TTL: the stale
+// series TTL, or the configured key TTL without one. Failures are logged
+// and counted; a snapshot then misses the values it could not read.
+type RedisStore struct {
+	client  *redis.Client
+	spiffe  *spiffeSources
+	prefix  string
+	timeout time.Duration
+	keyTTL  time.Duration
+
+	mu  sync.Mutex
+	ttl time.Duration
+}
+
+func NewRedisStore(cfg config.RedisConfig, policy config.TLSPolicy) (*RedisStore, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("redis store requires an address")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		return nil, fmt.Errorf("invalid redis address %q: %v", cfg.Address, err)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.KeyTTL <= 0 {
+		cfg.KeyTTL = defaultRedisKeyTTL
+	}
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+
+	options := &redis.Options{
+		Addr:         cfg.Address,
+		Username:     cfg.Username,
+		Password:     string(cfg.Password),
+		DB:           cfg.DB,
+		DialTimeout:  cfg.Timeout,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+	}
+	spiffe := newSPIFFESources()
+	if cfg.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(cfg.TLS, policy, spiffe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for redis: %v", err)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(cfg.Address)
+		}
+		options.TLSConfig = tlsConfig
+	}
+	return &RedisStore{client: redis.NewClient(options), spiffe: spiffe, prefix: prefix, timeout: cfg.Timeout, keyTTL: cfg.KeyTTL}, nil
+}
+
+// Close closes the connections to Redis and the Workload API
+func (s *RedisStore) Close() error {
+	return errors.Join(s.client.Close(), s.spiffe.Close())
+}
+
+func (s *RedisStore) SetTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// The stale series TTL, and the time keys and listed members are kept for
+func (s *RedisStore) ttls() (time.Duration, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ttl > 0 {
+		return s.ttl, s.ttl
+	}
+	return 0, s.keyTTL
+}
+
+func (s *RedisStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *RedisStore) Update(operator string, category string, metrics map[string]float64) {
+	if len(metrics) == 0 {
+		return
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	_, keyTTL := s.ttls()
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.update(ctx, pipe, operator, category, metrics, time.Now(), keyTTL)
+		return nil
+	}); err != nil {
+		s.fail("update", err)
+	}
+}
+
+func (s *RedisStore) update(ctx context.Context, pipe redis.Pipeliner, operator string, category string, metrics map[string]float64, updated time.Time, keyTTL time.Duration) {
+	stamp := strconv.FormatInt(updated.UnixMilli(), 10)
+	fields := make([]interface{}, 0, 2*len(metrics))
+	for metricName, value := range metrics {
+		fields = append(fields, metricName, strconv.FormatFloat(value, 'g', -1, 64)+" "+stamp)
+	}
+	score := float64(updated.UnixMilli())
+	pipe.ZAdd(ctx, s.operatorsKey(), redis.Z{Score: score, Member: operator})
+	pipe.ZAdd(ctx, s.categoriesKey(operator), redis.Z{Score: score, Member: category})
+	pipe.HSet(ctx, s.valuesKey(operator, category), fields...)
+	pipe.PExpire(ctx, s.operatorsKey(), keyTTL)
+	pipe.PExpire(ctx, s.categoriesKey(operator), keyTTL)
+	pipe.PExpire(ctx, s.valuesKey(operator, category), keyTTL)
+}
+
+// Drop the members of a sorted set not updated within keyTTL and return
+// the others
+func (s *RedisStore) members(ctx context.Context, key string, keyTTL time.Duration) ([]string, error) {
+	var members *redis.StringSliceCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(time.Now().Add(-keyTTL).UnixMilli(), 10))
+		members = pipe.ZRange(ctx, key, 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members.Val(), nil
+}
+
+func (s *RedisStore) Snapshot(operator string) map[string]map[string]float64 {
+	ctx, cancel := s.context()
+	defer cancel()
+	ttl, keyTTL := s.ttls()
+
+	snapshot := make(map[string]map[string]float64)
+	categories, err := s.members(ctx, s.categoriesKey(operator), keyTTL)
+	if err != nil {
+		s.fail("snapshot", err)
+		return snapshot
+	}
+	if len(categories) == 0 {
+		return snapshot
+	}
+
+	values := make([]*redis.MapStringStringCmd, len(categories))
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, category := range categories {
+			values[i] = pipe.HGetAll(ctx, s.valuesKey(operator, category))
+		}
+		return nil
+	}); err != nil {
+		s.fail("snapshot", err)
+		return snapshot
+	}
+
+	expired := make(map[string][]string)
+	for i, category := range categories {
+		metrics := make(map[string]float64, len(values[i].Val()))
+		for metricName, stored := range values[i].Val() {
+			value, updated, err := parseStoredValue(stored)
+			if err != nil {
+				log.Printf("Ignoring stored value of %s in category %s: %v", metricName, category, err)
+				continue
+			}
+			if ttl > 0 && time.Since(updated) > ttl {
+				expired[category] = append(expired[category], metricName)
+				continue
+			}
+			metrics[metricName] = value
+		}
+		if len(metrics) > 0 {
+			snapshot[category] = metrics
+		}
+	}
+	if len(expired) > 0 {
+		if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for category, stale := range expired {
+				expiredSeries.Add(float64(len(stale)))
+				pipe.HDel(ctx, s.valuesKey(operator, category), stale...)
+			}
+			return nil
+		}); err != nil {
+			s.fail("expire", err)
+		}
+	}
+	return snapshot
+}
+
+// Restored values expire like values updated now
+func (s *RedisStore) Restore(data map[string]map[string]map[string]float64) {
+	if len(data) == 0 {
+		return
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	_, keyTTL := s.ttls()
+	now := time.Now()
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for operator, categories := range data {
+			for category, metrics := range categories {
+				pipe.Del(ctx, s.valuesKey(operator, category))
+				if len(metrics) > 0 {
+					s.update(ctx, pipe, operator, category, metrics, now, keyTTL)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		s.fail("restore", err)
+	}
+}
+
+func (s *RedisStore) Operators() []string {
+	ctx, cancel := s.context()
+	defer cancel()
+	_, keyTTL := s.ttls()
+	operators, err := s.members(ctx, s.operatorsKey(), keyTTL)
+	if err != nil {
+		s.fail("operators", err)
+		return nil
+	}
+	return operators
+}
+
+// SetPolled shares a poll result with the other replicas
+func (s *RedisStore) SetPolled(key string, result []byte, ttl time.Duration) {
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.client.Set(ctx, s.polledKey(key), result, ttl).Err(); err != nil {
+		s.fail("set_polled", err)
+	}
+}
+
+// Polled returns the poll result of any replica unless it expired
+func (s *RedisStore) Polled(key string) ([]byte, bool) {
+	ctx, cancel := s.context()
+	defer cancel()
+	result, err := s.client.Get(ctx, s.polledKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	}
+	if err != nil {
+		s.fail("polled", err)
+		return nil, false
+	}
+	return result, true
+}
+
+func (s *RedisStore) DeletePolled(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = s.polledKey(key)
+	}
+	if err := s.client.Del(ctx, redisKeys...).Err(); err != nil {
+		s.fail("delete_polled", err)
+	}
+}
+
+func (s *RedisStore) operatorsKey() string {
+	return s.prefix + ":index:operators"
+}
+
+func (s *RedisStore) categoriesKey(operator string) string {
+	return s.prefix + ":index:categories:" + url.QueryEscape(operator)
+}
+
+func (s *RedisStore) valuesKey(operator string, category string) string {
+	return s.prefix + ":values:" + url.QueryEscape(operator) + ":" + url.QueryEscape(category)
+}
+
+func (s *RedisStore) polledKey(key string) string {
+	return s.prefix + ":polled:" + url.QueryEscape(key)
+}
+
+func (s *RedisStore) fail(operation string, err error) {
+	storeErrors.WithLabelValues(operation).Inc()
+	log.Printf("Redis store %s failed: %v", operation, err)
+}
+
+func parseStoredValue(stored string) (float64, time.Time, error) {
+	valueText, stampText, ok := strings.Cut(stored, " ")
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("malformed value %q", stored)
+	}
+	value, err := strconv.ParseFloat(valueText, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	stamp, err := strconv.ParseInt(stampText, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return value, time.UnixMilli(stamp), nil
+}
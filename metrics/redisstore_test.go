@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisStore(t *testing.T, server *miniredis.Miniredis, cfg config.RedisConfig) *RedisStore {
+	t.Helper()
+	cfg.Address = server.Addr()
+	store, err := NewRedisStore(cfg, config.TLSPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisStoreValues(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server, config.RedisConfig{KeyPrefix: "test"})
+	store.SetTTL(time.Minute)
+
+	store.Update("op 1", "amf", map[string]float64{"registrations": 3, "failures": 0.5})
+	store.Update("op 1", "smf", map[string]float64{"sessions": 7})
+
+	snapshot := store.Snapshot("op 1")
+	if snapshot["amf"]["registrations"] != 3 || snapshot["amf"]["failures"] != 0.5 || snapshot["smf"]["sessions"] != 7 {
+		t.Errorf("snapshot = %v", snapshot)
+	}
+	if operators := store.Operators(); len(operators) != 1 || operators[0] != "op 1" {
+		t.Errorf("operators = %q, want [op 1]", operators)
+	}
+
+	for _, key := range []string{"test:index:operators", "test:index:categories:op+1", "test:values:op+1:amf"} {
+		if ttl := server.TTL(key); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("TTL of %s = %s, want at most the stale series TTL", key, ttl)
+		}
+	}
+
+	// Members not updated within the TTL are dropped from the listings
+	server.ZAdd("test:index:operators", float64(time.Now().Add(-2*time.Minute).UnixMilli()), "gone")
+	server.ZAdd("test:index:categories:op+1", float64(time.Now().Add(-2*time.Minute).UnixMilli()), "gone")
+	if operators := store.Operators(); len(operators) != 1 {
+		t.Errorf("operators = %q, want the stale operator dropped", operators)
+	}
+	if snapshot := store.Snapshot("op 1"); len(snapshot) != 2 {
+		t.Errorf("snapshot = %v, want the stale category dropped", snapshot)
+	}
+
+	// Without a stale series TTL keys still expire after the key TTL
+	store.SetTTL(0)
+	store.Update("op 2", "amf", map[string]float64{"registrations": 1})
+	if ttl := server.TTL("test:values:op+2:amf"); ttl != defaultRedisKeyTTL {
+		t.Errorf("TTL without a stale series TTL = %s, want %s", ttl, defaultRedisKeyTTL)
+	}
+	server.FastForward(defaultRedisKeyTTL + time.Second)
+	if snapshot := store.Snapshot("op 2"); len(snapshot) != 0 {
+		t.Errorf("snapshot after the key TTL = %v, want none", snapshot)
+	}
+}
+
+func TestRedisStorePolled(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server, config.RedisConfig{})
+
+	store.SetPolled("schedule/op/amf", []byte(`{"data":{}}`), time.Minute)
+	if result, ok := store.Polled("schedule/op/amf"); !ok || string(result) != `{"data":{}}` {
+		t.Errorf("Polled = %q, %t", result, ok)
+	}
+	server.FastForward(time.Minute)
+	if _, ok := store.Polled("schedule/op/amf"); ok {
+		t.Errorf("poll result kept after its TTL")
+	}
+
+	store.SetPolled("a", []byte("1"), time.Minute)
+	store.DeletePolled("a")
+	if _, ok := store.Polled("a"); ok {
+		t.Errorf("poll result kept after DeletePolled")
+	}
+}
+
+func TestRedisStoreTLS(t *testing.T) {
+	cert, caPEM := newTestCertificate(t)
+	server := miniredis.NewMiniRedis()
+	if err := server.StartTLS(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	store := newTestRedisStore(t, server, config.RedisConfig{TLS: config.TLSClientConfig{Enabled: true, CA: config.Secret(caPEM)}})
+	store.Update("", "amf", map[string]float64{"registrations": 1})
+	if snapshot := store.Snapshot(""); snapshot["amf"]["registrations"] != 1 {
+		t.Errorf("snapshot over TLS = %v", snapshot)
+	}
+}
+
+// Self-signed certificate for 127.0.0.1 and its PEM encoding
+func newTestCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cnaasprom test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// Replicas sharing a store serve the collections another one fetched
+func TestSharedFetchedCollections(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"registration": {"attempts": %d}}`, requests.Add(1))
+	}))
+	t.Cleanup(upstream.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	server := miniredis.RunT(t)
+	replicas := make([]*Exporter, 2)
+	for i := range replicas {
+		exporter, err := NewExporter(&config.Config{
+			RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+			MetricsStatisticsCategory: []string{"amf"},
+			MinFetchInterval:          time.Minute,
+		}, newTestRedisStore(t, server, config.RedisConfig{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[i] = exporter
+	}
+
+	for i, exporter := range replicas {
+		collections, err := exporter.fetchCollections(context.Background(), []string{""}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := collections[0].data["amf_registration"]["attempts"]; got != 1 {
+			t.Errorf("replica %d serves attempts %v, want 1", i, got)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream fetched %d times, want once", n)
+	}
+}
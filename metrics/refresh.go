@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var errUnknownTarget = errors.New("unknown target")
+
+// Refresh drops the data kept of every target, or of the configured target
+// named, and fetches it again right away, e.g. after a maintenance of the
+// upstream APIs. The last polls, cached responses and collections reused
+// within the minimum fetch interval are dropped, here and in a shared store,
+// and the scheduler polls its categories now.
+func (e *Exporter) Refresh(ctx context.Context, name string) error {
+	targets := append([]*scrapeTarget{e.defaultTarget}, e.targets...)
+	if name != "" {
+		targets = nil
+		for _, t := range e.targets {
+			if t.name == name {
+				targets = append(targets, t)
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("%w %s", errUnknownTarget, name)
+		}
+	}
+
+	// Results shared with replicas are dropped too
+	operators, multiTenant := e.configuredOperators()
+	var shared []string
+	for _, t := range targets {
+		t.mu.Lock()
+		clear(t.polled)
+		t.mu.Unlock()
+		for _, operator := range operators {
+			shared = append(shared, targetPollKey(t, operator))
+		}
+	}
+	e.responses.clear()
+	e.mu.Lock()
+	shared = append(shared, fetchedPollKey(defaultFetchKey))
+	for key := range e.fetched {
+		if key != defaultFetchKey {
+			shared = append(shared, fetchedPollKey(key))
+		}
+	}
+	clear(e.fetched)
+	e.mu.Unlock()
+	if e.polls != nil {
+		e.polls.DeletePolled(shared...)
+	}
+
+	if name == "" {
+		e.scheduler.pollAll(ctx)
+	}
+	_, err := e.fetchCollections(ctx, operators, multiTenant)
+	return err
+}
+
+// RefreshHandler refreshes all targets on POST, or the one named by the
+// target parameter
+func (e *Exporter) RefreshHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeError(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.URL.Query().Get("target")
+		if err := e.Refresh(r.Context(), name); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, errUnknownTarget) {
+				code = http.StatusNotFound
+			}
+			writeError(w, fmt.Sprintf("Failed to refresh: %v", err), code)
+			return
+		}
+		if name == "" {
+			log.Printf("Refreshed all targets")
+		} else {
+			log.Printf("Refreshed target %s", name)
+		}
+	})
+}
+
+// Poll every category now, if the scheduler runs
+func (s *Scheduler) pollAll(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	running := s.results != nil
+	s.mu.Unlock()
+	if !running {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range s.polls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.poll(ctx, p)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// upstreamRequest holds what is sent to a remote server besides the URL.
+// Requests without a method are sent as GET.
+type upstreamRequest struct {
+	method  string
+	headers map[string]string
+	body    []byte
+	// Category fetched, labelling the upstream response histograms
+	category string
+}
+
+// Fields available to request body templates; {{json .Operator}} quotes a
+// value as a JSON string
+type requestBodyData struct {
+	Operator string
+	Category string
+}
+
+var requestBodyFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+type categoryRequest struct {
+	method string
+	body   *template.Template
+}
+
+// RequestBuilder builds the upstream requests of categories whose API expects
+// another method than GET or a request body, e.g. a POST with a JSON filter
+type RequestBuilder struct {
+	categories map[string]*categoryRequest
+}
+
+func NewRequestBuilder(defs map[string]config.RequestConfig) (*RequestBuilder, error) {
+	b := &RequestBuilder{categories: make(map[string]*categoryRequest, len(defs))}
+	for category, def := range defs {
+		request := &categoryRequest{method: strings.ToUpper(def.Method)}
+		if request.method == "" {
+			request.method = http.MethodGet
+			if def.Body != "" {
+				request.method = http.MethodPost
+			}
+		}
+		switch request.method {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			return nil, fmt.Errorf("unsupported method %q for category %s", def.Method, category)
+		}
+
+		if def.Body != "" {
+			body, err := template.New(category).Funcs(requestBodyFuncs).Parse(def.Body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request body template for category %s: %v", category, err)
+			}
+			request.body = body
+		}
+		b.categories[category] = request
+	}
+	return b, nil
+}
+
+// Build the request of a category for an operator. A JSON content type is
+// sent with request bodies unless the headers set one.
+func (b *RequestBuilder) build(category string, operator string, headers map[string]string) (upstreamRequest, error) {
+	request := upstreamRequest{method: http.MethodGet, headers: headers, category: category}
+	def, ok := b.categories[category]
+	if !ok {
+		return request, nil
+	}
+
+	request.method = def.method
+	if def.body == nil {
+		return request, nil
+	}
+	var body bytes.Buffer
+	if err := def.body.Execute(&body, requestBodyData{Operator: operator, Category: category}); err != nil {
+		return request, fmt.Errorf("failed to render request body: %v", err)
+	}
+	request.body = body.Bytes()
+	if !hasHeader(headers, "Content-Type") {
+		request.headers = make(map[string]string, len(headers)+1)
+		for name, value := range headers {
+			request.headers[name] = value
+		}
+		request.headers["Content-Type"] = "application/json"
+	}
+	return request, nil
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for header := range headers {
+		if http.CanonicalHeaderKey(header) == http.CanonicalHeaderKey(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	responseCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_response_cache_hits_total",
+		Help: "Upstream fetches answered from the response cache",
+	}, []string{"category"})
+	responseCacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_response_cache_misses_total",
+		Help: "Upstream fetches not found in the response cache",
+	}, []string{"category"})
+)
+
+func init() {
+	registerInternal(responseCacheHits, responseCacheMisses)
+}
+
+// ResponseCache keeps parsed upstream responses, the values or the labelled
+// series of a category, keyed by their full URL for a per-category TTL.
+// Categories with a zero TTL are never cached.
+type ResponseCache struct {
+	mu         sync.Mutex
+	defaultTTL time.Duration
+	categories map[string]time.Duration
+	entries    map[string]responseCacheEntry
+}
+
+type responseCacheEntry struct {
+	data    interface{}
+	expires time.Time
+}
+
+func NewResponseCache(cfg config.ResponseCacheConfig) *ResponseCache {
+	return &ResponseCache{
+		defaultTTL: cfg.TTL,
+		categories: cfg.Categories,
+		entries:    make(map[string]responseCacheEntry),
+	}
+}
+
+func (c *ResponseCache) ttl(category string) time.Duration {
+	if ttl, ok := c.categories[category]; ok {
+		return ttl
+	}
+	return c.defaultTTL
+}
+
+// Get returns the cached response of a URL if it has not expired
+func (c *ResponseCache) Get(category string, apiURL string) (interface{}, bool) {
+	if c.ttl(category) <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[apiURL]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, apiURL)
+		responseCacheMisses.WithLabelValues(category).Inc()
+		return nil, false
+	}
+	responseCacheHits.WithLabelValues(category).Inc()
+	return entry.data, true
+}
+
+// Put stores a response. The data must not be modified afterwards.
+func (c *ResponseCache) Put(category string, apiURL string, data interface{}) {
+	ttl := c.ttl(category)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[apiURL] = responseCacheEntry{data: data, expires: time.Now().Add(ttl)}
+}
+
+// Drop the cached responses of a server, given as host:port
+func (c *ResponseCache) forget(server string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for apiURL := range c.entries {
+		if parsed, err := url.Parse(apiURL); err == nil && parsed.Host == server {
+			delete(c.entries, apiURL)
+		}
+	}
+}
+
+// Drop every cached response
+func (c *ResponseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
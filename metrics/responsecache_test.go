@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Array categories are served from the response cache like the others
+func TestResponseCacheArrays(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, `[{"cellId": "1", "throughput": 5}, {"cellId": "2", "throughput": 7}]`)
+	}))
+	t.Cleanup(upstream.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"cells"},
+		ArrayIdentifiers:          map[string]string{"cells": "cellId"},
+		ResponseCache:             config.ResponseCacheConfig{TTL: time.Hour},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var out strings.Builder
+		if err := exporter.WriteOnce(&out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), `cells_throughput{cellId="2"} 7`) {
+			t.Fatalf("collection %d lacks the cached series:\n%s", i+1, out.String())
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want the second collection served from the cache", n)
+	}
+}
@@ -0,0 +1,316 @@
+package metrics
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Series whose samples were dropped for clashing with those of another
+// target, logged once
+var loggedTargetConflicts sync.Map
+
+// sampleSet collects the samples produced during a scrape and exposes them
+// as constant metrics. Samples with the same name form one metric family.
+// The samples and metrics are partitioned by the target they were added for,
+// so the data of one target never replaces or breaks that of another.
+type sampleSet struct {
+	families map[string]*sampleFamily
+	metadata map[string]MetricMetadata
+	namer    *metricNamer
+
+	// Target of the samples and metrics added, "" for the statistics server
+	target string
+	// Metrics added with addMetric, by target
+	metrics map[string][]builtMetric
+
+	// Timestamp offsets of categories exported with explicit timestamps
+	offsets timestampOffsets
+	// Upstream collection times of the categories of the samples added
+	collected map[string]time.Time
+}
+
+type sampleFamily struct {
+	category  string
+	help      string
+	valueType prometheus.ValueType
+	samples   map[string]sample
+}
+
+type sample struct {
+	labels prometheus.Labels
+	value  float64
+	target string
+	// Upstream collection times of the categories of the sample's collection
+	collected map[string]time.Time
+}
+
+func newSampleSet(metadata map[string]MetricMetadata, namer *metricNamer) *sampleSet {
+	return &sampleSet{families: make(map[string]*sampleFamily), metadata: metadata, namer: namer, metrics: make(map[string][]builtMetric)}
+}
+
+// Add a sample, replacing an earlier sample of the same target with the same
+// labels. A sample with the same labels as another target's is dropped.
+// Samples are gauges with the given help text unless the metadata says
+// otherwise.
+func (s *sampleSet) add(name string, help string, labels prometheus.Labels, value float64) {
+	family, exists := s.families[name]
+	if !exists {
+		family = &sampleFamily{help: help, valueType: prometheus.GaugeValue, samples: make(map[string]sample)}
+		if meta, ok := s.metadata[name]; ok {
+			if meta.Help != "" {
+				family.help = meta.Help
+			}
+			family.valueType, _ = valueType(meta.Type)
+		}
+		s.families[name] = family
+	}
+	key := labelsKey(labels)
+	if existing, ok := family.samples[key]; ok && existing.target != s.target {
+		if _, logged := loggedTargetConflicts.LoadOrStore(name+"\x00"+key, true); !logged {
+			log.Printf("Dropping %s with labels %v of %s, which %s already exported", name, labels, partitionName(s.target), partitionName(existing.target))
+		}
+		return
+	}
+	family.samples[key] = sample{labels: labels, value: value, target: s.target, collected: s.collected}
+}
+
+// A metric that has already been built, with the name and category its
+// series count against the series limits under
+type builtMetric struct {
+	prometheus.Metric
+	name     string
+	category string
+}
+
+// Add a metric that has already been built, such as a histogram
+func (s *sampleSet) addMetric(name string, category string, metric prometheus.Metric) {
+	s.metrics[s.target] = append(s.metrics[s.target], builtMetric{Metric: metric, name: name, category: category})
+}
+
+// Gather builds the metric families of the samples directly rather than
+// through descriptors and constant metrics, making the set a Gatherer.
+// Metrics added with addMetric are gathered through a registry.
+func (s *sampleSet) Gather() ([]*dto.MetricFamily, error) {
+	// The families, metrics, values and label pairs of the set are each
+	// allocated at once, sized in a first pass
+	names := make([]string, 0, len(s.families))
+	labelNames := make([][]string, 0, len(s.families))
+	samples, pairCount := 0, 0
+	for name, family := range s.families {
+		names = append(names, name)
+		familyLabels := familyLabelNames(family)
+		labelNames = append(labelNames, familyLabels)
+		samples += len(family.samples)
+		pairCount += len(family.samples) * len(familyLabels)
+	}
+
+	families := make([]*dto.MetricFamily, len(names))
+	familyValues := make([]dto.MetricFamily, len(names))
+	strs := make([]string, 2*len(names))
+	types := make([]dto.MetricType, len(names))
+	metrics := make([]*dto.Metric, samples)
+	metricValues := make([]dto.Metric, samples)
+	numbers := make([]float64, samples)
+	gauges := make([]dto.Gauge, samples)
+	var timestamps []int64
+	if len(s.offsets) > 0 {
+		timestamps = make([]int64, samples)
+	}
+	pairs := make([]dto.LabelPair, pairCount)
+	pairPointers := make([]*dto.LabelPair, pairCount)
+	labelValues := make([]string, pairCount)
+
+	now := time.Now()
+	m, k := 0, 0
+	for f, name := range names {
+		family := s.families[name]
+		familyLabels := labelNames[f]
+		offsetCategory, offset, timestamped := s.offsets.lookup(family.category)
+		types[f] = dtoType(family.valueType)
+		strs[2*f], strs[2*f+1] = s.namer.name(name), family.help
+		familyValues[f] = dto.MetricFamily{Name: &strs[2*f], Help: &strs[2*f+1], Type: &types[f], Metric: metrics[m : m+len(family.samples) : m+len(family.samples)]}
+		families[f] = &familyValues[f]
+
+		for _, sample := range family.samples {
+			metric := &metricValues[m]
+			first := k
+			for j, labelName := range familyLabels {
+				labelValues[k] = sample.labels[labelName]
+				pairs[k].Name, pairs[k].Value = &familyLabels[j], &labelValues[k]
+				pairPointers[k] = &pairs[k]
+				k++
+			}
+			metric.Label = pairPointers[first:k:k]
+			if timestamped {
+				timestamps[m] = offsetTimestamp(offsetCategory, offset, sample.collected, now)
+				metric.TimestampMs = &timestamps[m]
+			}
+			numbers[m] = sample.value
+			switch types[f] {
+			case dto.MetricType_COUNTER:
+				metric.Counter = &dto.Counter{Value: &numbers[m]}
+			case dto.MetricType_UNTYPED:
+				metric.Untyped = &dto.Untyped{Value: &numbers[m]}
+			default:
+				gauges[m].Value = &numbers[m]
+				metric.Gauge = &gauges[m]
+			}
+			metrics[m] = metric
+			m++
+		}
+	}
+
+	if len(s.metrics) > 0 {
+		families = s.gatherMetrics(families)
+	}
+	return families, nil
+}
+
+// Gather the metrics added for every target through a registry of its own
+// and merge them into the families of the same name. The metrics of a target
+// that fail to gather, e.g. inconsistent histograms, are dropped without
+// failing the others, as are families whose type differs from the one
+// already gathered.
+func (s *sampleSet) gatherMetrics(families []*dto.MetricFamily) []*dto.MetricFamily {
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+
+	targets := make([]string, 0, len(s.metrics))
+	for target := range s.metrics {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(metricList(s.metrics[target]))
+		built, err := registry.Gather()
+		if err != nil {
+			log.Printf("Dropping the metrics of %s: %v", partitionName(target), err)
+			continue
+		}
+
+		for _, family := range built {
+			existing, ok := byName[family.GetName()]
+			if !ok {
+				byName[family.GetName()] = family
+				families = append(families, family)
+				continue
+			}
+			if existing.GetType() != family.GetType() {
+				log.Printf("Dropping %s of %s of type %s, already gathered as %s", family.GetName(), partitionName(target), family.GetType(), existing.GetType())
+				continue
+			}
+			existing.Metric = append(existing.Metric, family.Metric...)
+		}
+	}
+	return families
+}
+
+func partitionName(target string) string {
+	if target == "" {
+		return "the statistics server"
+	}
+	return "target " + target
+}
+
+func dtoType(valueType prometheus.ValueType) dto.MetricType {
+	switch valueType {
+	case prometheus.CounterValue:
+		return dto.MetricType_COUNTER
+	case prometheus.UntypedValue:
+		return dto.MetricType_UNTYPED
+	}
+	return dto.MetricType_GAUGE
+}
+
+// metricList collects metrics that have already been built
+type metricList []builtMetric
+
+func (l metricList) Describe(chan<- *prometheus.Desc) {}
+
+func (l metricList) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range l {
+		ch <- metric.Metric
+	}
+}
+
+func familyLabelNames(family *sampleFamily) []string {
+	// Samples of most families share their label names
+	var first prometheus.Labels
+	for _, sample := range family.samples {
+		first = sample.labels
+		break
+	}
+	names := make([]string, 0, len(first))
+	for name := range first {
+		names = append(names, name)
+	}
+	shared := true
+	for _, sample := range family.samples {
+		if len(sample.labels) != len(first) {
+			shared = false
+			break
+		}
+		for name := range sample.labels {
+			if _, ok := first[name]; !ok {
+				shared = false
+				break
+			}
+		}
+		if !shared {
+			break
+		}
+	}
+	if !shared {
+		seen := make(map[string]bool)
+		names = names[:0]
+		for _, sample := range family.samples {
+			for name := range sample.labels {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stable key identifying a label set
+func labelsKey(labels prometheus.Labels) string {
+	switch len(labels) {
+	case 0:
+		return ""
+	case 1:
+		for name, value := range labels {
+			return name + "\xff" + value + "\xff"
+		}
+	}
+
+	names := make([]string, 0, len(labels))
+	size := 0
+	for name, value := range labels {
+		names = append(names, name)
+		size += len(name) + len(value) + 2
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	key.Grow(size)
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('\xff')
+		key.WriteString(labels[name])
+		key.WriteByte('\xff')
+	}
+	return key.String()
+}
@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultScheduleInterval = time.Minute
+
+var lastScheduledPoll = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cnaasprom_schedule_last_poll_timestamp_seconds",
+	Help: "Time the scheduler last polled a category",
+}, []string{"category"})
+
+func init() {
+	registerInternal(lastScheduledPoll)
+}
+
+// Scheduler polls every category of the statistics server, and of the
+// monitoring server unless it is streamed, on its own interval. While it
+// runs, scrapes serve the results of its last poll of a category and only
+// fetch categories it has not polled yet themselves, e.g. during the startup
+// delay. Replicas sharing a store serve the results of the replica whose
+// scheduler runs. Discovered and configured targets are still fetched on
+// scrape.
+type Scheduler struct {
+	exporter *Exporter
+	config   config.ScheduleConfig
+	polls    []scheduledPoll
+
+	// The monitoring server, nil unless its categories are polled
+	monitoring *scrapeTarget
+
+	// Nil while the scheduler does not run
+	mu      sync.Mutex
+	results map[string]scheduledResult
+}
+
+// A category of a server polled on its own interval
+type scheduledPoll struct {
+	target   *scrapeTarget
+	category string
+	interval time.Duration
+}
+
+// The result of the last poll of a category for an operator
+type scheduledResult struct {
+	data   map[string]map[string]float64
+	series []labeledData
+	err    error
+}
+
+// Intervals are set per data type, statistics or monitoring, and per
+// category, the interval of a category taking precedence
+func newScheduler(e *Exporter, cfg config.ScheduleConfig, monitoring *scrapeTarget) (*Scheduler, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultScheduleInterval
+	}
+	if cfg.Jitter < 0 {
+		return nil, fmt.Errorf("invalid schedule jitter %s", cfg.Jitter)
+	}
+
+	for dataType, interval := range cfg.DataTypes {
+		if dataType != "statistics" && dataType != "monitoring" {
+			return nil, fmt.Errorf("schedule interval for unknown data type %s", dataType)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule interval %s for data type %s", interval, dataType)
+		}
+	}
+	known := make(map[string]bool)
+	for _, category := range e.config.MetricsStatisticsCategory {
+		known[category] = true
+	}
+	for _, category := range e.config.MetricsMonitoringCategory {
+		known[category] = true
+	}
+	for category, interval := range cfg.Categories {
+		if !known[category] {
+			return nil, fmt.Errorf("schedule interval for unknown category %s", category)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule interval %s for category %s", interval, category)
+		}
+	}
+
+	s := &Scheduler{exporter: e, config: cfg, monitoring: monitoring}
+	for _, t := range []*scrapeTarget{e.defaultTarget, monitoring} {
+		if t == nil {
+			continue
+		}
+		for _, category := range t.module.Categories {
+			interval := cfg.Interval
+			if typeInterval, ok := cfg.DataTypes[t.module.DataType]; ok {
+				interval = typeInterval
+			}
+			if categoryInterval, ok := cfg.Categories[category]; ok {
+				interval = categoryInterval
+			}
+			s.polls = append(s.polls, scheduledPoll{target: t, category: category, interval: interval})
+		}
+	}
+	return s, nil
+}
+
+// Categories returns the number of categories polled
+func (s *Scheduler) Categories() int {
+	return len(s.polls)
+}
+
+// Run polls every category until the context is cancelled. The results are
+// dropped when it returns, e.g. on losing the leadership, so scrapes fetch
+// again rather than serve values nobody updates.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.results = make(map[string]scheduledResult)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range s.polls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runCategory(ctx, p)
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.results = nil
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) runCategory(ctx context.Context, p scheduledPoll) {
+	next := time.Now()
+	if s.config.Align {
+		next = next.Truncate(p.interval).Add(p.interval)
+	}
+	if s.config.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.config.Jitter))))
+	}
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.poll(ctx, p)
+
+		// Skip the polls missed while this one ran, keeping the offset
+		for !next.After(time.Now()) {
+			next = next.Add(p.interval)
+		}
+	}
+}
+
+// Fetch a category for every configured operator, within the interval
+func (s *Scheduler) poll(ctx context.Context, p scheduledPoll) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	operators, _ := s.exporter.configuredOperators()
+	for _, operator := range operators {
+		data, series, err := s.fetch(ctx, p.target, operator, p.category)
+		polled := time.Now()
+		// Rates are derived once per poll, however often it is scraped
+		s.exporter.rates.ObservePoll(operator, mergedGroups(p.target, p.category, data), polled)
+
+		key := scheduledPollKey(p.target, operator, p.category)
+		s.mu.Lock()
+		running := s.results != nil
+		if running {
+			s.results[key] = scheduledResult{data: data, series: series, err: err}
+		}
+		s.mu.Unlock()
+		// Replicas that don't poll serve the result until two polls are missed
+		if running {
+			s.exporter.sharePoll(key, sharedPoll{Time: polled, Data: data, Series: series, Error: pollError(err)}, 2*p.interval)
+		}
+	}
+	lastScheduledPoll.WithLabelValues(p.category).SetToCurrentTime()
+}
+
+// Fetch a category of the statistics or monitoring server. Monitoring
+// values are returned as the group of their category.
+func (s *Scheduler) fetch(ctx context.Context, t *scrapeTarget, operator string, category string) (map[string]map[string]float64, []labeledData, error) {
+	if t != s.monitoring {
+		return s.exporter.fetchCategory(ctx, t, operator, category)
+	}
+	values, series, err := s.exporter.fetchMonitoringCategory(ctx, t, operator, category)
+	if values == nil {
+		return nil, series, err
+	}
+	return map[string]map[string]float64{category: values}, series, err
+}
+
+// The last polled result of a category for the target and operator, if the
+// scheduler runs and polled it, or a replica sharing the store did
+func (s *Scheduler) latest(t *scrapeTarget, operator string, category string) (scheduledResult, bool) {
+	if s == nil || t != s.exporter.defaultTarget && t != s.monitoring {
+		return scheduledResult{}, false
+	}
+
+	key := scheduledPollKey(t, operator, category)
+	s.mu.Lock()
+	result, ok := s.results[key]
+	s.mu.Unlock()
+	if ok {
+		return result, true
+	}
+
+	shared, ok := s.exporter.sharedPoll(key)
+	if !ok {
+		return scheduledResult{}, false
+	}
+	s.exporter.rates.ObservePoll(operator, mergedGroups(t, category, shared.Data), shared.Time)
+	return scheduledResult{data: shared.Data, series: shared.Series, err: shared.err()}, true
+}
+
+// The monitoring server polled on schedule, nil unless the scheduler polls it
+func (s *Scheduler) monitoringTarget() *scrapeTarget {
+	if s == nil {
+		return nil
+	}
+	return s.monitoring
+}
+
+// The data of a category as merged with the others of its server. Monitoring
+// values are grouped by their category already.
+func mergedGroups(t *scrapeTarget, category string, data map[string]map[string]float64) map[string]map[string]float64 {
+	if t.module.DataType == "monitoring" {
+		return data
+	}
+	return prefixCategory(category, data)
+}
+
+// The data of a category as merged with the others by fetchAndCombineJSONData
+func prefixCategory(category string, data map[string]map[string]float64) map[string]map[string]float64 {
+	prefixed := make(map[string]map[string]float64, len(data))
+	for group, metrics := range data {
+		prefixed[category+"_"+group] = metrics
+	}
+	return prefixed
+}
+
+// Key of the poll of a category, also shared through the store
+func scheduledPollKey(t *scrapeTarget, operator string, category string) string {
+	return "schedule/" + t.module.DataType + "/" + operator + "/" + category
+}
+
+// Scheduler returns the poll scheduler to run, nil unless it is enabled
+func (e *Exporter) Scheduler() *Scheduler {
+	return e.scheduler
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Intervals are set per data type and per category; monitoring categories
+// are left to their stream when streaming is enabled
+func TestScheduleIntervals(t *testing.T) {
+	cfg := &config.Config{
+		RemoteStatisticServer:     *newStatisticsServer(t),
+		MetricsStatisticsCategory: []string{"amf", "smf"},
+		MetricsMonitoringCategory: []string{"systemInfo", "ranNodeID"},
+		Schedule: config.ScheduleConfig{
+			Enabled:    true,
+			DataTypes:  map[string]time.Duration{"monitoring": 10 * time.Second, "statistics": 5 * time.Minute},
+			Categories: map[string]time.Duration{"smf": time.Minute, "ranNodeID": 30 * time.Second},
+		},
+	}
+	exporter, err := NewExporter(cfg, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals := make(map[string]time.Duration)
+	for _, p := range exporter.Scheduler().polls {
+		intervals[p.target.module.DataType+"/"+p.category] = p.interval
+	}
+	want := map[string]time.Duration{
+		"statistics/amf":        5 * time.Minute,
+		"statistics/smf":        time.Minute,
+		"monitoring/systemInfo": 10 * time.Second,
+		"monitoring/ranNodeID":  30 * time.Second,
+	}
+	if fmt.Sprint(intervals) != fmt.Sprint(want) {
+		t.Errorf("intervals = %v, want %v", intervals, want)
+	}
+
+	cfg.Streaming.Enabled = true
+	if exporter, err = NewExporter(cfg, NewCache()); err != nil {
+		t.Fatal(err)
+	}
+	if n := exporter.Scheduler().Categories(); n != 2 {
+		t.Errorf("%d categories polled with streaming, want the 2 statistics categories", n)
+	}
+	cfg.Streaming.Enabled = false
+
+	for name, schedule := range map[string]config.ScheduleConfig{
+		"unknown category":  {Enabled: true, Categories: map[string]time.Duration{"udsf": time.Minute}},
+		"unknown data type": {Enabled: true, DataTypes: map[string]time.Duration{"open5gs": time.Minute}},
+		"zero interval":     {Enabled: true, DataTypes: map[string]time.Duration{"monitoring": 0}},
+	} {
+		cfg.Schedule = schedule
+		if _, err := NewExporter(cfg, NewCache()); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+// Scrapes serve the monitoring categories of the scheduler's last poll
+// without fetching them again
+func TestScheduledMonitoring(t *testing.T) {
+	var requests atomic.Int32
+	monitoring := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		fmt.Fprintf(w, `{"cpu": {"load": %d}}`, n)
+	}))
+	t.Cleanup(monitoring.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(monitoring.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     *newStatisticsServer(t),
+		RemoteMonitoringServer:    config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf"},
+		MetricsMonitoringCategory: []string{"systemInfo"},
+		Schedule:                  config.ScheduleConfig{Enabled: true, Interval: time.Hour},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := exporter.Scheduler()
+	scheduler.results = make(map[string]scheduledResult)
+	for _, p := range scheduler.polls {
+		if p.target == scheduler.monitoring {
+			scheduler.poll(context.Background(), p)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		collections, err := exporter.collectAll(context.Background(), []string{""}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if load := collections[0].data["systemInfo"]["cpu_load"]; load != 1 {
+			t.Errorf("scrape %d: load = %v, want 1 as of the poll", i, load)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d monitoring requests, want the scheduler's poll only", n)
+	}
+}
+
+// The schedule shipped in config.yaml is valid once uncommented
+func TestScheduleExample(t *testing.T) {
+	data, err := os.ReadFile("../config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var example []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "# schedule:" || len(example) > 0 && strings.HasPrefix(line, "#   ") {
+			example = append(example, strings.TrimPrefix(line, "# "))
+		} else if len(example) > 0 {
+			break
+		}
+	}
+	if len(example) == 0 {
+		t.Fatal("no schedule example in config.yaml")
+	}
+
+	// The shipped configuration with the schedule enabled
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(string(data)+"\n"+strings.Join(example, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Schedule.Enabled || len(cfg.Schedule.DataTypes) == 0 {
+		t.Fatalf("schedule example not loaded: %+v", cfg.Schedule)
+	}
+	if _, err := NewExporter(cfg, NewCache()); err != nil {
+		t.Errorf("schedule example rejected: %v", err)
+	}
+}
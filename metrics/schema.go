@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+var schemaValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cnaasprom_schema_validation_failures_total",
+	Help: "Upstream responses rejected for not matching the JSON Schema of their category",
+}, []string{"category"})
+
+func init() {
+	registerInternal(schemaValidationFailures)
+}
+
+// responseSchemas validate the responses of statistics categories against
+// a JSON Schema, so a changed vendor API fails the fetch instead of
+// exporting odd values
+type responseSchemas map[string]*jsonschema.Schema
+
+// Schemas are compiled by the draft their $schema names, 2020-12 without
+// one. References are resolved against the schema file and only loaded
+// from local files.
+func newResponseSchemas(paths map[string]string) (responseSchemas, error) {
+	schemas := make(responseSchemas, len(paths))
+	for category, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema path %s of category %s: %v", path, category, err)
+		}
+		schema, err := jsonschema.NewCompiler().Compile(absolute)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema %s of category %s: %v", path, category, err)
+		}
+		schemas[category] = schema
+	}
+	return schemas, nil
+}
+
+// Compile a schema document that refers to no other
+func compileSchema(data []byte) (*jsonschema.Schema, error) {
+	const url = "response.schema.json"
+	document, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(url, document); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(url)
+}
+
+// Validate a response of a category, if it has a schema
+func (s responseSchemas) validate(category string, data []byte) error {
+	schema, ok := s[category]
+	if !ok {
+		return nil
+	}
+
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		recordParseFailure(category, "", "", err)
+		return fmt.Errorf("failed to parse JSON: %v", err)
+	}
+	if err := schema.Validate(instance); err != nil {
+		schemaValidationFailures.WithLabelValues(category).Inc()
+		return fmt.Errorf("response does not match the schema: %v", err)
+	}
+	return nil
+}
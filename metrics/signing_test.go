@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Signatures of a fixed key and time, computed independently
+func TestRequestSigning(t *testing.T) {
+	const url = "https://NNFCM.example.net:8443/nnfcm-statistics/v2/stats/amf?operator=op1"
+	for _, tc := range []struct {
+		encoding, method, body, want string
+	}{
+		{"hex", http.MethodPost, `{"category": "amf"}`, "d3a60032bf57f53edb8b1dca360eeae6447ce2dad73727f3e48a3e32f511fc6d"},
+		{"base64", http.MethodGet, "", "lxDNQCbfHDQZYoQ9GrZG20TfeYB/fXsjds+ov4gTYfM="},
+	} {
+		signer, err := newRequestSigner(config.RequestSigningConfig{Key: "test-key", Encoding: tc.encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+		req, _ := http.NewRequest(tc.method, url, strings.NewReader(tc.body))
+		if tc.body == "" {
+			req, _ = http.NewRequest(tc.method, url, nil)
+		}
+		if err := signer.sign(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("X-Timestamp"); got != "1700000000" {
+			t.Errorf("%s: timestamp %q", tc.encoding, got)
+		}
+		if got := req.Header.Get("X-Signature"); got != tc.want {
+			t.Errorf("%s: signature %q, want %q", tc.encoding, got, tc.want)
+		}
+
+		// The same request to another host is signed differently
+		req.Host = "other.example.net:8443"
+		signer.sign(req)
+		if req.Header.Get("X-Signature") == tc.want {
+			t.Errorf("%s: signature doesn't cover the host", tc.encoding)
+		}
+	}
+
+	if _, err := newRequestSigner(config.RequestSigningConfig{Key: "test-key", Algorithm: "hmac-md5"}); err == nil {
+		t.Errorf("unsupported algorithm accepted")
+	}
+}
@@ -0,0 +1,438 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultSNMPTimeout = 5 * time.Second
+	defaultSNMPRetries = 1
+	// Variable bindings per get request and rows per get-bulk request
+	snmpMaxOIDs        = 32
+	snmpMaxRepetitions = 25
+	// Category of the collected values, prefixing the metric names
+	snmpCategory = "snmp"
+)
+
+// SNMPCollector polls legacy devices that are only reachable over SNMP.
+// Their values are exported like the statistics of a target, with a target
+// label naming the device.
+type SNMPCollector struct {
+	timeout time.Duration
+	retries int
+	scalars []snmpMetric
+	tables  []snmpMetric
+	targets []*snmpTarget
+}
+
+type snmpMetric struct {
+	name       string
+	oid        []uint32
+	indexLabel string
+}
+
+type snmpTarget struct {
+	name      string
+	address   string
+	labels    prometheus.Labels
+	version   int64
+	community []byte
+	usm       *usm
+	requestID atomic.Int32
+}
+
+func NewSNMPCollector(cfg config.SNMPConfig) (*SNMPCollector, error) {
+	c := &SNMPCollector{timeout: cfg.Timeout, retries: cfg.Retries}
+	if c.timeout <= 0 {
+		c.timeout = defaultSNMPTimeout
+	}
+	if c.retries <= 0 {
+		c.retries = defaultSNMPRetries
+	}
+
+	for _, def := range cfg.Metrics {
+		if def.Name == "" {
+			return nil, fmt.Errorf("snmp metric for %s has no name", def.OID)
+		}
+		oid, err := parseOID(def.OID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snmp metric %s: %v", def.Name, err)
+		}
+		metric := snmpMetric{name: def.Name, oid: oid, indexLabel: sanitizeMetricName(def.IndexLabel)}
+		if def.IndexLabel != "" {
+			c.tables = append(c.tables, metric)
+		} else {
+			c.scalars = append(c.scalars, metric)
+		}
+	}
+
+	for _, def := range cfg.Targets {
+		target, err := newSNMPTarget(def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snmp target %s: %v", def.Name, err)
+		}
+		c.targets = append(c.targets, target)
+	}
+	return c, nil
+}
+
+// The address of a target, on its port or 161 unless the address has one
+func snmpAddress(def config.SNMPTarget) string {
+	if _, _, err := net.SplitHostPort(def.Address); err == nil {
+		return def.Address
+	}
+	if def.Port == 0 {
+		return config.JoinHostPort(def.Address, 161)
+	}
+	return config.JoinHostPort(def.Address, def.Port)
+}
+
+func newSNMPTarget(def config.SNMPTarget) (*snmpTarget, error) {
+	if def.Name == "" || def.Address == "" {
+		return nil, fmt.Errorf("a name and address are required")
+	}
+	address := snmpAddress(def)
+
+	labels := prometheus.Labels{"target": def.Name}
+	for name, value := range def.Labels {
+		labels[sanitizeMetricName(name)] = value
+	}
+	t := &snmpTarget{name: def.Name, address: address, labels: labels, community: []byte(def.Community)}
+
+	switch def.Version {
+	case "1":
+		t.version = 0
+	case "", "2c":
+		t.version = 1
+	case "3":
+		t.version = 3
+		var err error
+		if t.usm, err = newUSM(def.V3); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported snmp version %q", def.Version)
+	}
+	if t.version != 3 && len(t.community) == 0 {
+		t.community = []byte("public")
+	}
+	return t, nil
+}
+
+// Values of a target: scalars in the snmp category and one labelled series
+// per table row
+type snmpValues struct {
+	target *snmpTarget
+	data   map[string]map[string]float64
+	series []labeledData
+}
+
+// Poll the configured targets and those given. Targets that fail are
+// logged and skipped.
+func (c *SNMPCollector) collect(ctx context.Context, targets []*snmpTarget) []snmpValues {
+	var results []snmpValues
+	for _, t := range append(c.targets[:len(c.targets):len(c.targets)], targets...) {
+		values, err := c.collectTarget(ctx, t)
+		if err != nil {
+			log.Printf("Error polling snmp target %s: %v", t.name, err)
+			continue
+		}
+		results = append(results, values)
+	}
+	return results
+}
+
+func (c *SNMPCollector) collectTarget(ctx context.Context, t *snmpTarget) (snmpValues, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", t.address)
+	if err != nil {
+		return snmpValues{}, err
+	}
+	defer conn.Close()
+	s := &snmpSession{target: t, conn: conn, timeout: c.timeout, retries: c.retries}
+
+	values := snmpValues{target: t, data: map[string]map[string]float64{snmpCategory: {}}}
+	for start := 0; start < len(c.scalars); start += snmpMaxOIDs {
+		metrics := c.scalars[start:min(start+snmpMaxOIDs, len(c.scalars))]
+		oids := make([][]uint32, len(metrics))
+		for i, metric := range metrics {
+			oids[i] = metric.oid
+		}
+		bindings, err := s.get(ctx, oids)
+		if err != nil {
+			return snmpValues{}, err
+		}
+		for i, binding := range bindings {
+			if value, ok := binding.value.number(); ok && i < len(metrics) {
+				values.data[snmpCategory][metrics[i].name] = value
+			}
+		}
+	}
+
+	rows := make(map[string]int)
+	for _, metric := range c.tables {
+		err := s.walk(ctx, metric.oid, func(binding snmpBinding) {
+			value, ok := binding.value.number()
+			if !ok {
+				return
+			}
+			index := formatOID(binding.oid[len(metric.oid):])
+			key := metric.indexLabel + "\x00" + index
+			i, ok := rows[key]
+			if !ok {
+				i = len(values.series)
+				rows[key] = i
+				values.series = append(values.series, labeledData{
+					Labels: prometheus.Labels{metric.indexLabel: index},
+					Data:   map[string]map[string]float64{snmpCategory: {}},
+				})
+			}
+			values.series[i].Data[snmpCategory][metric.name] = value
+		})
+		if err != nil {
+			return snmpValues{}, fmt.Errorf("failed to walk %s: %v", metric.name, err)
+		}
+	}
+	return values, nil
+}
+
+// A variable binding of a response
+type snmpBinding struct {
+	oid   []uint32
+	value berValue
+}
+
+// snmpSession exchanges requests with one target over a connected UDP socket
+type snmpSession struct {
+	target  *snmpTarget
+	conn    net.Conn
+	timeout time.Duration
+	retries int
+}
+
+func (s *snmpSession) get(ctx context.Context, oids [][]uint32) ([]snmpBinding, error) {
+	return s.request(ctx, snmpGetRequest, oids, 0, 0)
+}
+
+// Call fn for every binding below root, with get-next requests for SNMPv1
+// and get-bulk requests otherwise
+func (s *snmpSession) walk(ctx context.Context, root []uint32, fn func(snmpBinding)) error {
+	oid := root
+	for {
+		var bindings []snmpBinding
+		var err error
+		if s.target.version == 0 {
+			bindings, err = s.request(ctx, snmpGetNext, [][]uint32{oid}, 0, 0)
+			var statusErr *snmpStatusError
+			if errors.As(err, &statusErr) && statusErr.status == snmpNoSuchName {
+				return nil
+			}
+		} else {
+			bindings, err = s.request(ctx, snmpGetBulk, [][]uint32{oid}, 0, snmpMaxRepetitions)
+		}
+		if err != nil {
+			return err
+		}
+		if len(bindings) == 0 {
+			return nil
+		}
+
+		for _, binding := range bindings {
+			if binding.value.tag == snmpEndOfView || !oidHasPrefix(binding.oid, root) {
+				return nil
+			}
+			if compareOIDs(binding.oid, oid) <= 0 {
+				return fmt.Errorf("agent returned OID %s out of order", formatOID(binding.oid))
+			}
+			fn(binding)
+			oid = binding.oid
+		}
+	}
+}
+
+func compareOIDs(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+const snmpNoSuchName = 2
+
+// snmpStatusError is the error status of a response PDU
+type snmpStatusError struct {
+	status int64
+	index  int64
+}
+
+func (e *snmpStatusError) Error() string {
+	return fmt.Sprintf("snmp error status %d at index %d", e.status, e.index)
+}
+
+// Send a request PDU and return the bindings of its response. SNMPv3
+// engines are discovered on the first request and requests rejected for
+// being out of the engine's time window are sent once more.
+func (s *snmpSession) request(ctx context.Context, pduType byte, oids [][]uint32, nonRepeaters int, maxRepetitions int) ([]snmpBinding, error) {
+	if s.target.usm != nil && !s.target.usm.discovered() {
+		if _, err := s.exchange(ctx, snmpGetRequest, nil, 0, 0, true); err != nil {
+			var report *snmpReportError
+			if !errors.As(err, &report) {
+				return nil, fmt.Errorf("snmp engine discovery failed: %v", err)
+			}
+		}
+	}
+
+	bindings, err := s.exchange(ctx, pduType, oids, nonRepeaters, maxRepetitions, false)
+	var report *snmpReportError
+	if errors.As(err, &report) && report.oid == usmNotInTimeWindow {
+		bindings, err = s.exchange(ctx, pduType, oids, nonRepeaters, maxRepetitions, false)
+	}
+	return bindings, err
+}
+
+func (s *snmpSession) exchange(ctx context.Context, pduType byte, oids [][]uint32, nonRepeaters int, maxRepetitions int, discovery bool) ([]snmpBinding, error) {
+	requestID := s.target.requestID.Add(1) & 0x7fffffff
+	bindings := make([][]byte, len(oids))
+	for i, oid := range oids {
+		bindings[i] = berSeq(berSequence, berOIDValue(oid), berTLV(berNull, nil))
+	}
+	pdu := berSeq(pduType, berInt(int64(requestID)), berInt(int64(nonRepeaters)), berInt(int64(maxRepetitions)), berSeq(berSequence, bindings...))
+
+	var msg []byte
+	switch {
+	case discovery:
+		msg = s.target.usm.discoveryMessage(requestID, pdu)
+	case s.target.usm != nil:
+		var err error
+		if msg, err = s.target.usm.encode(requestID, pdu); err != nil {
+			return nil, err
+		}
+	default:
+		msg = berSeq(berSequence, berInt(s.target.version), berString(s.target.community), pdu)
+	}
+
+	buf := make([]byte, snmpMaxMessageSize)
+	for attempt := 0; ; attempt++ {
+		if _, err := s.conn.Write(msg); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(s.timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		s.conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := s.conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && attempt < s.retries && ctx.Err() == nil {
+					break
+				}
+				return nil, err
+			}
+
+			response, err := s.decode(buf[:n])
+			if err != nil {
+				log.Printf("Discarding invalid snmp response from %s: %v", s.target.name, err)
+				continue
+			}
+			items, err := berItems(response.content)
+			if err != nil || len(items) != 4 {
+				continue
+			}
+			if int32(items[0].int()) != requestID && response.tag != snmpReport {
+				// A late response to an earlier attempt
+				continue
+			}
+			return parseResponsePDU(response, items)
+		}
+	}
+}
+
+// The PDU of a response message
+func (s *snmpSession) decode(data []byte) (berValue, error) {
+	if s.target.usm != nil {
+		return s.target.usm.decode(data)
+	}
+
+	message, _, err := berDecode(data)
+	if err != nil {
+		return berValue{}, err
+	}
+	items, err := berItems(message.content)
+	if err != nil || len(items) != 3 || items[0].int() != s.target.version {
+		return berValue{}, fmt.Errorf("invalid snmp message")
+	}
+	return items[2], nil
+}
+
+func parseResponsePDU(pdu berValue, items []berValue) ([]snmpBinding, error) {
+	list, err := berItems(items[3].content)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []snmpBinding
+	for _, item := range list {
+		pair, err := berItems(item.content)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("invalid variable binding")
+		}
+		oid, err := pair[0].oid()
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, snmpBinding{oid: oid, value: pair[1]})
+	}
+
+	switch pdu.tag {
+	case snmpReport:
+		if len(bindings) == 0 {
+			return nil, &snmpReportError{}
+		}
+		return nil, &snmpReportError{oid: formatOID(bindings[0].oid)}
+	case snmpResponse:
+	default:
+		return nil, fmt.Errorf("unexpected snmp PDU type %#x", pdu.tag)
+	}
+	if status := items[1].int(); status != 0 {
+		return nil, &snmpStatusError{status: status, index: items[2].int()}
+	}
+	return bindings, nil
+}
+
+// Collections of the SNMP targets, labelled with the target name
+func (e *Exporter) collectSNMP(ctx context.Context) []*collection {
+	if e.snmp == nil {
+		return nil
+	}
+
+	var generated []*snmpTarget
+	if e.inventory != nil {
+		generated = e.inventory.snmpTargets()
+	}
+
+	var collections []*collection
+	for _, values := range e.snmp.collect(ctx, generated) {
+		c := e.newCollection(snmpCategory+"/"+values.target.name, values.target.labels, values.data)
+		c.target = values.target.name
+		c.series = values.series
+		collections = append(collections, c)
+	}
+	return collections
+}
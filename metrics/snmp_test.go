@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Localized keys of the password "maplesyrup" for the engine ID
+// 00 00 00 00 00 00 00 00 00 00 00 02 (RFC 3414 A.3.1 and A.3.2)
+func TestLocalizeKey(t *testing.T) {
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	for _, tc := range []struct {
+		name string
+		key  []byte
+		want string
+	}{
+		{"MD5", localizeKey(md5.New, "maplesyrup", engineID), "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", localizeKey(sha1.New, "maplesyrup", engineID), "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		if got := hex.EncodeToString(tc.key); got != tc.want {
+			t.Errorf("%s: localized key %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBERIntegers(t *testing.T) {
+	for _, tc := range []struct {
+		value   int64
+		encoded string
+	}{
+		{0, "020100"},
+		{127, "02017f"},
+		{128, "02020080"},
+		{256, "02020100"},
+		{-1, "0201ff"},
+		{-128, "020180"},
+		{-129, "0202ff7f"},
+		{math.MaxInt64, "02087fffffffffffffff"},
+		{math.MinInt64, "02088000000000000000"},
+	} {
+		encoded := berInt(tc.value)
+		if got := hex.EncodeToString(encoded); got != tc.encoded {
+			t.Errorf("berInt(%d) = %s, want %s", tc.value, got, tc.encoded)
+		}
+		decoded, rest, err := berDecode(encoded)
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("decoding %s: %v, %d bytes left", tc.encoded, err, len(rest))
+		}
+		if decoded.int() != tc.value {
+			t.Errorf("%s decoded to %d, want %d", tc.encoded, decoded.int(), tc.value)
+		}
+	}
+}
+
+func TestBERLengths(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 70000} {
+		content := bytes.Repeat([]byte{0xab}, n)
+		encoded := berString(content)
+		decoded, rest, err := berDecode(append(encoded, 0x05, 0x00))
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		if decoded.tag != berOctetString || !bytes.Equal(decoded.content, content) || !bytes.Equal(rest, []byte{0x05, 0x00}) {
+			t.Errorf("length %d: decoded %d bytes of tag %#x, %d bytes left", n, len(decoded.content), decoded.tag, len(rest))
+		}
+	}
+	// The length of 128 bytes needs the long form
+	if got := hex.EncodeToString(berString(make([]byte, 128))[:3]); got != "048180" {
+		t.Errorf("header of 128 bytes = %s, want 048180", got)
+	}
+
+	for _, data := range []string{"", "04", "0405abcd", "0485ffffffffff", "0480"} {
+		raw, _ := hex.DecodeString(data)
+		if _, _, err := berDecode(raw); err == nil {
+			t.Errorf("berDecode(%s) accepted", data)
+		}
+	}
+}
+
+func TestBEROIDs(t *testing.T) {
+	for _, tc := range []struct {
+		oid     string
+		encoded string
+	}{
+		{"1.3.6.1.2.1.1.3.0", "06082b06010201010300"},
+		{"1.3.6.1.4.1.2636.3.1.13.1.8", "060c2b06010401944c03010d0108"},
+		{"1.3.6.1.6.3.15.1.1.2.0", "060a2b060106030f01010200"},
+		{"2.999.3", "0603883703"},
+		{"1.3.6.1.4.1.4294967295", "060a2b060104018fffffff7f"},
+	} {
+		oid, err := parseOID(tc.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := berOIDValue(oid)
+		if got := hex.EncodeToString(encoded); got != tc.encoded {
+			t.Errorf("%s encoded to %s, want %s", tc.oid, got, tc.encoded)
+		}
+		decoded, _, err := berDecode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arcs, err := decoded.oid()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatOID(arcs); got != tc.oid {
+			t.Errorf("%s decoded to %s", tc.encoded, got)
+		}
+	}
+
+	for _, oid := range []string{"1", "3.1", "1.40", "1.3.x"} {
+		if _, err := parseOID(oid); err == nil {
+			t.Errorf("parseOID(%s) accepted", oid)
+		}
+	}
+	if _, err := (berValue{tag: berOID, content: []byte{0x2b, 0x86}}).oid(); err == nil {
+		t.Errorf("OID with a truncated arc accepted")
+	}
+}
+
+func TestSNMPNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		value berValue
+		want  float64
+	}{
+		{berValue{tag: snmpCounter32, content: []byte{0x00, 0xff, 0xff, 0xff, 0xff}}, math.MaxUint32},
+		{berValue{tag: snmpGauge32, content: []byte{0x80}}, 128},
+		{berValue{tag: snmpCounter64, content: []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}, math.MaxUint64},
+		{berValue{tag: berInteger, content: []byte{0xff, 0x7f}}, -129},
+		{berValue{tag: berOctetString, content: []byte(" 42.5 ")}, 42.5},
+	} {
+		if got, ok := tc.value.number(); !ok || got != tc.want {
+			t.Errorf("number of %#x %x = %v, %t, want %v", tc.value.tag, tc.value.content, got, ok, tc.want)
+		}
+	}
+	if _, ok := (berValue{tag: berOctetString, content: []byte("up")}).number(); ok {
+		t.Errorf("non-numeric string accepted")
+	}
+}
+
+// Authenticated and encrypted messages decode to the PDU they were built
+// from, and tampered ones are rejected
+func TestUSMMessages(t *testing.T) {
+	engineID, _ := hex.DecodeString("80001f8880e9630000d61ff449")
+	pdu := berSeq(snmpGetRequest, berInt(7), berInt(0), berInt(0), berSeq(berSequence,
+		berSeq(berSequence, berOIDValue([]uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}), berTLV(berNull, nil))))
+
+	for _, credentials := range []config.SNMPv3Credentials{
+		{Username: "user", AuthProtocol: "MD5", AuthPassword: "authpass1"},
+		{Username: "user", AuthProtocol: "MD5", AuthPassword: "authpass1", PrivProtocol: "DES", PrivPassword: "privpass1"},
+		{Username: "user", AuthProtocol: "SHA", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"},
+		{Username: "user", AuthProtocol: "SHA256", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"},
+		{Username: "user", AuthProtocol: "SHA512", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"},
+	} {
+		name := credentials.AuthProtocol + "/" + credentials.PrivProtocol
+		u, err := newUSM(credentials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.engineID, u.boots, u.engineTime, u.synced = engineID, 3, 1000, time.Now()
+		u.authKey = localizeKey(u.auth.hash, u.authPass, engineID)
+		if u.priv != "" {
+			u.privKey = localizeKey(u.auth.hash, u.privPass, engineID)
+		}
+
+		msg, err := u.encode(7, pdu)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if u.priv != "" && bytes.Contains(msg, pdu) {
+			t.Errorf("%s: PDU sent in clear text", name)
+		}
+		tampered := bytes.Clone(msg)
+		tampered[len(tampered)-3] ^= 0x01
+
+		decoded, err := u.decode(msg)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := berSeq(decoded.tag, decoded.content); !bytes.Equal(got, pdu) {
+			t.Errorf("%s: decoded PDU %x, want %x", name, got, pdu)
+		}
+		if _, err := u.decode(tampered); err == nil {
+			t.Errorf("%s: tampered message accepted", name)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// BER tags of the SNMP messages and values handled by the SNMP collector
+const (
+	berInteger     byte = 0x02
+	berOctetString byte = 0x04
+	berNull        byte = 0x05
+	berOID         byte = 0x06
+	berSequence    byte = 0x30
+
+	snmpCounter32 byte = 0x41
+	snmpGauge32   byte = 0x42
+	snmpTimeTicks byte = 0x43
+	snmpCounter64 byte = 0x46
+	snmpEndOfView byte = 0x82
+
+	snmpGetRequest byte = 0xa0
+	snmpGetNext    byte = 0xa1
+	snmpResponse   byte = 0xa2
+	snmpGetBulk    byte = 0xa5
+	snmpReport     byte = 0xa8
+)
+
+var errBERTruncated = errors.New("truncated BER encoding")
+
+// Encode a tag, length and value
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	default:
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, content...)
+}
+
+func berSeq(tag byte, items ...[]byte) []byte {
+	var content []byte
+	for _, item := range items {
+		content = append(content, item...)
+	}
+	return berTLV(tag, content)
+}
+
+// Encode an integer in the fewest two's complement bytes
+func berInt(v int64) []byte {
+	content := []byte{byte(v)}
+	for v >>= 8; ; v >>= 8 {
+		last := content[0]
+		if (v == 0 && last&0x80 == 0) || (v == -1 && last&0x80 != 0) {
+			break
+		}
+		content = append([]byte{byte(v)}, content...)
+	}
+	return berTLV(berInteger, content)
+}
+
+func berString(s []byte) []byte {
+	return berTLV(berOctetString, s)
+}
+
+func berOIDValue(oid []uint32) []byte {
+	var content []byte
+	if len(oid) >= 2 {
+		content = appendBase128(content, oid[0]*40+oid[1])
+		oid = oid[2:]
+	}
+	for _, arc := range oid {
+		content = appendBase128(content, arc)
+	}
+	return berTLV(berOID, content)
+}
+
+func appendBase128(out []byte, v uint32) []byte {
+	var digits []byte
+	digits = append(digits, byte(v&0x7f))
+	for v >>= 7; v > 0; v >>= 7 {
+		digits = append([]byte{byte(v&0x7f) | 0x80}, digits...)
+	}
+	return append(out, digits...)
+}
+
+// A decoded tag, length and value
+type berValue struct {
+	tag     byte
+	content []byte
+}
+
+// Decode the first value of data, returning the bytes that follow it
+func berDecode(data []byte) (berValue, []byte, error) {
+	if len(data) < 2 {
+		return berValue{}, nil, errBERTruncated
+	}
+	tag := data[0]
+	length := int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 || len(data) < size {
+			return berValue{}, nil, fmt.Errorf("invalid BER length")
+		}
+		length = 0
+		for _, b := range data[:size] {
+			length = length<<8 | int(b)
+		}
+		data = data[size:]
+	}
+	if length < 0 || len(data) < length {
+		return berValue{}, nil, errBERTruncated
+	}
+	return berValue{tag: tag, content: data[:length]}, data[length:], nil
+}
+
+// Decode all values of a constructed value's content
+func berItems(content []byte) ([]berValue, error) {
+	var items []berValue
+	for len(content) > 0 {
+		item, rest, err := berDecode(content)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		content = rest
+	}
+	return items, nil
+}
+
+// Decode the content of an integer or an unsigned SNMP number
+func (v berValue) int() int64 {
+	var n int64
+	for i, b := range v.content {
+		if i == 0 && b&0x80 != 0 && v.tag == berInteger {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (v berValue) uint() uint64 {
+	var n uint64
+	for _, b := range v.content {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func (v berValue) oid() ([]uint32, error) {
+	if v.tag != berOID || len(v.content) == 0 {
+		return nil, fmt.Errorf("invalid OID")
+	}
+	var arcs []uint32
+	var arc uint32
+	for i, b := range v.content {
+		arc = arc<<7 | uint32(b&0x7f)
+		if b&0x80 != 0 {
+			if i == len(v.content)-1 {
+				return nil, fmt.Errorf("invalid OID")
+			}
+			continue
+		}
+		if len(arcs) == 0 {
+			first := min(arc/40, 2)
+			arcs = append(arcs, first, arc-first*40)
+		} else {
+			arcs = append(arcs, arc)
+		}
+		arc = 0
+	}
+	return arcs, nil
+}
+
+// Numeric value of a variable binding; strings holding a number, as some
+// devices return them, are parsed too
+func (v berValue) number() (float64, bool) {
+	switch v.tag {
+	case berInteger:
+		return float64(v.int()), true
+	case snmpCounter32, snmpGauge32, snmpTimeTicks:
+		return float64(v.uint()), true
+	case snmpCounter64:
+		f, _ := new(big.Float).SetInt(new(big.Int).SetBytes(v.content)).Float64()
+		return f, true
+	case berOctetString:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v.content)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Parse a dotted OID such as 1.3.6.1.2.1.1.3.0; a leading dot is allowed
+func parseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make([]uint32, len(parts))
+	for i, part := range parts {
+		arc, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = uint32(arc)
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func formatOID(oid []uint32) string {
+	parts := make([]string, len(oid))
+	for i, arc := range oid {
+		parts[i] = strconv.FormatUint(uint64(arc), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Whether oid lies below prefix
+func oidHasPrefix(oid []uint32, prefix []uint32) bool {
+	if len(oid) <= len(prefix) {
+		return false
+	}
+	for i, arc := range prefix {
+		if oid[i] != arc {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,411 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Flags of an SNMPv3 message
+const (
+	snmpFlagAuth       = 0x01
+	snmpFlagPriv       = 0x02
+	snmpFlagReportable = 0x04
+
+	// The user-based security model of RFC 3414
+	snmpSecurityModelUSM = 3
+	snmpMaxMessageSize   = 65507
+)
+
+// Counters of the USM reports a device answers with when it rejects a request
+var usmReports = map[string]string{
+	"1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+	"1.3.6.1.6.3.15.1.1.2.0": "not in time window",
+	"1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+	"1.3.6.1.6.3.15.1.1.4.0": "unknown engine ID",
+	"1.3.6.1.6.3.15.1.1.5.0": "wrong digest",
+	"1.3.6.1.6.3.15.1.1.6.0": "decryption error",
+}
+
+const usmNotInTimeWindow = "1.3.6.1.6.3.15.1.1.2.0"
+
+// snmpReportError is returned when a device answers with a report PDU
+type snmpReportError struct {
+	oid string
+}
+
+func (e *snmpReportError) Error() string {
+	if reason, ok := usmReports[e.oid]; ok {
+		return "snmp report: " + reason
+	}
+	return "snmp report " + e.oid
+}
+
+// HMAC of the authentication protocols and the length of their truncated
+// digest (RFC 3414, RFC 7860)
+type snmpAuthProtocol struct {
+	hash   func() hash.Hash
+	macLen int
+}
+
+var snmpAuthProtocols = map[string]snmpAuthProtocol{
+	"MD5":    {md5.New, 12},
+	"SHA":    {sha1.New, 12},
+	"SHA224": {sha256.New224, 16},
+	"SHA256": {sha256.New, 24},
+	"SHA384": {sha512.New384, 32},
+	"SHA512": {sha512.New, 48},
+}
+
+// usm holds the credentials of an SNMPv3 user and what was learnt about the
+// authoritative engine of the device
+type usm struct {
+	username    []byte
+	contextName []byte
+	auth        *snmpAuthProtocol
+	priv        string
+	authPass    string
+	privPass    string
+
+	mu         sync.Mutex
+	engineID   []byte
+	boots      int64
+	engineTime int64
+	synced     time.Time
+	authKey    []byte
+	privKey    []byte
+	salt       uint64
+}
+
+func newUSM(cfg config.SNMPv3Credentials) (*usm, error) {
+	if cfg.Username == "" {
+		return nil, fmt.Errorf("snmp v3 needs a username")
+	}
+	u := &usm{
+		username:    []byte(cfg.Username),
+		contextName: []byte(cfg.ContextName),
+		priv:        strings.ToUpper(cfg.PrivProtocol),
+		authPass:    string(cfg.AuthPassword),
+		privPass:    string(cfg.PrivPassword),
+	}
+
+	if cfg.AuthProtocol != "" {
+		auth, ok := snmpAuthProtocols[strings.ToUpper(cfg.AuthProtocol)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported snmp auth protocol %q", cfg.AuthProtocol)
+		}
+		if len(u.authPass) < 8 {
+			return nil, fmt.Errorf("snmp auth password must be at least 8 characters")
+		}
+		u.auth = &auth
+	}
+	switch u.priv {
+	case "":
+	case "DES", "AES":
+		if u.auth == nil {
+			return nil, fmt.Errorf("snmp privacy needs an auth protocol")
+		}
+		if len(u.privPass) < 8 {
+			return nil, fmt.Errorf("snmp priv password must be at least 8 characters")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported snmp priv protocol %q", cfg.PrivProtocol)
+	}
+
+	var seed [8]byte
+	rand.Read(seed[:])
+	u.salt = binary.BigEndian.Uint64(seed[:])
+	return u, nil
+}
+
+func (u *usm) flags() byte {
+	flags := byte(snmpFlagReportable)
+	if u.auth != nil {
+		flags |= snmpFlagAuth
+	}
+	if u.priv != "" {
+		flags |= snmpFlagPriv
+	}
+	return flags
+}
+
+func (u *usm) discovered() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.engineID != nil
+}
+
+// Message discovering the engine ID, boots and time of the device, which
+// answers with a report
+func (u *usm) discoveryMessage(msgID int32, pdu []byte) []byte {
+	secParams := berSeq(berSequence, berString(nil), berInt(0), berInt(0), berString(nil), berString(nil), berString(nil))
+	scoped := berSeq(berSequence, berString(nil), berString(nil), pdu)
+	return v3Message(msgID, snmpFlagReportable, secParams, scoped)
+}
+
+func v3Message(msgID int32, flags byte, secParams []byte, scoped []byte) []byte {
+	header := berSeq(berSequence, berInt(int64(msgID)), berInt(snmpMaxMessageSize), berString([]byte{flags}), berInt(snmpSecurityModelUSM))
+	return berSeq(berSequence, berInt(3), header, berString(secParams), scoped)
+}
+
+// Authenticate and encrypt a request
+func (u *usm) encode(msgID int32, pdu []byte) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	boots := u.boots
+	engineTime := u.engineTime + int64(time.Since(u.synced).Seconds())
+
+	scoped := berSeq(berSequence, berString(u.engineID), berString(u.contextName), pdu)
+	var privParams []byte
+	if u.priv != "" {
+		encrypted, salt, err := u.encrypt(scoped, boots, engineTime)
+		if err != nil {
+			return nil, err
+		}
+		scoped = berString(encrypted)
+		privParams = salt
+	}
+
+	var authParams []byte
+	if u.auth != nil {
+		authParams = make([]byte, u.auth.macLen)
+	}
+	secParams := berSeq(berSequence, berString(u.engineID), berInt(boots), berInt(engineTime), berString(u.username), berString(authParams), berString(privParams))
+	msg := v3Message(msgID, u.flags(), secParams, scoped)
+
+	if u.auth != nil {
+		parsed, err := parseV3Message(msg)
+		if err != nil {
+			return nil, err
+		}
+		copy(parsed.authParams, u.mac(msg))
+	}
+	return msg, nil
+}
+
+// Check and decrypt a response, returning its scoped PDU. Reports update
+// the engine boots and time so a request out of the time window can be
+// retried.
+func (u *usm) decode(data []byte) (berValue, error) {
+	msg, err := parseV3Message(data)
+	if err != nil {
+		return berValue{}, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if msg.flags&snmpFlagAuth != 0 {
+		if u.auth == nil || len(msg.authParams) != u.auth.macLen {
+			return berValue{}, fmt.Errorf("unexpected authentication parameters")
+		}
+		received := bytes.Clone(msg.authParams)
+		clear(msg.authParams)
+		if !hmac.Equal(received, u.mac(data)) {
+			return berValue{}, fmt.Errorf("response authentication failed")
+		}
+	}
+
+	// Learn the engine from the discovery report and its clock from
+	// authenticated messages, or the discovery report
+	if u.engineID == nil {
+		u.engineID = msg.engineID
+		if u.auth != nil {
+			u.authKey = localizeKey(u.auth.hash, u.authPass, u.engineID)
+		}
+		if u.priv != "" {
+			u.privKey = localizeKey(u.auth.hash, u.privPass, u.engineID)
+		}
+	}
+	if msg.flags&snmpFlagAuth != 0 || u.auth == nil || u.synced.IsZero() {
+		u.boots, u.engineTime, u.synced = msg.boots, msg.engineTime, time.Now()
+	}
+
+	scoped := msg.scoped
+	if msg.flags&snmpFlagPriv != 0 {
+		if scoped.tag != berOctetString || u.privKey == nil {
+			return berValue{}, fmt.Errorf("unexpected encrypted response")
+		}
+		plain, err := u.decrypt(scoped.content, msg.privParams, msg.boots, msg.engineTime)
+		if err != nil {
+			return berValue{}, err
+		}
+		if scoped, _, err = berDecode(plain); err != nil {
+			return berValue{}, fmt.Errorf("failed to decrypt response: %v", err)
+		}
+	}
+	if scoped.tag != berSequence {
+		return berValue{}, fmt.Errorf("invalid scoped PDU")
+	}
+
+	items, err := berItems(scoped.content)
+	if err != nil || len(items) != 3 {
+		return berValue{}, fmt.Errorf("invalid scoped PDU")
+	}
+	return items[2], nil
+}
+
+func (u *usm) mac(msg []byte) []byte {
+	mac := hmac.New(u.auth.hash, u.authKey)
+	mac.Write(msg)
+	return mac.Sum(nil)[:u.auth.macLen]
+}
+
+// Encrypt a scoped PDU with DES-CBC (RFC 3414) or AES-128-CFB (RFC 3826),
+// returning the salt sent as privacy parameters
+func (u *usm) encrypt(scoped []byte, boots int64, engineTime int64) ([]byte, []byte, error) {
+	u.salt++
+	salt := make([]byte, 8)
+	if u.priv == "DES" {
+		binary.BigEndian.PutUint32(salt, uint32(boots))
+		binary.BigEndian.PutUint32(salt[4:], uint32(u.salt))
+
+		block, err := des.NewCipher(u.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ salt[i]
+		}
+		padded := append(bytes.Clone(scoped), make([]byte, (8-len(scoped)%8)%8)...)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return padded, salt, nil
+	}
+
+	binary.BigEndian.PutUint64(salt, u.salt)
+	block, err := aes.NewCipher(u.privKey[:16])
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted := make([]byte, len(scoped))
+	cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(encrypted, scoped)
+	return encrypted, salt, nil
+}
+
+func (u *usm) decrypt(data []byte, salt []byte, boots int64, engineTime int64) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("invalid privacy parameters")
+	}
+	plain := make([]byte, len(data))
+	if u.priv == "DES" {
+		if len(data)%8 != 0 {
+			return nil, fmt.Errorf("invalid encrypted data length")
+		}
+		block, err := des.NewCipher(u.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = u.privKey[8+i] ^ salt[i]
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+		return plain, nil
+	}
+
+	block, err := aes.NewCipher(u.privKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(plain, data)
+	return plain, nil
+}
+
+func aesIV(boots int64, engineTime int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
+
+// Derive the key of a password localized to an engine (RFC 3414 A.2)
+func localizeKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	repeated := []byte(password)
+	buf := make([]byte, 64)
+	for written, i := 0, 0; written < 1<<20; written += len(buf) {
+		for j := range buf {
+			buf[j] = repeated[i%len(repeated)]
+			i++
+		}
+		h.Write(buf)
+	}
+	key := h.Sum(nil)
+
+	h.Reset()
+	h.Write(key)
+	h.Write(engineID)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// The fields of an SNMPv3 message used by the collector. authParams and
+// privParams share the memory of the message, so the digest can be written
+// into or cleared from it.
+type v3MessageFields struct {
+	flags      byte
+	engineID   []byte
+	boots      int64
+	engineTime int64
+	authParams []byte
+	privParams []byte
+	scoped     berValue
+}
+
+var errNotV3 = errors.New("not an SNMPv3 message")
+
+func parseV3Message(data []byte) (*v3MessageFields, error) {
+	outer, _, err := berDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	items, err := berItems(outer.content)
+	if err != nil {
+		return nil, err
+	}
+	if outer.tag != berSequence || len(items) != 4 || items[0].int() != 3 {
+		return nil, errNotV3
+	}
+
+	header, err := berItems(items[1].content)
+	if err != nil || len(header) != 4 || len(header[2].content) != 1 {
+		return nil, fmt.Errorf("invalid SNMPv3 header")
+	}
+	secParams, _, err := berDecode(items[2].content)
+	if err != nil {
+		return nil, err
+	}
+	security, err := berItems(secParams.content)
+	if err != nil || len(security) != 6 {
+		return nil, fmt.Errorf("invalid SNMPv3 security parameters")
+	}
+
+	return &v3MessageFields{
+		flags:      header[2].content[0],
+		engineID:   bytes.Clone(security[0].content),
+		boots:      security[1].int(),
+		engineTime: security[2].int(),
+		authParams: security[4].content,
+		privParams: security[5].content,
+		scoped:     items[3],
+	}, nil
+}
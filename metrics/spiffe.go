@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// Time to wait for the first X.509 SVID of the Workload API
+const spiffeTimeout = 10 * time.Second
+
+var spiffeSVIDExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cnaasprom_spiffe_svid_expiry_timestamp_seconds",
+	Help: "Expiry of the X.509 SVIDs received from the SPIFFE Workload API",
+}, []string{"spiffe_id"})
+
+func init() {
+	registerInternal(spiffeSVIDExpiry)
+}
+
+// Check the SPIFFE settings of a TLS configuration
+func checkSPIFFEConfig(cfg config.SPIFFEConfig) error {
+	if cfg.ID != "" {
+		if _, err := spiffeid.FromString(cfg.ID); err != nil {
+			return fmt.Errorf("invalid SPIFFE ID %q: %v", cfg.ID, err)
+		}
+	}
+	if cfg.ServerID != "" {
+		if _, err := spiffeid.FromString(cfg.ServerID); err != nil {
+			return fmt.Errorf("invalid server SPIFFE ID %q: %v", cfg.ServerID, err)
+		}
+	}
+	return nil
+}
+
+// Present the X.509 SVID of the Workload API as client certificate. With
+// verifyServer the server is verified against the trust bundles and its
+// SPIFFE ID instead of the system roots and its host name.
+func useSPIFFE(tlsConfig *tls.Config, cfg config.SPIFFEConfig, verifyServer bool, sources *spiffeSources) error {
+	if err := checkSPIFFEConfig(cfg); err != nil {
+		return err
+	}
+	address := cfg.SocketPath
+	if address == "" {
+		address = os.Getenv(workloadapi.SocketEnv)
+	}
+	if address == "" {
+		return fmt.Errorf("no SPIFFE Workload API socket configured and %s is not set", workloadapi.SocketEnv)
+	}
+	if sources == nil {
+		return errors.New("SPIFFE is not supported for this connection")
+	}
+	source := sources.source(address, cfg.ID)
+
+	if !verifyServer {
+		tlsConfig.GetClientCertificate = tlsconfig.GetClientCertificate(source)
+		return nil
+	}
+	authorizer := tlsconfig.AdaptMatcher(func(id spiffeid.ID) error {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return err
+		}
+		if id.TrustDomain() != svid.ID.TrustDomain() {
+			return fmt.Errorf("server SPIFFE ID %s is not in trust domain %s", id, svid.ID.TrustDomain())
+		}
+		return nil
+	})
+	if cfg.ServerID != "" {
+		authorizer = tlsconfig.AuthorizeID(spiffeid.RequireFromString(cfg.ServerID))
+	}
+	tlsconfig.HookMTLSClientConfig(tlsConfig, source, source, authorizer)
+	return nil
+}
+
+// spiffeSources are the Workload API sources of the TLS configurations of
+// one owner, such as an exporter. A source connects on the first handshake
+// and keeps streaming, for the SVIDs to follow their rotation, until the
+// owner closes them.
+type spiffeSources struct {
+	mu      sync.Mutex
+	sources map[string]*spiffeSource
+	closed  bool
+}
+
+func newSPIFFESources() *spiffeSources {
+	return &spiffeSources{sources: make(map[string]*spiffeSource)}
+}
+
+func (s *spiffeSources) source(address string, id string) *spiffeSource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := address + "\x00" + id
+	source, ok := s.sources[key]
+	if !ok {
+		source = &spiffeSource{sources: s, address: address, id: id}
+		s.sources[key] = source
+	}
+	return source
+}
+
+// Close disconnects the sources from the Workload API; handshakes fail
+// from then on
+func (s *spiffeSources) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.closed = true
+	sources := make([]*spiffeSource, 0, len(s.sources))
+	for _, source := range s.sources {
+		sources = append(sources, source)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, source := range sources {
+		if err := source.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// spiffeSource is the X.509 source of one Workload API address and SVID,
+// implementing the SVID and bundle sources of go-spiffe
+type spiffeSource struct {
+	sources *spiffeSources
+	address string
+	id      string
+
+	mu     sync.Mutex
+	source *workloadapi.X509Source
+}
+
+func (s *spiffeSource) open() (*workloadapi.X509Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source != nil {
+		return s.source, nil
+	}
+	s.sources.mu.Lock()
+	closed := s.sources.closed
+	s.sources.mu.Unlock()
+	if closed {
+		return nil, fmt.Errorf("SPIFFE Workload API source for %s is closed", s.address)
+	}
+
+	options := []workloadapi.X509SourceOption{workloadapi.WithClientOptions(workloadapi.WithAddr(s.address))}
+	if s.id != "" {
+		options = append(options, workloadapi.WithDefaultX509SVIDPicker(s.pick))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeTimeout)
+	defer cancel()
+	source, err := workloadapi.NewX509Source(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("no X.509 SVID received from the SPIFFE Workload API at %s: %v", s.address, err)
+	}
+	s.source = source
+	return source, nil
+}
+
+// The SVID with the configured ID, nil when the workload has none
+func (s *spiffeSource) pick(svids []*x509svid.SVID) *x509svid.SVID {
+	for _, svid := range svids {
+		if svid.ID.String() == s.id {
+			return svid
+		}
+	}
+	return nil
+}
+
+func (s *spiffeSource) GetX509SVID() (*x509svid.SVID, error) {
+	source, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	svid, err := source.GetX509SVID()
+	if err != nil {
+		if s.id != "" {
+			return nil, fmt.Errorf("the SPIFFE Workload API at %s has no X.509 SVID %s: %v", s.address, s.id, err)
+		}
+		return nil, err
+	}
+	spiffeSVIDExpiry.WithLabelValues(svid.ID.String()).Set(float64(svid.Certificates[0].NotAfter.Unix()))
+	return svid, nil
+}
+
+func (s *spiffeSource) GetX509BundleForTrustDomain(trustDomain spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	source, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return source.GetX509BundleForTrustDomain(trustDomain)
+}
+
+func (s *spiffeSource) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.source == nil {
+		return nil
+	}
+	if svid, err := s.source.GetX509SVID(); err == nil {
+		spiffeSVIDExpiry.DeleteLabelValues(svid.ID.String())
+	}
+	err := s.source.Close()
+	s.source = nil
+	return err
+}
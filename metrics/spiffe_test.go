@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"google.golang.org/grpc"
+)
+
+// Workload API handing out the X.509 SVID of spiffe://example.org/client,
+// counting the open streams
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	response *workload.X509SVIDResponse
+	streams  atomic.Int32
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	f.streams.Add(1)
+	defer f.streams.Add(-1)
+	if err := stream.Send(f.response); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.org"},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// An X.509 SVID of the CA for the SPIFFE ID, and its PKCS#8 key
+func (ca *testCA) svid(t *testing.T, id string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{uri},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pkcs8
+}
+
+// Serve the fake Workload API on a unix socket and return its address
+func startWorkloadAPI(t *testing.T, api *fakeWorkloadAPI) string {
+	t.Helper()
+	// Socket paths are limited in length, so not below t.TempDir()
+	dir, err := os.MkdirTemp("", "spiffe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, api)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return "unix://" + socket
+}
+
+// Client certificates and server verification come from the Workload API,
+// whose stream is closed with the sources
+func TestSPIFFE(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert, _, clientKey := ca.svid(t, "spiffe://example.org/client")
+	api := &fakeWorkloadAPI{response: &workload.X509SVIDResponse{Svids: []*workload.X509SVID{{
+		SpiffeId:    "spiffe://example.org/client",
+		X509Svid:    clientCert.Raw,
+		X509SvidKey: clientKey,
+		Bundle:      ca.cert.Raw,
+	}}}}
+	address := startWorkloadAPI(t, api)
+
+	serverCert, serverKey, _ := ca.svid(t, "spiffe://example.org/server")
+	var clientID atomic.Value
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID.Store(r.TLS.PeerCertificates[0].URIs[0].String())
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	sources := newSPIFFESources()
+	get := func(serverID string) error {
+		t.Helper()
+		tlsConfig, err := newTLSConfig(config.TLSClientConfig{Enabled: true, SPIFFE: config.SPIFFEConfig{
+			Enabled: true, SocketPath: address, ServerID: serverID,
+		}}, config.TLSPolicy{}, sources)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(""); err != nil {
+		t.Fatalf("server of the trust domain: %v", err)
+	}
+	if got := clientID.Load(); got != "spiffe://example.org/client" {
+		t.Errorf("client presented %v, want its SVID", got)
+	}
+	if err := get("spiffe://example.org/server"); err != nil {
+		t.Errorf("server with the configured ID: %v", err)
+	}
+	if err := get("spiffe://example.org/other"); err == nil {
+		t.Errorf("server with another ID accepted")
+	}
+	if n := api.streams.Load(); n != 1 {
+		t.Errorf("%d Workload API streams open, want one shared by the configurations", n)
+	}
+
+	if err := sources.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for api.streams.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := api.streams.Load(); n != 0 {
+		t.Errorf("%d Workload API streams open after closing the sources", n)
+	}
+	if err := get(""); err == nil {
+		t.Errorf("handshake succeeded after closing the sources")
+	}
+}
+
+func TestSPIFFEConfig(t *testing.T) {
+	for _, cfg := range []config.SPIFFEConfig{
+		{Enabled: true, SocketPath: "unix:///run/agent.sock", ID: "example.org/client"},
+		{Enabled: true, SocketPath: "unix:///run/agent.sock", ServerID: "spiffe://Example.org/server"},
+	} {
+		if _, err := newTLSConfig(config.TLSClientConfig{Enabled: true, SPIFFE: cfg}, config.TLSPolicy{}, newSPIFFESources()); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
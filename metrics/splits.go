@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const defaultSplitDelimiter = "."
+
+// splitRules export the values of keys such as throughput.cell1 and
+// throughput.cell2 as one metric named after the prefix, with the suffixes
+// as label values, rather than as a metric per suffix
+type splitRules []splitRule
+
+type splitRule struct {
+	category  string
+	prefix    string
+	delimiter string
+	labels    []string
+}
+
+func newSplitRules(defs []config.SplitRule) (splitRules, error) {
+	var rules splitRules
+	for _, def := range defs {
+		if def.Prefix == "" || len(def.Labels) == 0 {
+			return nil, fmt.Errorf("split rules need a prefix and labels")
+		}
+		for _, label := range def.Labels {
+			if !model.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("invalid label %q of split rule %s", label, def.Prefix)
+			}
+		}
+		delimiter := def.Delimiter
+		if delimiter == "" {
+			delimiter = defaultSplitDelimiter
+		}
+		rules = append(rules, splitRule{category: def.Category, prefix: def.Prefix, delimiter: delimiter, labels: def.Labels})
+	}
+	return rules, nil
+}
+
+// The metric name and labels of a value of a category, if a rule splits its
+// name. The first matching rule applies.
+func (r splitRules) split(category string, metricName string) (string, prometheus.Labels, bool) {
+	for _, rule := range r {
+		if rule.category != "" && rule.category != category {
+			continue
+		}
+		suffix, ok := strings.CutPrefix(metricName, rule.prefix+rule.delimiter)
+		if !ok {
+			continue
+		}
+		values := strings.SplitN(suffix, rule.delimiter, len(rule.labels))
+		if len(values) != len(rule.labels) || slices.Contains(values, "") {
+			continue
+		}
+		labels := make(prometheus.Labels, len(values))
+		for i, value := range values {
+			labels[rule.labels[i]] = value
+		}
+		return rule.prefix, labels, true
+	}
+	return metricName, nil, false
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StateMapper turns string states such as "UP" or "DEGRADED" into their
+// configured numbers. Metrics matching a state set are exported as
+// name{state="..."} series instead, 1 for the current state and 0 for the
+// others.
+type StateMapper struct {
+	values map[string]float64
+	sets   []*stateSet
+}
+
+type stateSet struct {
+	pattern *regexp.Regexp
+	states  []string
+}
+
+func NewStateMapper(cfg config.StatesConfig) (*StateMapper, error) {
+	mapper := &StateMapper{values: cfg.Values}
+	for _, def := range cfg.StateSets {
+		pattern, err := regexp.Compile("^(?:" + def.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid state set pattern %q: %v", def.Metric, err)
+		}
+		if len(def.States) == 0 {
+			return nil, fmt.Errorf("state set %q has no states", def.Metric)
+		}
+		// The states are told apart by their values on export
+		seen := make(map[float64]string)
+		for _, state := range def.States {
+			value, ok := cfg.Values[state]
+			if !ok {
+				return nil, fmt.Errorf("state %q of state set %q has no value", state, def.Metric)
+			}
+			if other, ok := seen[value]; ok {
+				return nil, fmt.Errorf("states %q and %q of state set %q have the same value %v", other, state, def.Metric, value)
+			}
+			seen[value] = state
+		}
+		mapper.sets = append(mapper.sets, &stateSet{pattern: pattern, states: def.States})
+	}
+	return mapper, nil
+}
+
+func (m *StateMapper) stateSet(name string) *stateSet {
+	for _, set := range m.sets {
+		if set.pattern.MatchString(name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// Value maps the state of the named metric to its configured number. State
+// set metrics in a state they don't list are NaN, exported with every state
+// at 0 rather than dropped with the last known state left behind.
+func (m *StateMapper) Value(name string, state string) (float64, bool) {
+	if set := m.stateSet(name); set != nil && !set.has(state) {
+		log.Printf("Unknown state %q of %s", state, name)
+		return math.NaN(), true
+	}
+	value, ok := m.values[state]
+	return value, ok
+}
+
+func (s *stateSet) has(state string) bool {
+	for _, listed := range s.states {
+		if listed == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a metric to the sample set, expanding state set metrics into one
+// series per state
+func (m *StateMapper) add(set *sampleSet, name string, help string, labels prometheus.Labels, value float64) {
+	states := m.stateSet(name)
+	if states == nil {
+		set.add(name, help, labels, value)
+		return
+	}
+
+	for _, state := range states.states {
+		stateValue := 0.0
+		if m.values[state] == value {
+			stateValue = 1
+		}
+		set.add(name, help, mergeLabels(labels, prometheus.Labels{"state": state}), stateValue)
+	}
+}
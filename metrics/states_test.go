@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// State sets export the state whose configured value was collected, and no
+// state at all for one they don't list
+func TestStateSets(t *testing.T) {
+	cfg := config.StatesConfig{
+		Values:    map[string]float64{"UP": 1, "DOWN": 0, "DEGRADED": 5},
+		StateSets: []config.StateSet{{Metric: "nf_status", States: []string{"UP", "DOWN", "DEGRADED"}}},
+	}
+	mapper, err := NewStateMapper(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := mapper.Value("nf_status", "DEGRADED"); !ok || value != 5 {
+		t.Errorf("DEGRADED = %v, want its configured 5", value)
+	}
+	unknown, ok := mapper.Value("nf_status", "MAINTENANCE")
+	if !ok || !math.IsNaN(unknown) {
+		t.Errorf("unlisted state = %v %t, want NaN", unknown, ok)
+	}
+	if _, ok := mapper.Value("amf_mode", "MAINTENANCE"); ok {
+		t.Errorf("unconfigured state of another metric mapped")
+	}
+
+	for value, want := range map[float64]map[string]float64{
+		5:          {"UP": 0, "DOWN": 0, "DEGRADED": 1},
+		math.NaN(): {"UP": 0, "DOWN": 0, "DEGRADED": 0},
+	} {
+		set := newSampleSet(nil, newMetricNamer(config.NamingConfig{}))
+		mapper.add(set, "nf_status", "", nil, value)
+		families, err := set.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]float64)
+		for _, metric := range families[0].GetMetric() {
+			got[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+		if len(got) != len(want) {
+			t.Errorf("value %v exported %v, want %v", value, got, want)
+		}
+		for state, v := range want {
+			if got[state] != v {
+				t.Errorf("value %v exported %v, want %v", value, got, want)
+				break
+			}
+		}
+	}
+
+	cfg.Values["DEGRADED"] = 1
+	if _, err := NewStateMapper(cfg); err == nil {
+		t.Errorf("states sharing a value accepted")
+	}
+	delete(cfg.Values, "DEGRADED")
+	if _, err := NewStateMapper(cfg); err == nil {
+		t.Errorf("state without a value accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Categories not fetched for this long, e.g. of pods that went away, are
+// dropped from the status
+const staleStatusAge = time.Hour
+
+// statusError is returned for upstream responses other than 200 OK
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.code)
+}
+
+// fetchError is returned when no response was received from upstream
+type fetchError struct {
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("failed to fetch JSON data: %v", e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+// CategoryStatus is the outcome of the last fetch of a category from a target
+type CategoryStatus struct {
+	Target      string     `json:"target,omitempty"`
+	Server      string     `json:"server"`
+	Operator    string     `json:"operator,omitempty"`
+	Category    string     `json:"category"`
+	URL         string     `json:"url"`
+	LastFetch   time.Time  `json:"lastFetch"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastStatus  int        `json:"lastStatus,omitempty"`
+	Metrics     int        `json:"metrics"`
+}
+
+// Last fetch outcome per target, operator and category
+type statusLog struct {
+	mu         sync.Mutex
+	categories map[string]*CategoryStatus
+	webhooks   *webhookNotifier
+}
+
+func newStatusLog(webhooks *webhookNotifier) *statusLog {
+	return &statusLog{categories: make(map[string]*CategoryStatus), webhooks: webhooks}
+}
+
+// Record a fetch. The HTTP status is taken from err, or is 200 without error.
+func (l *statusLog) record(t *scrapeTarget, operator string, category string, url string, metrics int, err error) {
+	if l.webhooks != nil {
+		l.webhooks.observe(t.name, serverHost(t.server), operator+"\x00"+category, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := t.name + "\x00" + serverHost(t.server) + "\x00" + operator + "\x00" + category
+	status, ok := l.categories[key]
+	if !ok {
+		status = &CategoryStatus{Target: t.name, Server: serverHost(t.server), Operator: operator, Category: category}
+		l.categories[key] = status
+	}
+
+	now := time.Now()
+	status.URL = url
+	status.LastFetch = now
+	status.LastError = ""
+	status.LastStatus = 0
+	if err == nil {
+		status.LastSuccess = &now
+		status.LastStatus = http.StatusOK
+		status.Metrics = metrics
+		return
+	}
+
+	status.LastError = err.Error()
+	status.Metrics = 0
+	var statusErr *statusError
+	var redirectErr *redirectError
+	if errors.As(err, &statusErr) {
+		status.LastStatus = statusErr.code
+	} else if errors.As(err, &redirectErr) {
+		status.LastStatus = redirectErr.code
+	}
+}
+
+// Drop the statuses of a target
+func (l *statusLog) forget(t *scrapeTarget) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, status := range l.categories {
+		if status.Target == t.name && status.Server == serverHost(t.server) {
+			delete(l.categories, key)
+		}
+	}
+}
+
+// Return the recorded statuses sorted by target, operator and category
+func (l *statusLog) list() []CategoryStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]CategoryStatus, 0, len(l.categories))
+	for key, status := range l.categories {
+		if time.Since(status.LastFetch) > staleStatusAge {
+			delete(l.categories, key)
+			continue
+		}
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.Target+a.Server != b.Target+b.Server {
+			return a.Target+a.Server < b.Target+b.Server
+		}
+		if a.Operator != b.Operator {
+			return a.Operator < b.Operator
+		}
+		return a.Category < b.Category
+	})
+	return statuses
+}
+
+// Count the values of a fetched category
+func countMetrics(data map[string]map[string]float64) int {
+	count := 0
+	for _, metrics := range data {
+		count += len(metrics)
+	}
+	return count
+}
+
+// Summary of the configuration shown by /status; credentials are left out
+type configSummary struct {
+	StatisticServer      string            `json:"statisticServer"`
+	MonitoringServer     string            `json:"monitoringServer"`
+	StatisticCategories  []string          `json:"statisticCategories"`
+	MonitoringCategories []string          `json:"monitoringCategories"`
+	Operators            []string          `json:"operators,omitempty"`
+	Targets              map[string]string `json:"targets,omitempty"`
+	Modules              []string          `json:"modules,omitempty"`
+	KubernetesSD         bool              `json:"kubernetesSD"`
+	Streaming            bool              `json:"streaming"`
+	Kafka                bool              `json:"kafka"`
+	MinFetchInterval     string            `json:"minFetchInterval,omitempty"`
+}
+
+func (e *Exporter) configSummary() configSummary {
+	summary := configSummary{
+		StatisticServer:      e.config.RemoteStatisticServer.HostPort(),
+		MonitoringServer:     e.config.RemoteMonitoringServer.HostPort(),
+		StatisticCategories:  e.config.MetricsStatisticsCategory,
+		MonitoringCategories: e.config.MetricsMonitoringCategory,
+		Operators:            e.config.QueryParams.Operators,
+		KubernetesSD:         e.config.KubernetesSD.Enabled,
+		Streaming:            e.config.Streaming.Enabled,
+		Kafka:                len(e.config.Kafka.Brokers) > 0,
+	}
+	if e.config.MinFetchInterval > 0 {
+		summary.MinFetchInterval = e.config.MinFetchInterval.String()
+	}
+	if len(e.targets) > 0 {
+		summary.Targets = make(map[string]string, len(e.targets))
+		for _, t := range e.targets {
+			summary.Targets[t.name] = serverHost(t.server)
+		}
+	}
+	for name := range e.modules {
+		summary.Modules = append(summary.Modules, name)
+	}
+	sort.Strings(summary.Modules)
+	return summary
+}
+
+// StatusHandler reports the last fetch of every target and category and a
+// summary of the configuration as JSON
+func (e *Exporter) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Config     configSummary    `json:"config"`
+			Categories []CategoryStatus `json:"categories"`
+		}{e.configSummary(), e.status.list()})
+	})
+}
+
+// Write an error as a JSON object with the status code and message
+func writeError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{code, message})
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Store holds the latest metric values pushed by streaming sources, per
+// operator identifier. The Cache keeps them in memory; with replicas behind
+// a load balancer a RedisStore shares them, so every replica serves the
+// values any of them received.
+type Store interface {
+	// Update stores the given metric values for a category, replacing
+	// previous values
+	Update(operator string, category string, metrics map[string]float64)
+	// Snapshot returns a copy of the values of an operator, dropping values
+	// older than the TTL
+	Snapshot(operator string) map[string]map[string]float64
+	// Restore replaces the stored values, e.g. with persisted values
+	Restore(data map[string]map[string]map[string]float64)
+	// Operators returns the operator identifiers with stored values
+	Operators() []string
+	// SetTTL drops values not updated within ttl; zero keeps them forever
+	SetTTL(ttl time.Duration)
+}
+
+// NewStore returns the configured store, the in-memory Cache by default
+func NewStore(cfg config.StoreConfig, policy config.TLSPolicy) (Store, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return NewCache(), nil
+	case "redis":
+		return NewRedisStore(cfg.Redis, policy)
+	}
+	return nil, fmt.Errorf("unsupported store type %q, use memory or redis", cfg.Type)
+}
+
+// CloseStore closes the connections of stores that hold any
+func CloseStore(store Store) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// PollStore is implemented by stores shared by replicas. Results polled from
+// upstream are shared through it so that every replica serves the result of
+// the last poll, whichever replica polled.
+type PollStore interface {
+	// SetPolled stores an encoded poll result under key for ttl
+	SetPolled(key string, result []byte, ttl time.Duration)
+	// Polled returns the result stored under key unless it expired
+	Polled(key string) ([]byte, bool)
+	// DeletePolled drops the results stored under the keys
+	DeletePolled(keys ...string)
+}
+
+// A poll result as shared through a PollStore: the data of a category or
+// target, or the collections of a fetch
+type sharedPoll struct {
+	Time        time.Time                     `json:"time"`
+	Data        map[string]map[string]float64 `json:"data,omitempty"`
+	Series      []labeledData                 `json:"series,omitempty"`
+	Error       string                        `json:"error,omitempty"`
+	Collections []sharedCollection            `json:"collections,omitempty"`
+}
+
+type sharedCollection struct {
+	Group         string                        `json:"group"`
+	Target        string                        `json:"target,omitempty"`
+	Labels        prometheus.Labels             `json:"labels"`
+	Data          map[string]map[string]float64 `json:"data,omitempty"`
+	Series        []labeledData                 `json:"series,omitempty"`
+	Rates         map[string]float64            `json:"rates,omitempty"`
+	Time          time.Time                     `json:"time"`
+	UpstreamTimes map[string]time.Time          `json:"upstreamTimes,omitempty"`
+}
+
+// Share a poll result with the replicas using the same store
+func (e *Exporter) sharePoll(key string, poll sharedPoll, ttl time.Duration) {
+	if e.polls == nil || ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(poll)
+	if err != nil {
+		log.Printf("Failed to encode poll result %s: %v", key, err)
+		return
+	}
+	e.polls.SetPolled(key, data, ttl)
+}
+
+// The poll result shared under key by any replica
+func (e *Exporter) sharedPoll(key string) (sharedPoll, bool) {
+	if e.polls == nil {
+		return sharedPoll{}, false
+	}
+	data, ok := e.polls.Polled(key)
+	if !ok {
+		return sharedPoll{}, false
+	}
+	var poll sharedPoll
+	if err := json.Unmarshal(data, &poll); err != nil {
+		log.Printf("Ignoring shared poll result %s: %v", key, err)
+		return sharedPoll{}, false
+	}
+	return poll, true
+}
+
+// The error of a shared poll result
+func (p sharedPoll) err() error {
+	if p.Error == "" {
+		return nil
+	}
+	return errors.New(p.Error)
+}
+
+func pollError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func shareCollections(collections []*collection) []sharedCollection {
+	shared := make([]sharedCollection, len(collections))
+	for i, c := range collections {
+		shared[i] = sharedCollection{Group: c.group, Target: c.target, Labels: c.labels, Data: c.data, Series: c.series, Rates: c.rates, Time: c.time, UpstreamTimes: c.upstreamTimes}
+	}
+	return shared
+}
+
+func sharedCollections(shared []sharedCollection) []*collection {
+	collections := make([]*collection, len(shared))
+	for i, c := range shared {
+		if c.Labels == nil {
+			c.Labels = prometheus.Labels{}
+		}
+		collections[i] = &collection{group: c.Group, target: c.Target, labels: c.Labels, data: c.Data, series: c.Series, rates: c.Rates, time: c.Time, upstreamTimes: c.UpstreamTimes}
+	}
+	return collections
+}
@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/gorilla/websocket"
+)
+
+// StreamSource subscribes to the live monitoring stream of every monitoring
+// category and keeps the cache up to date. While a stream is down the category
+// is polled over the regular monitoring API until the stream reconnects.
+type StreamSource struct {
+	config     config.StreamingConfig
+	categories []string
+	operators  []string
+	server     config.RemoteServer
+	headers    map[string]map[string]config.Secret
+	requests   *RequestBuilder
+	cache      Store
+	client     *http.Client
+	dialer     *websocket.Dialer
+	states     *StateMapper
+	values     *ValueExtractor
+	urls       *urlBuilder
+	maxSize    int64
+}
+
+// NewStreamSource subscribes to the monitoring streams. Its polls wait for
+// the global rate limit of the given RateLimits.
+func NewStreamSource(cfg *config.Config, cache Store, rateLimits *RateLimits) (*StreamSource, error) {
+	streaming := cfg.Streaming
+	switch streaming.Protocol {
+	case "":
+		streaming.Protocol = "websocket"
+	case "websocket", "sse":
+	default:
+		return nil, fmt.Errorf("unsupported streaming protocol: %s", streaming.Protocol)
+	}
+	if streaming.PollInterval <= 0 {
+		streaming.PollInterval = 30 * time.Second
+	}
+	if streaming.ReconnectInterval <= 0 {
+		streaming.ReconnectInterval = time.Minute
+	}
+
+	// Without operator identifiers the categories are streamed once
+	operators := cfg.QueryParams.Operators
+	if len(operators) == 0 {
+		operators = []string{""}
+	}
+
+	client, err := newHTTPClient(cfg.RemoteMonitoringServer, newClientOptions(cfg, nil, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := newWebsocketDialer(cfg.RemoteMonitoringServer, newClientOptions(cfg, nil, rateLimits))
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := NewStateMapper(cfg.States)
+	if err != nil {
+		return nil, err
+	}
+	values, err := NewValueExtractor(cfg.ValueExtractions)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := newURLBuilder(cfg)
+	if err != nil {
+		return nil, err
+	}
+	requests, err := NewRequestBuilder(cfg.CategoryRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamSource{
+		config:     streaming,
+		categories: cfg.MetricsMonitoringCategory,
+		operators:  operators,
+		server:     cfg.RemoteMonitoringServer,
+		headers:    cfg.CategoryHeaders,
+		requests:   requests,
+		cache:      cache,
+		client:     client,
+		dialer:     dialer,
+		states:     states,
+		values:     values,
+		urls:       urls,
+		maxSize:    cfg.ResponseLimit(),
+	}, nil
+}
+
+// Run subscribes to all categories of every operator until the context is cancelled
+func (s *StreamSource) Run(ctx context.Context) {
+	for _, operator := range s.operators {
+		for _, category := range s.categories {
+			go s.runCategory(ctx, operator, category)
+		}
+	}
+	<-ctx.Done()
+}
+
+func (s *StreamSource) runCategory(ctx context.Context, operator string, category string) {
+	for {
+		err := s.subscribe(ctx, operator, category)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Monitoring stream for %s dropped: %v, falling back to polling", category, err)
+		s.poll(ctx, operator, category)
+	}
+}
+
+// Subscribe to the stream of a category, blocking while it is connected
+func (s *StreamSource) subscribe(ctx context.Context, operator string, category string) error {
+	if s.config.Protocol == "sse" {
+		return s.subscribeSSE(ctx, operator, category)
+	}
+	return s.subscribeWebsocket(ctx, operator, category)
+}
+
+func (s *StreamSource) subscribeWebsocket(ctx context.Context, operator string, category string) error {
+	streamURL := s.urls.monitoringURL("ws", s.server, "stream", category, operator)
+
+	header := http.Header{}
+	for name, value := range requestHeaders(s.server, s.headers[category]) {
+		header.Set(name, value)
+	}
+
+	conn, _, err := s.dialer.DialContext(ctx, streamURL, header)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", streamURL, err)
+	}
+	defer conn.Close()
+	conn.SetReadLimit(s.maxSize)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Subscribed to monitoring stream %s", streamURL)
+	for {
+		_, message, err := conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			responsesTooLarge.WithLabelValues(serverHost(s.server)).Inc()
+			return errResponseTooLarge
+		}
+		if err != nil {
+			return err
+		}
+		s.update(operator, category, message)
+	}
+}
+
+func (s *StreamSource) subscribeSSE(ctx context.Context, operator string, category string) error {
+	streamURL := s.urls.monitoringURL("http", s.server, "stream", category, operator)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range requestHeaders(s.server, s.headers[category]) {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", streamURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	log.Printf("Subscribed to monitoring stream %s", streamURL)
+	var event strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line terminates the event
+			if event.Len() > 0 {
+				s.update(operator, category, []byte(event.String()))
+				event.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if event.Len() > 0 {
+				event.WriteByte('\n')
+			}
+			event.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			responsesTooLarge.WithLabelValues(serverHost(s.server)).Inc()
+			return errResponseTooLarge
+		}
+		return err
+	}
+	return fmt.Errorf("stream closed by server")
+}
+
+// Poll the monitoring API until it is time to reconnect the stream
+func (s *StreamSource) poll(ctx context.Context, operator string, category string) {
+	pollURL := s.urls.monitoringURL("http", s.server, "monitoring", category, operator)
+
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+	reconnect := time.NewTimer(s.config.ReconnectInterval)
+	defer reconnect.Stop()
+
+	for {
+		monitoring, err := s.fetch(ctx, operator, category, pollURL)
+		if err != nil {
+			log.Printf("Error fetching data from %s: %v", pollURL, err)
+		} else {
+			s.cache.Update(operator, category, unlabeled(category, monitoring.values, monitoring.series))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-reconnect.C:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fetch the monitoring payload of a category with the method and body
+// configured for it
+func (s *StreamSource) fetch(ctx context.Context, operator string, category string, pollURL string) (monitoringData, error) {
+	request, err := s.requests.build(category, operator, requestHeaders(s.server, s.headers[category]))
+	if err != nil {
+		return monitoringData{}, err
+	}
+	return fetchMonitoringData(ctx, s.client, s.states, s.values, nil, category, pollURL, request)
+}
+
+func (s *StreamSource) update(operator string, category string, message []byte) {
+	values, series, err := parseMonitoringData(s.states, s.values, category, message)
+	if err != nil {
+		log.Printf("Error parsing monitoring stream message for %s: %v", category, err)
+		return
+	}
+	s.cache.Update(operator, category, unlabeled(category, values, series))
+}
+
+// The store keeps plain values, so the labels extracted from streamed
+// values are dropped
+func unlabeled(category string, values map[string]float64, series []labeledData) map[string]float64 {
+	for _, s := range series {
+		for name, value := range s.Data[category] {
+			values[name] = value
+		}
+	}
+	return values
+}
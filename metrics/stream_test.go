@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Polls between stream connections send the method and body configured for
+// the category
+func TestStreamPollRequest(t *testing.T) {
+	type request struct {
+		method, contentType, body string
+	}
+	requests := make(chan request, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case requests <- request{r.Method, r.Header.Get("Content-Type"), string(body)}:
+		default:
+		}
+		io.WriteString(w, `{"connected": 3}`)
+	}))
+	t.Cleanup(upstream.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+
+	cache := NewCache()
+	source, err := NewStreamSource(&config.Config{
+		RemoteMonitoringServer:    config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsMonitoringCategory: []string{"cells"},
+		CategoryRequests: map[string]config.RequestConfig{
+			"cells": {Body: `{"operator": {{json .Operator}}, "category": {{json .Category}}}`},
+		},
+		Streaming: config.StreamingConfig{PollInterval: time.Hour, ReconnectInterval: time.Millisecond},
+	}, cache, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.poll(context.Background(), "op1", "cells")
+
+	got := <-requests
+	want := request{http.MethodPost, "application/json", `{"operator": "op1", "category": "cells"}`}
+	if got != want {
+		t.Errorf("poll request = %+v, want %+v", got, want)
+	}
+	if values := cache.Snapshot("op1")["cells"]; values["connected"] != 3 {
+		t.Errorf("polled values = %v, want connected 3", values)
+	}
+}
@@ -0,0 +1,363 @@
+package metrics
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeTarget is an upstream API, the module settings used to fetch from it
+// and the labels attached to its metrics
+type scrapeTarget struct {
+	name   string
+	server config.RemoteServer
+	module config.Module
+	labels prometheus.Labels
+	client *http.Client
+
+	// Name of the configured module, which /probe finds the target by.
+	// Targets probed without being configured or discovered are anonymous:
+	// they get neither the module's nor the category credentials.
+	moduleName string
+	anonymous  bool
+
+	mu     sync.Mutex
+	polled map[string]polledData
+}
+
+// Last data fetched for an operator, reused within the poll interval
+type polledData struct {
+	data   map[string]map[string]float64
+	series []labeledData
+	err    error
+	time   time.Time
+}
+
+func newScrapeTarget(name string, server config.RemoteServer, module config.Module, labels prometheus.Labels, options clientOptions) (*scrapeTarget, error) {
+	switch module.Scheme {
+	case "":
+		module.Scheme = "http"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q for target %s", module.Scheme, name)
+	}
+	switch module.DataType {
+	case "":
+		module.DataType = "statistics"
+	case "statistics", "monitoring", "open5gs", "free5gc", "ueransim":
+	default:
+		return nil, fmt.Errorf("unsupported data type %q for target %s", module.DataType, name)
+	}
+	if err := checkErrorPolicy(module.OnUpstreamError); err != nil {
+		return nil, fmt.Errorf("%v for target %s", err, name)
+	}
+	if err := checkCategories(module.DataType, module.Categories); err != nil {
+		return nil, fmt.Errorf("%v for target %s", err, name)
+	}
+
+	// Module headers and credentials are sent with every request
+	headers := requestHeaders(server, module.Headers)
+	if module.Auth.BearerToken != "" {
+		headers["Authorization"] = "Bearer " + string(module.Auth.BearerToken)
+	} else if module.Auth.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(module.Auth.Username + ":" + string(module.Auth.Password)))
+		headers["Authorization"] = "Basic " + credentials
+	}
+	server.Headers = make(map[string]config.Secret, len(headers))
+	for name, value := range headers {
+		server.Headers[name] = config.Secret(value)
+	}
+	if module.ProxyURL != "" {
+		server.ProxyURL = module.ProxyURL
+	}
+
+	client, err := newHTTPClient(server, options)
+	if err != nil {
+		return nil, err
+	}
+	if module.TLS.Enabled {
+		tlsConfig, err := newTLSConfig(module.TLS, options.tlsPolicy, options.spiffe)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for target %s: %v", name, err)
+		}
+		baseTransport(client).TLSClientConfig = tlsConfig
+	}
+
+	if labels == nil {
+		labels = prometheus.Labels{}
+	}
+	return &scrapeTarget{
+		name:   name,
+		server: server,
+		module: module,
+		labels: labels,
+		client: client,
+		polled: make(map[string]polledData),
+	}, nil
+}
+
+// Copy of the target for another address, sharing its HTTP client
+func (t *scrapeTarget) withAddress(name string, address string, port uint, labels prometheus.Labels) *scrapeTarget {
+	server := t.server
+	server.Address = address
+	server.Port = port
+	return &scrapeTarget{
+		name:   name,
+		server: server,
+		module: t.module,
+		labels: labels,
+		client: t.client,
+		polled: make(map[string]polledData),
+
+		moduleName: t.moduleName,
+	}
+}
+
+// Build the configured targets, applying the settings of their module
+func newScrapeTargets(cfg *config.Config, options clientOptions) ([]*scrapeTarget, error) {
+	seen := make(map[string]bool)
+	var targets []*scrapeTarget
+	for _, def := range cfg.Targets {
+		if def.Name == "" {
+			return nil, fmt.Errorf("target %s:%d has no name", def.Address, def.Port)
+		}
+		if seen[def.Name] {
+			return nil, fmt.Errorf("duplicate target name %s", def.Name)
+		}
+		seen[def.Name] = true
+
+		// A target type selects the settings of a known upstream
+		module := config.Module{OnUpstreamError: cfg.OnUpstreamError}
+		switch def.Type {
+		case "":
+		case "open5gs", "free5gc", "ueransim":
+			module.DataType = def.Type
+		default:
+			return nil, fmt.Errorf("target %s has unknown type %s", def.Name, def.Type)
+		}
+		if def.Module != "" {
+			named, ok := cfg.Modules[def.Module]
+			if !ok {
+				return nil, fmt.Errorf("target %s uses unknown module %s", def.Name, def.Module)
+			}
+			module = module.Merge(named)
+		}
+
+		labels := prometheus.Labels{"target": def.Name}
+		for name, value := range def.Labels {
+			labels[sanitizeMetricName(name)] = value
+		}
+
+		server := config.RemoteServer{Address: def.Address, Port: def.Port}
+		target, err := newScrapeTarget(def.Name, server, module.Merge(def.Settings), labels, options)
+		if err != nil {
+			return nil, err
+		}
+		target.moduleName = def.Module
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// Build a target without an address for every module, used by /probe
+func newModuleTargets(modules map[string]config.Module, onUpstreamError string, options clientOptions) (map[string]*scrapeTarget, error) {
+	targets := make(map[string]*scrapeTarget, len(modules))
+	for name, module := range modules {
+		module = config.Module{OnUpstreamError: onUpstreamError}.Merge(module)
+		target, err := newScrapeTarget(name, config.RemoteServer{}, module, nil, options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid module %s: %v", name, err)
+		}
+		target.moduleName = name
+		targets[name] = target
+	}
+	return targets, nil
+}
+
+// The module without the credentials it authenticates to its targets with,
+// used for probes of targets that are neither configured nor discovered
+func withoutCredentials(module config.Module) config.Module {
+	module.Auth = config.TargetAuth{}
+	module.Headers = nil
+	module.TLS.CertFile, module.TLS.KeyFile = "", ""
+	module.TLS.Certificate, module.TLS.Key = "", ""
+	module.TLS.SPIFFE = config.SPIFFEConfig{}
+	return module
+}
+
+// Headers of the requests for a category of the target
+func (e *Exporter) categoryHeaders(t *scrapeTarget, category string) map[string]string {
+	if t.anonymous {
+		return requestHeaders(t.server, nil)
+	}
+	return requestHeaders(t.server, e.config.CategoryHeaders[category])
+}
+
+// Fetch the data of a target for an operator, reusing the last result
+// within the poll interval of its module, polled here or by a replica
+// sharing the store. The rates of polled data are derived once per poll for
+// the collection group. The data fetched is returned along with the errors
+// of the fetches that failed.
+func (e *Exporter) collectTarget(ctx context.Context, t *scrapeTarget, group string, operator string) (map[string]map[string]float64, []labeledData, error) {
+	if t.module.PollInterval > 0 {
+		t.mu.Lock()
+		polled, ok := t.polled[operator]
+		t.mu.Unlock()
+		if ok && time.Since(polled.time) < t.module.PollInterval {
+			return polled.data, polled.series, polled.err
+		}
+		if shared, ok := e.sharedTargetPoll(t, operator); ok && time.Since(shared.Time) < t.module.PollInterval {
+			t.mu.Lock()
+			t.polled[operator] = polledData{data: shared.Data, series: shared.Series, err: shared.err(), time: shared.Time}
+			t.mu.Unlock()
+			e.rates.ObservePoll(group, shared.Data, shared.Time)
+			return shared.Data, shared.Series, shared.err()
+		}
+	}
+
+	var data map[string]map[string]float64
+	var series []labeledData
+	var err error
+	switch t.module.DataType {
+	case "monitoring":
+		data, series, err = e.fetchMonitoringCategories(ctx, t, operator)
+	case "open5gs", "free5gc", "ueransim":
+		series, err = e.fetchTargetType(ctx, t, operator)
+	default:
+		data, series, err = e.fetchAndCombineJSONData(ctx, t, operator)
+	}
+
+	if t.module.PollInterval > 0 {
+		now := time.Now()
+		t.mu.Lock()
+		t.polled[operator] = polledData{data: data, series: series, err: err, time: now}
+		t.mu.Unlock()
+		e.rates.ObservePoll(group, data, now)
+		if !t.anonymous {
+			e.sharePoll(targetPollKey(t, operator), sharedPoll{Time: now, Data: data, Series: series, Error: pollError(err)}, t.module.PollInterval)
+		}
+	}
+	return data, series, err
+}
+
+// Key of the poll of a target shared through the store
+func targetPollKey(t *scrapeTarget, operator string) string {
+	return "target/" + t.name + "/" + serverHost(t.server) + "/" + operator
+}
+
+func (e *Exporter) sharedTargetPoll(t *scrapeTarget, operator string) (sharedPoll, bool) {
+	if t.anonymous {
+		return sharedPoll{}, false
+	}
+	return e.sharedPoll(targetPollKey(t, operator))
+}
+
+// Fetch a target of a known upstream type. Its last series are served after
+// a failure with the serve-cached policy.
+func (e *Exporter) fetchTargetType(ctx context.Context, t *scrapeTarget, operator string) ([]labeledData, error) {
+	var series []labeledData
+	var err error
+	switch t.module.DataType {
+	case "open5gs":
+		series, err = e.fetchOpen5GS(ctx, t, operator)
+	case "free5gc":
+		series, err = e.fetchFree5GC(ctx, t, operator)
+	case "ueransim":
+		series, err = e.fetchUERANSIM(ctx, t, operator)
+	}
+
+	key := t.module.DataType + "/" + t.name + "/" + operator
+	if err != nil {
+		fallback, ok := e.fallbackFor(t, key, err)
+		if !ok {
+			return nil, err
+		}
+		return fallback.([]labeledData), nil
+	}
+	e.fallback.put(key, series)
+	return series, nil
+}
+
+// Fetch the monitoring payload of every category of a target. Categories
+// polled by the scheduler are served from its last poll.
+func (e *Exporter) fetchMonitoringCategories(ctx context.Context, t *scrapeTarget, operator string) (map[string]map[string]float64, []labeledData, error) {
+	data := make(map[string]map[string]float64)
+	var series []labeledData
+	var errs []error
+	for _, category := range t.module.Categories {
+		if result, ok := e.scheduler.latest(t, operator, category); ok {
+			if result.err != nil {
+				errs = append(errs, fmt.Errorf("category %s: %v", category, result.err))
+			}
+			mergeMetrics(data, result.data)
+			series = append(series, result.series...)
+			continue
+		}
+		values, categorySeries, err := e.fetchMonitoringCategory(ctx, t, operator, category)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("category %s: %v", category, err))
+			continue
+		}
+		data[category] = values
+		series = append(series, categorySeries...)
+	}
+	return data, series, errors.Join(errs...)
+}
+
+// Fetch the monitoring payload of one category of a target. Failures are
+// logged, unless the last payload is served instead.
+func (e *Exporter) fetchMonitoringCategory(ctx context.Context, t *scrapeTarget, operator string, category string) (map[string]float64, []labeledData, error) {
+	apiURL := e.urls.monitoringURL(t.module.Scheme, t.server, "monitoring", category, operator)
+	request, err := e.requests.build(category, operator, e.categoryHeaders(t, category))
+	if err != nil {
+		log.Printf("Error fetching data from %s: %v", apiURL, err)
+		return nil, nil, err
+	}
+	monitoring, err := fetchMonitoringData(ctx, t.client, e.states, e.values, e.upstreamTimes, category, apiURL, request)
+	e.status.record(t, operator, category, apiURL, len(monitoring.values)+len(monitoring.series), err)
+	if err != nil {
+		fallback, ok := e.fallbackFor(t, apiURL, err)
+		if !ok {
+			log.Printf("Error fetching data from %s: %v", apiURL, err)
+			return nil, nil, err
+		}
+		monitoring = fallback.(monitoringData)
+	} else {
+		e.fallback.put(apiURL, monitoring)
+		if monitoring.timestamped {
+			e.upstreamTimes.record(t, operator, category, monitoring.collected)
+		}
+	}
+	return monitoring.values, monitoring.series, nil
+}
+
+// Collect every configured target for each operator. Targets failing with
+// the fail policy, or with metric conflicts with the error policy, fail the
+// collection.
+func (e *Exporter) collectTargets(ctx context.Context, operators []string, multiTenant bool) ([]*collection, error) {
+	var collections []*collection
+	for _, operator := range operators {
+		for _, t := range e.targets {
+			group := operator + "/" + t.name
+			data, series, err := e.collectTarget(ctx, t, group, operator)
+			data, series, err = e.withRestored(group, data, series, err)
+			if t.failsOn(err) {
+				return nil, fmt.Errorf("failed to fetch target %s: %v", t.name, err)
+			}
+			c := e.newCollection(group, mergeLabels(operatorLabels(operator, multiTenant), t.labels), data)
+			c.target = t.name
+			c.series = series
+			c.upstreamTimes = e.upstreamTimes.lookup(t, operator)
+			collections = append(collections, c)
+		}
+	}
+	return collections, nil
+}
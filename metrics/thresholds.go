@@ -0,0 +1,257 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var thresholdBreached = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cnaasprom_threshold_breached",
+	Help: "Whether a series breaches the threshold rule for its configured duration",
+}, []string{"rule"})
+
+func init() {
+	registerInternal(thresholdBreached)
+}
+
+var thresholdOperators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Evaluation interval of the threshold rules unless configured
+const defaultThresholdInterval = 30 * time.Second
+
+// ThresholdEvaluator checks the collected values of the configured operators
+// against the threshold rules every interval, for sites without
+// Alertmanager, whether or not Prometheus scrapes. Breaching series are
+// pending until they breached a rule for its duration, then firing.
+type ThresholdEvaluator struct {
+	rules    []*thresholdRule
+	interval time.Duration
+	// Collects the samples the rules are evaluated over
+	collect func(ctx context.Context) (*sampleSet, error)
+
+	mu     sync.Mutex
+	alerts map[string]*Alert
+}
+
+type thresholdRule struct {
+	name      string
+	pattern   *regexp.Regexp
+	labels    map[string]string
+	compare   func(a, b float64) bool
+	threshold string
+	value     float64
+	duration  time.Duration
+	severity  string
+	summary   string
+}
+
+// Alert is a series breaching a threshold rule
+type Alert struct {
+	Rule      string            `json:"rule"`
+	State     string            `json:"state"`
+	Severity  string            `json:"severity,omitempty"`
+	Summary   string            `json:"summary,omitempty"`
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Threshold string            `json:"threshold"`
+	Since     time.Time         `json:"since"`
+}
+
+func NewThresholdEvaluator(defs []config.ThresholdRule, interval time.Duration) (*ThresholdEvaluator, error) {
+	if interval <= 0 {
+		interval = defaultThresholdInterval
+	}
+	t := &ThresholdEvaluator{interval: interval, alerts: make(map[string]*Alert)}
+	seen := make(map[string]bool)
+	for _, def := range defs {
+		if def.Name == "" || seen[def.Name] {
+			return nil, fmt.Errorf("threshold rules need a unique name, got %q", def.Name)
+		}
+		seen[def.Name] = true
+
+		compare, ok := thresholdOperators[def.Operator]
+		if !ok {
+			return nil, fmt.Errorf("threshold rule %s has unknown operator %q", def.Name, def.Operator)
+		}
+		pattern, err := regexp.Compile("^(?:" + def.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold pattern %q: %v", def.Metric, err)
+		}
+		t.rules = append(t.rules, &thresholdRule{
+			name:      def.Name,
+			pattern:   pattern,
+			labels:    def.Labels,
+			compare:   compare,
+			threshold: def.Operator + " " + strconv.FormatFloat(def.Value, 'g', -1, 64),
+			value:     def.Value,
+			duration:  def.For,
+			severity:  def.Severity,
+			summary:   def.Summary,
+		})
+		thresholdBreached.WithLabelValues(def.Name).Set(0)
+	}
+	return t, nil
+}
+
+// Run evaluates the rules every interval until ctx is done
+func (t *ThresholdEvaluator) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		t.evaluateCollected(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate the rules over the collected values. Alerts are kept when the
+// values can't be collected, rather than resolved.
+func (t *ThresholdEvaluator) evaluateCollected(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, t.interval)
+	defer cancel()
+	set, err := t.collect(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to collect metrics for threshold rules: %v", err)
+		}
+		return
+	}
+	t.evaluate(set)
+}
+
+// Evaluate the rules over the samples of every configured operator. Series
+// that no longer breach a rule, or are gone, resolve their alert.
+func (t *ThresholdEvaluator) evaluate(set *sampleSet) {
+	if len(t.rules) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	breaching := make(map[string]bool)
+	for name, family := range set.families {
+		for _, rule := range t.rules {
+			if !rule.pattern.MatchString(name) {
+				continue
+			}
+			for key, sample := range family.samples {
+				if !rule.matchLabels(sample.labels) || !rule.compare(sample.value, rule.value) {
+					continue
+				}
+				id := rule.name + "\x00" + name + "\x00" + key
+				breaching[id] = true
+				alert, ok := t.alerts[id]
+				if !ok {
+					alert = &Alert{
+						Rule:      rule.name,
+						Severity:  rule.severity,
+						Summary:   rule.summary,
+						Metric:    set.namer.name(name),
+						Labels:    sample.labels,
+						Threshold: rule.threshold,
+						Since:     now,
+					}
+					t.alerts[id] = alert
+				}
+				alert.Value = sample.value
+				alert.State = "pending"
+				if now.Sub(alert.Since) >= rule.duration {
+					alert.State = "firing"
+				}
+			}
+		}
+	}
+
+	firing := make(map[string]bool)
+	for id, alert := range t.alerts {
+		if !breaching[id] {
+			delete(t.alerts, id)
+		} else if alert.State == "firing" {
+			firing[alert.Rule] = true
+		}
+	}
+	for _, rule := range t.rules {
+		value := 0.0
+		if firing[rule.name] {
+			value = 1
+		}
+		thresholdBreached.WithLabelValues(rule.name).Set(value)
+	}
+}
+
+func (r *thresholdRule) matchLabels(labels prometheus.Labels) bool {
+	for name, value := range r.labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *ThresholdEvaluator) list() []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(t.alerts))
+	for _, alert := range t.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		a, b := alerts[i], alerts[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return labelsKey(a.Labels) < labelsKey(b.Labels)
+	})
+	return alerts
+}
+
+// AlertsHandler lists the series breaching a threshold rule as JSON, as of
+// the last evaluation
+// Thresholds returns the evaluator of the threshold rules to run, nil
+// without rules
+func (e *Exporter) Thresholds() *ThresholdEvaluator {
+	if len(e.thresholds.rules) == 0 {
+		return nil
+	}
+	return e.thresholds
+}
+
+func (e *Exporter) AlertsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Keep the operators of the thresholds readable
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(struct {
+			Alerts []Alert `json:"alerts"`
+		}{e.thresholds.list()})
+	})
+}
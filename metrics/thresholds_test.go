@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Alerts follow the evaluations of the configured operators' values, not
+// the scrapes, which may ask for other operators or none of the series
+func TestThresholdsIndependentOfScrapes(t *testing.T) {
+	var failures atomic.Int64
+	failures.Store(20)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("operatorIdentifier") != "" {
+			fmt.Fprint(w, `{"registration": {"failures": 0}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"registration": {"failures": %d}}`, failures.Load())
+	}))
+	t.Cleanup(upstream.Close)
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(upstream.URL, "http://"))
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	exporter, err := NewExporter(&config.Config{
+		RemoteStatisticServer:     config.RemoteServer{Address: host, Port: uint(p)},
+		MetricsStatisticsCategory: []string{"amf"},
+		Thresholds: []config.ThresholdRule{
+			{Name: "failures", Metric: "amf_registration_failures", Operator: ">", Value: 10},
+		},
+	}, NewCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thresholds := exporter.Thresholds()
+	if thresholds == nil {
+		t.Fatal("no threshold evaluator with rules configured")
+	}
+
+	thresholds.evaluateCollected(context.Background())
+	if alerts := thresholds.list(); len(alerts) != 1 || alerts[0].State != "firing" || alerts[0].Value != 20 {
+		t.Fatalf("alerts = %+v, want the breaching series firing", alerts)
+	}
+
+	recorder := httptest.NewRecorder()
+	exporter.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics?operator=other", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape: status %d: %s", recorder.Code, recorder.Body)
+	}
+	if alerts := thresholds.list(); len(alerts) != 1 {
+		t.Errorf("alerts after a scrape of another operator = %+v, want the alert kept", alerts)
+	}
+
+	failures.Store(0)
+	thresholds.evaluateCollected(context.Background())
+	if alerts := thresholds.list(); len(alerts) != 0 {
+		t.Errorf("alerts = %+v, want the alert resolved", alerts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	thresholds.Run(ctx)
+}
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Back-off after a 429 response without a usable Retry-After header
+	defaultRetryAfter = 30 * time.Second
+	// Longest back-off honoured, whatever the server advertises
+	maxRetryAfter = 10 * time.Minute
+	// Responses kept to be served while a server throttles
+	maxFallbackResponses = 1024
+)
+
+var (
+	errThrottled = errors.New("upstream server is throttling requests")
+
+	throttledResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cnaasprom_upstream_throttled_total",
+		Help: "Upstream responses with status 429 Too Many Requests",
+	}, []string{"server"})
+)
+
+func init() {
+	registerInternal(throttledResponses)
+}
+
+// throttle holds back requests to servers that answered 429 until their
+// Retry-After has passed
+type throttle struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{until: make(map[string]time.Time)}
+}
+
+func (t *throttle) allow(server string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if until, ok := t.until[server]; ok {
+		if time.Now().Before(until) {
+			return errThrottled
+		}
+		delete(t.until, server)
+	}
+	return nil
+}
+
+func (t *throttle) record(server string, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	throttledResponses.WithLabelValues(server).Inc()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.until[server] = time.Now().Add(retryAfter(resp.Header.Get("Retry-After")))
+}
+
+// Parse a Retry-After header given in seconds or as an HTTP date
+func retryAfter(header string) time.Duration {
+	delay := defaultRetryAfter
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
+
+// Whether a fetch failed because the server throttles requests
+func isThrottled(err error) bool {
+	var statusErr *statusError
+	return errors.Is(err, errThrottled) || errors.As(err, &statusErr) && statusErr.code == http.StatusTooManyRequests
+}
+
+// fallbackResponses keeps the last response parsed from each URL, served
+// instead of an error while the server throttles requests, or after any
+// error with the serve-cached policy
+type fallbackResponses struct {
+	mu      sync.Mutex
+	entries map[string]interface{}
+}
+
+func newFallbackResponses() *fallbackResponses {
+	return &fallbackResponses{entries: make(map[string]interface{})}
+}
+
+func (f *fallbackResponses) put(apiURL string, data interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.entries[apiURL]; !ok && len(f.entries) >= maxFallbackResponses {
+		for other := range f.entries {
+			delete(f.entries, other)
+			break
+		}
+	}
+	f.entries[apiURL] = data
+}
+
+// Return the last response of a URL when err means the server throttles
+func (f *fallbackResponses) get(apiURL string, err error) (interface{}, bool) {
+	if !isThrottled(err) {
+		return nil, false
+	}
+	return f.last(apiURL)
+}
+
+// Return the last response of a URL whatever the error
+func (f *fallbackResponses) last(apiURL string) (interface{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.entries[apiURL]
+	return data, ok
+}
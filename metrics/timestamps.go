@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Timestamp offset of each category exported with explicit timestamps
+type timestampOffsets map[string]time.Duration
+
+// The default offset covers the statistics categories
+func newTimestampOffsets(cfg config.TimestampOffsetConfig, statistics []string) (timestampOffsets, error) {
+	if cfg.Offset < 0 {
+		return nil, fmt.Errorf("negative timestamp offset %s", cfg.Offset)
+	}
+
+	offsets := make(timestampOffsets)
+	if cfg.Offset > 0 {
+		for _, category := range statistics {
+			offsets[category] = cfg.Offset
+		}
+	}
+	for category, offset := range cfg.Categories {
+		switch {
+		case offset < 0:
+			return nil, fmt.Errorf("negative timestamp offset %s for category %s", offset, category)
+		case offset == 0:
+			delete(offsets, category)
+		default:
+			offsets[category] = offset
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+	return offsets, nil
+}
+
+// Configured category and offset of the samples of a family. Families of
+// statistics are named after the category and the group within it, e.g.
+// amf_registration.
+func (o timestampOffsets) lookup(category string) (string, time.Duration, bool) {
+	if len(o) == 0 {
+		return "", 0, false
+	}
+	for {
+		if offset, ok := o[category]; ok {
+			return category, offset, true
+		}
+		i := strings.LastIndexByte(category, '_')
+		if i < 0 {
+			return "", 0, false
+		}
+		category = category[:i]
+	}
+}
+
+// Timestamp in milliseconds of a sample of a category exported with the
+// offset. The data describes the interval of the offset before the time
+// upstream collected it, or without a collection time the interval before
+// the bin boundary the scrape falls after, so the timestamp stays the same
+// while the data is unchanged.
+func offsetTimestamp(category string, offset time.Duration, collected map[string]time.Time, now time.Time) int64 {
+	if at, ok := collected[category]; ok {
+		return at.Add(-offset).UnixMilli()
+	}
+	return now.Truncate(offset).Add(-offset).UnixMilli()
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Samples are timestamped from when upstream collected them or the bin
+// boundary, so repeated scrapes of the same data export the same timestamp
+func TestOffsetTimestamps(t *testing.T) {
+	offsets, err := newTimestampOffsets(config.TimestampOffsetConfig{
+		Offset:     5 * time.Minute,
+		Categories: map[string]time.Duration{"smf": 0},
+	}, []string{"amf", "smf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := offsets.lookup("smf_sessions"); ok {
+		t.Errorf("smf exported with timestamps, want it disabled")
+	}
+	category, offset, ok := offsets.lookup("amf_registration")
+	if !ok || category != "amf" || offset != 5*time.Minute {
+		t.Fatalf("lookup = %s %s %t, want amf 5m", category, offset, ok)
+	}
+
+	bin := time.Date(2024, 3, 1, 10, 5, 0, 0, time.UTC)
+	first := offsetTimestamp(category, offset, nil, bin.Add(10*time.Second))
+	second := offsetTimestamp(category, offset, nil, bin.Add(4*time.Minute))
+	if want := bin.Add(-offset).UnixMilli(); first != want || second != want {
+		t.Errorf("timestamps = %d, %d, want %d within the bin", first, second, want)
+	}
+
+	collected := map[string]time.Time{"amf": bin.Add(30 * time.Second)}
+	if got, want := offsetTimestamp(category, offset, collected, bin.Add(4*time.Minute)), bin.Add(30*time.Second-offset).UnixMilli(); got != want {
+		t.Errorf("timestamp = %d, want %d from the collection time", got, want)
+	}
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// ISO 8601 durations without years and months, whose length varies
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// timeWindows adds the rolling time window of each category to its
+// statistics requests. The window is computed at every fetch.
+type timeWindows struct {
+	config     config.TimeWindowConfig
+	defaults   statisticsWindow
+	categories map[string]statisticsWindow
+}
+
+type statisticsWindow struct {
+	duration    time.Duration
+	granularity string
+	step        time.Duration
+}
+
+func newTimeWindows(cfg config.TimeWindowConfig) (*timeWindows, error) {
+	if cfg.Duration == 0 && cfg.Granularity == "" && len(cfg.Categories) == 0 {
+		return nil, nil
+	}
+	if cfg.StartParam == "" {
+		cfg.StartParam = "start"
+	}
+	if cfg.EndParam == "" {
+		cfg.EndParam = "end"
+	}
+	if cfg.GranularityParam == "" {
+		cfg.GranularityParam = "granularity"
+	}
+
+	w := &timeWindows{config: cfg, categories: make(map[string]statisticsWindow, len(cfg.Categories))}
+	var err error
+	if w.defaults, err = newStatisticsWindow(cfg.TimeWindow, cfg.Align); err != nil {
+		return nil, fmt.Errorf("invalid time window: %v", err)
+	}
+	for category, override := range cfg.Categories {
+		window := cfg.TimeWindow
+		if override.Duration != 0 {
+			window.Duration = override.Duration
+		}
+		if override.Granularity != "" {
+			window.Granularity = override.Granularity
+		}
+		if w.categories[category], err = newStatisticsWindow(window, cfg.Align); err != nil {
+			return nil, fmt.Errorf("invalid time window for category %s: %v", category, err)
+		}
+	}
+	return w, nil
+}
+
+func newStatisticsWindow(def config.TimeWindow, align bool) (statisticsWindow, error) {
+	window := statisticsWindow{duration: def.Duration, granularity: def.Granularity}
+	if def.Duration < 0 {
+		return window, fmt.Errorf("negative duration %s", def.Duration)
+	}
+	if def.Granularity != "" {
+		step, err := parseISODuration(def.Granularity)
+		if err != nil {
+			return window, err
+		}
+		window.step = step
+	} else if align && def.Duration > 0 {
+		return window, fmt.Errorf("align requires a granularity")
+	}
+	return window, nil
+}
+
+// Parse an ISO 8601 duration of weeks, days, hours, minutes and seconds
+func parseISODuration(text string) (time.Duration, error) {
+	match := isoDuration.FindStringSubmatch(text)
+	if match == nil {
+		return 0, fmt.Errorf("granularity %q is not an ISO 8601 duration of weeks, days, hours, minutes or seconds", text)
+	}
+	var total time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if match[i+1] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(value * float64(unit))
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("granularity %q is empty", text)
+	}
+	return total, nil
+}
+
+// Add the window of a category ending now to a statistics URL
+func (w *timeWindows) apply(rawURL string, category string, now time.Time) string {
+	if w == nil {
+		return rawURL
+	}
+	window, ok := w.categories[category]
+	if !ok {
+		window = w.defaults
+	}
+	if window.duration == 0 && window.granularity == "" {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	if window.duration > 0 {
+		end := now.UTC().Truncate(time.Second)
+		if w.config.Align && window.step > 0 {
+			end = end.Truncate(window.step)
+		}
+		query.Set(w.config.StartParam, w.formatTime(end.Add(-window.duration)))
+		query.Set(w.config.EndParam, w.formatTime(end))
+	}
+	if window.granularity != "" {
+		query.Set(w.config.GranularityParam, window.granularity)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (w *timeWindows) formatTime(t time.Time) string {
+	switch w.config.TimeFormat {
+	case "":
+		return t.Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	default:
+		return t.Format(w.config.TimeFormat)
+	}
+}
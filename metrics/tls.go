@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Restrict the TLS configuration of an upstream connection to the policy,
+// creating one when nil
+func withTLSPolicy(t *tls.Config, policy config.TLSPolicy) (*tls.Config, error) {
+	if t == nil {
+		t = &tls.Config{}
+	}
+	if err := policy.Apply(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// HTTP transport of clients without settings of their own, following the
+// TLS policy
+func newPolicyTransport(policy config.TLSPolicy) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := withTLSPolicy(transport.TLSClientConfig, policy)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// Build a TLS client configuration from the configured files or PEM
+// values, or with SPIFFE from the Workload API through the sources of the
+// configuration's owner, restricted to the policy
+func newTLSConfig(cfg config.TLSClientConfig, policy config.TLSPolicy, sources *spiffeSources) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" && cfg.CA != "" {
+		return nil, fmt.Errorf("only one of caFile and ca can be set")
+	}
+	if cfg.CAFile != "" {
+		caCert, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CA)) {
+			return nil, fmt.Errorf("no certificates found in CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	hasCertFile := cfg.CertFile != "" || cfg.KeyFile != ""
+	hasCert := cfg.Certificate != "" || cfg.Key != ""
+	if hasCertFile && hasCert {
+		return nil, fmt.Errorf("only one of certFile and keyFile or certificate and key can be set")
+	}
+	if hasCertFile {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if hasCert {
+		cert, err := tls.X509KeyPair([]byte(cfg.Certificate), []byte(cfg.Key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.SPIFFE.Enabled {
+		if hasCertFile || hasCert {
+			return nil, fmt.Errorf("a client certificate can't be used with SPIFFE")
+		}
+		if err := useSPIFFE(tlsConfig, cfg.SPIFFE, cfg.CAFile == "" && cfg.CA == "" && !cfg.InsecureSkipVerify, sources); err != nil {
+			return nil, err
+		}
+	}
+
+	return withTLSPolicy(tlsConfig, policy)
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation scope of the exporter's spans
+const tracerName = "cnaasprom"
+
+// EnableTracing exports the spans of scrapes to the configured OTLP/HTTP
+// endpoint and continues the W3C trace context of incoming requests. The
+// returned function flushes the queued spans and stops the exporter.
+func EnableTracing(cfg config.TracingConfig, policy config.TLSPolicy) (func(context.Context) error, error) {
+	provider, err := newTracerProvider(cfg, policy)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Build the tracer provider batching the sampled spans to the collector
+func newTracerProvider(cfg config.TracingConfig, policy config.TLSPolicy) (*sdktrace.TracerProvider, error) {
+	tlsConfig, err := withTLSPolicy(nil, policy)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(cfg.Headers))
+	for name, value := range cfg.Headers {
+		headers[name] = string(value)
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(cfg.Endpoint),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithTLSClientConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ratio := cfg.SamplingRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceName(tracerName))),
+	), nil
+}
+
+// Start a span as a child of the span in ctx. Spans are no-ops until
+// EnableTracing installs a tracer provider.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Mark the span as failed when err is set
+func setSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// Serve h in a server span continuing the trace of the request
+func tracedHandler(h http.Handler, name string) http.Handler {
+	return otelhttp.NewHandler(h, name)
+}
+
+// Run the upstream requests of base in client spans propagating the trace
+// context. A span ends once the response body is read or closed.
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(string, *http.Request) string {
+		return "fetch"
+	}))
+}
@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	testSpansOnce sync.Once
+	testSpans     *tracetest.SpanRecorder
+)
+
+// Record the spans of the package in memory. The global tracer provider
+// can be installed only once, so the tests share the recorder and tell
+// their spans apart by trace ID.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	testSpansOnce.Do(func() {
+		testSpans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(testSpans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return testSpans
+}
+
+// The ended spans of the trace with the given name
+func endedSpans(recorder *tracetest.SpanRecorder, traceID trace.TraceID, name string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID && span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// The fetch span propagates its context upstream and lasts until the body
+// is consumed
+func TestFetchSpan(t *testing.T) {
+	recorder := recordSpans(t)
+	traceparents := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, `{"amf": {"attempts": 1}}`)
+	}))
+	t.Cleanup(upstream.Close)
+	client, err := newHTTPClient(config.RemoteServer{}, newClientOptions(&config.Config{}, nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "scrape")
+	defer parent.End()
+	traceID := parent.SpanContext().TraceID()
+
+	body, err := openBody(ctx, client, upstream.URL, upstreamRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := <-traceparents; !strings.Contains(header, traceID.String()) {
+		t.Errorf("traceparent = %q, want trace %s", header, traceID)
+	}
+	if spans := endedSpans(recorder, traceID, "fetch"); len(spans) != 0 {
+		t.Errorf("fetch span ended before the body was read")
+	}
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	spans := endedSpans(recorder, traceID, "fetch")
+	if len(spans) != 1 {
+		t.Fatalf("%d fetch spans ended, want one once the body was read", len(spans))
+	}
+	if spans[0].Parent().SpanID() != parent.SpanContext().SpanID() || spans[0].SpanKind() != trace.SpanKindClient {
+		t.Errorf("fetch span is not a client span of the scrape")
+	}
+
+	if _, err := openBody(ctx, client, upstream.URL+"/fail", upstreamRequest{}); err == nil {
+		t.Fatal("failed fetch succeeded")
+	}
+	<-traceparents
+	spans = endedSpans(recorder, traceID, "fetch")
+	if len(spans) != 2 || spans[1].Status().Code != codes.Error {
+		t.Errorf("failed fetch not recorded as error")
+	}
+}
+
+// Server spans continue the trace of the incoming request
+func TestServerSpan(t *testing.T) {
+	recorder := recordSpans(t)
+	handler := tracedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "scrape")
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spans := endedSpans(recorder, traceID, "scrape")
+	if len(spans) != 1 || spans[0].Parent().SpanID().String() != "00f067aa0ba902b7" || spans[0].SpanKind() != trace.SpanKindServer {
+		t.Errorf("scrape spans = %v, want a server span continuing the trace", spans)
+	}
+}
+
+// Shutting the tracer provider down flushes the queued spans to the
+// collector with the configured headers
+func TestTracingExport(t *testing.T) {
+	type export struct {
+		path, contentType, authorization string
+		size                             int
+	}
+	exports := make(chan export, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		exports <- export{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), len(data)}
+	}))
+	t.Cleanup(collector.Close)
+
+	provider, err := newTracerProvider(config.TracingConfig{
+		Endpoint: collector.URL + "/v1/traces",
+		Headers:  map[string]config.Secret{"Authorization": "Bearer token"},
+	}, config.TLSPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := provider.Tracer("test").Start(context.Background(), "scrape")
+	span.End()
+	select {
+	case <-exports:
+		t.Fatal("span exported before the batch was flushed")
+	default:
+	}
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-exports:
+		if got.path != "/v1/traces" || got.contentType != "application/x-protobuf" || got.authorization != "Bearer token" || got.size == 0 {
+			t.Errorf("export = %+v", got)
+		}
+	default:
+		t.Fatal("no spans exported on shutdown")
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Transformer converts the values of matching metrics on export, e.g. from
+// bytes to bits, so dashboards can rely on standard units
+type Transformer struct {
+	rules []*valueTransform
+}
+
+type valueTransform struct {
+	pattern  *regexp.Regexp
+	multiply float64
+	divide   float64
+	offset   float64
+}
+
+func NewTransformer(defs []config.ValueTransform) (*Transformer, error) {
+	t := &Transformer{}
+	for _, def := range defs {
+		pattern, err := regexp.Compile("^(?:" + def.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform pattern %q: %v", def.Metric, err)
+		}
+
+		rule := &valueTransform{pattern: pattern, multiply: def.Multiply, divide: def.Divide, offset: def.Offset}
+		if rule.multiply == 0 {
+			rule.multiply = 1
+		}
+		if rule.divide == 0 {
+			rule.divide = 1
+		}
+		t.rules = append(t.rules, rule)
+	}
+	return t, nil
+}
+
+// Apply the first rule matching the metric name to its value
+func (t *Transformer) Apply(name string, value float64) float64 {
+	for _, rule := range t.rules {
+		if rule.pattern.MatchString(name) {
+			return value*rule.multiply/rule.divide + rule.offset
+		}
+	}
+	return value
+}
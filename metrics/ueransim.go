@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The UERANSIM command line interface, found on the PATH
+	ueransimCLI      = "nr-cli"
+	ueransimCategory = "ueransim"
+	ueransimTimeout  = 10 * time.Second
+)
+
+// Read the status of a UERANSIM gNB or UE, named by the target address,
+// with nr-cli. Numeric and boolean fields such as is-ngap-up become
+// metrics, the cm, rm and mm states of a UE labels of ueransim_state.
+// A gNB also reports its ue_count, a UE its active pdu_sessions.
+func (e *Exporter) fetchUERANSIM(ctx context.Context, t *scrapeTarget, operator string) ([]labeledData, error) {
+	node := t.server.Address
+	samples, err := ueransimStatus(ctx, node)
+	e.status.record(t, operator, ueransimCategory, ueransimCLI+" "+node, len(samples), err)
+	if err != nil {
+		log.Printf("Error reading the status of UERANSIM node %s: %v", node, err)
+		return nil, err
+	}
+	return groupSamples(ueransimCategory, samples), nil
+}
+
+func ueransimStatus(ctx context.Context, node string) ([]Sample, error) {
+	var status map[string]interface{}
+	if err := runNRCLI(ctx, node, "status", &status); err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	states := make(map[string]string)
+	for key, value := range status {
+		name := sanitizeMetricName(key)
+		switch v := value.(type) {
+		case bool:
+			samples = append(samples, Sample{Name: name, Value: boolValue(v)})
+		case int:
+			samples = append(samples, Sample{Name: name, Value: float64(v)})
+		case float64:
+			samples = append(samples, Sample{Name: name, Value: v})
+		case string:
+			switch key {
+			case "cm-state", "rm-state", "mm-state":
+				states[name] = v
+			}
+		}
+	}
+	if len(states) > 0 {
+		samples = append(samples, Sample{Name: "state", Labels: states, Value: 1})
+	}
+
+	switch {
+	case status["is-ngap-up"] != nil:
+		var count int
+		if err := runNRCLI(ctx, node, "ue-count", &count); err != nil {
+			return nil, err
+		}
+		samples = append(samples, Sample{Name: "ue_count", Value: float64(count)})
+	case status["cm-state"] != nil:
+		var sessions map[string]struct {
+			State string `yaml:"state"`
+		}
+		if err := runNRCLI(ctx, node, "ps-list", &sessions); err != nil {
+			return nil, err
+		}
+		active := 0
+		for _, session := range sessions {
+			if session.State == "PS-ACTIVE" {
+				active++
+			}
+		}
+		samples = append(samples, Sample{Name: "pdu_sessions", Value: float64(active)})
+	}
+	return samples, nil
+}
+
+// Run a command of nr-cli on a node and decode its YAML output into out
+func runNRCLI(ctx context.Context, node string, command string, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, ueransimTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ueransimCLI, node, "-e", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", ueransimCLI, command, err, strings.TrimSpace(stderr.String()))
+	}
+	if err := yaml.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("invalid %s %s output: %v", ueransimCLI, command, err)
+	}
+	return nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	// Timezones are found without a zoneinfo database, e.g. in scratch images
+	_ "time/tzdata"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+// Fields and formats of upstream timestamps unless configured
+var (
+	defaultTimestampFields  = []string{"lastUpdated", "collectionTime"}
+	defaultTimestampFormats = []string{"rfc3339", "unix"}
+)
+
+// upstreamTimes reads the times upstream collected its responses at and
+// keeps the latest of each target, operator and category for their age to
+// be exported
+type upstreamTimes struct {
+	defaults   *timestampParser
+	categories map[string]*timestampParser
+
+	mu    sync.Mutex
+	times map[string]map[string]time.Time
+}
+
+type timestampParser struct {
+	fields   []string
+	formats  []string
+	location *time.Location
+}
+
+func newUpstreamTimes(cfg config.UpstreamTimestampsConfig) (*upstreamTimes, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	defaults, err := newTimestampParser(cfg.TimestampFormat, config.TimestampFormat{Fields: defaultTimestampFields, Formats: defaultTimestampFormats})
+	if err != nil {
+		return nil, err
+	}
+	times := &upstreamTimes{defaults: defaults, categories: make(map[string]*timestampParser), times: make(map[string]map[string]time.Time)}
+	for category, format := range cfg.Categories {
+		parser, err := newTimestampParser(format, config.TimestampFormat{Fields: defaults.fields, Formats: defaults.formats, Timezone: cfg.Timezone})
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %v", category, err)
+		}
+		times.categories[category] = parser
+	}
+	return times, nil
+}
+
+// Settings left empty are taken from the defaults
+func newTimestampParser(format config.TimestampFormat, defaults config.TimestampFormat) (*timestampParser, error) {
+	parser := &timestampParser{fields: format.Fields, formats: format.Formats, location: time.UTC}
+	if len(parser.fields) == 0 {
+		parser.fields = defaults.Fields
+	}
+	if len(parser.formats) == 0 {
+		parser.formats = defaults.Formats
+	}
+	timezone := format.Timezone
+	if timezone == "" {
+		timezone = defaults.Timezone
+	}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream timestamp timezone %q: %v", timezone, err)
+		}
+		parser.location = location
+	}
+	return parser, nil
+}
+
+func (u *upstreamTimes) parser(category string) *timestampParser {
+	if parser, ok := u.categories[category]; ok {
+		return parser
+	}
+	return u.defaults
+}
+
+// Remove the timestamp fields from a response body, at its top level and in
+// its groups, returning the body without them and the oldest timestamp.
+// Bodies that aren't JSON objects are returned unchanged for the parser to
+// report.
+func (u *upstreamTimes) strip(category string, body []byte) ([]byte, time.Time, bool) {
+	if u == nil {
+		return body, time.Time{}, false
+	}
+	parser := u.parser(category)
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body, time.Time{}, false
+	}
+	fields := len(doc)
+	oldest, found := parser.take(category, doc)
+	changed := len(doc) != fields
+	for name, raw := range doc {
+		if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			continue
+		}
+		var group map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &group); err != nil {
+			continue
+		}
+		groupFields := len(group)
+		t, ok := parser.take(category, group)
+		if len(group) == groupFields {
+			continue
+		}
+		doc[name], _ = json.Marshal(group)
+		changed = true
+		if ok && (!found || t.Before(oldest)) {
+			oldest, found = t, true
+		}
+	}
+	if !changed {
+		return body, time.Time{}, false
+	}
+
+	stripped, err := json.Marshal(doc)
+	if err != nil {
+		return body, time.Time{}, false
+	}
+	return stripped, oldest, found
+}
+
+// Remove the timestamp fields of an object, returning the oldest timestamp
+func (p *timestampParser) take(category string, fields map[string]json.RawMessage) (time.Time, bool) {
+	var oldest time.Time
+	found := false
+	for _, field := range p.fields {
+		raw, ok := fields[field]
+		if !ok {
+			continue
+		}
+		delete(fields, field)
+		t, err := p.parse(raw)
+		if err != nil {
+			recordParseFailure(category, field, string(raw), err)
+			continue
+		}
+		if !found || t.Before(oldest) {
+			oldest, found = t, true
+		}
+	}
+	return oldest, found
+}
+
+// Parse a timestamp, a JSON string or number, with the first format matching
+func (p *timestampParser) parse(raw json.RawMessage) (time.Time, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return time.Time{}, err
+	}
+	s, isString := value.(string)
+	if !isString {
+		if _, ok := value.(float64); !ok {
+			return time.Time{}, fmt.Errorf("timestamp is neither a string nor a number")
+		}
+		s = string(bytes.TrimSpace(raw))
+	}
+
+	for _, format := range p.formats {
+		switch format {
+		case "rfc3339":
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t, nil
+			}
+		case "unix", "unix_ms":
+			seconds, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+			if format == "unix_ms" {
+				seconds /= 1000
+			}
+			return time.Unix(0, int64(seconds*float64(time.Second))), nil
+		default:
+			if !isString {
+				continue
+			}
+			if t, err := time.ParseInLocation(format, s, p.location); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("timestamp %q matches none of the formats %v", s, p.formats)
+}
+
+func upstreamTimesKey(t *scrapeTarget, operator string) string {
+	return t.name + "\x00" + serverHost(t.server) + "\x00" + operator
+}
+
+// Record the time upstream collected the response of a category at
+func (u *upstreamTimes) record(t *scrapeTarget, operator string, category string, collected time.Time) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := upstreamTimesKey(t, operator)
+	if u.times[key] == nil {
+		u.times[key] = make(map[string]time.Time)
+	}
+	u.times[key][category] = collected
+}
+
+// The recorded times of the categories of a target
+func (u *upstreamTimes) lookup(t *scrapeTarget, operator string) map[string]time.Time {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	times := make(map[string]time.Time, len(u.times[upstreamTimesKey(t, operator)]))
+	for category, collected := range u.times[upstreamTimesKey(t, operator)] {
+		times[category] = collected
+	}
+	return times
+}
+
+// Drop the recorded times of a target
+func (u *upstreamTimes) forget(t *scrapeTarget, operator string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.times, upstreamTimesKey(t, operator))
+}
+
+// Name of the age metric of a category
+func dataAgeName(category string) string {
+	return sanitizeMetricName("cnaas_" + category + "_data_age_seconds")
+}
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+const (
+	defaultStatisticsURLTemplate = "{scheme}://{address}{path}?operatorIdentifier={operator}"
+	defaultMonitoringURLTemplate = "{scheme}://{address}/nnfcm-monitoring/v2/{path}/{category}?operatorIdentifier={operator}"
+)
+
+var urlPlaceholder = regexp.MustCompile(`\{([a-zA-Z][a-zA-Z0-9_]*)\}`)
+
+// Placeholders filled in for every URL; variables of the configuration
+// cannot override them
+var urlBuiltins = map[string]bool{
+	"scheme": true, "host": true, "port": true, "address": true, "category": true, "operator": true,
+	"basePath": true, "version": true, "resource": true, "path": true,
+}
+
+// urlBuilder builds the upstream URLs from the configured templates
+type urlBuilder struct {
+	statistics string
+	monitoring string
+	api        config.StatisticsAPIConfig
+	variables  map[string]string
+
+	// Query parameters added to every URL, and those of the categories
+	parameters         map[string]string
+	categoryParameters map[string]map[string]string
+}
+
+func newURLBuilder(cfg *config.Config) (*urlBuilder, error) {
+	b := &urlBuilder{
+		statistics: defaultStatisticsURLTemplate,
+		monitoring: defaultMonitoringURLTemplate,
+		api:        cfg.StatisticsAPI,
+		variables:  cfg.URLTemplates.Variables,
+
+		parameters:         cfg.QueryParams.Parameters,
+		categoryParameters: cfg.CategoryQueryParams,
+	}
+	if cfg.URLTemplates.Statistics != "" {
+		b.statistics = cfg.URLTemplates.Statistics
+	}
+	if cfg.URLTemplates.Monitoring != "" {
+		b.monitoring = cfg.URLTemplates.Monitoring
+	}
+
+	if err := checkCategories("statistics", cfg.MetricsStatisticsCategory); err != nil {
+		return nil, err
+	}
+	if err := checkCategories("monitoring", cfg.MetricsMonitoringCategory); err != nil {
+		return nil, err
+	}
+	for name := range b.variables {
+		if urlBuiltins[name] {
+			return nil, fmt.Errorf("url template variable %q is reserved", name)
+		}
+	}
+	for _, template := range []string{b.statistics, b.monitoring} {
+		for _, match := range urlPlaceholder.FindAllStringSubmatch(template, -1) {
+			if _, ok := b.variables[match[1]]; !ok && !urlBuiltins[match[1]] {
+				return nil, fmt.Errorf("unknown variable %q in url template %q", match[1], template)
+			}
+		}
+	}
+	return b, nil
+}
+
+// URL of a statistics category
+func (b *urlBuilder) statisticsURL(scheme string, server config.RemoteServer, category string, operator string) string {
+	api := b.api.Resolve(category)
+	vars := b.serverVariables(scheme, server, category, operator)
+	vars["basePath"] = api.BasePath
+	vars["version"] = api.Version
+	vars["resource"] = api.Resource
+	vars["path"] = b.api.Path(category)
+	return b.addParameters(expandURL(b.statistics, vars), category)
+}
+
+// URL of a monitoring category; path is monitoring for the values and
+// stream for their updates
+func (b *urlBuilder) monitoringURL(scheme string, server config.RemoteServer, path string, category string, operator string) string {
+	vars := b.serverVariables(scheme, server, category, operator)
+	vars["version"] = "v2"
+	vars["path"] = path
+	return b.addParameters(expandURL(b.monitoring, vars), category)
+}
+
+func (b *urlBuilder) serverVariables(scheme string, server config.RemoteServer, category string, operator string) map[string]string {
+	vars := make(map[string]string, len(b.variables)+len(urlBuiltins))
+	for name, value := range b.variables {
+		vars[name] = value
+	}
+	vars["scheme"] = scheme
+	vars["address"] = serverHost(server)
+	vars["host"] = "localhost"
+	if _, ok := server.SocketPath(); !ok {
+		vars["host"] = strings.TrimSuffix(strings.TrimPrefix(server.Address, "["), "]")
+		if strings.Contains(vars["host"], ":") {
+			vars["host"] = "[" + vars["host"] + "]"
+		}
+		vars["port"] = strconv.FormatUint(uint64(server.Port), 10)
+	}
+	vars["category"] = config.EscapeCategory(category)
+	vars["operator"] = url.QueryEscape(operator)
+	return vars
+}
+
+// Add the configured query parameters of a category, encoded, to a URL.
+// Parameters of the category override the others and those of the template.
+func (b *urlBuilder) addParameters(rawURL string, category string) string {
+	categoryParameters := b.categoryParameters[category]
+	if len(b.parameters) == 0 && len(categoryParameters) == 0 {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	for _, parameters := range []map[string]string{b.parameters, categoryParameters} {
+		for name, value := range parameters {
+			query.Set(name, value)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Check the categories of a configuration list. A category may name a
+// sub-resource such as AMF/nfUpdate; each of its segments is escaped in URLs.
+func checkCategories(kind string, categories []string) error {
+	for _, category := range categories {
+		if err := checkCategory(category); err != nil {
+			return fmt.Errorf("invalid %s category %q: %v", kind, category, err)
+		}
+	}
+	return nil
+}
+
+func checkCategory(category string) error {
+	if category == "" {
+		return fmt.Errorf("empty name")
+	}
+	if strings.TrimSpace(category) != category {
+		return fmt.Errorf("leading or trailing spaces")
+	}
+	if strings.IndexFunc(category, unicode.IsControl) >= 0 {
+		return fmt.Errorf("contains control characters")
+	}
+	for _, segment := range strings.Split(category, "/") {
+		switch segment {
+		case "":
+			return fmt.Errorf("empty path segment")
+		case ".", "..":
+			return fmt.Errorf("relative path segment %q", segment)
+		}
+	}
+	return nil
+}
+
+func expandURL(template string, vars map[string]string) string {
+	return urlPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return vars[placeholder[1:len(placeholder)-1]]
+	})
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Named group of a value extraction pattern holding the metric value
+const valueGroup = "value"
+
+// ValueExtractor splits string values of monitoring metrics such as
+// "UP since 2024-01-02" into a value and labels
+type ValueExtractor struct {
+	rules []*valueExtraction
+}
+
+type valueExtraction struct {
+	metric  *regexp.Regexp
+	pattern *regexp.Regexp
+	info    bool
+}
+
+func NewValueExtractor(defs []config.ValueExtraction) (*ValueExtractor, error) {
+	extractor := &ValueExtractor{}
+	for _, def := range defs {
+		metric, err := regexp.Compile("^(?:" + def.Metric + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid value extraction metric %q: %v", def.Metric, err)
+		}
+		pattern, err := regexp.Compile(def.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value extraction pattern %q: %v", def.Pattern, err)
+		}
+		labels := 0
+		for _, name := range pattern.SubexpNames() {
+			if name != "" && name != valueGroup {
+				labels++
+			}
+		}
+		if labels == 0 {
+			return nil, fmt.Errorf("value extraction pattern %q has no named groups to use as labels", def.Pattern)
+		}
+		if pattern.SubexpIndex(valueGroup) < 0 && !def.Info {
+			return nil, fmt.Errorf("value extraction pattern %q needs a value group unless info is set", def.Pattern)
+		}
+		extractor.rules = append(extractor.rules, &valueExtraction{metric: metric, pattern: pattern, info: def.Info})
+	}
+	return extractor, nil
+}
+
+// The parts of a string value. Without a value group in the pattern only
+// the info series is exported.
+type extractedValue struct {
+	value    string
+	hasValue bool
+	labels   prometheus.Labels
+	info     bool
+}
+
+// Extract the value and labels of the named metric from its string value
+func (x *ValueExtractor) extract(name string, s string) (extractedValue, bool) {
+	for _, rule := range x.rules {
+		if !rule.metric.MatchString(name) {
+			continue
+		}
+		match := rule.pattern.FindStringSubmatch(s)
+		if match == nil {
+			continue
+		}
+		extracted := extractedValue{labels: prometheus.Labels{}, info: rule.info}
+		for i, group := range rule.pattern.SubexpNames() {
+			switch group {
+			case "":
+			case valueGroup:
+				extracted.value, extracted.hasValue = match[i], true
+			default:
+				extracted.labels[sanitizeMetricName(group)] = match[i]
+			}
+		}
+		return extracted, true
+	}
+	return extractedValue{}, false
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CollectedValue is one value of the collected data as served by /api/v1/values
+type CollectedValue struct {
+	Target    string            `json:"target,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Category  string            `json:"category"`
+	Metric    string            `json:"metric"`
+	Value     *float64          `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// ValuesHandler serves the collected data as JSON, before any metric
+// naming, for consumers other than Prometheus. Values that JSON cannot
+// represent, NaN and infinities, are null.
+func (e *Exporter) ValuesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := e.scrapeContext(r)
+		defer cancel()
+
+		operators, multiTenant, err := e.scrapeOperators(r)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		collections, err := e.fetchCollections(ctx, operators, multiTenant)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Failed to fetch and combine JSON data: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		values := []CollectedValue{}
+		for _, c := range collections {
+			values = appendValues(values, c, c.labels, c.data)
+			for _, element := range c.series {
+				values = appendValues(values, c, mergeLabels(c.labels, element.Labels), element.Data)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Values []CollectedValue `json:"values"`
+		}{values})
+	})
+}
+
+func appendValues(values []CollectedValue, c *collection, labels prometheus.Labels, data map[string]map[string]float64) []CollectedValue {
+	categories := make([]string, 0, len(data))
+	for category := range data {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		names := make([]string, 0, len(data[category]))
+		for name := range data[category] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := data[category][name]
+			v := CollectedValue{Target: c.target, Labels: labels, Category: category, Metric: name, Timestamp: c.time}
+			if !math.IsNaN(value) && !math.IsInf(value, 0) {
+				v.Value = &value
+			}
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+const (
+	defaultWebhookCooldown    = 5 * time.Minute
+	defaultWebhookContentType = "application/json"
+	webhookTimeout            = 10 * time.Second
+)
+
+// WebhookEvent is the state change of an upstream server sent to webhooks.
+// Templates refer to its fields, e.g. {{.Server}} is {{.State}}.
+type WebhookEvent struct {
+	Target string    `json:"target,omitempty"`
+	Server string    `json:"server"`
+	State  string    `json:"state"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// webhookNotifier follows whether each upstream server answers and notifies
+// the webhooks when that changes. A category is unreachable when its
+// request gets no response or a 5xx status; any other response makes it
+// reachable. A server is unreachable once all of its categories are.
+type webhookNotifier struct {
+	hooks []*webhook
+
+	mu      sync.Mutex
+	servers map[string]*serverReachability
+}
+
+// The state last notified for a server and the state of each of its
+// categories
+type serverReachability struct {
+	state      string
+	categories map[string]string
+}
+
+type webhook struct {
+	url         string
+	template    *template.Template
+	contentType string
+	headers     map[string]config.Secret
+	cooldown    time.Duration
+	client      *http.Client
+
+	mu   sync.Mutex
+	sent map[string]*webhookDelivery
+}
+
+// The last event sent for a server, and the latest one held back by the
+// cooldown
+type webhookDelivery struct {
+	state   string
+	at      time.Time
+	pending *WebhookEvent
+	timer   *time.Timer
+}
+
+func newWebhookNotifier(defs []config.WebhookConfig, policy config.TLSPolicy) (*webhookNotifier, error) {
+	if len(defs) == 0 {
+		return nil, nil
+	}
+	n := &webhookNotifier{servers: make(map[string]*serverReachability)}
+	for _, def := range defs {
+		if def.URL == "" {
+			return nil, fmt.Errorf("webhook without url")
+		}
+		transport, err := newPolicyTransport(policy)
+		if err != nil {
+			return nil, err
+		}
+		hook := &webhook{
+			url:         def.URL,
+			contentType: def.ContentType,
+			headers:     def.Headers,
+			cooldown:    def.Cooldown,
+			client:      &http.Client{Transport: transport, Timeout: webhookTimeout},
+			sent:        make(map[string]*webhookDelivery),
+		}
+		if hook.cooldown <= 0 {
+			hook.cooldown = defaultWebhookCooldown
+		}
+		if hook.contentType == "" {
+			hook.contentType = defaultWebhookContentType
+		}
+		if def.Template != "" {
+			tmpl, err := template.New(def.URL).Funcs(requestBodyFuncs).Parse(def.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template of webhook %s: %v", def.URL, err)
+			}
+			hook.template = tmpl
+		}
+		n.hooks = append(n.hooks, hook)
+	}
+	return n, nil
+}
+
+// Observe the outcome of the request of a category to a server. Servers
+// found unreachable at their first requests are reported too.
+func (n *webhookNotifier) observe(target string, server string, category string, err error) {
+	// Requests cancelled or timed out by the scrape say nothing about the
+	// server
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	categoryState := "reachable"
+	var fetchErr *fetchError
+	var statusErr *statusError
+	if errors.As(err, &fetchErr) || errors.As(err, &statusErr) && statusErr.code >= 500 {
+		categoryState = "unreachable"
+	}
+
+	key := target + "\x00" + server
+	n.mu.Lock()
+	reachability, ok := n.servers[key]
+	if !ok {
+		reachability = &serverReachability{categories: make(map[string]string)}
+		n.servers[key] = reachability
+	}
+	reachability.categories[category] = categoryState
+	state := "unreachable"
+	for _, s := range reachability.categories {
+		if s == "reachable" {
+			state = "reachable"
+			break
+		}
+	}
+	previous := reachability.state
+	reachability.state = state
+	n.mu.Unlock()
+	if previous == state || previous == "" && state == "reachable" {
+		return
+	}
+
+	event := WebhookEvent{Target: target, Server: server, State: state, Time: time.Now()}
+	if state == "unreachable" {
+		event.Error = err.Error()
+	}
+	log.Printf("Upstream server %s is %s", server, state)
+	for _, hook := range n.hooks {
+		hook.notify(key, event)
+	}
+}
+
+// Send the event, or hold it back until the cooldown of the server ends
+func (h *webhook) notify(key string, event WebhookEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivery, ok := h.sent[key]
+	if !ok {
+		delivery = &webhookDelivery{}
+		h.sent[key] = delivery
+	}
+	if wait := h.cooldown - time.Since(delivery.at); ok && wait > 0 {
+		delivery.pending = &event
+		if delivery.timer == nil {
+			delivery.timer = time.AfterFunc(wait, func() { h.flush(key) })
+		}
+		return
+	}
+	delivery.state, delivery.at = event.State, time.Now()
+	go h.send(event)
+}
+
+// Send the event held back during the cooldown unless the server went back
+// to the state last sent
+func (h *webhook) flush(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivery := h.sent[key]
+	event := delivery.pending
+	delivery.pending, delivery.timer = nil, nil
+	if event == nil || event.State == delivery.state {
+		return
+	}
+	delivery.state, delivery.at = event.State, time.Now()
+	go h.send(*event)
+}
+
+func (h *webhook) send(event WebhookEvent) {
+	var body bytes.Buffer
+	if h.template != nil {
+		if err := h.template.Execute(&body, event); err != nil {
+			log.Printf("Error rendering webhook %s: %v", h.url, err)
+			return
+		}
+	} else if err := json.NewEncoder(&body).Encode(event); err != nil {
+		log.Printf("Error rendering webhook %s: %v", h.url, err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, &body)
+	if err != nil {
+		log.Printf("Error sending webhook %s: %v", h.url, err)
+		return
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	for name, value := range h.headers {
+		req.Header.Set(name, string(value))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Printf("Error sending webhook %s: %v", h.url, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook %s answered with status %d", h.url, resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+)
+
+type webhookRequest struct {
+	contentType string
+	body        string
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	requests := make(chan webhookRequest, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header.Get("Content-Type"), string(body)}
+	}))
+	t.Cleanup(receiver.Close)
+
+	notifier, err := newWebhookNotifier([]config.WebhookConfig{{
+		URL:         receiver.URL,
+		Template:    "{{.Server}} is {{.State}}",
+		ContentType: "text/plain",
+		Cooldown:    time.Millisecond,
+	}}, config.TLSPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-requests:
+			if got.body != want || got.contentType != "text/plain" {
+				t.Errorf("webhook got %+v, want %q as text/plain", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no webhook sent, want %q", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-requests:
+			t.Errorf("unexpected webhook %+v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	unreachable := &fetchError{err: errors.New("connection refused")}
+	// Scrapes ending early say nothing about the server
+	notifier.observe("", "smf:8080", "amf", &fetchError{err: context.DeadlineExceeded})
+	notifier.observe("", "smf:8080", "smf", context.Canceled)
+	// One failing category leaves a server answering the others reachable
+	notifier.observe("", "smf:8080", "amf", nil)
+	notifier.observe("", "smf:8080", "smf", &statusError{code: http.StatusBadGateway})
+	expectNone()
+
+	notifier.observe("", "smf:8080", "amf", unreachable)
+	expect("smf:8080 is unreachable")
+	notifier.observe("", "smf:8080", "amf", unreachable)
+	expectNone()
+	notifier.observe("", "smf:8080", "smf", &statusError{code: http.StatusNotFound})
+	expect("smf:8080 is reachable")
+}
@@ -0,0 +1,214 @@
+// Package mockserver serves nnfcm-statistics and nnfcm-monitoring fixtures so
+// the exporter can be run and tested without a 5G core.
+package mockserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options configures the mock server
+type Options struct {
+	// Directory with statistics/<category>.json and monitoring/<category>.json
+	// files served instead of the generated fixtures
+	FixturesDir string
+	// Delay added to every response
+	Latency time.Duration
+	// Fraction of requests, between 0 and 1, answered with a server error
+	ErrorRate float64
+	// Interval between messages on the monitoring streams
+	StreamInterval time.Duration
+}
+
+// Server generates upstream responses whose counters grow on every request
+type Server struct {
+	options  Options
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	counters map[string]int
+}
+
+func New(options Options) *Server {
+	if options.StreamInterval <= 0 {
+		options.StreamInterval = 5 * time.Second
+	}
+	return &Server{options: options, counters: make(map[string]int)}
+}
+
+// Handler returns the HTTP handler of the mock APIs
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nnfcm-statistics/v2/stats/", s.inject(s.statistics))
+	mux.HandleFunc("/nnfcm-monitoring/v2/monitoring/", s.inject(s.monitoring))
+	mux.HandleFunc("/nnfcm-monitoring/v2/stream/", s.inject(s.stream))
+	return mux
+}
+
+// ListenAndServe serves the mock APIs on address
+func (s *Server) ListenAndServe(address string) error {
+	log.Printf("Serving mock nnfcm APIs on %s", address)
+	return http.ListenAndServe(address, s.Handler())
+}
+
+// Apply the configured latency and error injection to a handler. Requests
+// given up during the latency are not answered.
+func (s *Server) inject(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL)
+		if s.options.Latency > 0 {
+			timer := time.NewTimer(s.options.Latency)
+			select {
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if rand.Float64() < s.options.ErrorRate {
+			http.Error(w, "injected error", http.StatusInternalServerError)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) statistics(w http.ResponseWriter, r *http.Request) {
+	category := strings.TrimPrefix(r.URL.Path, "/nnfcm-statistics/v2/stats/")
+	if s.serveFixture(w, "statistics", category) {
+		return
+	}
+
+	attempts := s.next(category, 10+rand.Intn(10))
+	failures := attempts / 20
+	writeJSON(w, map[string]map[string]int{
+		"sessions": {
+			"attempts": attempts,
+			"success":  attempts - failures,
+			"failures": failures,
+			"active":   50 + rand.Intn(50),
+		},
+		"latency": {
+			"latency_lt_10ms":  attempts / 2,
+			"latency_lt_50ms":  attempts * 9 / 10,
+			"latency_lt_100ms": attempts,
+			"latency_count":    attempts,
+			"latency_sum_ms":   attempts * 18,
+		},
+	})
+}
+
+func (s *Server) monitoring(w http.ResponseWriter, r *http.Request) {
+	category := strings.TrimPrefix(r.URL.Path, "/nnfcm-monitoring/v2/monitoring/")
+	if s.serveFixture(w, "monitoring", category) {
+		return
+	}
+	writeJSON(w, monitoringPayload())
+}
+
+// Serve the monitoring stream as Server-Sent Events or over a websocket
+// until the client goes away
+func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
+	ticker := time.NewTicker(s.options.StreamInterval)
+	defer ticker.Stop()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Hijacked connections don't end the request context; reading does
+		// notice the client closing the websocket
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			if err := conn.WriteJSON(monitoringPayload()); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	for {
+		data, _ := json.Marshal(monitoringPayload())
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func monitoringPayload() map[string]interface{} {
+	return map[string]interface{}{
+		"status":        "UP",
+		"cpuUsage":      fmt.Sprintf("%.1f", 20+rand.Float64()*40),
+		"connectedUEs":  100 + rand.Intn(20),
+		"uplinkMbps":    rand.Float64() * 500,
+		"downlinkMbps":  rand.Float64() * 900,
+		"memory":        map[string]interface{}{"usedBytes": 1 << 30, "totalBytes": 4 << 30},
+		"lastRestarted": "2024-01-02T10:00:00Z",
+	}
+}
+
+// Increase and return the counter of a category
+func (s *Server) next(category string, increment int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[category] += increment
+	return s.counters[category]
+}
+
+// Serve <FixturesDir>/<kind>/<category>.json if it exists
+func (s *Server) serveFixture(w http.ResponseWriter, kind string, category string) bool {
+	if s.options.FixturesDir == "" {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join(s.options.FixturesDir, kind, filepath.Clean("/"+category)+".json"))
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
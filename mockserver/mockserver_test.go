@@ -0,0 +1,155 @@
+package mockserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer(t *testing.T, options Options) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(New(options).Handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getJSON(t *testing.T, url string, value interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Statistics counters grow with every request
+func TestStatistics(t *testing.T) {
+	server := newTestServer(t, Options{})
+	var first, second map[string]map[string]int
+	getJSON(t, server.URL+"/nnfcm-statistics/v2/stats/amf", &first)
+	getJSON(t, server.URL+"/nnfcm-statistics/v2/stats/amf", &second)
+	if second["sessions"]["attempts"] <= first["sessions"]["attempts"] {
+		t.Errorf("attempts went from %d to %d, want them to grow", first["sessions"]["attempts"], second["sessions"]["attempts"])
+	}
+
+	var monitoring map[string]interface{}
+	getJSON(t, server.URL+"/nnfcm-monitoring/v2/monitoring/upf", &monitoring)
+	if monitoring["status"] != "UP" {
+		t.Errorf("monitoring status = %v, want UP", monitoring["status"])
+	}
+}
+
+// Fixtures replace the generated responses, without escaping their directory
+func TestFixtures(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "statistics"), 0o755)
+	os.WriteFile(filepath.Join(dir, "statistics", "smf.json"), []byte(`{"pdu": {"sessions": 3}}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"secret": {"value": 1}}`), 0o644)
+	server := newTestServer(t, Options{FixturesDir: dir})
+
+	var fixture map[string]map[string]int
+	getJSON(t, server.URL+"/nnfcm-statistics/v2/stats/smf", &fixture)
+	if fixture["pdu"]["sessions"] != 3 {
+		t.Errorf("smf = %v, want the fixture", fixture)
+	}
+	var escaped map[string]map[string]int
+	getJSON(t, server.URL+"/nnfcm-statistics/v2/stats/..%2Fsecret", &escaped)
+	if _, ok := escaped["secret"]; ok {
+		t.Errorf("fixture outside the statistics directory served")
+	}
+}
+
+func TestErrorInjection(t *testing.T) {
+	server := newTestServer(t, Options{ErrorRate: 1})
+	resp, err := http.Get(server.URL + "/nnfcm-statistics/v2/stats/amf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status %d, want the injected error", resp.StatusCode)
+	}
+}
+
+// Requests given up during the injected latency return right away
+func TestLatencyCancelled(t *testing.T) {
+	handler := New(Options{Latency: time.Hour}).Handler()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/nnfcm-statistics/v2/stats/amf", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(w, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler waited out the latency of a cancelled request")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("cancelled request answered with %q", w.Body.String())
+	}
+}
+
+// The stream sends payloads until the client goes away
+func TestStream(t *testing.T) {
+	server := newTestServer(t, Options{StreamInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/nnfcm-monitoring/v2/stream/upf", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("content type %q, want text/event-stream", resp.Header.Get("Content-Type"))
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "data: {") {
+		t.Errorf("first event %q: %v", line, err)
+	}
+	cancel()
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/nnfcm-monitoring/v2/stream/upf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := conn.ReadJSON(&payload); err != nil || payload["status"] != "UP" {
+		t.Errorf("websocket payload %v: %v", payload, err)
+	}
+	conn.Close()
+
+	// Closing the server waits for the stream handlers to return
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream handlers still running after their clients left")
+	}
+}
@@ -0,0 +1,117 @@
+// Package collector embeds the collection of CNaaS statistics in other Go
+// services, instead of running cnaasprom as a separate exporter.
+//
+//	c, err := collector.NewCollector(collector.Options{ConfigFile: "cnaasprom.yaml"})
+//	if err != nil {
+//		return err
+//	}
+//	families, err := c.Collect(ctx)
+//
+// A collection fetches the statistics categories of every target once, as
+// a scrape of the exporter's /metrics endpoint does. The sources the
+// exporter runs in the background, such as the poll scheduler, streaming and
+// Kafka, are not started.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Options configure a Collector. Config is used as is when set, otherwise
+// the configuration is loaded from ConfigFile, a file or a directory of
+// *.yaml files. The TLS policy of the upstream connections is the
+// configuration's.
+type Options struct {
+	Config     *config.Config
+	ConfigFile string
+
+	// Registry the collector's own metrics, such as the upstream fetch
+	// durations, are registered with and collected from. A registry of the
+	// collector's own when nil.
+	Registry *prometheus.Registry
+	// RateLimits are the global request rate limits, shared by the
+	// collectors given the same. The collector has its own when nil.
+	RateLimits *metrics.RateLimits
+}
+
+// Collector collects the metrics of one configuration. It is safe for
+// concurrent use.
+type Collector struct {
+	config   *config.Config
+	store    metrics.Store
+	exporter *metrics.Exporter
+}
+
+// NewCollector validates the configuration and prepares the collection
+func NewCollector(opts Options) (*Collector, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		if opts.ConfigFile == "" {
+			return nil, fmt.Errorf("either a configuration or a configuration file is required")
+		}
+		var err error
+		if cfg, err = config.LoadConfig(opts.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	registry := opts.Registry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+	if err := metrics.RegisterInternalMetrics(registry); err != nil {
+		return nil, err
+	}
+
+	store, err := metrics.NewStore(cfg.Store, cfg.TLSPolicy)
+	if err != nil {
+		return nil, err
+	}
+	store.SetTTL(cfg.StaleSeriesTTL)
+	exporter, err := metrics.NewExporterWithOptions(cfg, store, metrics.ExporterOptions{Registry: registry, RateLimits: opts.RateLimits})
+	if err != nil {
+		metrics.CloseStore(store)
+		return nil, fmt.Errorf("failed to create exporter: %v", err)
+	}
+	return &Collector{config: cfg, store: store, exporter: exporter}, nil
+}
+
+// Collect fetches the statistics now and returns the metric families the
+// exporter would serve. The fetches are canceled with ctx.
+func (c *Collector) Collect(ctx context.Context) ([]*dto.MetricFamily, error) {
+	return c.exporter.Gather(ctx)
+}
+
+// Gatherer collects on every Gather, e.g. to add the metrics to the
+// prometheus.Gatherers a service already serves
+func (c *Collector) Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return c.Collect(context.Background())
+	})
+}
+
+// Handler serves the metrics like the exporter's /metrics endpoint,
+// honouring Prometheus' scrape timeout and the operator parameter
+func (c *Collector) Handler() http.Handler {
+	return c.exporter.MetricsHandler()
+}
+
+// Refresh drops the data kept between collections, such as cached
+// responses, so the next collection fetches everything again
+func (c *Collector) Refresh(ctx context.Context) error {
+	return c.exporter.Refresh(ctx, "")
+}
+
+// Close closes the connections of the configured store and to the SPIFFE
+// Workload API. The collector must not be used afterwards.
+func (c *Collector) Close() error {
+	return errors.Join(c.exporter.Close(), metrics.CloseStore(c.store))
+}
@@ -0,0 +1,107 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AbdallahRustom/CNaaSProm/config"
+	"github.com/AbdallahRustom/CNaaSProm/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Statistics server counting its requests
+func newStatisticsServer(t *testing.T, requests *atomic.Int32) config.RemoteServer {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		fmt.Fprintf(w, `{"registration": {"attempts": %d}}`, n)
+	}))
+	t.Cleanup(server.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.ParseUint(port, 10, 32)
+	return config.RemoteServer{Address: host, Port: uint(p)}
+}
+
+func hasFamily(families []*dto.MetricFamily, name string) bool {
+	for _, family := range families {
+		if family.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestCollector(t *testing.T, cfg *config.Config, opts Options) *Collector {
+	t.Helper()
+	opts.Config = cfg
+	c, err := NewCollector(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// The collector's own metrics are registered with the given registry and
+// collected from it
+func TestCollectorRegistry(t *testing.T) {
+	var requests atomic.Int32
+	cfg := &config.Config{RemoteStatisticServer: newStatisticsServer(t, &requests), MetricsStatisticsCategory: []string{"amf"}}
+	registry := prometheus.NewRegistry()
+	c := newTestCollector(t, cfg, Options{Registry: registry})
+	// Collectors of their own registries don't conflict
+	other := newTestCollector(t, cfg, Options{})
+
+	families, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFamily(families, "amf_registration_attempts") || !hasFamily(families, "cnaasprom_upstream_fetch_duration_seconds") {
+		t.Errorf("collected %d families, want the statistics and the fetch durations", len(families))
+	}
+	own, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasFamily(own, "cnaasprom_upstream_fetch_duration_seconds") {
+		t.Errorf("fetch durations not registered with the given registry")
+	}
+	if _, err := other.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Collectors given the same rate limits share the global bucket
+func TestCollectorRateLimits(t *testing.T) {
+	var requests atomic.Int32
+	cfg := &config.Config{
+		RemoteStatisticServer:     newStatisticsServer(t, &requests),
+		MetricsStatisticsCategory: []string{"amf"},
+		RateLimit:                 config.RateLimitConfig{RateLimit: config.RateLimit{RequestsPerSecond: 0.01, Burst: 1}},
+	}
+	limits := metrics.NewRateLimits()
+	first := newTestCollector(t, cfg, Options{RateLimits: limits})
+	second := newTestCollector(t, cfg, Options{RateLimits: limits})
+
+	if _, err := first.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	second.Collect(ctx)
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests sent, want the one the shared limit allows", n)
+	}
+}